@@ -0,0 +1,97 @@
+package scp
+
+import (
+	"os"
+	"path"
+	"regexp"
+	"time"
+)
+
+// The AcceptFunc builders below filter files. They accept all directories,
+// so that the files under them are checked, unless stated otherwise.
+
+// AcceptByGlob returns an AcceptFunc which accepts the files whose names
+// match any of patterns in the syntax of path.Match.
+func AcceptByGlob(patterns ...string) AcceptFunc {
+	return func(parentDir string, info os.FileInfo) (bool, error) {
+		if info.IsDir() {
+			return true, nil
+		}
+		for _, pattern := range patterns {
+			ok, err := path.Match(pattern, info.Name())
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
+
+// AcceptByRegexp returns an AcceptFunc which accepts the files whose names
+// match re.
+func AcceptByRegexp(re *regexp.Regexp) AcceptFunc {
+	return func(parentDir string, info os.FileInfo) (bool, error) {
+		return info.IsDir() || re.MatchString(info.Name()), nil
+	}
+}
+
+// AcceptMaxSize returns an AcceptFunc which accepts the files of at most
+// size bytes.
+func AcceptMaxSize(size int64) AcceptFunc {
+	return func(parentDir string, info os.FileInfo) (bool, error) {
+		return info.IsDir() || info.Size() <= size, nil
+	}
+}
+
+// AcceptModifiedAfter returns an AcceptFunc which accepts the files modified
+// after t.
+func AcceptModifiedAfter(t time.Time) AcceptFunc {
+	return func(parentDir string, info os.FileInfo) (bool, error) {
+		return info.IsDir() || info.ModTime().After(t), nil
+	}
+}
+
+// AcceptAnd returns an AcceptFunc which accepts the entries accepted by all
+// of fns. The functions are called in order until one rejects the entry.
+func AcceptAnd(fns ...AcceptFunc) AcceptFunc {
+	return func(parentDir string, info os.FileInfo) (bool, error) {
+		for _, fn := range fns {
+			ok, err := fn(parentDir, info)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+}
+
+// AcceptOr returns an AcceptFunc which accepts the entries accepted by any
+// of fns. The functions are called in order until one accepts the entry.
+func AcceptOr(fns ...AcceptFunc) AcceptFunc {
+	return func(parentDir string, info os.FileInfo) (bool, error) {
+		for _, fn := range fns {
+			ok, err := fn(parentDir, info)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	}
+}
+
+// AcceptNot returns an AcceptFunc which rejects the files accepted by fn
+// and accepts the others. For directories, the result of fn is returned as
+// is, so that AcceptNot(AcceptByGlob("*.log")) still descends into
+// the directories.
+func AcceptNot(fn AcceptFunc) AcceptFunc {
+	return func(parentDir string, info os.FileInfo) (bool, error) {
+		ok, err := fn(parentDir, info)
+		if err != nil || info.IsDir() {
+			return ok, err
+		}
+		return !ok, nil
+	}
+}
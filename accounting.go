@@ -0,0 +1,159 @@
+package scp
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrBudgetExceeded is returned when a session is started for a remote host
+// whose usage already reached the budget set with Accounting.SetBudget.
+var ErrBudgetExceeded = errors.New("scp: bandwidth budget of remote host exceeded")
+
+// HostUsage is the cumulative usage of a remote host.
+type HostUsage struct {
+	// BytesSent is the number of bytes written to the remote host,
+	// including the protocol messages.
+	BytesSent int64
+	// BytesReceived is the number of bytes read from the remote host,
+	// including the protocol messages.
+	BytesReceived int64
+	// Sessions is the number of started sessions.
+	Sessions int64
+}
+
+// Total returns the sum of the sent and received bytes.
+func (u HostUsage) Total() int64 { return u.BytesSent + u.BytesReceived }
+
+// Accounting tracks the usage per remote address. It can be shared by
+// multiple SCP clients with WithAccounting and is safe for concurrent use.
+type Accounting struct {
+	mu      sync.Mutex
+	hosts   map[string]*hostUsage
+	budgets map[string]int64
+}
+
+// NewAccounting creates an empty Accounting.
+func NewAccounting() *Accounting {
+	return &Accounting{
+		hosts:   make(map[string]*hostUsage),
+		budgets: make(map[string]int64),
+	}
+}
+
+// Usage returns the usage of the remote address.
+func (a *Accounting) Usage(addr string) HostUsage {
+	a.mu.Lock()
+	u := a.hosts[addr]
+	a.mu.Unlock()
+	if u == nil {
+		return HostUsage{}
+	}
+	return u.snapshot()
+}
+
+// Snapshot returns the usages of all the remote addresses.
+func (a *Accounting) Snapshot() map[string]HostUsage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	usages := make(map[string]HostUsage, len(a.hosts))
+	for addr, u := range a.hosts {
+		usages[addr] = u.snapshot()
+	}
+	return usages
+}
+
+// SetBudget sets the maximum number of total bytes for the remote address.
+// Once the usage reaches the budget, new sessions for the address fail with
+// ErrBudgetExceeded. The running sessions are not interrupted.
+// A budget of zero or less removes the limit.
+func (a *Accounting) SetBudget(addr string, bytes int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if bytes <= 0 {
+		delete(a.budgets, addr)
+		return
+	}
+	a.budgets[addr] = bytes
+}
+
+// Reset clears the usages of all the remote addresses. The budgets are kept.
+func (a *Accounting) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.hosts = make(map[string]*hostUsage)
+}
+
+// startSession returns the usage of the address for a new session, which is
+// counted with the started method of the usage once the session is opened.
+// It returns nil without an error if a is nil.
+func (a *Accounting) startSession(addr string) (*hostUsage, error) {
+	if a == nil {
+		return nil, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u := a.hosts[addr]
+	if u == nil {
+		u = &hostUsage{}
+		a.hosts[addr] = u
+	}
+	if budget, ok := a.budgets[addr]; ok && u.snapshot().Total() >= budget {
+		return nil, ErrBudgetExceeded
+	}
+	return u, nil
+}
+
+type hostUsage struct {
+	bytesSent     int64
+	bytesReceived int64
+	sessions      int64
+}
+
+func (u *hostUsage) snapshot() HostUsage {
+	return HostUsage{
+		BytesSent:     atomic.LoadInt64(&u.bytesSent),
+		BytesReceived: atomic.LoadInt64(&u.bytesReceived),
+		Sessions:      atomic.LoadInt64(&u.sessions),
+	}
+}
+
+// started counts the session opened. It does nothing if u is nil.
+func (u *hostUsage) started() {
+	if u != nil {
+		atomic.AddInt64(&u.sessions, 1)
+	}
+}
+
+// wrap returns stdin and stdout which count the bytes. It returns them as is
+// if u is nil.
+func (u *hostUsage) wrap(stdin io.WriteCloser, stdout io.Reader) (io.WriteCloser, io.Reader) {
+	if u == nil {
+		return stdin, stdout
+	}
+	return &countingWriteCloser{WriteCloser: stdin, n: &u.bytesSent},
+		&countingReader{Reader: stdout, n: &u.bytesReceived}
+}
+
+type countingWriteCloser struct {
+	io.WriteCloser
+	n *int64
+}
+
+func (w *countingWriteCloser) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
+
+type countingReader struct {
+	io.Reader
+	n *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
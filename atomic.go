@@ -0,0 +1,78 @@
+package scp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// WithAtomicUploads makes Send, SendFile, SendBytes and SendReader upload
+// the file to a temporary name in the destination directory and rename it
+// to the destination with the mv command only when the upload succeeds, so
+// readers on the remote server never see a half-written file. The remote
+// server must have the mv command, and SendFile also needs the stat command
+// to resolve the destination.
+func WithAtomicUploads() ScpOption {
+	return func(s *SCP) {
+		s.atomicUploads = true
+	}
+}
+
+// remoteTempName returns a temporary name for remotePath in the same
+// directory.
+func remoteTempName(remotePath string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return path.Join(path.Dir(remotePath), "."+path.Base(remotePath)+".tmp-"+hex.EncodeToString(b)), nil
+}
+
+// sendFileAtomic is sendFile with WithAtomicUploads.
+func (s *SCP) sendFileAtomic(srcFile, destFile string) error {
+	remote, err := s.statRemote(destFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to get information of destination file: err=%w", err)
+	}
+	fi, file, err := s.openLocalFile(srcFile)
+	if err != nil {
+		return err
+	}
+	if remote != nil && remote.IsDir() {
+		destFile = path.Join(destFile, fi.Name())
+	}
+	// NOTE: file will be closed by sendAtomic.
+	return s.sendAtomic(fi, file, srcFile, destFile)
+}
+
+// sendAtomic uploads the content from r to a temporary file and renames it
+// to remotePath. localPath is used only for the audit record.
+func (s *SCP) sendAtomic(info *FileInfo, r io.ReadCloser, localPath, remotePath string) error {
+	tmpPath, err := remoteTempName(remotePath)
+	if err != nil {
+		r.Close()
+		return fmt.Errorf("failed to generate temporary name: err=%w", err)
+	}
+	tmpInfo := *info
+	tmpInfo.name = path.Base(tmpPath)
+	err = s.runFileSinkSession(path.Dir(remotePath), func(ss *sinkSession) error {
+		if err := s.writeFile(ss, &tmpInfo, r, localPath, remotePath); err != nil {
+			return fmt.Errorf("failed to copy file: err=%w", err)
+		}
+		return nil
+	})
+	if err == nil {
+		cmd := "mv -f -- " + escapeShellArg(tmpPath) + " " + escapeShellArg(remotePath)
+		if err = runCommandSession(s.sessionConfig(), cmd, nil, nil); err != nil {
+			err = fmt.Errorf("failed to rename temporary file: err=%w", err)
+		}
+	}
+	if err != nil {
+		// The temporary file may be left if the connection is lost.
+		_ = runCommandSession(s.sessionConfig(), "rm -f -- "+escapeShellArg(tmpPath), nil, nil)
+	}
+	return err
+}
@@ -0,0 +1,150 @@
+package scp
+
+import (
+	"crypto/sha256"
+	"hash"
+	"io"
+	"time"
+)
+
+// AuditRecord describes a file transferred in either direction.
+type AuditRecord struct {
+	// Direction is DirectionUpload for a file sent to the remote host and
+	// DirectionDownload for a file received from it.
+	Direction Direction
+	// LocalPath is the local path of the file. It is empty if the file
+	// was read from or written to an io.Reader or io.Writer.
+	LocalPath string
+	// RemotePath is the remote path of the file. In SendFile and FanOut,
+	// it is the destination path as specified, which may be a directory.
+	RemotePath string
+	// RemoteAddr is the address of the remote host.
+	RemoteAddr string
+	// Bytes is the number of content bytes transferred.
+	Bytes int64
+	// Hash is the digest of the transferred content, computed with the
+	// hash set with WithHash or SHA-256 by default. It is the digest of
+	// a partial content if the transfer failed.
+	Hash []byte
+	// Duration is the elapsed time of the transfer.
+	Duration time.Duration
+	// Err is the error of the transfer, or nil if it succeeded.
+	Err error
+}
+
+// WithAuditHook sets the function called with an AuditRecord after each
+// file is transferred, whether or not the transfer succeeded. The hook is
+// called synchronously from the operation, so it must be safe for concurrent
+// use if the client is used by multiple goroutines, for example in FanOut.
+func WithAuditHook(hook func(AuditRecord)) ScpOption {
+	return func(s *SCP) {
+		s.auditHook = hook
+	}
+}
+
+// auditor builds the audit record of a file transfer and sends the progress
+// events of the file. All the methods are no-op on a nil auditor, which is
+// returned if none of an audit hook, a report, a progress channel and
+// a tracer is set.
+type auditor struct {
+	hook     func(AuditRecord)
+	report   func(AuditRecord)
+	progress *progressSink
+	span     Span
+	op       *observedOp
+	record   AuditRecord
+	start    time.Time
+	// hash is nil if no audit hook is set.
+	hash hash.Hash
+	tee  *io.Writer
+}
+
+func (s *SCP) newAuditor(direction Direction, localPath, remotePath string) *auditor {
+	progress := s.progressSink()
+	if s.auditHook == nil && s.reportHook == nil && progress == nil && s.tracer == nil {
+		return nil
+	}
+	remoteAddr := s.sessionConfig().remoteAddr()
+	a := &auditor{
+		hook:     s.auditHook,
+		report:   s.reportHook,
+		progress: progress,
+		span:     s.startFileSpan(remoteAddr, localPath, remotePath),
+		op:       s.observedOp,
+		record: AuditRecord{
+			Direction:  direction,
+			LocalPath:  localPath,
+			RemotePath: remotePath,
+			RemoteAddr: remoteAddr,
+		},
+		start: time.Now(),
+	}
+	if a.hook != nil {
+		newHash := s.newHash
+		if newHash == nil {
+			newHash = sha256.New
+		}
+		a.hash = newHash()
+	}
+	a.progress.send(a.event(EventFileStarted))
+	return a
+}
+
+// event returns the progress event of the file.
+func (a *auditor) event(t ProgressEventType) ProgressEvent {
+	return ProgressEvent{
+		Type:       t,
+		Direction:  a.record.Direction,
+		LocalPath:  a.record.LocalPath,
+		RemotePath: a.record.RemotePath,
+		Bytes:      a.record.Bytes,
+		Err:        a.record.Err,
+	}
+}
+
+func (a *auditor) Write(p []byte) (int, error) {
+	a.record.Bytes += int64(len(p))
+	a.progress.send(a.event(EventBytesCopied))
+	if a.hash == nil {
+		return len(p), nil
+	}
+	return a.hash.Write(p)
+}
+
+// attach sets the auditor to tee, the tee field of a protocol, so that
+// the file body transferred over the protocol is written to the auditor.
+func (a *auditor) attach(tee *io.Writer) {
+	if a == nil {
+		return
+	}
+	a.tee = tee
+	*tee = a
+}
+
+// finish detaches the auditor, ends the span and calls the hook with
+// the record.
+func (a *auditor) finish(err error) {
+	if a == nil {
+		return
+	}
+	if a.tee != nil {
+		*a.tee = nil
+	}
+	a.record.Duration = time.Since(a.start)
+	a.record.Err = err
+	a.progress.send(a.event(EventFileFinished))
+	a.op.addBytes(a.record.Bytes)
+	if a.span != nil {
+		a.span.SetAttribute(AttrBytes, a.record.Bytes)
+		a.span.SetAttribute(AttrDuration, a.record.Duration)
+		a.span.End(err)
+	}
+	if a.report != nil {
+		a.report(a.record)
+	}
+	if a.hook == nil {
+		return
+	}
+	a.record.Hash = a.hash.Sum(nil)
+	a.hook(a.record)
+}
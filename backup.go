@@ -0,0 +1,66 @@
+package scp
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// defaultBackupSuffix is the suffix of the backups when WithBackup is given
+// an empty suffix.
+const defaultBackupSuffix = "~"
+
+// WithBackup makes the existing destination files kept as backups with
+// the name followed by suffix before they are replaced, like the --backup
+// option of cp. An empty suffix means "~". On receives, the local file is
+// renamed to the backup. On Send, SendFile and SendFiles, the remote file is
+// copied to the backup with the cp command before the transfer. A previous
+// backup is replaced.
+func WithBackup(suffix string) ScpOption {
+	return func(s *SCP) {
+		if suffix == "" {
+			suffix = defaultBackupSuffix
+		}
+		s.backupSuffix = suffix
+	}
+}
+
+// backupLocal renames the existing local file to the backup and reports
+// whether it did.
+func (s *SCP) backupLocal(localPath string) (bool, error) {
+	if s.backupSuffix == "" {
+		return false, nil
+	}
+	fi, err := os.Lstat(localPath)
+	if err != nil || !fi.Mode().IsRegular() {
+		return false, nil
+	}
+	if err := os.Rename(localPath, localPath+s.backupSuffix); err != nil {
+		return false, fmt.Errorf("failed to back up destination file: err=%w", err)
+	}
+	return true, nil
+}
+
+// restoreLocal renames the backup made by backupLocal back to localPath.
+func (s *SCP) restoreLocal(localPath string) {
+	os.Rename(localPath+s.backupSuffix, localPath)
+}
+
+// backupRemote copies the existing remote files to the backups. The files
+// are the names under destPath if it is a directory, or destPath itself.
+func (s *SCP) backupRemote(destPath string, names ...string) error {
+	if s.backupSuffix == "" {
+		return nil
+	}
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = escapeShellArg(name)
+	}
+	cmd := "d=" + escapeShellArg(destPath) + "; for n in " + strings.Join(quoted, " ") + `; do ` +
+		`if [ -d "$d" ]; then f="$d/$n"; else f="$d"; fi; ` +
+		`if [ -f "$f" ]; then cp -p -- "$f" "$f"` + escapeShellArg(s.backupSuffix) + ` || exit 1; fi; done`
+	if err := runCommandSession(s.sessionConfig(), cmd, nil, nil); err != nil {
+		return fmt.Errorf("failed to back up destination file: err=%w", err)
+	}
+	return nil
+}
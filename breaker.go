@@ -0,0 +1,133 @@
+package scp
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned for a host whose circuit breaker is open.
+var ErrCircuitOpen = errors.New("scp: circuit breaker is open for host")
+
+// BreakerState is the state of the circuit breaker for a host.
+type BreakerState int
+
+const (
+	// BreakerClosed means operations on the host are allowed.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen means the host failed too many times in a row and
+	// operations on it are rejected with ErrCircuitOpen.
+	BreakerOpen
+	// BreakerHalfOpen means the cool down period passed and a trial
+	// operation on the host is allowed.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreaker stops operations on hosts which keep failing.
+// After threshold consecutive failures, the breaker for the host opens and
+// operations on it fail with ErrCircuitOpen until cooldown passes. Then one
+// trial operation is allowed, which closes the breaker on success or opens it
+// again on failure. A CircuitBreaker can be shared by many operations and is
+// safe for concurrent use.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*breakerHost
+}
+
+type breakerHost struct {
+	failures int
+	state    BreakerState
+	openedAt time.Time
+}
+
+// NewCircuitBreaker creates a CircuitBreaker.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold <= 0 {
+		threshold = 1
+	}
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		hosts:     make(map[string]*breakerHost),
+	}
+}
+
+// State returns the state of the breaker for the host.
+func (b *CircuitBreaker) State(host string) BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h := b.hosts[host]
+	if h == nil {
+		return BreakerClosed
+	}
+	if h.state == BreakerOpen && time.Since(h.openedAt) >= b.cooldown {
+		return BreakerHalfOpen
+	}
+	return h.state
+}
+
+// Reset closes the breaker for the host.
+func (b *CircuitBreaker) Reset(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.hosts, host)
+}
+
+// allow reports whether an operation on the host is allowed.
+func (b *CircuitBreaker) allow(host string) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h := b.hosts[host]
+	if h == nil || h.state == BreakerClosed {
+		return true
+	}
+	if h.state == BreakerOpen && time.Since(h.openedAt) >= b.cooldown {
+		h.state = BreakerHalfOpen
+		return true
+	}
+	// Only one trial operation is allowed in the half-open state.
+	return false
+}
+
+// record records the result of an operation on the host.
+func (b *CircuitBreaker) record(host string, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h := b.hosts[host]
+	if h == nil {
+		h = &breakerHost{}
+		b.hosts[host] = h
+	}
+	if err == nil {
+		h.failures = 0
+		h.state = BreakerClosed
+		return
+	}
+	h.failures++
+	if h.state == BreakerHalfOpen || h.failures >= b.threshold {
+		h.state = BreakerOpen
+		h.openedAt = time.Now()
+	}
+}
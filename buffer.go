@@ -0,0 +1,49 @@
+package scp
+
+import (
+	"io"
+	"sync"
+)
+
+// defaultBufferSize is the size of the buffers copying the file bodies,
+// which is the same as io.Copy.
+const defaultBufferSize = 32 * 1024
+
+// WithBufferSize sets the size of the buffers copying the file bodies in
+// the scp protocol. Larger buffers reduce the system calls of transfers over
+// fast networks. The buffers are pooled per size and reused across
+// transfers. The default is 32KiB, and zero or a negative value means
+// the default.
+func WithBufferSize(size int) ScpOption {
+	return func(s *SCP) {
+		s.bufferSize = size
+	}
+}
+
+// bufferPools holds a *sync.Pool of *[]byte for each buffer size.
+var bufferPools sync.Map
+
+func bufferPool(size int) *sync.Pool {
+	if p, ok := bufferPools.Load(size); ok {
+		return p.(*sync.Pool)
+	}
+	p, _ := bufferPools.LoadOrStore(size, &sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, size)
+			return &b
+		},
+	})
+	return p.(*sync.Pool)
+}
+
+// copyBuffer copies src to dst with a pooled buffer of size bytes, or of
+// defaultBufferSize if size is not positive.
+func copyBuffer(dst io.Writer, src io.Reader, size int) (int64, error) {
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	pool := bufferPool(size)
+	buf := pool.Get().(*[]byte)
+	defer pool.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
@@ -0,0 +1,245 @@
+package scp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// ObjectsDirName is the name of the directory which holds the file
+	// contents in the content-addressable output mode.
+	ObjectsDirName = "objects"
+	// ManifestFileName is the name of the manifest file written by
+	// ReceiveDirObjects.
+	ManifestFileName = "manifest.json"
+	// SignatureFileSuffix is appended to the name of a manifest file to get
+	// the name of its signature file.
+	SignatureFileSuffix = ".sig"
+)
+
+// ErrInvalidManifestSignature is returned when the signature of a manifest
+// does not match its content.
+var ErrInvalidManifestSignature = errors.New("scp: invalid manifest signature")
+
+// Manifest maps the paths of received files to the digests of their contents.
+type Manifest struct {
+	Entries []ManifestEntry `json:"entries"`
+}
+
+// ManifestEntry describes a file in Manifest.
+type ManifestEntry struct {
+	// Path is the slash separated path relative to the source directory.
+	Path    string      `json:"path"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"modTime"`
+	// SHA256 is the hex encoded SHA-256 digest of the content.
+	SHA256 string `json:"sha256"`
+}
+
+// ObjectPath returns the path of the object for the entry under destDir.
+func (e ManifestEntry) ObjectPath(destDir string) string {
+	return filepath.Join(destDir, ObjectsDirName, e.SHA256)
+}
+
+// ReadManifest reads the manifest written by ReceiveDirObjects.
+func ReadManifest(filename string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: err=%w", err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: err=%w", err)
+	}
+	return &m, nil
+}
+
+// WriteFile writes the manifest as JSON to the file.
+func (m *Manifest) WriteFile(filename string) error {
+	_, err := m.writeFile(filename)
+	return err
+}
+
+// WriteSignedFile writes the manifest as JSON to the file, and the base64
+// encoded ed25519 signature of the written content to the file with
+// SignatureFileSuffix appended to filename.
+func (m *Manifest) WriteSignedFile(filename string, key ed25519.PrivateKey) error {
+	data, err := m.writeFile(filename)
+	if err != nil {
+		return err
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, data)) + "\n"
+	if err := ioutil.WriteFile(filename+SignatureFileSuffix, []byte(sig), 0644); err != nil {
+		return fmt.Errorf("failed to write manifest signature: err=%w", err)
+	}
+	return nil
+}
+
+func (m *Manifest) writeFile(filename string) ([]byte, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest: err=%w", err)
+	}
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write manifest: err=%w", err)
+	}
+	return data, nil
+}
+
+// VerifySignedManifest reads the manifest written by WriteSignedFile and
+// verifies its signature with publicKey. If the signature does not match,
+// the returned error wraps ErrInvalidManifestSignature.
+func VerifySignedManifest(filename string, publicKey ed25519.PublicKey) (*Manifest, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: err=%w", err)
+	}
+	encoded, err := ioutil.ReadFile(filename + SignatureFileSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest signature: err=%w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidManifestSignature, err)
+	}
+	if !ed25519.Verify(publicKey, data, sig) {
+		return nil, ErrInvalidManifestSignature
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: err=%w", err)
+	}
+	return &m, nil
+}
+
+// ReceiveDirObjects copies files under a remote srcDir in the
+// content-addressable layout. Each file content is written to
+// destDir/objects/<sha256>, so identical contents are stored only once,
+// and destDir/manifest.json maps the paths relative to srcDir to the digests.
+// If a signing key is set with WithManifestSigningKey, the manifest is signed
+// as with Manifest.WriteSignedFile.
+// You can filter the files with acceptFn as in ReceiveDir. Directories are
+// not created and the permissions and times are recorded only in the manifest.
+func (s *SCP) ReceiveDirObjects(srcDir, destDir string, acceptFn AcceptFunc) (manifest *Manifest, err error) {
+	s, op := s.withTimeout()
+	defer op.finish(&err)
+	srcDir = s.cleanRemotePath(srcDir)
+	destDir = filepath.Clean(destDir)
+	objectsDir := filepath.Join(destDir, ObjectsDirName)
+	if err := os.MkdirAll(objectsDir, 0777); err != nil {
+		return nil, fmt.Errorf("failed to create objects directory: err=%w", err)
+	}
+
+	receiver := &objectReceiver{
+		scp:        s,
+		root:       destDir,
+		objectsDir: objectsDir,
+		manifest:   &Manifest{},
+	}
+	err = runResourceSession(s.sessionConfig(), srcDir, false, true, func(rs *resourceSession) error {
+		return s.walkRemoteDir(rs, destDir, true, acceptFn, receiver)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	manifestFile := filepath.Join(destDir, ManifestFileName)
+	if s.manifestSigningKey != nil {
+		err = receiver.manifest.WriteSignedFile(manifestFile, s.manifestSigningKey)
+	} else {
+		err = receiver.manifest.WriteFile(manifestFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return receiver.manifest, nil
+}
+
+// objectReceiver writes the received files to the objects directory.
+type objectReceiver struct {
+	scp        *SCP
+	root       string
+	objectsDir string
+	manifest   *Manifest
+}
+
+func (r *objectReceiver) startDirectory(dir string, timeHeader TimeMsgHeader, dirHeader StartDirectoryMsgHeader) error {
+	return nil
+}
+
+func (r *objectReceiver) endDirectory(dir string, timeHeader TimeMsgHeader) error {
+	return nil
+}
+
+func (r *objectReceiver) receiveFile(rs *resourceSession, path string, timeHeader TimeMsgHeader, fileHeader FileMsgHeader) (err error) {
+	rel, err := filepath.Rel(r.root, path)
+	if err != nil {
+		return fmt.Errorf("failed to get relative path: err=%w", err)
+	}
+	fileInfo := NewFileInfo(path, fileHeader.Size, fileHeader.Mode, timeHeader.Mtime, timeHeader.Atime)
+	observer := r.scp.sourceObserver
+	observer.OnFileInfo(fileInfo)
+	defer func() {
+		notifyFileDone(observer, fileInfo, err)
+	}()
+
+	tmp, err := ioutil.TempFile(r.objectsDir, ".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary object file: err=%w", err)
+	}
+	tmpName := tmp.Name()
+	h := sha256.New()
+	wo := &writerProxy{
+		writer:       io.MultiWriter(tmp, h),
+		onWriterFunc: observer.OnWrite,
+	}
+	if err := rs.CopyFileBodyTo(fileHeader, wo); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to copy file: err=%w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to close temporary object file: err=%w", err)
+	}
+
+	sum := h.Sum(nil)
+	if hashObserver, ok := observer.(HashObserver); ok {
+		hashObserver.OnHash(fileInfo, sum, true)
+	}
+	entry := ManifestEntry{
+		Path:    filepath.ToSlash(rel),
+		Size:    fileHeader.Size,
+		Mode:    fileHeader.Mode,
+		ModTime: timeHeader.Mtime,
+		SHA256:  hex.EncodeToString(sum),
+	}
+	objectPath := entry.ObjectPath(r.root)
+	if _, err := os.Stat(objectPath); err == nil {
+		// The same content is already stored.
+		os.Remove(tmpName)
+	} else {
+		if err := os.Chmod(tmpName, 0444); err != nil {
+			os.Remove(tmpName)
+			return fmt.Errorf("failed to change object mode: err=%w", err)
+		}
+		if err := os.Rename(tmpName, objectPath); err != nil {
+			os.Remove(tmpName)
+			return fmt.Errorf("failed to rename object file: err=%w", err)
+		}
+	}
+	r.manifest.Entries = append(r.manifest.Entries, entry)
+	return nil
+}
@@ -0,0 +1,34 @@
+package scp
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// exitCommandNotFound is the exit status of the shell when the command is
+// not found.
+const exitCommandNotFound = 127
+
+// WithCatFallback makes SendFile and ReceiveFile fall back to transferring
+// the file with the cat command when the scp command is not found on
+// the remote server, for minimal containers without scp. The size is taken
+// from the stat command before the transfer and checked after it, so
+// a truncated transfer fails. The time and permission are set as with scp,
+// with the times in seconds. The remote server must have the stat, cat, wc,
+// chmod and touch commands.
+func WithCatFallback() ScpOption {
+	return func(s *SCP) {
+		s.catFallback = true
+	}
+}
+
+// fallsBackToCat reports whether the transfer failed with err should be
+// retried with the cat command.
+func (s *SCP) fallsBackToCat(err error) bool {
+	if !s.catFallback || s.subsystem != "" {
+		return false
+	}
+	var exitErr *ssh.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitStatus() == exitCommandNotFound
+}
@@ -0,0 +1,43 @@
+package scp
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// Sender is the set of the operations of SCP sending files to the remote
+// host. Applications can depend on it instead of *SCP to replace the
+// transfers with a fake in their unit tests.
+type Sender interface {
+	Send(info *FileInfo, r io.ReadCloser, destFile string) error
+	SendContext(ctx context.Context, info *FileInfo, r io.ReadCloser, destFile string) error
+	SendBytes(data []byte, mode os.FileMode, destFile string) error
+	SendReader(r io.Reader, mode os.FileMode, destFile string) error
+	SendFile(srcFile, destFile string) error
+	SendFileContext(ctx context.Context, srcFile, destFile string) error
+	SendFiles(srcFiles []string, destDir string) error
+	SendDir(srcDir, destDir string, acceptFn AcceptFunc) (*TransferReport, error)
+	SendDirContext(ctx context.Context, srcDir, destDir string, acceptFn AcceptFunc) (*TransferReport, error)
+}
+
+// Receiver is the set of the operations of SCP receiving files from
+// the remote host, for the same purpose as Sender.
+type Receiver interface {
+	Receive(srcFile string, dest io.Writer) (os.FileInfo, error)
+	ReceiveBytes(srcFile string) ([]byte, os.FileInfo, error)
+	ReceiveFile(srcFile, destFile string) error
+	ReceiveFiles(srcFiles []string, destDir string) error
+	ReceiveDir(srcDir, destDir string, acceptFn AcceptFunc) (*TransferReport, error)
+}
+
+// Client is the set of the common operations of SCP, which *SCP
+// implements. The operations specific to *SCP, such as With and OpenSink,
+// are not included, so a fake needs the transfers only.
+type Client interface {
+	Sender
+	Receiver
+	Close() error
+}
+
+var _ Client = (*SCP)(nil)
@@ -0,0 +1,112 @@
+package scp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// runCommandSession executes cmd on the remote server with the input
+// written by writeFn, which may be nil for no input. The standard output is
+// copied to out. If out is nil, the standard output is included in the error
+// with the standard error when the command fails.
+func runCommandSession(cfg *sessionConfig, cmd string, writeFn func(w io.Writer) error, out io.Writer) error {
+	usage, err := cfg.accounting.startSession(cfg.remoteAddr())
+	if err != nil {
+		return err
+	}
+	session, err := cfg.newSession()
+	if err != nil {
+		return err
+	}
+	usage.started()
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if cfg.forwardAgent {
+		ss, ok := session.(sshSession)
+		if !ok {
+			return errNotSSHSession
+		}
+		if err := agent.RequestAgentForwarding(ss.Session); err != nil {
+			return fmt.Errorf("failed to request agent forwarding: err=%w", err)
+		}
+	}
+	teardown := cfg.newTeardown(session)
+	teardown.cmd = cmd
+	stdin, stdout = usage.wrap(stdin, stdout)
+	stdin, stdout = cfg.usage.wrap(stdin, stdout)
+	stdin, stdout = cfg.hostMetrics().wrap(stdin, stdout)
+	stdin, stdout = teardown.idle.wrap(stdin, stdout)
+	stdin, stdout = cfg.pause.wrap(stdin, stdout)
+
+	teardown.log.debug("scp: starting command", "cmd", cmd, "sudo", cfg.sudo)
+	if err := session.Start(cfg.sudoCommand(cmd)); err != nil {
+		return err
+	}
+	teardown.active = startExpvarSession()
+	go func() {
+		done := cfg.ctx.Done()
+		// can never canceled
+		if done == nil {
+			return
+		}
+		<-done
+		session.Close()
+	}()
+
+	var output bytes.Buffer
+	if out == nil {
+		out = &output
+	}
+	var cerr error
+	outputDone := make(chan struct{})
+	go func() {
+		_, cerr = io.Copy(out, stdout)
+		if cerr != nil {
+			// Unblock the remote command.
+			io.Copy(ioutil.Discard, stdout)
+		}
+		close(outputDone)
+	}()
+
+	var werr error
+	if writeFn != nil {
+		werr = writeFn(stdin)
+	} else {
+		// Some servers stop forwarding the output once the input is
+		// closed, so the input is kept open until the output ends.
+		<-outputDone
+	}
+	stdin.Close()
+	err = teardown.wait(session)
+	if errors.Is(err, ErrTeardownTimeout) {
+		return err
+	}
+	<-outputDone
+	if werr != nil {
+		return teardown.idle.err(werr)
+	}
+	if cerr != nil {
+		return teardown.idle.err(cerr)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(output.String()); msg != "" {
+			return fmt.Errorf("%w: stdout=%q", err, msg)
+		}
+		return err
+	}
+	return nil
+}
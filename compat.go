@@ -0,0 +1,106 @@
+package scp
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+// Compat is the compatibility mode for the implementation of scp on
+// the remote server, which determines the options passed to it.
+type Compat int
+
+const (
+	// CompatOpenSSH passes the options understood by the scp of OpenSSH.
+	CompatOpenSSH Compat = iota
+	// CompatBusyBox omits the -d option, which the scp applet of BusyBox
+	// rejects. The remote destination directory is still checked by
+	// the protocol.
+	CompatBusyBox
+	// CompatDropbear omits the -d option and the -p option of the sink
+	// side. The times and the permissions are still sent in the protocol
+	// messages, and the -p option is kept for receives, where it makes
+	// the remote scp send the times.
+	CompatDropbear
+	// CompatAuto detects the implementation once per SCP by resolving
+	// the remote scp command, falling back to the version of the SSH
+	// server, and uses CompatOpenSSH if it cannot be detected.
+	CompatAuto
+)
+
+// WithCompat sets the compatibility mode for the remote scp, for embedded
+// devices running BusyBox or Dropbear. The default is CompatOpenSSH.
+func WithCompat(c Compat) ScpOption {
+	return func(s *SCP) {
+		s.compat = c
+		if c == CompatAuto {
+			s.compatDetection = &compatDetection{}
+		}
+	}
+}
+
+// compatDetection holds the result of CompatAuto shared by the copies
+// of an SCP.
+type compatDetection struct {
+	once   sync.Once
+	result Compat
+}
+
+// compatMode returns the compatibility mode, detecting it if it is CompatAuto.
+func (c *sessionConfig) compatMode() Compat {
+	if c.compat != CompatAuto {
+		return c.compat
+	}
+	if c.compatDetection == nil || c.subsystem != "" {
+		return CompatOpenSSH
+	}
+	c.compatDetection.once.Do(func() {
+		c.compatDetection.result = c.detectCompat()
+	})
+	return c.compatDetection.result
+}
+
+// detectCompat resolves the remote scp command, which is usually a link to
+// the multi-call binary of BusyBox or Dropbear on embedded devices.
+func (c *sessionConfig) detectCompat() Compat {
+	scpPath := c.scpPath
+	if scpPath == "" {
+		scpPath = "scp"
+	}
+	cmd := `p=$(command -v ` + scpPath + `) && { readlink -f "$p" || echo "$p"; }`
+	var out bytes.Buffer
+	if err := runCommandSession(c, cmd, nil, &out); err == nil {
+		resolved := strings.ToLower(out.String())
+		switch {
+		case strings.Contains(resolved, "busybox"):
+			return CompatBusyBox
+		case strings.Contains(resolved, "dropbear"):
+			return CompatDropbear
+		}
+	}
+	if c.client != nil && strings.Contains(strings.ToLower(string(c.client.ServerVersion())), "dropbear") {
+		return CompatDropbear
+	}
+	return CompatOpenSSH
+}
+
+// scpOptions returns the options of the remote scp, such as "-tpd",
+// without the ones not accepted in the compatibility mode.
+func (c *sessionConfig) scpOptions(opt []byte) string {
+	mode := c.compatMode()
+	if mode == CompatOpenSSH {
+		return string(opt)
+	}
+	sink := len(opt) > 1 && opt[1] == 't'
+	var b []byte
+	for _, o := range opt {
+		switch {
+		case o == 'd':
+			continue
+		case o == 'p' && sink && mode == CompatDropbear:
+			continue
+		}
+		b = append(b, o)
+	}
+	return string(b)
+}
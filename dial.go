@@ -0,0 +1,202 @@
+package scp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// DialOption is the type of options for Dial.
+type DialOption func(c *dialConfig)
+
+type dialConfig struct {
+	auth            []ssh.AuthMethod
+	useAgent        bool
+	hostKeyCallback ssh.HostKeyCallback
+	knownHostsFiles []string
+	timeout         time.Duration
+	scpOptions      []ScpOption
+	jumpHosts       []string
+	err             error
+}
+
+// WithPassword makes Dial authenticate with password.
+func WithPassword(password string) DialOption {
+	return func(c *dialConfig) {
+		c.auth = append(c.auth, ssh.Password(password))
+	}
+}
+
+// WithKeyFile makes Dial authenticate with the private key in the file at
+// path, such as ~/.ssh/id_ed25519.
+func WithKeyFile(path string) DialOption {
+	return withKeyFile(path, nil)
+}
+
+// WithEncryptedKeyFile is like WithKeyFile for a key encrypted with
+// passphrase.
+func WithEncryptedKeyFile(path string, passphrase []byte) DialOption {
+	return withKeyFile(path, passphrase)
+}
+
+func withKeyFile(path string, passphrase []byte) DialOption {
+	return func(c *dialConfig) {
+		if c.err != nil {
+			return
+		}
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			c.err = fmt.Errorf("failed to read key file: err=%w", err)
+			return
+		}
+		var signer ssh.Signer
+		if passphrase != nil {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, passphrase)
+		} else {
+			signer, err = ssh.ParsePrivateKey(pem)
+		}
+		if err != nil {
+			c.err = fmt.Errorf("failed to parse key file %s: err=%w", path, err)
+			return
+		}
+		c.auth = append(c.auth, ssh.PublicKeys(signer))
+	}
+}
+
+// WithAgent makes Dial authenticate with the keys of the SSH agent at
+// SSH_AUTH_SOCK. The connection to the agent is closed by Close.
+func WithAgent() DialOption {
+	return func(c *dialConfig) {
+		c.useAgent = true
+	}
+}
+
+// WithHostKeyCallback sets the callback checking the host key of the server
+// instead of the known hosts files.
+func WithHostKeyCallback(callback ssh.HostKeyCallback) DialOption {
+	return func(c *dialConfig) {
+		c.hostKeyCallback = callback
+	}
+}
+
+// WithKnownHostsFiles sets the known hosts files which the host key of
+// the server must be found in. The default is ~/.ssh/known_hosts.
+func WithKnownHostsFiles(files ...string) DialOption {
+	return func(c *dialConfig) {
+		c.knownHostsFiles = append(c.knownHostsFiles, files...)
+	}
+}
+
+// WithDialTimeout sets the maximum time to connect to each of the jump
+// hosts and the target, which bounds the TCP connection and the SSH
+// handshake separately. Zero means no limit, which is the default.
+func WithDialTimeout(d time.Duration) DialOption {
+	return func(c *dialConfig) {
+		c.timeout = d
+	}
+}
+
+// WithDialClientOptions sets the options for the SCP client returned by Dial.
+func WithDialClientOptions(options ...ScpOption) DialOption {
+	return func(c *dialConfig) {
+		c.scpOptions = append(c.scpOptions, options...)
+	}
+}
+
+// dialedConn is the connection opened by Dial, which is closed by Close of
+// the SCP and its copies made by With.
+type dialedConn struct {
+	client *ssh.Client
+	// jumps are the clients of the jump hosts in order.
+	jumps     []*ssh.Client
+	agentConn net.Conn
+	once      sync.Once
+	err       error
+}
+
+func (d *dialedConn) Close() error {
+	d.once.Do(func() {
+		if d.client != nil {
+			d.err = d.client.Close()
+		}
+		for i := len(d.jumps) - 1; i >= 0; i-- {
+			d.jumps[i].Close()
+		}
+		if d.agentConn != nil {
+			d.agentConn.Close()
+		}
+	})
+	return d.err
+}
+
+// Dial connects to the SSH server at addr as user and returns the SCP client
+// over the connection, which must be closed with Close. The port defaults
+// to 22 if addr has none. At least one of WithPassword, WithKeyFile,
+// WithEncryptedKeyFile and WithAgent is required for the authentication,
+// and the host key is checked with ~/.ssh/known_hosts unless
+// WithKnownHostsFiles or WithHostKeyCallback is given.
+func Dial(addr, user string, options ...DialOption) (*SCP, error) {
+	c := &dialConfig{}
+	for _, option := range options {
+		option(c)
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	hostKeyCallback := c.hostKeyCallback
+	if hostKeyCallback == nil {
+		files := c.knownHostsFiles
+		if len(files) == 0 {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, fmt.Errorf("failed to find known_hosts: err=%w", err)
+			}
+			files = []string{filepath.Join(home, ".ssh", "known_hosts")}
+		}
+		callback, err := knownhosts.New(files...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read known_hosts: err=%w", err)
+		}
+		hostKeyCallback = callback
+	}
+
+	conn := &dialedConn{}
+	auth := c.auth
+	if c.useAgent {
+		agentConn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to ssh agent: err=%w", err)
+		}
+		conn.agentConn = agentConn
+		auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("scp: no authentication method for %s", addr)
+	}
+
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         c.timeout,
+	}
+	if err := conn.dial(addr, config, c.jumpHosts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s := NewSCP(conn.client, c.scpOptions...)
+	s.dialed = conn
+	return s, nil
+}
@@ -0,0 +1,15 @@
+// +build !windows
+
+package scp
+
+import "os"
+
+// syncDir fsyncs the directory, which makes the entries in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
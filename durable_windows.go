@@ -0,0 +1,7 @@
+package scp
+
+// syncDir does nothing, since Windows cannot fsync directories and
+// the entries are made durable with the files.
+func syncDir(dir string) error {
+	return nil
+}
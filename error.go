@@ -1,9 +1,38 @@
 package scp
 
-type protocolError struct {
-	msg   string
-	fatal bool
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ljun20160606/go-scp/scpwire"
+)
+
+// RemoteError is an error reply sent by the peer scp, such as
+// "scp: /foo: No such file or directory". errors.Is reports whether it is
+// os.ErrNotExist or os.ErrPermission from the message.
+type RemoteError = scpwire.RemoteError
+
+// ProtocolError is returned when the peer sends a message which does not
+// follow the scp protocol.
+type ProtocolError = scpwire.ProtocolError
+
+// CommandError is returned when the remote command fails or does not exit
+// in time. Err is the error of the session, such as *ssh.ExitError, or
+// ErrTeardownTimeout.
+type CommandError struct {
+	// Cmd is the remote command line.
+	Cmd string
+	// Stderr is the beginning of the standard error of the command.
+	Stderr string
+	Err    error
+}
+
+func (e *CommandError) Error() string {
+	msg := fmt.Sprintf("remote command %q failed: %s", e.Cmd, e.Err)
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += fmt.Sprintf(": stderr=%q", stderr)
+	}
+	return msg
 }
 
-func (e *protocolError) Error() string { return e.msg }
-func (e *protocolError) Fatal() bool   { return e.fatal }
+func (e *CommandError) Unwrap() error { return e.Err }
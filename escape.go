@@ -2,6 +2,68 @@ package scp
 
 import "strings"
 
+// ShellQuoting is the quoting of the arguments in the command line of
+// the remote scp, which depends on the shell of the remote server.
+type ShellQuoting int
+
+const (
+	// QuotingPOSIX quotes the arguments for POSIX sh and compatible shells
+	// such as bash and zsh.
+	QuotingPOSIX ShellQuoting = iota
+	// QuotingCsh quotes the arguments for csh and tcsh, which expand "!"
+	// even in single quotes.
+	QuotingCsh
+	// QuotingCmd quotes the arguments for Windows cmd.exe and the programs
+	// parsing the command line with the rules of CommandLineToArgvW.
+	// Note that cmd.exe expands environment variables such as %PATH% even
+	// in double quotes.
+	QuotingCmd
+	// QuotingPowerShell quotes the arguments for Windows PowerShell.
+	QuotingPowerShell
+)
+
+func (q ShellQuoting) quote(arg string) string {
+	switch q {
+	case QuotingCsh:
+		return quoteCsh(arg)
+	case QuotingCmd:
+		return quoteCmd(arg)
+	case QuotingPowerShell:
+		return "'" + strings.Replace(arg, "'", "''", -1) + "'"
+	default:
+		return escapeShellArg(arg)
+	}
+}
+
 func escapeShellArg(arg string) string {
 	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
 }
+
+func quoteCsh(arg string) string {
+	r := strings.NewReplacer("'", `'\''`, "!", `\!`, "\n", "\\\n")
+	return "'" + r.Replace(arg) + "'"
+}
+
+func quoteCmd(arg string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	backslashes := 0
+	for i := 0; i < len(arg); i++ {
+		c := arg[i]
+		switch c {
+		case '\\':
+			backslashes++
+			continue
+		case '"':
+			// The backslashes before a quote and the quote are escaped.
+			backslashes = 2*backslashes + 1
+		}
+		b.WriteString(strings.Repeat(`\`, backslashes))
+		backslashes = 0
+		b.WriteByte(c)
+	}
+	// The backslashes before the closing quote are escaped.
+	b.WriteString(strings.Repeat(`\`, 2*backslashes))
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,74 @@
+package scp
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// WithExclude makes SendDir and ReceiveDir skip the files and directories
+// matching any of patterns, in addition to the filtering with acceptFn.
+// A pattern without '/' is matched against the name in the syntax of
+// path.Match, like "*.log". A pattern with '/' is matched against the path
+// relative to the top of the copied directory, where "**" matches any
+// number of directories, like "node_modules/**" or "**/testdata".
+// The entries under an excluded directory are skipped too.
+func WithExclude(patterns ...string) ScpOption {
+	return func(s *SCP) {
+		s.excludes = append(s.excludes, patterns...)
+	}
+}
+
+// excludeFilter returns acceptFn which also rejects the entries matching
+// the patterns set with WithExclude. root is the local top directory of
+// the copied tree.
+func (s *SCP) excludeFilter(root string, acceptFn AcceptFunc) AcceptFunc {
+	if len(s.excludes) == 0 {
+		return acceptFn
+	}
+	excludes := s.excludes
+	return func(parentDir string, info os.FileInfo) (bool, error) {
+		rel, err := filepath.Rel(root, filepath.Join(parentDir, info.Name()))
+		rel = filepath.ToSlash(rel)
+		if err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, "../") {
+			for _, pattern := range excludes {
+				if matchExclude(pattern, rel) {
+					return false, nil
+				}
+			}
+		}
+		return acceptFn(parentDir, info)
+	}
+}
+
+// matchExclude reports whether the slash separated relative path rel
+// matches pattern.
+func matchExclude(pattern, rel string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(rel))
+		return ok
+	}
+	return matchSegments(strings.Split(strings.Trim(pattern, "/"), "/"), strings.Split(rel, "/"))
+}
+
+func matchSegments(pattern, names []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(names); i++ {
+				if matchSegments(pattern[1:], names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], names[0]); !ok {
+			return false
+		}
+		pattern, names = pattern[1:], names[1:]
+	}
+	return len(names) == 0
+}
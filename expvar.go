@@ -0,0 +1,111 @@
+package scp
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The counters published by PublishExpvar. They are counted only after
+// PublishExpvar is called.
+var (
+	expvarEnabled         int32
+	expvarOnce            sync.Once
+	expvarBytesSent       expvar.Int
+	expvarBytesReceived   expvar.Int
+	expvarSessionsActive  expvar.Int
+	expvarSessionsStarted expvar.Int
+	expvarFailures        expvar.Int
+)
+
+// PublishExpvar publishes the counters of all the SCP clients in the process
+// as the expvar map named "scp", so that the /debug/vars endpoint shows them.
+// The map has bytes_sent and bytes_received, the bytes of all the sessions
+// including the protocol messages, sessions_active and sessions_started,
+// and failures, the number of failed operations observed as with
+// WithMetrics. Nothing is counted until it is called. It may be called more
+// than once.
+func PublishExpvar() {
+	expvarOnce.Do(func() {
+		m := expvar.NewMap("scp")
+		m.Set("bytes_sent", &expvarBytesSent)
+		m.Set("bytes_received", &expvarBytesReceived)
+		m.Set("sessions_active", &expvarSessionsActive)
+		m.Set("sessions_started", &expvarSessionsStarted)
+		m.Set("failures", &expvarFailures)
+		atomic.StoreInt32(&expvarEnabled, 1)
+	})
+}
+
+func expvarPublished() bool {
+	return atomic.LoadInt32(&expvarEnabled) == 1
+}
+
+// expvarMetrics counts the bytes and the failures to the expvar counters.
+type expvarMetrics struct{}
+
+func (expvarMetrics) AddBytes(host string, direction Direction, n int64) {
+	if direction == DirectionUpload {
+		expvarBytesSent.Add(n)
+	} else {
+		expvarBytesReceived.Add(n)
+	}
+}
+
+func (expvarMetrics) ObserveTransfer(host, op string, d time.Duration, err error) {
+	if err != nil {
+		expvarFailures.Add(1)
+	}
+}
+
+// withExpvarMetrics returns m with the expvar counters added if they are
+// published.
+func withExpvarMetrics(m Metrics) Metrics {
+	if !expvarPublished() {
+		return m
+	}
+	if m == nil {
+		return expvarMetrics{}
+	}
+	return multiMetrics{m, expvarMetrics{}}
+}
+
+type multiMetrics []Metrics
+
+func (ms multiMetrics) AddBytes(host string, direction Direction, n int64) {
+	for _, m := range ms {
+		m.AddBytes(host, direction, n)
+	}
+}
+
+func (ms multiMetrics) ObserveTransfer(host, op string, d time.Duration, err error) {
+	for _, m := range ms {
+		m.ObserveTransfer(host, op, d, err)
+	}
+}
+
+// expvarSession counts an active session. end is no-op on a nil
+// expvarSession, which is used when the counters are not published.
+type expvarSession struct {
+	once sync.Once
+}
+
+func startExpvarSession() *expvarSession {
+	if !expvarPublished() {
+		return nil
+	}
+	expvarSessionsActive.Add(1)
+	expvarSessionsStarted.Add(1)
+	return &expvarSession{}
+}
+
+// end counts the end of the session once.
+func (e *expvarSession) end() {
+	if e == nil {
+		return
+	}
+	e.once.Do(func() {
+		expvarSessionsActive.Add(-1)
+	})
+}
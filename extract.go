@@ -0,0 +1,178 @@
+package scp
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUnsafeArchivePath is returned when an archive has an entry whose path
+// is absolute or points outside the destination directory.
+var ErrUnsafeArchivePath = errors.New("scp: unsafe path in archive")
+
+type archiveFormat int
+
+const (
+	archiveNone archiveFormat = iota
+	archiveTar
+	archiveTarGz
+	archiveZip
+)
+
+// archiveFormatOf returns the format of the archive by the file name.
+func archiveFormatOf(name string) archiveFormat {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".tar"):
+		return archiveTar
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return archiveTarGz
+	case strings.HasSuffix(lower, ".zip"):
+		return archiveZip
+	default:
+		return archiveNone
+	}
+}
+
+// extractReceived extracts the received file into its directory if it is
+// an archive and auto extraction is enabled with WithAutoExtract.
+func (s *SCP) extractReceived(localFilename string) error {
+	if !s.autoExtract {
+		return nil
+	}
+	format := archiveFormatOf(localFilename)
+	if format == archiveNone {
+		return nil
+	}
+	if err := extractArchive(localFilename, filepath.Dir(localFilename), format); err != nil {
+		return fmt.Errorf("failed to extract archive: err=%w", err)
+	}
+	if s.removeExtractedArchives {
+		if err := os.Remove(localFilename); err != nil {
+			return fmt.Errorf("failed to remove extracted archive: err=%w", err)
+		}
+	}
+	return nil
+}
+
+func extractArchive(archive, destDir string, format archiveFormat) error {
+	if format == archiveZip {
+		return extractZip(archive, destDir)
+	}
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if format == archiveTarGz {
+		gr, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		target, err := archiveEntryPath(destDir, h.Name)
+		if err != nil {
+			return err
+		}
+		mode := os.FileMode(h.Mode).Perm()
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := writeArchiveEntry(target, mode, tr); err != nil {
+				return err
+			}
+		default:
+			// Links and special files are skipped, since links could be
+			// used to write outside destDir.
+		}
+	}
+}
+
+func extractZip(archive, destDir string) error {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		target, err := archiveEntryPath(destDir, f.Name)
+		if err != nil {
+			return err
+		}
+		mode := f.Mode()
+		if mode.IsDir() {
+			if err := os.MkdirAll(target, mode.Perm()|0700); err != nil {
+				return err
+			}
+			continue
+		}
+		if !mode.IsRegular() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = writeArchiveEntry(target, mode.Perm(), rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveEntryPath returns the local path of the archive entry under destDir.
+// It rejects absolute paths and paths escaping destDir to prevent zip slip.
+func archiveEntryPath(destDir, name string) (string, error) {
+	name = strings.Replace(name, "\\", "/", -1)
+	if strings.HasPrefix(name, "/") || filepath.IsAbs(filepath.FromSlash(name)) || filepath.VolumeName(filepath.FromSlash(name)) != "" {
+		return "", fmt.Errorf("%w: %s", ErrUnsafeArchivePath, name)
+	}
+	target := filepath.Join(destDir, filepath.FromSlash(name))
+	ok, err := isSubdirectory(destDir, target)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnsafeArchivePath, name)
+	}
+	return target, nil
+}
+
+func writeArchiveEntry(target string, mode os.FileMode, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
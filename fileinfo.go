@@ -15,13 +15,18 @@ type FileInfo struct {
 	accessTime time.Time
 }
 
+// modePermBits is the permission bits and the setuid, setgid and sticky
+// bits, which are carried in the scp protocol.
+const modePermBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
 // NewFileInfo creates a file information. The filepath.Base(name) is
-// used as the name and the mode is masked with (os.ModePerm | os.ModeDir).
+// used as the name and the mode is masked with the permission bits, the
+// setuid, setgid and sticky bits, and os.ModeDir.
 func NewFileInfo(name string, size int64, mode os.FileMode, modTime, accessTime time.Time) *FileInfo {
 	return &FileInfo{
 		name:       filepath.Base(name),
 		size:       size,
-		mode:       mode & (os.ModePerm | os.ModeDir),
+		mode:       mode & (modePermBits | os.ModeDir),
 		modTime:    modTime,
 		accessTime: accessTime,
 	}
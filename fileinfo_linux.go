@@ -25,3 +25,12 @@ func NewFileInfoFromOS(fi os.FileInfo, replaceName string) *FileInfo {
 
 	return NewFileInfo(name, fi.Size(), fi.Mode(), modTime, accessTime)
 }
+
+// fileOwner returns the user and group IDs of the owner of fi.
+func fileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+	sysStat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(sysStat.Uid), int(sysStat.Gid), true
+}
@@ -24,3 +24,9 @@ func NewFileInfoFromOS(fi os.FileInfo, replaceName string) *FileInfo {
 
 	return NewFileInfo(name, fi.Size(), fi.Mode(), modTime, accessTime)
 }
+
+// fileOwner returns the user and group IDs of the owner of fi, which are
+// not available on Windows.
+func fileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
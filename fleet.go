@@ -0,0 +1,412 @@
+package scp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const defaultFleetConcurrency = 8
+
+// HostResult is the result of an operation on a remote host.
+type HostResult struct {
+	// Host is the remote address of the client.
+	Host string
+	// Duration is the elapsed time of the operation on the host.
+	Duration time.Duration
+	// Bytes is the number of bytes sent to and received from the host,
+	// including the protocol messages.
+	Bytes int64
+	// Attempts is the number of attempts of the operation on the host.
+	Attempts int
+	// Breaker is the state of the circuit breaker for the host after the
+	// operation. It is BreakerClosed if no breaker is set.
+	Breaker BreakerState
+	// Err is the error of the operation, or nil if it succeeded.
+	Err error
+}
+
+// HostResults is the results of an operation on many hosts.
+type HostResults []HostResult
+
+// Failed returns the results of the hosts where the operation failed.
+func (r HostResults) Failed() HostResults {
+	var failed HostResults
+	for _, result := range r {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// Succeeded returns the results of the hosts where the operation succeeded.
+func (r HostResults) Succeeded() HostResults {
+	var succeeded HostResults
+	for _, result := range r {
+		if result.Err == nil {
+			succeeded = append(succeeded, result)
+		}
+	}
+	return succeeded
+}
+
+// Hosts returns the hosts of the results.
+func (r HostResults) Hosts() []string {
+	hosts := make([]string, len(r))
+	for i, result := range r {
+		hosts[i] = result.Host
+	}
+	return hosts
+}
+
+// TotalBytes returns the sum of the bytes of all the results.
+func (r HostResults) TotalBytes() int64 {
+	var total int64
+	for _, result := range r {
+		total += result.Bytes
+	}
+	return total
+}
+
+// Err returns an error summarizing the failed hosts, or nil if the operation
+// succeeded on all the hosts.
+func (r HostResults) Err() error {
+	failed := r.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(failed))
+	for i, result := range failed {
+		msgs[i] = fmt.Sprintf("%s: %s", result.Host, result.Err)
+	}
+	return fmt.Errorf("failed on %d of %d hosts: %s", len(failed), len(r), strings.Join(msgs, "; "))
+}
+
+// Host describes a remote host in the operations on many hosts.
+// It is the data for the destination path templates of FanOut.
+type Host struct {
+	// Client is the SSH client of the host.
+	Client *ssh.Client
+	// Index is the index of the client in the clients.
+	Index int
+	// Addr is the remote address of the client.
+	Addr string
+	// Hostname is the host part of Addr.
+	Hostname string
+	// Port is the port part of Addr.
+	Port string
+	// User is the user name reported by the client connection.
+	// It can be empty depending on the version of golang.org/x/crypto/ssh.
+	User string
+}
+
+func newHost(index int, client *ssh.Client) Host {
+	addr := client.RemoteAddr().String()
+	hostname, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		hostname = addr
+	}
+	return Host{
+		Client:   client,
+		Index:    index,
+		Addr:     addr,
+		Hostname: hostname,
+		Port:     port,
+		User:     client.User(),
+	}
+}
+
+// FleetOption is the type of options for the operations on many hosts.
+type FleetOption func(c *fleetConfig)
+
+type fleetConfig struct {
+	concurrency int
+	scpOptions  []ScpOption
+	hostDirName func(client *ssh.Client) string
+	destFunc    func(host Host) (string, error)
+	retries     int
+	backoff     time.Duration
+	breaker     *CircuitBreaker
+}
+
+func newFleetConfig(options []FleetOption) *fleetConfig {
+	c := &fleetConfig{
+		concurrency: defaultFleetConcurrency,
+		hostDirName: defaultHostDirName,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	if c.concurrency <= 0 {
+		c.concurrency = 1
+	}
+	return c
+}
+
+// WithConcurrency sets the maximum number of hosts operated concurrently.
+// The default is 8.
+func WithConcurrency(n int) FleetOption {
+	return func(c *fleetConfig) {
+		c.concurrency = n
+	}
+}
+
+// WithClientOptions sets the options for the SCP client created for each host.
+func WithClientOptions(options ...ScpOption) FleetOption {
+	return func(c *fleetConfig) {
+		c.scpOptions = append(c.scpOptions, options...)
+	}
+}
+
+// WithHostDirName sets the function which returns the name of the local
+// per-host directory used by FanIn and FanInDir. The default is the remote
+// address with the characters not allowed in file names replaced with '_'.
+func WithHostDirName(fn func(client *ssh.Client) string) FleetOption {
+	return func(c *fleetConfig) {
+		c.hostDirName = fn
+	}
+}
+
+// WithDestFunc sets the function which returns the destination path for
+// each host in FanOut. It takes precedence over the destPath argument.
+func WithDestFunc(fn func(host Host) (string, error)) FleetOption {
+	return func(c *fleetConfig) {
+		c.destFunc = fn
+	}
+}
+
+// WithHostRetry makes the operation on each host retried up to retries times
+// after the first failure. The wait before the n-th retry is backoff * 2^(n-1).
+// The retries of a host do not delay the other hosts except for occupying
+// the concurrency slot.
+func WithHostRetry(retries int, backoff time.Duration) FleetOption {
+	return func(c *fleetConfig) {
+		c.retries = retries
+		c.backoff = backoff
+	}
+}
+
+// WithCircuitBreaker sets the circuit breaker which stops retrying and
+// operating on hosts which keep failing. Share the breaker among calls
+// to keep the state of hosts across operations.
+func WithCircuitBreaker(b *CircuitBreaker) FleetOption {
+	return func(c *fleetConfig) {
+		c.breaker = b
+	}
+}
+
+func defaultHostDirName(client *ssh.Client) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '/', '\\', '[', ']', '%':
+			return '_'
+		}
+		return r
+	}, client.RemoteAddr().String())
+}
+
+func (c *fleetConfig) newSCP(ctx context.Context, client *ssh.Client) *SCP {
+	options := append([]ScpOption{WithContext(ctx)}, c.scpOptions...)
+	s := NewSCP(client, options...)
+	s.usage = &hostUsage{}
+	return s
+}
+
+// run calls fn for each client with bounded concurrency and returns
+// the results in the order of clients.
+func (c *fleetConfig) run(ctx context.Context, clients []*ssh.Client, fn func(s *SCP, host Host) error) HostResults {
+	results := make(HostResults, len(clients))
+	sem := make(chan struct{}, c.concurrency)
+	var wg sync.WaitGroup
+	for i, client := range clients {
+		results[i].Host = client.RemoteAddr().String()
+		select {
+		case <-ctx.Done():
+			results[i].Err = ctx.Err()
+			continue
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(i int, client *ssh.Client) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			s := c.newSCP(ctx, client)
+			start := time.Now()
+			results[i].Attempts, results[i].Err = c.runHost(ctx, s, newHost(i, client), fn)
+			if err := s.Close(); err != nil && results[i].Err == nil {
+				results[i].Err = err
+			}
+			results[i].Duration = time.Since(start)
+			results[i].Bytes = s.usage.snapshot().Total()
+			if c.breaker != nil {
+				results[i].Breaker = c.breaker.State(results[i].Host)
+			}
+		}(i, client)
+	}
+	wg.Wait()
+	return results
+}
+
+// runHost calls fn for the host with the retries and the circuit breaker.
+// It returns the number of attempts and the last error.
+func (c *fleetConfig) runHost(ctx context.Context, s *SCP, host Host, fn func(s *SCP, host Host) error) (int, error) {
+	var err error
+	attempts := 0
+	for {
+		if !c.breaker.allow(host.Addr) {
+			if err == nil {
+				err = ErrCircuitOpen
+			}
+			return attempts, err
+		}
+		attempts++
+		err = fn(s, host)
+		c.breaker.record(host.Addr, err)
+		if err == nil || attempts > c.retries || ctx.Err() != nil {
+			return attempts, err
+		}
+
+		wait := c.backoff << uint(attempts-1)
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return attempts, err
+		case <-t.C:
+		}
+	}
+}
+
+// FanOut copies a single local file to destPath on all the clients
+// concurrently. The file is read once into memory and the same content is
+// sent to every host. destPath is handled in the same way as SendFile.
+// If destPath contains "{{", it is a text/template executed with the Host,
+// for example "/etc/app/{{.Hostname}}.conf". The destination can also be
+// computed per host with WithDestFunc.
+// The results are returned in the order of clients.
+func FanOut(ctx context.Context, clients []*ssh.Client, srcFile, destPath string, options ...FleetOption) (HostResults, error) {
+	srcFile = filepath.Clean(srcFile)
+	osFileInfo, err := os.Stat(srcFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat source file: err=%w", err)
+	}
+	data, err := ioutil.ReadFile(srcFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source file: err=%w", err)
+	}
+	fi := NewFileInfoFromOS(osFileInfo, "")
+	fi.size = int64(len(data))
+
+	c := newFleetConfig(options)
+	destFunc := c.destFunc
+	if destFunc == nil {
+		destFunc, err = destPathFunc(destPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.run(ctx, clients, func(s *SCP, host Host) error {
+		dest, err := destFunc(host)
+		if err != nil {
+			return fmt.Errorf("failed to get destination path: err=%w", err)
+		}
+		return s.sendToPath(fi, ioutil.NopCloser(bytes.NewReader(data)), srcFile, dest)
+	}), nil
+}
+
+// Broadcast copies the local srcPath to destPath on all the clients
+// concurrently, for example to push a release artifact to many hosts.
+// If srcPath is a file, it is sent as FanOut does and acceptFn is ignored.
+// If srcPath is a directory, the tree is sent to each host as SendDir does,
+// filtered with acceptFn. destPath can be a template or computed with
+// WithDestFunc as in FanOut. The results are returned in the order of
+// clients.
+func Broadcast(ctx context.Context, clients []*ssh.Client, srcPath, destPath string, acceptFn AcceptFunc, options ...FleetOption) (HostResults, error) {
+	srcPath = filepath.Clean(srcPath)
+	fi, err := os.Stat(srcPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat source: err=%w", err)
+	}
+	if !fi.IsDir() {
+		return FanOut(ctx, clients, srcPath, destPath, options...)
+	}
+
+	c := newFleetConfig(options)
+	destFunc := c.destFunc
+	if destFunc == nil {
+		destFunc, err = destPathFunc(destPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.run(ctx, clients, func(s *SCP, host Host) error {
+		dest, err := destFunc(host)
+		if err != nil {
+			return fmt.Errorf("failed to get destination path: err=%w", err)
+		}
+		_, err = s.SendDir(srcPath, dest, acceptFn)
+		return err
+	}), nil
+}
+
+// destPathFunc returns the function which executes destPath as a template
+// if it contains "{{", or returns destPath as is.
+func destPathFunc(destPath string) (func(host Host) (string, error), error) {
+	if !strings.Contains(destPath, "{{") {
+		return func(host Host) (string, error) { return destPath, nil }, nil
+	}
+	tmpl, err := template.New("dest").Option("missingkey=error").Parse(destPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse destination path template: err=%w", err)
+	}
+	return func(host Host) (string, error) {
+		var b strings.Builder
+		if err := tmpl.Execute(&b, host); err != nil {
+			return "", err
+		}
+		return b.String(), nil
+	}, nil
+}
+
+// FanIn copies the same remote file from all the clients concurrently.
+// The file from each host is written under destDir/<host>/, where the name of
+// the per-host directory can be changed with WithHostDirName.
+// The results are returned in the order of clients.
+func FanIn(ctx context.Context, clients []*ssh.Client, srcFile, destDir string, options ...FleetOption) (HostResults, error) {
+	c := newFleetConfig(options)
+	destDir = filepath.Clean(destDir)
+	return c.run(ctx, clients, func(s *SCP, host Host) error {
+		hostDir := filepath.Join(destDir, c.hostDirName(host.Client))
+		if err := os.MkdirAll(hostDir, 0777); err != nil {
+			return fmt.Errorf("failed to create host directory: err=%w", err)
+		}
+		return s.ReceiveFile(srcFile, hostDir)
+	}), nil
+}
+
+// FanInDir copies files and directories under the same remote srcDir from all
+// the clients concurrently. The entries from each host are written under
+// destDir/<host>/ as ReceiveDir does for a non-existing destination directory.
+// The results are returned in the order of clients.
+func FanInDir(ctx context.Context, clients []*ssh.Client, srcDir, destDir string, acceptFn AcceptFunc, options ...FleetOption) (HostResults, error) {
+	c := newFleetConfig(options)
+	destDir = filepath.Clean(destDir)
+	if err := os.MkdirAll(destDir, 0777); err != nil {
+		return nil, fmt.Errorf("failed to create destination directory: err=%w", err)
+	}
+	return c.run(ctx, clients, func(s *SCP, host Host) error {
+		_, err := s.ReceiveDir(srcDir, filepath.Join(destDir, c.hostDirName(host.Client)), acceptFn)
+		return err
+	}), nil
+}
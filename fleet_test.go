@@ -0,0 +1,381 @@
+// +build !windows
+
+package scp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestFanOut(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	localDir, err := ioutil.TempDir("", "go-scp-TestFanOut-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestFanOut-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	localName := "test1.dat"
+	localPath := filepath.Join(localDir, localName)
+	if err := generateRandomFile(localPath); err != nil {
+		t.Fatalf("fail to generate local file; %s", err)
+	}
+
+	results, err := FanOut(context.Background(), []*ssh.Client{c}, localPath, remoteDir)
+	if err != nil {
+		t.Fatalf("fail to FanOut; %s", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("unmatch result count. got:%d, want:1", len(results))
+	}
+	if err := results.Err(); err != nil {
+		t.Errorf("fail to send; %s", err)
+	}
+	if len(results.Succeeded()) != 1 {
+		t.Errorf("unmatch succeeded count. got:%d, want:1", len(results.Succeeded()))
+	}
+	if results[0].Bytes == 0 {
+		t.Errorf("bytes must be counted")
+	}
+	sameFileInfoAndContent(t, remoteDir, localDir, localName, localName)
+
+	missing := filepath.Join(remoteDir, "missing", "dest.dat")
+	results, err = FanOut(context.Background(), []*ssh.Client{c}, localPath, missing)
+	if err != nil {
+		t.Fatalf("fail to FanOut; %s", err)
+	}
+	if len(results.Failed()) != 1 {
+		t.Errorf("sending to a missing directory must fail")
+	}
+}
+
+func TestFanOutCircuitBreaker(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	localDir, err := ioutil.TempDir("", "go-scp-TestFanOutCircuitBreaker-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+
+	localPath := filepath.Join(localDir, "test1.dat")
+	if err := generateRandomFile(localPath); err != nil {
+		t.Fatalf("fail to generate local file; %s", err)
+	}
+
+	breaker := NewCircuitBreaker(2, time.Hour)
+	missing := filepath.Join(localDir, "missing", "dest.dat")
+	results, err := FanOut(context.Background(), []*ssh.Client{c}, localPath, missing,
+		WithHostRetry(5, time.Millisecond), WithCircuitBreaker(breaker))
+	if err != nil {
+		t.Fatalf("fail to FanOut; %s", err)
+	}
+	if results[0].Attempts != 2 {
+		t.Errorf("unmatch attempts. got:%d, want:2", results[0].Attempts)
+	}
+	if results[0].Breaker != BreakerOpen {
+		t.Errorf("unmatch breaker state. got:%s, want:%s", results[0].Breaker, BreakerOpen)
+	}
+
+	results, err = FanOut(context.Background(), []*ssh.Client{c}, localPath, missing, WithCircuitBreaker(breaker))
+	if err != nil {
+		t.Fatalf("fail to FanOut; %s", err)
+	}
+	if results[0].Err != ErrCircuitOpen {
+		t.Errorf("unmatch error. got:%v, want:%v", results[0].Err, ErrCircuitOpen)
+	}
+}
+
+func TestFanOutTemplate(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	var clients []*ssh.Client
+	for i := 0; i < 2; i++ {
+		c, err := newTestSshClient(l.Addr().String())
+		if err != nil {
+			t.Fatalf("fail to serve test sshd server; %s", err)
+		}
+		defer c.Close()
+		clients = append(clients, c)
+	}
+
+	localDir, err := ioutil.TempDir("", "go-scp-TestFanOutTemplate-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestFanOutTemplate-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	localName := "test1.dat"
+	localPath := filepath.Join(localDir, localName)
+	if err := generateRandomFile(localPath); err != nil {
+		t.Fatalf("fail to generate local file; %s", err)
+	}
+
+	dest := filepath.Join(remoteDir, "{{.Index}}-{{.Hostname}}.dat")
+	results, err := FanOut(context.Background(), clients, localPath, dest)
+	if err != nil {
+		t.Fatalf("fail to FanOut; %s", err)
+	}
+	if err := results.Err(); err != nil {
+		t.Errorf("fail to send; %s", err)
+	}
+	hostname := newHost(0, clients[0]).Hostname
+	sameFileContent(t, remoteDir, localDir, "0-"+hostname+".dat", localName)
+	sameFileContent(t, remoteDir, localDir, "1-"+hostname+".dat", localName)
+}
+
+func TestBroadcast(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	var clients []*ssh.Client
+	for i := 0; i < 2; i++ {
+		c, err := newTestSshClient(l.Addr().String())
+		if err != nil {
+			t.Fatalf("fail to serve test sshd server; %s", err)
+		}
+		defer c.Close()
+		clients = append(clients, c)
+	}
+
+	localDir, err := ioutil.TempDir("", "go-scp-TestBroadcast-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestBroadcast-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	srcDir := filepath.Join(localDir, "release")
+	entries := []fileInfo{
+		{name: "app", maxSize: testMaxFileSize, mode: 0755},
+		{name: "conf", isDir: true, mode: 0755,
+			entries: []fileInfo{
+				{name: "app.conf", maxSize: testMaxFileSize, mode: 0644},
+			},
+		},
+	}
+	if err := os.Mkdir(srcDir, 0755); err != nil {
+		t.Fatalf("fail to create directory; %s", err)
+	}
+	if err := generateRandomFiles(srcDir, entries); err != nil {
+		t.Fatalf("fail to generate local files; %s", err)
+	}
+
+	dest := filepath.Join(remoteDir, "host{{.Index}}")
+	results, err := Broadcast(context.Background(), clients, srcDir, dest, nil)
+	if err != nil {
+		t.Fatalf("fail to Broadcast; %s", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("unmatch result count. got:%d, want:2", len(results))
+	}
+	if err := results.Err(); err != nil {
+		t.Errorf("fail to send; %s", err)
+	}
+	sameDirTreeContent(t, srcDir, filepath.Join(remoteDir, "host0"))
+	sameDirTreeContent(t, srcDir, filepath.Join(remoteDir, "host1"))
+
+	results, err = Broadcast(context.Background(), clients, filepath.Join(srcDir, "app"), remoteDir, nil)
+	if err != nil {
+		t.Fatalf("fail to Broadcast; %s", err)
+	}
+	if err := results.Err(); err != nil {
+		t.Errorf("fail to send; %s", err)
+	}
+	sameFileInfoAndContent(t, remoteDir, srcDir, "app", "app")
+}
+
+func TestFanIn(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	localDir, err := ioutil.TempDir("", "go-scp-TestFanIn-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestFanIn-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	remoteName := "app.log"
+	remotePath := filepath.Join(remoteDir, remoteName)
+	if err := generateRandomFile(remotePath); err != nil {
+		t.Fatalf("fail to generate remote file; %s", err)
+	}
+
+	hostDirName := func(client *ssh.Client) string { return "host1" }
+	results, err := FanIn(context.Background(), []*ssh.Client{c}, remotePath, localDir, WithHostDirName(hostDirName))
+	if err != nil {
+		t.Fatalf("fail to FanIn; %s", err)
+	}
+	if results[0].Err != nil {
+		t.Errorf("fail to receive from %s; %s", results[0].Host, results[0].Err)
+	}
+	sameFileInfoAndContent(t, filepath.Join(localDir, "host1"), remoteDir, remoteName, remoteName)
+}
+
+func TestPool(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	localDir, err := ioutil.TempDir("", "go-scp-TestPool-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestPool-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	localName := "test1.dat"
+	localPath := filepath.Join(localDir, localName)
+	if err := generateRandomFile(localPath); err != nil {
+		t.Fatalf("fail to generate local file; %s", err)
+	}
+
+	dial := func(ctx context.Context) (*ssh.Client, error) {
+		return newTestSshClient(l.Addr().String())
+	}
+	p := NewPool(dial, WithPoolSize(2), WithPoolConcurrency(4), WithPoolRetry(1, 0))
+	defer p.Close()
+
+	t.Run("concurrent operations", func(t *testing.T) {
+		errs := make(chan error, 8)
+		for i := 0; i < 8; i++ {
+			go func(i int) {
+				errs <- p.Do(context.Background(), func(s *SCP) error {
+					return s.SendFile(localPath, filepath.Join(remoteDir, fmt.Sprintf("%d.dat", i)))
+				})
+			}(i)
+		}
+		for i := 0; i < 8; i++ {
+			if err := <-errs; err != nil {
+				t.Errorf("fail to SendFile; %s", err)
+			}
+		}
+		for i := 0; i < 8; i++ {
+			sameFileContent(t, remoteDir, localDir, fmt.Sprintf("%d.dat", i), localName)
+		}
+		stats := p.Stats()
+		if stats.Operations != 8 || stats.Failures != 0 {
+			t.Errorf("unmatch operations. got:%d (%d failed), want:8", stats.Operations, stats.Failures)
+		}
+		if stats.Connections < 1 || stats.Connections > 2 || stats.Dials != int64(stats.Connections) {
+			t.Errorf("unmatch connections. got:%d (%d dialed), want:1 or 2", stats.Connections, stats.Dials)
+		}
+		if stats.Active != 0 {
+			t.Errorf("unmatch active operations. got:%d, want:0", stats.Active)
+		}
+		if stats.Usage.BytesSent == 0 {
+			t.Errorf("bytes must be counted")
+		}
+	})
+
+	t.Run("retry on broken connection", func(t *testing.T) {
+		before := p.Stats()
+		calls := 0
+		err := p.Do(context.Background(), func(s *SCP) error {
+			calls++
+			if calls == 1 {
+				s.client.Close()
+			}
+			return s.SendFile(localPath, filepath.Join(remoteDir, "retried.dat"))
+		})
+		if err != nil {
+			t.Fatalf("fail to SendFile; %s", err)
+		}
+		sameFileContent(t, remoteDir, localDir, "retried.dat", localName)
+		stats := p.Stats()
+		if stats.Retries != before.Retries+1 {
+			t.Errorf("unmatch retries. got:%d, want:%d", stats.Retries, before.Retries+1)
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		if err := p.Close(); err != nil {
+			t.Fatalf("fail to close pool; %s", err)
+		}
+		err := p.Do(context.Background(), func(s *SCP) error { return nil })
+		if !errors.Is(err, ErrPoolClosed) {
+			t.Errorf("unmatch error. got:%v, want:%v", err, ErrPoolClosed)
+		}
+	})
+}
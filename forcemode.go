@@ -0,0 +1,34 @@
+package scp
+
+import "os"
+
+// WithForceMode makes the files and directories sent and received with
+// the scp protocol get fileMode and dirMode instead of the permissions of
+// the source, for example 0644 and 0755 for web assets. It does not apply
+// to WithTarStream.
+func WithForceMode(fileMode, dirMode os.FileMode) ScpOption {
+	return func(s *SCP) {
+		s.forcedMode = &forcedMode{file: fileMode & modePermBits, dir: dirMode & modePermBits}
+	}
+}
+
+// forcedMode is the permissions set with WithForceMode.
+type forcedMode struct {
+	file, dir os.FileMode
+}
+
+// fileMode returns the permission of a file, which is mode if f is nil.
+func (f *forcedMode) fileMode(mode os.FileMode) os.FileMode {
+	if f == nil {
+		return mode
+	}
+	return f.file
+}
+
+// dirMode returns the permission of a directory, which is mode if f is nil.
+func (f *forcedMode) dirMode(mode os.FileMode) os.FileMode {
+	if f == nil {
+		return mode
+	}
+	return f.dir
+}
@@ -0,0 +1,109 @@
+package scp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// WriteFS is a writable filesystem which ReceiveDirFS writes the received
+// files and directories to, such as an in-memory filesystem or a sandbox.
+// The paths are joined with the separator of the local OS.
+type WriteFS interface {
+	MkdirAll(path string, perm os.FileMode) error
+	OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error)
+	Chtimes(name string, atime, mtime time.Time) error
+	Chmod(name string, mode os.FileMode) error
+}
+
+// OSFS is the WriteFS of the local filesystem.
+var OSFS WriteFS = osFS{}
+
+type osFS struct{}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) Chtimes(name string, atime, mtime time.Time) error { return os.Chtimes(name, atime, mtime) }
+
+func (osFS) Chmod(name string, mode os.FileMode) error { return os.Chmod(name, mode) }
+
+// ReceiveDirFS copies files and directories under a remote srcDir to destDir
+// in fsys. Unlike ReceiveDir, the entries under srcDir are always placed
+// directly under destDir, which is created if it does not exist. You can
+// filter the files and directories with acceptFn as in ReceiveDir.
+// The time and permission are set to the same value of the source file or
+// directory.
+func (s *SCP) ReceiveDirFS(srcDir string, fsys WriteFS, destDir string, acceptFn AcceptFunc) (err error) {
+	s, op := s.withTimeout()
+	defer op.finish(&err)
+	srcDir = s.cleanRemotePath(srcDir)
+	destDir = filepath.Clean(destDir)
+	if err := fsys.MkdirAll(destDir, 0777); err != nil {
+		return fmt.Errorf("failed to create destination directory: err=%w", err)
+	}
+	receiver := &fsReceiver{scp: s, fsys: fsys}
+	return runResourceSession(s.sessionConfig(), srcDir, false, true, func(rs *resourceSession) error {
+		return s.walkRemoteDir(rs, destDir, true, acceptFn, receiver)
+	})
+}
+
+// fsReceiver writes the received files and directories to a WriteFS.
+type fsReceiver struct {
+	scp  *SCP
+	fsys WriteFS
+}
+
+func (r *fsReceiver) startDirectory(dir string, timeHeader TimeMsgHeader, dirHeader StartDirectoryMsgHeader) error {
+	if err := r.fsys.MkdirAll(dir, dirHeader.Mode); err != nil {
+		return fmt.Errorf("failed to create directory: err=%w", err)
+	}
+	if err := r.fsys.Chmod(dir, dirHeader.Mode); err != nil {
+		return fmt.Errorf("failed to change directory mode: err=%w", err)
+	}
+	return nil
+}
+
+func (r *fsReceiver) endDirectory(dir string, timeHeader TimeMsgHeader) error {
+	if err := r.fsys.Chtimes(dir, timeHeader.Atime, timeHeader.Mtime); err != nil {
+		return fmt.Errorf("failed to change directory time: err=%w", err)
+	}
+	return nil
+}
+
+func (r *fsReceiver) receiveFile(rs *resourceSession, path string, timeHeader TimeMsgHeader, fileHeader FileMsgHeader) (err error) {
+	fileInfo := NewFileInfo(path, fileHeader.Size, fileHeader.Mode, timeHeader.Mtime, timeHeader.Atime)
+	observer := r.scp.sourceObserver
+	observer.OnFileInfo(fileInfo)
+	defer func() {
+		notifyFileDone(observer, fileInfo, err)
+	}()
+
+	file, err := r.fsys.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileInfo.Mode())
+	if err != nil {
+		return fmt.Errorf("failed to open destination file: err=%w", err)
+	}
+	wo := &writerProxy{
+		writer:       file,
+		onWriterFunc: observer.OnWrite,
+	}
+	if err := rs.CopyFileBodyTo(fileHeader, wo); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to copy file: err=%w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close destination file: err=%w", err)
+	}
+	if err := r.fsys.Chmod(path, fileInfo.Mode()); err != nil {
+		return fmt.Errorf("failed to change file mode: err=%w", err)
+	}
+	if err := r.fsys.Chtimes(path, fileInfo.AccessTime(), fileInfo.ModTime()); err != nil {
+		return fmt.Errorf("failed to change file time: err=%w", err)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package scp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileResult is the result of an operation on a local file.
+type FileResult struct {
+	// Path is the local path of the file.
+	Path string
+	// Err is the error of the operation, or nil if it succeeded.
+	Err error
+}
+
+// FileResults is the results of an operation on many files.
+type FileResults []FileResult
+
+// Failed returns the results of the files where the operation failed.
+func (r FileResults) Failed() FileResults {
+	var failed FileResults
+	for _, result := range r {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// Err returns an error summarizing the failed files, or nil if the operation
+// succeeded on all the files.
+func (r FileResults) Err() error {
+	failed := r.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(failed))
+	for i, result := range failed {
+		msgs[i] = fmt.Sprintf("%s: %s", result.Path, result.Err)
+	}
+	return fmt.Errorf("failed on %d of %d files: %s", len(failed), len(r), strings.Join(msgs, "; "))
+}
+
+// SendGlob copies the local files matching pattern, in the syntax of
+// filepath.Glob, to the remote destDir in a single session. destDir must be
+// an existing directory. The matches which are not regular files and
+// the files which cannot be opened fail without stopping the others.
+// If the session fails, the files not sent yet fail with the error.
+// The returned error is not nil only if pattern is malformed or the remote
+// scp fails after all the files are sent.
+func (s *SCP) SendGlob(pattern, destDir string) (results FileResults, err error) {
+	s, op := s.withTimeout()
+	defer op.finish(&err)
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	results = make(FileResults, len(matches))
+	for i, match := range matches {
+		results[i].Path = match
+	}
+	if len(matches) == 0 {
+		return results, nil
+	}
+
+	destDir = s.cleanRemotePath(destDir)
+	next := 0
+	err = runSinkSession(s.sessionConfig(), destDir, true, false, func(ss *sinkSession) error {
+		for ; next < len(results); next++ {
+			srcFile := results[next].Path
+			if fi, err := os.Stat(srcFile); err == nil && !fi.Mode().IsRegular() {
+				results[next].Err = fmt.Errorf("not a regular file: %s", srcFile)
+				continue
+			}
+			fi, file, err := s.openLocalFile(srcFile)
+			if err != nil {
+				results[next].Err = err
+				continue
+			}
+			// NOTE: file will be closed by WriteFile.
+			if err := s.writeFile(ss, fi, file, srcFile, realPath(filepath.Join(destDir, fi.Name()))); err != nil {
+				return fmt.Errorf("failed to copy file: err=%w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil && next == len(results) {
+		return results, err
+	}
+	for ; next < len(results); next++ {
+		results[next].Err = err
+	}
+	return results, nil
+}
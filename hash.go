@@ -0,0 +1,47 @@
+package scp
+
+import "hash"
+
+// HashObserver is an optional interface implemented by a SourceObserver.
+// When hashing is enabled with WithHash, the observer is notified of the
+// digest of the content while it is copied, so the final digest is available
+// without reading the file again.
+type HashObserver interface {
+	// OnHash is called with the running digest after each write, and
+	// once more with done set to true after the whole content is copied.
+	OnHash(fileInfo *FileInfo, sum []byte, done bool)
+}
+
+// contentHasher computes the digest of a file content and reports it
+// to the observer.
+type contentHasher struct {
+	hash     hash.Hash
+	fileInfo *FileInfo
+	observer HashObserver
+}
+
+// newContentHasher returns nil if hashing is not enabled.
+func (s *SCP) newContentHasher(fileInfo *FileInfo, observer interface{}) *contentHasher {
+	if s.newHash == nil {
+		return nil
+	}
+	hashObserver, _ := observer.(HashObserver)
+	return &contentHasher{
+		hash:     s.newHash(),
+		fileInfo: fileInfo,
+		observer: hashObserver,
+	}
+}
+
+func (h *contentHasher) write(p []byte) {
+	h.hash.Write(p)
+	if h.observer != nil {
+		h.observer.OnHash(h.fileInfo, h.hash.Sum(nil), false)
+	}
+}
+
+func (h *contentHasher) done() {
+	if h.observer != nil {
+		h.observer.OnHash(h.fileInfo, h.hash.Sum(nil), true)
+	}
+}
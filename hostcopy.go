@@ -0,0 +1,75 @@
+package scp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// HostCopyOption is the type of options for CopyToHost.
+type HostCopyOption func(c *hostCopyConfig)
+
+type hostCopyConfig struct {
+	forwardAgent bool
+	port         int
+	sshOptions   []string
+}
+
+// WithHostCopyAgentForwarding makes CopyToHost request agent forwarding for
+// the session, so the scp on the source host can authenticate to the
+// destination host with the local agent. The forwarded connections must be
+// handled on the ssh.Client with agent.ForwardToAgent or
+// agent.ForwardToRemote beforehand.
+func WithHostCopyAgentForwarding() HostCopyOption {
+	return func(c *hostCopyConfig) {
+		c.forwardAgent = true
+	}
+}
+
+// WithHostCopyPort sets the ssh port of the destination host.
+func WithHostCopyPort(port int) HostCopyOption {
+	return func(c *hostCopyConfig) {
+		c.port = port
+	}
+}
+
+// WithHostCopySSHOptions adds options passed to the ssh of the source host
+// with -o, like "StrictHostKeyChecking=accept-new".
+func WithHostCopySSHOptions(options ...string) HostCopyOption {
+	return func(c *hostCopyConfig) {
+		c.sshOptions = append(c.sshOptions, options...)
+	}
+}
+
+// CopyToHost copies srcPath on the remote server to destPath on destHost by
+// running scp on the remote server, so the data does not flow through
+// the local machine. destHost is passed to scp as is, like "user@host".
+// srcPath can be a file or a directory, which is copied recursively with
+// the times and the permissions. The remote server must be able to reach
+// destHost and authenticate to it without a prompt, since scp runs in
+// batch mode. Note that destPath may be interpreted by the shell of
+// destHost, depending on the scp version of the remote server.
+func (s *SCP) CopyToHost(srcPath, destHost, destPath string, options ...HostCopyOption) (err error) {
+	s, op := s.withTimeout()
+	defer op.finish(&err)
+	c := &hostCopyConfig{}
+	for _, option := range options {
+		option(c)
+	}
+
+	args := []string{"scp", "-r", "-p", "-o", "BatchMode=yes"}
+	if c.port != 0 {
+		args = append(args, "-P", strconv.Itoa(c.port))
+	}
+	for _, o := range c.sshOptions {
+		args = append(args, "-o", escapeShellArg(o))
+	}
+	args = append(args, "--", escapeShellArg(realPath(srcPath)), escapeShellArg(destHost+":"+destPath))
+
+	cfg := s.sessionConfig()
+	cfg.forwardAgent = c.forwardAgent
+	if err := runCommandSession(cfg, strings.Join(args, " "), nil, nil); err != nil {
+		return fmt.Errorf("failed to copy to host: err=%w", err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package scp
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// ErrIdleTimeout is returned when no bytes are transferred over a session
+// within the timeout set with WithIdleTimeout.
+var ErrIdleTimeout = errors.New("scp: transfer stalled for idle timeout")
+
+// idleWatch closes a session when no bytes move over it for the timeout.
+// All the methods are no-op on a nil idleWatch, which is used when no idle
+// timeout is set.
+type idleWatch struct {
+	timeout time.Duration
+	session io.Closer
+	timer   *time.Timer
+	// pause is the gate of a Transfer, which is not idle while paused.
+	pause *pauseGate
+
+	// last is the time of the last activity in Unix nanoseconds.
+	last    int64
+	stalled int32
+	stopped int32
+}
+
+func newIdleWatch(timeout time.Duration, session io.Closer, pause *pauseGate) *idleWatch {
+	if timeout <= 0 {
+		return nil
+	}
+	w := &idleWatch{
+		timeout: timeout,
+		session: session,
+		pause:   pause,
+		last:    time.Now().UnixNano(),
+	}
+	w.timer = time.AfterFunc(timeout, w.check)
+	return w
+}
+
+func (w *idleWatch) check() {
+	if atomic.LoadInt32(&w.stopped) != 0 {
+		return
+	}
+	paused, resumedAt := w.pause.state()
+	if paused {
+		w.timer.Reset(w.timeout)
+		return
+	}
+	last := time.Unix(0, atomic.LoadInt64(&w.last))
+	if resumedAt.After(last) {
+		last = resumedAt
+	}
+	idle := time.Since(last)
+	if idle < w.timeout {
+		w.timer.Reset(w.timeout - idle)
+		return
+	}
+	atomic.StoreInt32(&w.stalled, 1)
+	_ = w.session.Close()
+}
+
+func (w *idleWatch) touch(n int) {
+	if n > 0 {
+		atomic.StoreInt64(&w.last, time.Now().UnixNano())
+	}
+}
+
+// stop stops watching, for example when the transfer is done and only
+// the exit of the remote command is waited for.
+func (w *idleWatch) stop() {
+	if w == nil {
+		return
+	}
+	atomic.StoreInt32(&w.stopped, 1)
+	w.timer.Stop()
+}
+
+// err returns an error wrapping ErrIdleTimeout instead of err if the session
+// was closed for the idle timeout.
+func (w *idleWatch) err(err error) error {
+	if w == nil || err == nil || atomic.LoadInt32(&w.stalled) == 0 {
+		return err
+	}
+	return &timeoutError{kind: ErrIdleTimeout, msg: w.timeout.String(), err: err}
+}
+
+// wrap returns stdin and stdout of the session which record the activity.
+func (w *idleWatch) wrap(stdin io.WriteCloser, stdout io.Reader) (io.WriteCloser, io.Reader) {
+	if w == nil {
+		return stdin, stdout
+	}
+	return &idleWriteCloser{WriteCloser: stdin, w: w}, &idleReader{Reader: stdout, w: w}
+}
+
+type idleWriteCloser struct {
+	io.WriteCloser
+	w *idleWatch
+}
+
+func (w *idleWriteCloser) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.w.touch(n)
+	return n, err
+}
+
+type idleReader struct {
+	io.Reader
+	w *idleWatch
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.w.touch(n)
+	return n, err
+}
@@ -0,0 +1,113 @@
+package scp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// WithProxyJump makes Dial connect to the target through the jump hosts in
+// order, like the -J option of ssh. Each host is "[user@]host[:port]", and
+// a host may list several hosts separated with commas as in ssh. The user
+// defaults to the user of Dial and the port to 22. The jump hosts are
+// authenticated and their host keys are checked in the same way as
+// the target.
+func WithProxyJump(hosts ...string) DialOption {
+	return func(c *dialConfig) {
+		for _, host := range hosts {
+			for _, h := range strings.Split(host, ",") {
+				if h = strings.TrimSpace(h); h != "" {
+					c.jumpHosts = append(c.jumpHosts, h)
+				}
+			}
+		}
+	}
+}
+
+// DialThrough connects to the SSH server at addr through the connection of
+// client, such as a bastion host, and returns the client of the server.
+// Closing the returned client does not close client. config.Timeout bounds
+// the handshake with the server if it is not zero.
+func DialThrough(client *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := client.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conn, addr, config)
+}
+
+// newClient makes the handshake over conn and returns the client.
+// The handshake fails if it does not finish within config.Timeout, unless
+// it is zero. conn is closed on an error.
+func newClient(conn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	// A timer closing conn is used instead of a deadline, since the
+	// connections through the jump hosts do not support deadlines.
+	var timer *time.Timer
+	if config.Timeout > 0 {
+		timer = time.AfterFunc(config.Timeout, func() { conn.Close() })
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if timer != nil && !timer.Stop() {
+		if err == nil {
+			c.Close()
+		}
+		return nil, fmt.Errorf("ssh handshake with %s timed out after %s", addr, config.Timeout)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// splitJumpHost splits "[user@]host[:port]" into the user and the address
+// with the port. user is empty if the host has none.
+func splitJumpHost(host string) (user, addr string) {
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		user, host = host[:i], host[i+1:]
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "22")
+	}
+	return user, host
+}
+
+// dial connects to addr through the jump hosts and sets the clients of conn.
+// The clients already connected are kept in conn on an error, so that Close
+// closes them.
+func (d *dialedConn) dial(addr string, config *ssh.ClientConfig, jumpHosts []string) error {
+	var via *ssh.Client
+	for _, host := range jumpHosts {
+		user, jumpAddr := splitJumpHost(host)
+		jumpConfig := *config
+		if user != "" {
+			jumpConfig.User = user
+		}
+		client, err := dialHop(via, jumpAddr, &jumpConfig)
+		if err != nil {
+			return fmt.Errorf("failed to dial jump host %s: err=%w", jumpAddr, err)
+		}
+		d.jumps = append(d.jumps, client)
+		via = client
+	}
+	client, err := dialHop(via, addr, config)
+	if err != nil {
+		return fmt.Errorf("failed to dial %s: err=%w", addr, err)
+	}
+	d.client = client
+	return nil
+}
+
+func dialHop(via *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if via == nil {
+		conn, err := net.DialTimeout("tcp", addr, config.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		return newClient(conn, addr, config)
+	}
+	return DialThrough(via, addr, config)
+}
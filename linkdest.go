@@ -0,0 +1,71 @@
+package scp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// findLinkDest returns the path of an unchanged file in the link destination
+// directories which corresponds to rel, or an empty string if there is none.
+// A file is unchanged if it is a regular file with the same size,
+// permission and modification time in seconds.
+func (s *SCP) findLinkDest(rel string, fileHeader FileMsgHeader, timeHeader TimeMsgHeader) string {
+	for _, dir := range s.linkDests {
+		candidate := filepath.Join(dir, rel)
+		fi, err := os.Lstat(candidate)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if fi.Size() == fileHeader.Size &&
+			fi.Mode()&modePermBits == fileHeader.Mode&modePermBits &&
+			fi.ModTime().Unix() == timeHeader.Mtime.Unix() {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// linkFromLinkDest hardlinks the unchanged file in the link destination
+// directories to localFilename without receiving it. It returns false if
+// there is no unchanged file.
+func (s *SCP) linkFromLinkDest(rel, localFilename string, timeHeader TimeMsgHeader, fileHeader FileMsgHeader) (bool, error) {
+	candidate := s.findLinkDest(rel, fileHeader, timeHeader)
+	if candidate == "" {
+		return false, nil
+	}
+	// The link destination may be the destination itself, and then
+	// removing localFilename would remove the only copy.
+	if fi, err := os.Lstat(localFilename); err == nil {
+		if cfi, err := os.Lstat(candidate); err == nil && os.SameFile(fi, cfi) {
+			return true, nil
+		}
+	}
+	if err := os.Remove(localFilename); err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("failed to remove destination file: err=%w", err)
+	}
+	if err := os.Link(candidate, localFilename); err != nil {
+		return false, fmt.Errorf("failed to link unchanged file: err=%w", err)
+	}
+	return true, nil
+}
+
+// linkUnchanged hardlinks the files unchanged in the link destination
+// directories with receiver, and returns the other files to receive.
+func (s *SCP) linkUnchanged(files []parallelEntry, receiver *localDirReceiver) ([]parallelEntry, error) {
+	if len(s.linkDests) == 0 {
+		return files, nil
+	}
+	var rest []parallelEntry
+	for _, f := range files {
+		header := FileMsgHeader{Mode: f.mode & modePermBits, Size: f.size, Name: filepath.Base(f.localPath)}
+		linked, err := receiver.linkFile(f.localPath, f.timeHeader, header)
+		if err != nil {
+			return nil, err
+		}
+		if !linked {
+			rest = append(rest, f)
+		}
+	}
+	return rest, nil
+}
@@ -0,0 +1,40 @@
+package scp
+
+import "time"
+
+// debugLogger is the logger set with WithLogger, which is implemented by
+// *slog.Logger.
+type debugLogger interface {
+	Debug(msg string, args ...interface{})
+}
+
+// sessionLog writes the debug logs of a session. All the methods are no-op
+// on a nil sessionLog, which is used when no logger is set.
+type sessionLog struct {
+	logger debugLogger
+	addr   string
+	start  time.Time
+}
+
+func (c *sessionConfig) newSessionLog() *sessionLog {
+	if c.logger == nil {
+		return nil
+	}
+	return &sessionLog{logger: c.logger, addr: c.remoteAddr(), start: time.Now()}
+}
+
+// debug writes msg with the key-value pairs in args and the remote address.
+func (l *sessionLog) debug(msg string, args ...interface{}) {
+	if l == nil {
+		return
+	}
+	l.logger.Debug(msg, append([]interface{}{"addr", l.addr}, args...)...)
+}
+
+// finish writes the elapsed time of the session and its error.
+func (l *sessionLog) finish(cmd string, err error) {
+	if l == nil {
+		return
+	}
+	l.debug("scp: session finished", "cmd", cmd, "duration", time.Since(l.start), "err", err)
+}
@@ -0,0 +1,15 @@
+// +build go1.21
+
+package scp
+
+import "log/slog"
+
+// WithLogger sets the logger for diagnosing the sessions. The start of each
+// session with the remote command line, each protocol message and reply,
+// the time of each file and the exit of the session are logged at the debug
+// level.
+func WithLogger(logger *slog.Logger) ScpOption {
+	return func(s *SCP) {
+		s.logger = logger
+	}
+}
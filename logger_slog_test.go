@@ -0,0 +1,74 @@
+// +build go1.21,!windows
+
+package scp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWithLogger(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	localDir, err := ioutil.TempDir("", "go-scp-TestWithLogger-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestWithLogger-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	localName := "test1.dat"
+	localPath := filepath.Join(localDir, localName)
+	if err := generateRandomFile(localPath); err != nil {
+		t.Fatalf("fail to generate local file; %s", err)
+	}
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	scp := NewSCP(c, WithLogger(logger))
+	if err := scp.SendFile(localPath, remoteDir); err != nil {
+		t.Fatalf("fail to SendFile; %s", err)
+	}
+	if err := scp.ReceiveFile(filepath.Join(remoteDir, localName), filepath.Join(localDir, "received.dat")); err != nil {
+		t.Fatalf("fail to ReceiveFile; %s", err)
+	}
+
+	logs := buf.String()
+	for _, want := range []string{
+		`msg="scp: starting session" addr=`,
+		`cmd="scp -tp`,
+		`msg="scp: sending file message"`,
+		`msg="scp: received reply"`,
+		`msg="scp: sent file"`,
+		`msg="scp: received message"`,
+		`header="{Mode:-rw-r--r-- Size:`,
+		`msg="scp: received file"`,
+		`msg="scp: sending reply"`,
+		`msg="scp: session finished"`,
+	} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("log must contain %q, got:\n%s", want, logs)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrInvalidMappedPath is returned when a MapFunc returns an empty or
+// absolute path, or a path outside the copied directory.
+var ErrInvalidMappedPath = errors.New("scp: invalid mapped path")
+
+// MapFunc is the type of the function called for each file copied by
+// SendDir, ReceiveDir and DeployDir to rewrite its destination path.
+// relPath is the slash separated path of the file relative to the top of
+// the copied directory, and the returned path is relative to the same top.
+type MapFunc func(relPath string, info os.FileInfo) (string, error)
+
+// WithMapFunc sets the function to rewrite the destination paths of
+// the files in directory copies, for example to rename files or to
+// reorganize them into other directories. The function is called for
+// the files accepted by acceptFn. Since the files may be moved to other
+// directories, the directories are created as needed for the mapped files,
+// and the permission and the times of the source directories are not kept
+// except for the directories which SendDir sends as is.
+func WithMapFunc(fn MapFunc) ScpOption {
+	return func(s *SCP) {
+		s.mapFunc = fn
+	}
+}
+
+// mapPath returns the mapped path of the file at the slash separated relPath.
+func (s *SCP) mapPath(relPath string, info os.FileInfo) (string, error) {
+	mapped, err := s.mapFunc(relPath, info)
+	if err != nil {
+		return "", fmt.Errorf("error from mapFunc: err=%w", err)
+	}
+	mapped = path.Clean(filepath.ToSlash(mapped))
+	if mapped == "." || path.IsAbs(mapped) || mapped == ".." || strings.HasPrefix(mapped, "../") {
+		return "", fmt.Errorf("%w: %q for %q", ErrInvalidMappedPath, mapped, relPath)
+	}
+	return mapped, nil
+}
+
+// mapLocalPath returns the mapped local path of localPath under the local
+// top directory, and creates its parent directory.
+func (s *SCP) mapLocalPath(top, localPath string, info os.FileInfo) (string, error) {
+	rel, err := filepath.Rel(top, localPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to get relative path: err=%w", err)
+	}
+	mapped, err := s.mapPath(filepath.ToSlash(rel), info)
+	if err != nil {
+		return "", err
+	}
+	localPath = filepath.Join(top, filepath.FromSlash(mapped))
+	if err := os.MkdirAll(filepath.Dir(localPath), 0777); err != nil {
+		return "", fmt.Errorf("failed to create directory: err=%w", err)
+	}
+	return localPath, nil
+}
+
+// mappedFile is a local file to send with its mapped path.
+type mappedFile struct {
+	path   string
+	mapped string
+	info   *FileInfo
+}
+
+// sendDirMapped is SendDir with WithMapFunc in the scp mode. The files are
+// collected first and sent in the order of the mapped paths, so that
+// the files in the same directory are sent together.
+func (s *SCP) sendDirMapped(srcDir, destDir string, acceptFn AcceptFunc) error {
+	rootInfo, err := os.Stat(srcDir)
+	if err != nil {
+		return fmt.Errorf("failed to stat source directory: err=%w", err)
+	}
+	if accepted, err := acceptFn(filepath.Dir(srcDir), NewFileInfoFromOS(rootInfo, "")); err != nil || !accepted {
+		return err
+	}
+
+	var files []mappedFile
+	walkFn := func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == srcDir {
+			return nil
+		}
+		scpFileInfo := NewFileInfoFromOS(info, "")
+		accepted, err := acceptFn(filepath.Dir(p), scpFileInfo)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if !accepted {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !accepted {
+			return nil
+		}
+		rel, err := filepath.Rel(srcDir, p)
+		if err != nil {
+			return err
+		}
+		mapped, err := s.mapPath(filepath.ToSlash(rel), scpFileInfo)
+		if err != nil {
+			return err
+		}
+		files = append(files, mappedFile{path: p, mapped: s.nameNormalization.normalize(mapped), info: scpFileInfo})
+		return nil
+	}
+	if err := filepath.Walk(srcDir, walkFn); err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].mapped < files[j].mapped
+	})
+
+	// dirInfo returns the information of the source directory at the mapped
+	// directory if it exists, or the default for a new directory.
+	now := time.Now()
+	dirInfo := func(dirs []string) *FileInfo {
+		name := dirs[len(dirs)-1]
+		if fi, err := os.Stat(filepath.Join(srcDir, filepath.FromSlash(path.Join(dirs...)))); err == nil && fi.IsDir() {
+			return s.nameNormalization.normalizeFileInfo(NewFileInfoFromOS(fi, name))
+		}
+		return NewFileInfo(name, 0, os.ModeDir|0755, now, now)
+	}
+
+	remoteTop := realPath(filepath.Join(destDir, s.topDirBase(srcDir)))
+	return runSinkSession(s.sessionConfig(), destDir, false, true, func(ss *sinkSession) error {
+		if err := ss.StartDirectory(s.nameNormalization.normalizeFileInfo(NewFileInfoFromOS(rootInfo, s.topDirName))); err != nil {
+			return err
+		}
+		var cur []string
+		for _, f := range files {
+			var dirs []string
+			if dir := path.Dir(f.mapped); dir != "." {
+				dirs = strings.Split(dir, "/")
+			}
+			common := 0
+			for common < len(cur) && common < len(dirs) && cur[common] == dirs[common] {
+				common++
+			}
+			for ; len(cur) > common; cur = cur[:len(cur)-1] {
+				if err := ss.EndDirectory(); err != nil {
+					return err
+				}
+			}
+			for ; len(cur) < len(dirs); cur = dirs[:len(cur)+1] {
+				if err := ss.StartDirectory(dirInfo(dirs[:len(cur)+1])); err != nil {
+					return err
+				}
+			}
+
+			file, err := os.Open(f.path)
+			if err != nil {
+				return err
+			}
+			fi := NewFileInfo(path.Base(f.mapped), f.info.Size(), f.info.Mode(), f.info.ModTime(), f.info.AccessTime())
+			// NOTE: file will be closed by WriteFile.
+			if err := s.writeFile(ss, fi, file, f.path, path.Join(remoteTop, f.mapped)); err != nil {
+				return err
+			}
+		}
+		for range cur {
+			if err := ss.EndDirectory(); err != nil {
+				return err
+			}
+		}
+		return ss.EndDirectory()
+	})
+}
@@ -0,0 +1,93 @@
+package scp
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// metadataApplier applies the permission and the time of received files
+// and directories. A new applier is created for each operation.
+type metadataApplier struct {
+	warnings   *Warnings
+	progress   *progressSink
+	bestEffort bool
+	// skips is true with WithoutPreserve.
+	skips bool
+
+	// disabled holds the operations which are skipped for the rest of the
+	// operation in the best-effort mode.
+	disabled map[string]bool
+}
+
+func (s *SCP) newMetadataApplier() *metadataApplier {
+	return &metadataApplier{
+		warnings:   s.warnings,
+		progress:   s.progressSink(),
+		bestEffort: s.bestEffortMetadata,
+		skips:      s.noPreserve,
+		disabled:   make(map[string]bool),
+	}
+}
+
+// chmod changes the mode of the file. If a warning collector is set,
+// a failure is recorded as a warning and nil is returned.
+func (m *metadataApplier) chmod(name string, mode os.FileMode) error {
+	return m.apply(name, "chmod", func() error {
+		return changeMode(name, mode)
+	})
+}
+
+// chtimes changes the access and modification times of the file.
+// If a warning collector is set, a failure is recorded as a warning
+// and nil is returned.
+func (m *metadataApplier) chtimes(name string, atime, mtime time.Time) error {
+	return m.apply(name, "chtimes", func() error {
+		return os.Chtimes(name, atime, mtime)
+	})
+}
+
+func (m *metadataApplier) apply(name, op string, fn func() error) error {
+	if m.skips || m.disabled[op] {
+		return nil
+	}
+	err := fn()
+	if err == nil {
+		return nil
+	}
+	if m.bestEffort && isUnsupportedMetadataError(err) {
+		// The destination does not allow this operation, so it is very likely
+		// to fail for the other entries too. Record it once and stop trying.
+		m.disabled[op] = true
+		m.warn(Warning{Path: name, Op: op, Err: err})
+		return nil
+	}
+	if m.warnings == nil {
+		return err
+	}
+	m.warn(Warning{Path: name, Op: op, Err: err})
+	return nil
+}
+
+// warn records warning to the collector if it is set and sends it as
+// a progress event.
+func (m *metadataApplier) warn(warning Warning) {
+	if m.warnings != nil {
+		m.warnings.add(warning)
+	}
+	m.progress.send(ProgressEvent{
+		Type:      EventWarning,
+		Direction: DirectionDownload,
+		LocalPath: warning.Path,
+		Err:       warning.Err,
+		Warning:   warning,
+	})
+}
+
+func isUnsupportedMetadataError(err error) bool {
+	return errors.Is(err, os.ErrPermission) ||
+		errors.Is(err, syscall.EPERM) ||
+		errors.Is(err, syscall.ENOTSUP) ||
+		errors.Is(err, syscall.EOPNOTSUPP)
+}
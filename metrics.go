@@ -0,0 +1,121 @@
+package scp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// Metrics receives the metrics of the client set with WithMetrics, for
+// example to update the counters and the histograms of Prometheus labeled
+// with the remote host. The methods are called synchronously from
+// the operations, so they must be fast and safe for concurrent use.
+type Metrics interface {
+	// AddBytes is called with the bytes sent to (DirectionUpload) or
+	// received from (DirectionDownload) the remote host over a session,
+	// including the protocol messages.
+	AddBytes(host string, direction Direction, n int64)
+	// ObserveTransfer is called when an operation, such as "SendFile" or
+	// "ReceiveDir", finishes with its duration and its error, which is nil
+	// if it succeeded. Use ErrorKind to label the errors by type.
+	ObserveTransfer(host, op string, d time.Duration, err error)
+}
+
+// WithMetrics makes the sessions report the bytes sent and received, and
+// SendFile, SendDir, ReceiveFile, ReceiveDir and their parallel variants
+// report their durations and errors, to m.
+func WithMetrics(m Metrics) ScpOption {
+	return func(s *SCP) {
+		s.metrics = m
+	}
+}
+
+// ErrorKind returns a short label of the type of err for metrics, such as
+// "timeout", "canceled", "not_found", "permission" or "command". It returns
+// "" for a nil error and "other" for an error of an unknown type.
+func ErrorKind(err error) string {
+	var remoteErr *RemoteError
+	var protocolErr *ProtocolError
+	var commandErr *CommandError
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrTimeout), errors.Is(err, ErrIdleTimeout),
+		errors.Is(err, ErrTeardownTimeout), errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, ErrTransferCanceled), errors.Is(err, ErrJobCanceled),
+		errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, ErrBudgetExceeded):
+		return "budget"
+	case errors.Is(err, ErrCircuitOpen):
+		return "circuit_open"
+	case errors.Is(err, ErrFileExists):
+		return "exists"
+	case errors.Is(err, os.ErrNotExist):
+		return "not_found"
+	case errors.Is(err, os.ErrPermission), errors.Is(err, ErrSudoPasswordRequired),
+		errors.Is(err, ErrPolicyDenied):
+		return "permission"
+	case errors.As(err, &protocolErr):
+		return "protocol"
+	case errors.As(err, &remoteErr):
+		return "remote"
+	case errors.As(err, &commandErr):
+		return "command"
+	default:
+		return "other"
+	}
+}
+
+// hostMetrics counts the bytes of the sessions for a remote host. All
+// the methods are no-op on a nil hostMetrics, which is used when no metrics
+// are set.
+type hostMetrics struct {
+	metrics Metrics
+	host    string
+}
+
+func (c *sessionConfig) hostMetrics() *hostMetrics {
+	if c.metrics == nil {
+		return nil
+	}
+	return &hostMetrics{metrics: c.metrics, host: c.remoteAddr()}
+}
+
+// wrap returns stdin and stdout which report the bytes. It returns them as
+// is if m is nil.
+func (m *hostMetrics) wrap(stdin io.WriteCloser, stdout io.Reader) (io.WriteCloser, io.Reader) {
+	if m == nil {
+		return stdin, stdout
+	}
+	return &metricsWriteCloser{WriteCloser: stdin, m: m}, &metricsReader{Reader: stdout, m: m}
+}
+
+type metricsWriteCloser struct {
+	io.WriteCloser
+	m *hostMetrics
+}
+
+func (w *metricsWriteCloser) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	if n > 0 {
+		w.m.metrics.AddBytes(w.m.host, DirectionUpload, int64(n))
+	}
+	return n, err
+}
+
+type metricsReader struct {
+	io.Reader
+	m *hostMetrics
+}
+
+func (r *metricsReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.m.metrics.AddBytes(r.m.host, DirectionDownload, int64(n))
+	}
+	return n, err
+}
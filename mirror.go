@@ -0,0 +1,198 @@
+package scp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// WithDelete makes SendDir and ReceiveDir remove the files and directories
+// in the destination which do not exist in the source directory after
+// the copy, producing a mirror like rsync --delete. The entries under
+// the directories rejected by acceptFn and the entries matching the patterns
+// of WithExclude are kept. The times of the directories whose entries are
+// removed are kept. SendDir removes the remote entries with the find, rm,
+// mktemp and touch commands. It cannot be used with WithMapFunc.
+func WithDelete() ScpOption {
+	return func(s *SCP) {
+		s.delete = true
+	}
+}
+
+var errDeleteWithMapFunc = errors.New("scp: WithDelete cannot be used with WithMapFunc")
+
+// mirror records the entries of the source directory seen during a copy.
+type mirror struct {
+	top           string
+	normalization NameNormalization
+	excludes      []string
+	seen          map[string]bool
+	protected     []string
+}
+
+// newMirror returns a mirror for the copy whose top directory on the side
+// acceptFn is called for is top.
+func (s *SCP) newMirror(top string) (*mirror, error) {
+	if s.mapFunc != nil {
+		return nil, errDeleteWithMapFunc
+	}
+	return &mirror{
+		top:           top,
+		normalization: s.nameNormalization,
+		excludes:      s.excludes,
+		seen:          make(map[string]bool),
+	}, nil
+}
+
+// record returns acceptFn which records the entries passed to it.
+func (m *mirror) record(acceptFn AcceptFunc) AcceptFunc {
+	return func(parentDir string, info os.FileInfo) (bool, error) {
+		accepted, err := acceptFn(parentDir, info)
+		if err != nil {
+			return accepted, err
+		}
+		rel, err := filepath.Rel(m.top, filepath.Join(parentDir, info.Name()))
+		if err != nil || rel == "." {
+			return accepted, err
+		}
+		rel = m.normalization.normalize(filepath.ToSlash(rel))
+		m.seen[rel] = true
+		if info.IsDir() && !accepted {
+			m.protected = append(m.protected, rel)
+		}
+		return accepted, nil
+	}
+}
+
+// extraneous reports whether the destination entry at the slash separated
+// relative path rel should be removed.
+func (m *mirror) extraneous(rel string) bool {
+	if m.seen[rel] {
+		return false
+	}
+	for _, dir := range m.protected {
+		if strings.HasPrefix(rel, dir+"/") {
+			return false
+		}
+	}
+	for _, pattern := range m.excludes {
+		if matchExclude(pattern, rel) {
+			return false
+		}
+	}
+	return true
+}
+
+// deleteRemoteExtraneous removes the extraneous entries under the remote
+// top directory. The times of the parent directories are kept, since they
+// are already set by the copy.
+func (s *SCP) deleteRemoteExtraneous(top string, m *mirror) error {
+	cmd := "cd " + escapeShellArg(top) + " && find . -mindepth 1"
+	var out bytes.Buffer
+	if err := runCommandSession(s.sessionConfig(), cmd, nil, &out); err != nil {
+		return fmt.Errorf("failed to list remote files: err=%w", err)
+	}
+	var paths []string
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		paths = append(paths, strings.TrimPrefix(scanner.Text(), "./"))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	var deleted []string
+	for _, rel := range paths {
+		if n := len(deleted); n > 0 && strings.HasPrefix(rel, deleted[n-1]+"/") {
+			continue
+		}
+		if m.extraneous(rel) {
+			deleted = append(deleted, rel)
+		}
+	}
+	if len(deleted) == 0 {
+		return nil
+	}
+
+	cmd = "cd " + escapeShellArg(top) + ` && t=$(mktemp) && trap 'rm -f "$t"' EXIT && ` +
+		`while IFS= read -r p; do d=$(dirname -- "$p"); touch -r "$d" "$t" && rm -rf -- "$p" && touch -r "$t" "$d" || exit 1; done`
+	err := runCommandSession(s.sessionConfig(), cmd, func(w io.Writer) error {
+		for _, rel := range deleted {
+			if _, err := fmt.Fprintf(w, "./%s\n", rel); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to remove remote files: err=%w", err)
+	}
+	return nil
+}
+
+// deleteLocalExtraneous removes the extraneous entries under the local top
+// directory. The times of the parent directories are kept, since they are
+// already set by the copy.
+func deleteLocalExtraneous(top string, m *mirror) error {
+	var deleted []string
+	err := filepath.Walk(top, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == top {
+			return nil
+		}
+		rel, err := filepath.Rel(top, path)
+		if err != nil {
+			return err
+		}
+		if !m.extraneous(filepath.ToSlash(rel)) {
+			return nil
+		}
+		deleted = append(deleted, path)
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The times of the parents are read before any removal, since
+	// the removals change them.
+	parents := make(map[string]*FileInfo)
+	for _, path := range deleted {
+		dir := filepath.Dir(path)
+		if _, ok := parents[dir]; ok {
+			continue
+		}
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("failed to get information of directory: err=%w", err)
+		}
+		parents[dir] = NewFileInfoFromOS(fi, "")
+	}
+	for _, path := range deleted {
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove local file: err=%w", err)
+		}
+	}
+	for dir, fi := range parents {
+		atime := fi.AccessTime()
+		if atime.IsZero() {
+			atime = fi.ModTime()
+		}
+		if err := os.Chtimes(dir, atime, fi.ModTime()); err != nil {
+			return fmt.Errorf("failed to change directory time: err=%w", err)
+		}
+	}
+	return nil
+}
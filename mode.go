@@ -0,0 +1,9 @@
+// +build !windows
+
+package scp
+
+import "os"
+
+func changeMode(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
@@ -0,0 +1,29 @@
+// +build windows
+
+package scp
+
+import "os"
+
+// changeMode maps the POSIX mode to the read-only attribute, which is the
+// only permission Windows can represent. Files without the owner write bit
+// become read-only, and the mode of directories is left untouched.
+func changeMode(name string, mode os.FileMode) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return nil
+	}
+	readOnly := fi.Mode()&0200 == 0
+	if mode&0200 == 0 {
+		if readOnly {
+			return nil
+		}
+		return os.Chmod(name, 0444)
+	}
+	if !readOnly {
+		return nil
+	}
+	return os.Chmod(name, 0666)
+}
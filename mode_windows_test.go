@@ -0,0 +1,56 @@
+package scp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChangeMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-scp-TestChangeMode")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "foo")
+	if err := ioutil.WriteFile(name, []byte("foo\n"), 0644); err != nil {
+		t.Fatalf("fail to write file; %s", err)
+	}
+	defer os.Chmod(name, 0666)
+
+	tests := []struct {
+		mode     os.FileMode
+		readOnly bool
+	}{
+		{0444, true},
+		{0400, true},
+		{0644, false},
+		{0600, false},
+	}
+	for _, tt := range tests {
+		if err := changeMode(name, tt.mode); err != nil {
+			t.Fatalf("fail to change mode to %o; %s", tt.mode, err)
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("fail to stat file; %s", err)
+		}
+		if readOnly := fi.Mode()&0200 == 0; readOnly != tt.readOnly {
+			t.Errorf("unmatch read-only attribute for %o. got:%v, want:%v", tt.mode, readOnly, tt.readOnly)
+		}
+	}
+
+	// The mode of directories is left untouched.
+	if err := changeMode(dir, 0555); err != nil {
+		t.Fatalf("fail to change mode of directory; %s", err)
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatalf("fail to stat directory; %s", err)
+	}
+	if fi.Mode()&0200 == 0 {
+		t.Errorf("directory must not become read-only")
+	}
+}
@@ -0,0 +1,41 @@
+package scp
+
+import "golang.org/x/text/unicode/norm"
+
+// NameNormalization is the Unicode normalization form applied to
+// the names of transferred files and directories.
+type NameNormalization int
+
+const (
+	// NormalizationNone leaves names as they are.
+	NormalizationNone NameNormalization = iota
+	// NormalizationNFC converts names to the Normalization Form C,
+	// which is commonly used on Linux and Windows.
+	NormalizationNFC
+	// NormalizationNFD converts names to the Normalization Form D,
+	// which is used by the macOS filesystems.
+	NormalizationNFD
+)
+
+func (n NameNormalization) normalize(name string) string {
+	switch n {
+	case NormalizationNFC:
+		return norm.NFC.String(name)
+	case NormalizationNFD:
+		return norm.NFD.String(name)
+	default:
+		return name
+	}
+}
+
+// normalizeFileInfo returns a copy of info with the normalized name.
+// info is returned as is if the name does not change.
+func (n NameNormalization) normalizeFileInfo(info *FileInfo) *FileInfo {
+	name := n.normalize(info.name)
+	if name == info.name {
+		return info
+	}
+	normalized := *info
+	normalized.name = name
+	return &normalized
+}
@@ -0,0 +1,79 @@
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// ErrFileExists is returned by OverwriteErrorIfExists when the local file
+// exists.
+var ErrFileExists = errors.New("scp: destination file exists")
+
+// OverwritePolicy decides whether a received file replaces the existing
+// local file. existing is the information of the local file and incoming is
+// that of the remote file. Returning false keeps the local file and skips
+// the remote one, and returning an error aborts the receive.
+type OverwritePolicy func(localPath string, existing, incoming os.FileInfo) (bool, error)
+
+// OverwriteAlways replaces the existing files. It is the default.
+func OverwriteAlways(localPath string, existing, incoming os.FileInfo) (bool, error) {
+	return true, nil
+}
+
+// OverwriteSkip keeps the existing files.
+func OverwriteSkip(localPath string, existing, incoming os.FileInfo) (bool, error) {
+	return false, nil
+}
+
+// OverwriteErrorIfExists fails with ErrFileExists if the file exists.
+func OverwriteErrorIfExists(localPath string, existing, incoming os.FileInfo) (bool, error) {
+	return false, fmt.Errorf("%w: %s", ErrFileExists, localPath)
+}
+
+// OverwriteNewerOnly replaces the existing files only if the remote file
+// has a newer modification time.
+func OverwriteNewerOnly(localPath string, existing, incoming os.FileInfo) (bool, error) {
+	return incoming.ModTime().After(existing.ModTime()), nil
+}
+
+// WithOverwritePolicy sets the policy deciding whether ReceiveFile,
+// ReceiveFiles and ReceiveDir replace the existing local files. Only regular
+// files are checked, and directories are always merged.
+func WithOverwritePolicy(p OverwritePolicy) ScpOption {
+	return func(s *SCP) {
+		s.overwritePolicy = p
+	}
+}
+
+// keepsExisting reports whether the existing localPath is kept instead of
+// being replaced with the incoming file.
+func (s *SCP) keepsExisting(localPath string, incoming os.FileInfo) (bool, error) {
+	if s.overwritePolicy == nil {
+		return false, nil
+	}
+	existing, err := os.Stat(localPath)
+	if err != nil || !existing.Mode().IsRegular() {
+		return false, nil
+	}
+	overwrites, err := s.overwritePolicy(localPath, existing, incoming)
+	if err != nil {
+		return false, err
+	}
+	return !overwrites, nil
+}
+
+// discardIfKept discards the body of the file if the existing localPath is
+// kept, and reports whether it is.
+func (s *SCP) discardIfKept(rs *resourceSession, localPath string, timeHeader TimeMsgHeader, fileHeader FileMsgHeader) (bool, error) {
+	incoming := NewFileInfo(localPath, fileHeader.Size, fileHeader.Mode, timeHeader.Mtime, timeHeader.Atime)
+	kept, err := s.keepsExisting(localPath, incoming)
+	if err != nil || !kept {
+		return false, err
+	}
+	if err := rs.CopyFileBodyTo(fileHeader, ioutil.Discard); err != nil {
+		return false, fmt.Errorf("failed to skip file: err=%w", err)
+	}
+	return true, nil
+}
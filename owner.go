@@ -0,0 +1,239 @@
+package scp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// OwnerMapping is how WithPreserveOwner maps the owners between the local
+// machine and the remote server.
+type OwnerMapping int
+
+const (
+	// OwnerByID keeps the numeric user and group IDs.
+	OwnerByID OwnerMapping = iota
+	// OwnerByName keeps the user and group names, and falls back to
+	// the numeric IDs for the names which do not exist on the destination.
+	OwnerByName
+)
+
+// WithPreserveOwner makes SendFile, SendDir, ReceiveFile and ReceiveDir
+// keep the owner and the group of the files and directories, for system
+// backups and restores. Since the scp protocol does not carry them, they are
+// read with the stat command and set with the chown command on the remote
+// server. On receives, they are set only when the local process runs as
+// root, and otherwise the option has no effect. It does not support
+// WithMapFunc, and the paths with newlines are skipped.
+func WithPreserveOwner(m OwnerMapping) ScpOption {
+	return func(s *SCP) {
+		s.preserveOwner = true
+		s.ownerMapping = m
+	}
+}
+
+// owner is the owner and the group of a file.
+type owner struct {
+	uid, gid    int
+	user, group string
+}
+
+// localOwner returns the owner of the local file.
+func localOwner(fi os.FileInfo) (owner, bool) {
+	uid, gid, ok := fileOwner(fi)
+	if !ok {
+		return owner{}, false
+	}
+	o := owner{uid: uid, gid: gid}
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		o.user = u.Username
+	}
+	if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+		o.group = g.Name
+	}
+	return o, true
+}
+
+// spec returns the argument of chown for o.
+func (o owner) spec(m OwnerMapping) string {
+	u, g := strconv.Itoa(o.uid), strconv.Itoa(o.gid)
+	if m == OwnerByName {
+		if o.user != "" {
+			u = o.user
+		}
+		if o.group != "" {
+			g = o.group
+		}
+	}
+	return u + ":" + g
+}
+
+// localIDs returns the local user and group IDs for o.
+func (o owner) localIDs(m OwnerMapping) (uid, gid int) {
+	uid, gid = o.uid, o.gid
+	if m != OwnerByName {
+		return uid, gid
+	}
+	if u, err := user.Lookup(o.user); err == nil {
+		if id, err := strconv.Atoi(u.Uid); err == nil {
+			uid = id
+		}
+	}
+	if g, err := user.LookupGroup(o.group); err == nil {
+		if id, err := strconv.Atoi(g.Gid); err == nil {
+			gid = id
+		}
+	}
+	return uid, gid
+}
+
+// chownsLocal reports whether the owners are set on receives.
+func (s *SCP) chownsLocal() bool {
+	return s.preserveOwner && os.Geteuid() == 0
+}
+
+// remoteOwners returns the owners of the remote path and the entries under
+// it if it is a directory, keyed by the slash separated relative paths,
+// where "." is the path itself. GNU and BSD stat are supported.
+func (s *SCP) remoteOwners(remotePath string) (map[string]owner, error) {
+	p := escapeShellArg(remotePath)
+	cmd := "if [ -d " + p + " ]; then cd " + p + " && set -- .; else set -- " + p + "; fi; " +
+		`if stat -c %u "$1" >/dev/null 2>&1; then find "$1" -exec stat -c '%u %g %U %G %n' {} +; ` +
+		`else find "$1" -exec stat -f '%u %g %Su %Sg %N' {} +; fi`
+	var out bytes.Buffer
+	if err := runCommandSession(s.sessionConfig(), cmd, nil, &out); err != nil {
+		return nil, fmt.Errorf("failed to get owners of remote files: err=%w", err)
+	}
+	owners := make(map[string]owner)
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 5)
+		if len(fields) != 5 {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		gid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		// A file is listed with remotePath, and the entries of a directory
+		// with "." and the paths starting with "./".
+		rel := "."
+		if strings.HasPrefix(fields[4], "./") {
+			rel = path.Clean(fields[4])
+		}
+		owners[rel] = owner{uid: uid, gid: gid, user: fields[2], group: fields[3]}
+	}
+	return owners, scanner.Err()
+}
+
+// chownLocalFromRemote sets the owners of the local path and the entries
+// under it to those of the remote path. If accepted is not nil, only
+// the local paths in it are changed, so that the existing local files which
+// were not received keep their owners.
+func (s *SCP) chownLocalFromRemote(remotePath, localPath string, accepted map[string]bool) error {
+	if !s.chownsLocal() || s.mapFunc != nil {
+		return nil
+	}
+	owners, err := s.remoteOwners(remotePath)
+	if err != nil {
+		return err
+	}
+	for rel, o := range owners {
+		name := filepath.Join(localPath, filepath.FromSlash(s.nameNormalization.normalize(rel)))
+		if accepted != nil && !accepted[name] {
+			continue
+		}
+		uid, gid := o.localIDs(s.ownerMapping)
+		if err := os.Lchown(name, uid, gid); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to change owner: err=%w", err)
+		}
+	}
+	return nil
+}
+
+// ownedEntry is a sent entry whose owner is set on the remote server.
+type ownedEntry struct {
+	localPath string
+	// remoteRel is the slash separated path relative to the remote top
+	// directory.
+	remoteRel string
+}
+
+// ownerRecorder records the local entries accepted for sending by SendDir.
+type ownerRecorder struct {
+	top           string
+	normalization NameNormalization
+	entries       []ownedEntry
+}
+
+func (r *ownerRecorder) record(acceptFn AcceptFunc) AcceptFunc {
+	return func(parentDir string, info os.FileInfo) (bool, error) {
+		accepted, err := acceptFn(parentDir, info)
+		if err != nil || !accepted {
+			return accepted, err
+		}
+		localPath := filepath.Join(parentDir, info.Name())
+		rel, err := filepath.Rel(r.top, localPath)
+		if err != nil {
+			return false, err
+		}
+		r.entries = append(r.entries, ownedEntry{
+			localPath: localPath,
+			remoteRel: r.normalization.normalize(filepath.ToSlash(rel)),
+		})
+		return true, nil
+	}
+}
+
+// chownRemote sets the owners of the remote entries under remoteTop to
+// those of the local entries.
+func (s *SCP) chownRemote(remoteTop string, entries []ownedEntry) error {
+	var input bytes.Buffer
+	for _, e := range entries {
+		fi, err := os.Lstat(e.localPath)
+		if err != nil {
+			return fmt.Errorf("failed to stat source file: err=%w", err)
+		}
+		o, ok := localOwner(fi)
+		if !ok || strings.Contains(e.remoteRel, "\n") {
+			continue
+		}
+		fmt.Fprintf(&input, "%s\n%s\n", o.spec(s.ownerMapping), e.remoteRel)
+	}
+	if input.Len() == 0 {
+		return nil
+	}
+	cmd := "cd " + escapeShellArg(remoteTop) + ` && while IFS= read -r o && IFS= read -r p; do chown -h -- "$o" "$p" || exit 1; done`
+	err := runCommandSession(s.sessionConfig(), cmd, func(w io.Writer) error {
+		_, err := w.Write(input.Bytes())
+		return err
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to change owner of remote files: err=%w", err)
+	}
+	return nil
+}
+
+// chownRemoteFile sets the owner of the remote file sent by SendFile to
+// that of the local srcFile.
+func (s *SCP) chownRemoteFile(srcFile, destFile string) error {
+	fi, err := s.statRemote(destFile)
+	if err != nil {
+		return fmt.Errorf("failed to get information of destination file: err=%w", err)
+	}
+	if fi.IsDir() {
+		destFile = path.Join(destFile, s.nameNormalization.normalize(filepath.Base(srcFile)))
+	}
+	return s.chownRemote(path.Dir(destFile), []ownedEntry{{localPath: srcFile, remoteRel: path.Base(destFile)}})
+}
@@ -0,0 +1,644 @@
+package scp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ljun20160606/go-scp/scpwire"
+)
+
+// parallelBlockSize is the block size of the dd command used by
+// ReceiveFileParallel. The chunks are multiples of it.
+const parallelBlockSize = 64 * 1024
+
+// ReceiveFileParallel is like ReceiveFile but fetches the remote file in
+// n chunks concurrently, each with its own session, and writes them at
+// their offsets in the local file. It is useful for a large file when
+// the throughput of a single stream is limited. If n is less than 1, 1 is
+// used. The time and permission are set as in ReceiveFile, with the times
+// in seconds. The remote server must have the stat and dd commands.
+func (s *SCP) ReceiveFileParallel(srcFile, destFile string, n int) (err error) {
+	s, obs := s.observeOp("ReceiveFileParallel", destFile, srcFile)
+	defer obs.finish(&err)
+	s, op := s.withTimeout()
+	defer op.finish(&err)
+	srcFile = s.cleanRemotePath(srcFile)
+	destFile = filepath.Clean(destFile)
+	fiDest, err := os.Stat(destFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to get information of destnation file: err=%w", err)
+	}
+	if err == nil && fiDest.IsDir() {
+		destFile = filepath.Join(destFile, s.nameNormalization.normalize(filepath.Base(srcFile)))
+	}
+
+	remote, err := s.statRemote(srcFile)
+	if err != nil {
+		return fmt.Errorf("failed to get information of source file: err=%w", err)
+	}
+	if remote.IsDir() {
+		return fmt.Errorf("source is a directory: %s", srcFile)
+	}
+
+	fileInfo := NewFileInfo(destFile, remote.Size(), remote.Mode(), remote.ModTime(), remote.AccessTime())
+	s.sourceObserver.OnFileInfo(fileInfo)
+	a := s.newAuditor(DirectionDownload, destFile, srcFile)
+	err = s.receiveChunks(srcFile, destFile, remote, n)
+	if err == nil && a != nil && a.hook != nil {
+		// The chunks arrive out of order, so the hash for the audit record
+		// is computed from the assembled file.
+		err = hashLocalFile(destFile, a)
+	}
+	a.finish(err)
+	notifyFileDone(s.sourceObserver, fileInfo, err)
+	if err != nil {
+		return err
+	}
+
+	m := s.newMetadataApplier()
+	if err := m.chmod(destFile, remote.Mode()); err != nil {
+		return fmt.Errorf("failed to change file mode: err=%w", err)
+	}
+	if err := m.chtimes(destFile, remote.AccessTime(), remote.ModTime()); err != nil {
+		return fmt.Errorf("failed to change file time: err=%w", err)
+	}
+	return s.extractReceived(destFile)
+}
+
+// receiveChunks writes the content of the remote srcFile to destFile with
+// n concurrent sessions.
+func (s *SCP) receiveChunks(srcFile, destFile string, remote *FileInfo, n int) error {
+	file, err := os.OpenFile(destFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, remote.Mode())
+	if err != nil {
+		return fmt.Errorf("failed to open destination file: err=%w", err)
+	}
+	err = s.receiveChunksTo(file, srcFile, remote.Size(), n)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *SCP) receiveChunksTo(w io.WriterAt, srcFile string, size int64, n int) error {
+	if n < 1 {
+		n = 1
+	}
+	blocks := (size + parallelBlockSize - 1) / parallelBlockSize
+	chunkBlocks := (blocks + int64(n) - 1) / int64(n)
+	if chunkBlocks == 0 {
+		return nil
+	}
+
+	cfg := *s.sessionConfig()
+	ctx, cancel := context.WithCancel(cfg.ctx)
+	defer cancel()
+	cfg.ctx = ctx
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for skip := int64(0); skip < blocks; skip += chunkBlocks {
+		off := skip * parallelBlockSize
+		want := chunkBlocks * parallelBlockSize
+		if off+want > size {
+			want = size - off
+		}
+		wg.Add(1)
+		go func(skip, off, want int64) {
+			defer wg.Done()
+			cmd := "dd if=" + escapeShellArg(srcFile) +
+				" bs=" + strconv.Itoa(parallelBlockSize) +
+				" skip=" + strconv.FormatInt(skip, 10) +
+				" count=" + strconv.FormatInt(chunkBlocks, 10) + " 2>/dev/null"
+			ow := &offsetWriter{
+				w:   w,
+				off: off,
+				onWrite: func(p []byte) {
+					mu.Lock()
+					s.sourceObserver.OnWrite(p)
+					mu.Unlock()
+				},
+			}
+			err := runCommandSession(&cfg, cmd, nil, ow)
+			if err == nil && ow.off-off != want {
+				err = fmt.Errorf("unexpected size of chunk at %d: got=%d, want=%d", off, ow.off-off, want)
+			}
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}(skip, off, want)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return fmt.Errorf("failed to copy file: err=%w", firstErr)
+	}
+	return nil
+}
+
+// SendDirParallel is like SendDir but sends the files with n concurrent
+// sessions on the same client, which is much faster for trees of many small
+// files. The tree is walked and acceptFn is called for all the entries
+// first. Then the directories are created with a single session, the files
+// are split into n parts sent concurrently, and the permissions and the times
+// of the directories are set again at the end, since sending the files
+// changes them. If n is less than 1, 1 is used. WithTarStream, WithMapFunc,
+// WithSync, WithDelete and WithReadAhead have no effect on it.
+func (s *SCP) SendDirParallel(srcDir, destDir string, n int, acceptFn AcceptFunc) (report *TransferReport, err error) {
+	s, obs := s.observeOp("SendDirParallel", srcDir, destDir)
+	defer obs.finish(&err)
+	s, op := s.withTimeout()
+	defer op.finish(&err)
+	s, r := s.withReporter()
+	srcDir = filepath.Clean(srcDir)
+	destDir = s.cleanRemotePath(destDir)
+	// The top directory is decided before the first attempt, since
+	// the attempt creates it.
+	top, err := s.remoteTopDir(srcDir, destDir)
+	if err != nil {
+		return r.finish(), err
+	}
+	c := s.withLockedAuditHook()
+	c.topDirName = path.Base(top)
+	err = s.retry(func() error {
+		return c.sendDirParallel(srcDir, path.Dir(top), n, acceptFn, r)
+	})
+	return r.finish(), err
+}
+
+// sendDirParallel sends the tree under srcDir into the remote destDir,
+// which must be an existing directory, with n sessions for the files.
+func (s *SCP) sendDirParallel(srcDir, destDir string, n int, acceptFn AcceptFunc, r *reporter) error {
+	if acceptFn == nil {
+		acceptFn = acceptAny
+	}
+	q := &queuedDirSender{}
+	if err := s.walkLocalDir(srcDir, destDir, r.accept(s.excludeFilter(srcDir, acceptFn)), q); err != nil {
+		return err
+	}
+	// The directories are created before the files are sent, since the
+	// remote scp fails to create a directory created by another session
+	// at the same time.
+	if err := q.sendDirs(s, destDir); err != nil {
+		return err
+	}
+	if n < 1 {
+		n = 1
+	}
+	if files := q.fileCount(); n > files {
+		n = files
+	}
+
+	cfg := *s.sessionConfig()
+	ctx, cancel := context.WithCancel(cfg.ctx)
+	defer cancel()
+	cfg.ctx = ctx
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := runSinkSession(&cfg, destDir, true, true, func(ss *sinkSession) error {
+				return q.sendPart(s, ss, i, n)
+			})
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return q.sendDirs(s, destDir)
+}
+
+// fileCount returns the number of the recorded files.
+func (q *queuedDirSender) fileCount() int {
+	files := 0
+	for _, e := range q.entries {
+		if e.fi != nil {
+			files++
+		}
+	}
+	return files
+}
+
+// sendDirs sends only the directories of the recorded entries into
+// the remote destDir.
+func (q *queuedDirSender) sendDirs(s *SCP, destDir string) error {
+	return runSinkSession(s.sessionConfig(), destDir, true, true, func(ss *sinkSession) error {
+		for _, e := range q.entries {
+			var err error
+			switch {
+			case e.dirInfo != nil:
+				err = ss.StartDirectory(e.dirInfo)
+			case e.fi == nil:
+				err = ss.EndDirectory()
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// sendPart sends the i-th of the n parts of the recorded files over ss,
+// entering the directories leading to each file.
+func (q *queuedDirSender) sendPart(s *SCP, ss *sinkSession, i, n int) error {
+	files := q.fileCount()
+	var dirs []*FileInfo
+	// entered is the number of dirs entered over ss.
+	entered := 0
+	index := 0
+	for _, e := range q.entries {
+		switch {
+		case e.dirInfo != nil:
+			dirs = append(dirs, e.dirInfo)
+		case e.fi != nil:
+			part := index * n / files
+			index++
+			if part != i {
+				continue
+			}
+			for ; entered < len(dirs); entered++ {
+				if err := ss.StartDirectory(dirs[entered]); err != nil {
+					return err
+				}
+			}
+			file, err := os.Open(e.path)
+			if err != nil {
+				return err
+			}
+			if err := s.writeFile(ss, e.fi, file, e.path, e.remotePath); err != nil {
+				return err
+			}
+		default:
+			dirs = dirs[:len(dirs)-1]
+			if entered > len(dirs) {
+				entered--
+				if err := ss.EndDirectory(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// withLockedAuditHook returns a shallow copy of s whose audit hook and
+// report hook may be called from the concurrent sessions.
+func (s *SCP) withLockedAuditHook() *SCP {
+	c := *s
+	var mu sync.Mutex
+	if hook := s.auditHook; hook != nil {
+		c.auditHook = func(record AuditRecord) {
+			mu.Lock()
+			defer mu.Unlock()
+			hook(record)
+		}
+	}
+	if hook := s.reportHook; hook != nil {
+		c.reportHook = func(record AuditRecord) {
+			mu.Lock()
+			defer mu.Unlock()
+			hook(record)
+		}
+	}
+	return &c
+}
+
+// parallelReceiveBatch is the maximum number of the files requested in
+// a single session by ReceiveDirParallel, which bounds the length of
+// the command line.
+const parallelReceiveBatch = 256
+
+// ReceiveDirParallel is like ReceiveDir but receives the files with
+// n concurrent sessions on the same client, which is much faster for trees
+// of many small files. The remote tree is listed with the find and stat
+// commands first, and acceptFn is called for all the entries. Then
+// the directories are created, the files are split into n parts received
+// concurrently, and the times of the directories are set at the end.
+// The observer set with WithSourceObserver is called from the concurrent
+// sessions. If n is less than 1, 1 is used. WithTarStream, WithSync and
+// WithDelete have no effect on it, and the paths with newlines are not
+// supported.
+func (s *SCP) ReceiveDirParallel(srcDir, destDir string, n int, acceptFn AcceptFunc) (report *TransferReport, err error) {
+	s, obs := s.observeOp("ReceiveDirParallel", destDir, srcDir)
+	defer obs.finish(&err)
+	s, op := s.withTimeout()
+	defer op.finish(&err)
+	s, r := s.withReporter()
+	srcDir = s.cleanRemotePath(srcDir)
+	destDir = filepath.Clean(destDir)
+	_, err = os.Stat(destDir)
+	if err != nil && !os.IsNotExist(err) {
+		return r.finish(), fmt.Errorf("failed to get information of destination directory: err=%w", err)
+	}
+	// The placement is decided before the first attempt, since the attempt
+	// creates destDir.
+	var skipsFirstDirectory bool
+	if os.IsNotExist(err) {
+		skipsFirstDirectory = true
+		if err := os.MkdirAll(destDir, 0777); err != nil {
+			return r.finish(), fmt.Errorf("failed to create destination directory: err=%w", err)
+		}
+	}
+	c := s.withLockedAuditHook()
+	err = s.retry(func() error {
+		return c.receiveDirParallel(srcDir, destDir, skipsFirstDirectory, n, acceptFn, r)
+	})
+	return r.finish(), err
+}
+
+// parallelEntry is a remote entry accepted by ReceiveDirParallel.
+type parallelEntry struct {
+	remotePath string
+	localPath  string
+	timeHeader TimeMsgHeader
+	mode       os.FileMode
+	size       int64
+}
+
+func (s *SCP) receiveDirParallel(srcDir, destDir string, skipsFirstDirectory bool, n int, acceptFn AcceptFunc, r *reporter) error {
+	if acceptFn == nil {
+		acceptFn = acceptAny
+	}
+	root := destDir
+	if !skipsFirstDirectory {
+		root = filepath.Join(destDir, s.nameNormalization.normalize(path.Base(srcDir)))
+	}
+	acceptFn = r.accept(s.excludeFilter(root, acceptFn))
+	if err := s.receiveListedTree(srcDir, destDir, root, skipsFirstDirectory, n, acceptFn); err != nil {
+		return err
+	}
+	if skipsFirstDirectory {
+		// root is destDir created for the top directory.
+		r.accepted[root] = true
+	}
+	return s.chownLocalFromRemote(srcDir, root, r.accepted)
+}
+
+// receiveListedTree lists the remote tree under srcDir with
+// listRemoteEntries and receives the entries accepted by acceptFn to root,
+// the local top directory under destDir, with n concurrent sessions.
+// Only the files not linked from the link destination directories are
+// requested.
+func (s *SCP) receiveListedTree(srcDir, destDir, root string, skipsFirstDirectory bool, n int, acceptFn AcceptFunc) error {
+	entries, err := s.listRemoteEntries(srcDir)
+	if err != nil {
+		return err
+	}
+
+	var dirs, files []parallelEntry
+	rejected := make(map[string]bool)
+	for _, e := range entries {
+		parent := path.Dir(e.rel)
+		if e.rel == "." {
+			parent = ""
+		}
+		if rejected[parent] {
+			rejected[e.rel] = true
+			continue
+		}
+		if e.rel == "." && skipsFirstDirectory {
+			// The top directory is destDir itself, which is kept as is.
+			continue
+		}
+		localPath := filepath.Join(root, filepath.FromSlash(s.nameNormalization.normalize(e.rel)))
+		info := NewFileInfo(filepath.Base(localPath), e.info.Size(), e.info.Mode(), e.info.ModTime(), e.info.AccessTime())
+		accepted, err := acceptFn(filepath.Dir(localPath), info)
+		if err != nil {
+			return fmt.Errorf("error from accessFn: err=%w", err)
+		}
+		if !accepted {
+			rejected[e.rel] = true
+			continue
+		}
+		pe := parallelEntry{
+			remotePath: path.Join(srcDir, e.rel),
+			localPath:  localPath,
+			timeHeader: TimeMsgHeader{Mtime: info.ModTime(), Atime: info.AccessTime()},
+			mode:       info.Mode(),
+			size:       info.Size(),
+		}
+		if info.IsDir() {
+			dirs = append(dirs, pe)
+		} else {
+			files = append(files, pe)
+		}
+	}
+
+	receiver := &localDirReceiver{scp: s, root: destDir, top: root, metadata: s.newMetadataApplier()}
+	for _, d := range dirs {
+		header := StartDirectoryMsgHeader{Mode: d.mode & modePermBits, Name: filepath.Base(d.localPath)}
+		if err := receiver.startDirectory(d.localPath, d.timeHeader, header); err != nil {
+			return err
+		}
+	}
+	if files, err = s.linkUnchanged(files, receiver); err != nil {
+		return err
+	}
+	if err := s.receiveFilesParallel(files, receiver, n); err != nil {
+		return err
+	}
+	// The times are set at the end, since receiving the files changes
+	// the times of the directories.
+	for _, d := range dirs {
+		if err := receiver.endDirectory(d.localPath, d.timeHeader); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receiveFilesParallel receives the files with n concurrent sessions, each
+// with its own copy of receiver.
+func (s *SCP) receiveFilesParallel(files []parallelEntry, receiver *localDirReceiver, n int) error {
+	if n < 1 {
+		n = 1
+	}
+	if n > len(files) {
+		n = len(files)
+	}
+	cfg := *s.sessionConfig()
+	ctx, cancel := context.WithCancel(cfg.ctx)
+	defer cancel()
+	cfg.ctx = ctx
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(part []parallelEntry) {
+			defer wg.Done()
+			r := *receiver
+			r.metadata = s.newMetadataApplier()
+			var err error
+			for len(part) > 0 && err == nil {
+				batch := part
+				if len(batch) > parallelReceiveBatch {
+					batch = batch[:parallelReceiveBatch]
+				}
+				part = part[len(batch):]
+				err = s.receiveBatch(&cfg, batch, &r)
+			}
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}(files[i*len(files)/n : (i+1)*len(files)/n])
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// receiveBatch receives the files in a single session.
+func (s *SCP) receiveBatch(cfg *sessionConfig, files []parallelEntry, receiver *localDirReceiver) error {
+	remotePaths := make([]string, len(files))
+	for i, f := range files {
+		remotePaths[i] = f.remotePath
+	}
+	return runResourceSessionPaths(cfg, remotePaths, false, false, func(rs *resourceSession) error {
+		var timeHeader TimeMsgHeader
+		i := 0
+		for {
+			h, err := rs.ReadHeaderOrReply()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("failed to read scp message header: err=%w", err)
+			}
+			switch h := h.(type) {
+			case TimeMsgHeader:
+				timeHeader = h
+			case FileMsgHeader:
+				if i >= len(files) {
+					return fmt.Errorf("unexpected file message header, got %+v", h)
+				}
+				f := files[i]
+				i++
+				h.Name = filepath.Base(f.localPath)
+				a := s.newAuditor(DirectionDownload, f.localPath, f.remotePath)
+				a.attach(&rs.tee)
+				err := receiver.receiveFile(rs, f.localPath, timeHeader, h)
+				a.finish(err)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// remoteTreeEntry is an entry listed by listRemoteEntries.
+type remoteTreeEntry struct {
+	// rel is the slash separated path relative to the listed directory,
+	// which is "." for the directory itself.
+	rel  string
+	info *FileInfo
+}
+
+// listRemoteEntries lists the directories and the regular files under
+// the remote dir with the find and stat commands. GNU and BSD stat are
+// supported. The directories come first, each after its parent.
+func (s *SCP) listRemoteEntries(dir string) ([]remoteTreeEntry, error) {
+	list := func(stat, format string) string {
+		return "find . -type d -exec " + stat + " 'd " + format + "' {} + && " +
+			"find . -type f -exec " + stat + " 'f " + format + "' {} +"
+	}
+	cmd := "cd " + escapeShellArg(dir) + " && if stat -c %a . >/dev/null 2>&1; then " +
+		list("stat -c", "%a %s %Y %X %n") + "; else " +
+		list("stat -f", "%Mp%Lp %z %m %a %N") + "; fi"
+	var out bytes.Buffer
+	if err := runCommandSession(s.sessionConfig(), cmd, nil, &out); err != nil {
+		return nil, fmt.Errorf("failed to list remote files: err=%w", err)
+	}
+	var entries []remoteTreeEntry
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 6)
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("unexpected output of remote stat: %q", scanner.Text())
+		}
+		perm, err := strconv.ParseUint(fields[1], 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mode in remote stat: err=%w", err)
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size in remote stat: err=%w", err)
+		}
+		mtime, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modification time in remote stat: err=%w", err)
+		}
+		atime, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access time in remote stat: err=%w", err)
+		}
+		mode := scpwire.FromUnixMode(uint32(perm))
+		if fields[0] == "d" {
+			mode |= os.ModeDir
+		}
+		rel := path.Clean(fields[5])
+		entries = append(entries, remoteTreeEntry{
+			rel:  rel,
+			info: NewFileInfo(path.Base(rel), size, mode, time.Unix(mtime, 0), time.Unix(atime, 0)),
+		})
+	}
+	return entries, scanner.Err()
+}
+
+// offsetWriter writes to w sequentially from off.
+type offsetWriter struct {
+	w       io.WriterAt
+	off     int64
+	onWrite func(p []byte)
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.w.WriteAt(p, w.off)
+	w.off += int64(n)
+	w.onWrite(p[:n])
+	return n, err
+}
+
+func hashLocalFile(filename string, w io.Writer) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
@@ -0,0 +1,92 @@
+package scp
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// pauseGate blocks the reads and writes of the sessions while it is paused.
+// All the methods are no-op on a nil pauseGate, which is used for
+// the operations not started with a Transfer.
+type pauseGate struct {
+	mu sync.Mutex
+	// resumed is closed when the gate is resumed. It is nil while the gate
+	// is open.
+	resumed chan struct{}
+	// resumedAt is the time when the gate was resumed last.
+	resumedAt time.Time
+}
+
+func (g *pauseGate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed == nil {
+		g.resumed = make(chan struct{})
+	}
+}
+
+func (g *pauseGate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed != nil {
+		close(g.resumed)
+		g.resumed = nil
+		g.resumedAt = time.Now()
+	}
+}
+
+func (g *pauseGate) paused() bool {
+	paused, _ := g.state()
+	return paused
+}
+
+// state returns whether the gate is paused and the time when it was
+// resumed last.
+func (g *pauseGate) state() (paused bool, resumedAt time.Time) {
+	if g == nil {
+		return false, time.Time{}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resumed != nil, g.resumedAt
+}
+
+// wait blocks while the gate is paused.
+func (g *pauseGate) wait() {
+	g.mu.Lock()
+	resumed := g.resumed
+	g.mu.Unlock()
+	if resumed != nil {
+		<-resumed
+	}
+}
+
+// wrap returns stdin and stdout of the session which block while the gate
+// is paused.
+func (g *pauseGate) wrap(stdin io.WriteCloser, stdout io.Reader) (io.WriteCloser, io.Reader) {
+	if g == nil {
+		return stdin, stdout
+	}
+	return &pausingWriteCloser{WriteCloser: stdin, g: g}, &pausingReader{Reader: stdout, g: g}
+}
+
+type pausingWriteCloser struct {
+	io.WriteCloser
+	g *pauseGate
+}
+
+func (w *pausingWriteCloser) Write(p []byte) (int, error) {
+	w.g.wait()
+	return w.WriteCloser.Write(p)
+}
+
+type pausingReader struct {
+	io.Reader
+	g *pauseGate
+}
+
+func (r *pausingReader) Read(p []byte) (int, error) {
+	r.g.wait()
+	return r.Reader.Read(p)
+}
@@ -0,0 +1,115 @@
+package scp
+
+import (
+	"context"
+	"sync"
+)
+
+// persistentSink keeps a sink session open between the sends to the same
+// remote path, to save the cost of starting a session and the remote scp
+// for each file.
+type persistentSink struct {
+	mu   sync.Mutex
+	path string
+	ss   *sinkSession
+}
+
+// WithPersistentSession makes Send and SendFile keep the remote scp
+// running after a file is sent, and reuse it for the next file sent to the
+// same remote path, which is the directory of destFile for Send and destFile
+// for SendFile. It greatly reduces the time to send many small files to
+// the same directory in sequence. When the file is sent to another path,
+// the running scp is finished and a new one is started.
+// Since the errors of a finished scp may be reported only when it exits,
+// call Close to finish the last scp and check the error.
+func WithPersistentSession() ScpOption {
+	return func(s *SCP) {
+		s.persistent = &persistentSink{}
+	}
+}
+
+// Close finishes the remote scp kept running by WithPersistentSession, and
+// closes the connection of an SCP created by Dial and the connections dialed
+// by WithReconnect. It does nothing in the other cases.
+func (s *SCP) Close() error {
+	var err error
+	if s.persistent != nil {
+		s.persistent.mu.Lock()
+		err = s.persistent.finish()
+		s.persistent.mu.Unlock()
+	}
+	if s.dialed != nil {
+		if cerr := s.dialed.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if s.reconnect != nil {
+		if cerr := s.reconnect.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// runFileSinkSession runs handler with a non-recursive sink session for
+// remoteDestPath, which is kept open for the next call in the persistent
+// session mode.
+func (s *SCP) runFileSinkSession(remoteDestPath string, handler func(ss *sinkSession) error) error {
+	cfg := s.sessionConfig()
+	p := s.persistent
+	if p == nil {
+		return runSinkSession(cfg, remoteDestPath, false, false, handler)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ss != nil && p.path != remoteDestPath {
+		// The files sent to the previous path were already acknowledged
+		// by the remote scp, so an error on exit is not reported here.
+		_ = p.finish()
+	}
+	if p.ss == nil {
+		// The session outlives the context of this call, which is watched
+		// only while the call is running below.
+		sessionCfg := *cfg
+		sessionCfg.ctx = context.Background()
+		ss, err := newSinkSession(&sessionCfg, remoteDestPath, false, false)
+		if err != nil {
+			return err
+		}
+		p.path = remoteDestPath
+		p.ss = ss
+	}
+	done := make(chan struct{})
+	go closeOnDone(cfg.ctx, done, p.ss)
+	err := handler(p.ss)
+	if err == nil {
+		err = p.ss.flush()
+	}
+	close(done)
+	if err != nil {
+		// The state of the session is unknown after an error.
+		p.ss.Close()
+		p.ss = nil
+		return err
+	}
+	return nil
+}
+
+// finish closes the input of the running scp and waits for it to exit.
+// p.mu must be held.
+func (p *persistentSink) finish() error {
+	if p.ss == nil {
+		return nil
+	}
+	ss := p.ss
+	p.ss = nil
+	defer ss.Close()
+	if err := ss.flush(); err != nil {
+		return err
+	}
+	if err := ss.CloseStdin(); err != nil {
+		return err
+	}
+	return ss.Wait()
+}
@@ -0,0 +1,85 @@
+package scp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// PingStage is the check of Ping which failed.
+type PingStage int
+
+const (
+	// PingConnection means the connection does not respond to a keepalive
+	// request.
+	PingConnection PingStage = iota
+	// PingSession means a session cannot be opened on the connection.
+	PingSession
+	// PingScp means the remote scp cannot be run, for example because it
+	// is not installed.
+	PingScp
+)
+
+func (s PingStage) String() string {
+	switch s {
+	case PingConnection:
+		return "connection"
+	case PingSession:
+		return "session"
+	case PingScp:
+		return "scp"
+	default:
+		return "unknown"
+	}
+}
+
+// PingError is returned by Ping. Stage is the check which failed and Err is
+// its error.
+type PingError struct {
+	Stage PingStage
+	Err   error
+}
+
+func (e *PingError) Error() string {
+	return fmt.Sprintf("scp: ping failed at %s: %s", e.Stage, e.Err)
+}
+
+func (e *PingError) Unwrap() error { return e.Err }
+
+// Ping checks that the connection responds and that the remote scp can be
+// run, so that a problem is found before a large job starts. It sends a
+// keepalive request on the connection, and then runs the remote scp in
+// the sink mode for the home directory without sending any file. The error
+// is *PingError describing the check which failed. With WithReconnect,
+// a lost connection is dialed again instead of failing the ping. ctx is
+// used instead of the context set with WithContext.
+func (s *SCP) Ping(ctx context.Context) error {
+	s = s.withContext(ctx)
+	cfg := s.sessionConfig()
+	if cfg.transport == nil && cfg.client != nil && s.reconnect == nil {
+		alive := make(chan bool, 1)
+		go func() {
+			alive <- isAlive(cfg.client)
+		}()
+		select {
+		case ok := <-alive:
+			if !ok {
+				return &PingError{Stage: PingConnection, Err: errors.New("no reply to keepalive request")}
+			}
+		case <-ctx.Done():
+			return &PingError{Stage: PingConnection, Err: ctx.Err()}
+		}
+	}
+
+	err := runSinkSession(cfg, ".", true, false, func(*sinkSession) error { return nil })
+	if err == nil {
+		return nil
+	}
+	var cerr *CommandError
+	var rerr *RemoteError
+	var perr *ProtocolError
+	if errors.As(err, &cerr) || errors.As(err, &rerr) || errors.As(err, &perr) {
+		return &PingError{Stage: PingScp, Err: err}
+	}
+	return &PingError{Stage: PingSession, Err: err}
+}
@@ -0,0 +1,56 @@
+package scp
+
+import "errors"
+
+// WithPipelining makes sends write the messages of the scp protocol without
+// waiting for the reply to each of them, reading the replies later while at
+// most n of them are outstanding. It hides the round trip time of each
+// message, which speeds up sending many small files over high latency links
+// such as with SendDir. A file may be reported as sent to the observers
+// before the remote scp acknowledges it, and an error reply is returned
+// from a later write or at the end of the transfer. Zero or a negative n,
+// the default, means each reply is read before the next message.
+func WithPipelining(n int) ScpOption {
+	return func(s *SCP) {
+		s.pipeline = n
+	}
+}
+
+// awaitReply reads the reply to the message just written. In the pipelined
+// mode, it is deferred until more than pipeline replies are outstanding.
+func (s *sourceProtocol) awaitReply() error {
+	if s.pipeline <= 0 {
+		return s.readReply()
+	}
+	s.pending++
+	if s.pending <= s.pipeline {
+		return nil
+	}
+	s.pending--
+	return s.readReply()
+}
+
+// flush reads all the outstanding replies.
+func (s *sourceProtocol) flush() error {
+	for s.pending > 0 {
+		s.pending--
+		if err := s.readReply(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeError returns err of a failed write. In the pipelined mode, the remote
+// scp may have exited after an error reply to an earlier message, which is
+// returned instead.
+func (s *sourceProtocol) writeError(err error) error {
+	if s.pending == 0 {
+		return err
+	}
+	var rerr *RemoteError
+	if ferr := s.flush(); errors.As(ferr, &rerr) {
+		return ferr
+	}
+	return err
+}
@@ -0,0 +1,112 @@
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// ErrPolicyDenied is returned when a request or a file is rejected by
+// a RestrictedPolicy.
+var ErrPolicyDenied = errors.New("scp: denied by policy")
+
+// Access is the kind of access allowed by a RestrictedPolicy.
+type Access int
+
+const (
+	// AccessReadWrite allows both uploads and downloads.
+	AccessReadWrite Access = iota
+	// AccessReadOnly allows downloads only.
+	AccessReadOnly
+	// AccessWriteOnly allows uploads only.
+	AccessWriteOnly
+)
+
+func (a Access) String() string {
+	switch a {
+	case AccessReadWrite:
+		return "read-write"
+	case AccessReadOnly:
+		return "read-only"
+	case AccessWriteOnly:
+		return "write-only"
+	default:
+		return "unknown"
+	}
+}
+
+// RestrictedPolicy is a Policy for scponly-style restricted endpoints.
+// The zero value allows all requests, and each non-zero field adds
+// a restriction. All the errors returned wrap ErrPolicyDenied.
+type RestrictedPolicy struct {
+	// AllowedPrefixes are the slash separated paths relative to the served
+	// root under which files can be accessed, for example "/incoming".
+	// If empty, all the paths under the root are allowed.
+	AllowedPrefixes []string
+	// Access is the allowed direction of the requests.
+	Access Access
+	// MaxSize is the maximum size in bytes of each file. If zero or
+	// negative, the size is not limited.
+	MaxSize int64
+	// AllowedUsers are the names of the users allowed to make requests.
+	// If empty, all the users are allowed.
+	AllowedUsers []string
+}
+
+// CheckRequest implements Policy.
+func (p *RestrictedPolicy) CheckRequest(req *ServeRequest) error {
+	if len(p.AllowedUsers) > 0 && !containsString(p.AllowedUsers, req.User) {
+		return fmt.Errorf("%w: user %q is not allowed", ErrPolicyDenied, req.User)
+	}
+	switch {
+	case p.Access == AccessReadOnly && req.Direction == DirectionUpload:
+		return fmt.Errorf("%w: uploads are not allowed", ErrPolicyDenied)
+	case p.Access == AccessWriteOnly && req.Direction == DirectionDownload:
+		return fmt.Errorf("%w: downloads are not allowed", ErrPolicyDenied)
+	}
+	for _, name := range req.Paths {
+		if !p.allowedPath(name) {
+			return fmt.Errorf("%w: %s: path is not allowed", ErrPolicyDenied, name)
+		}
+	}
+	return nil
+}
+
+// CheckFile implements Policy.
+func (p *RestrictedPolicy) CheckFile(req *ServeRequest, name string, info os.FileInfo) error {
+	if !p.allowedPath(name) {
+		return fmt.Errorf("%w: %s: path is not allowed", ErrPolicyDenied, name)
+	}
+	if p.MaxSize > 0 && !info.IsDir() && info.Size() > p.MaxSize {
+		return fmt.Errorf("%w: %s: size %d exceeds limit %d", ErrPolicyDenied, name, info.Size(), p.MaxSize)
+	}
+	return nil
+}
+
+// allowedPath returns true if name is under one of the allowed prefixes.
+// Both are cleaned as absolute paths under the served root, the same way
+// as the requested paths are resolved.
+func (p *RestrictedPolicy) allowedPath(name string) bool {
+	if len(p.AllowedPrefixes) == 0 {
+		return true
+	}
+	name = path.Clean("/" + name)
+	for _, prefix := range p.AllowedPrefixes {
+		prefix = path.Clean("/" + prefix)
+		if prefix == "/" || name == prefix || strings.HasPrefix(name, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,297 @@
+package scp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrPoolClosed is returned by Pool.Do after the pool is closed.
+var ErrPoolClosed = errors.New("scp: pool is closed")
+
+const (
+	defaultPoolSize        = 1
+	defaultPoolConcurrency = 8
+)
+
+// DialFunc connects a new SSH client for a Pool.
+type DialFunc func(ctx context.Context) (*ssh.Client, error)
+
+// PoolOption is the type of options for NewPool.
+type PoolOption func(p *Pool)
+
+// WithPoolSize sets the maximum number of SSH connections of the pool.
+// The default is 1, where all the operations share the channels of a single
+// connection.
+func WithPoolSize(n int) PoolOption {
+	return func(p *Pool) {
+		p.size = n
+	}
+}
+
+// WithPoolConcurrency sets the maximum number of operations run
+// concurrently over all the connections. The default is 8.
+func WithPoolConcurrency(n int) PoolOption {
+	return func(p *Pool) {
+		p.concurrency = n
+	}
+}
+
+// WithPoolClientOptions sets the options for the SCP client passed to
+// the operations.
+func WithPoolClientOptions(options ...ScpOption) PoolOption {
+	return func(p *Pool) {
+		p.scpOptions = append(p.scpOptions, options...)
+	}
+}
+
+// WithPoolRetry makes an operation retried up to retries times when it fails
+// because its connection is broken or a new connection cannot be dialed.
+// The broken connection is closed and the retry runs on another one.
+// The wait before the n-th retry is backoff * 2^(n-1).
+func WithPoolRetry(retries int, backoff time.Duration) PoolOption {
+	return func(p *Pool) {
+		p.retries = retries
+		p.backoff = backoff
+	}
+}
+
+// PoolStats is the aggregate statistics of a Pool.
+type PoolStats struct {
+	// Connections is the number of open connections.
+	Connections int
+	// Active is the number of running operations.
+	Active int
+	// Operations is the number of finished operations.
+	Operations int64
+	// Failures is the number of operations which failed after the retries.
+	Failures int64
+	// Retries is the number of retries of operations.
+	Retries int64
+	// Dials is the number of connections dialed, including the ones
+	// replacing broken connections.
+	Dials int64
+	// Usage is the usage of all the connections.
+	Usage HostUsage
+}
+
+// Pool owns SSH connections dialed on demand and runs SCP operations on
+// them with a concurrency cap, for building tools which copy many files
+// to or from a host. Each operation runs on the connection with the fewest
+// running operations, and a new connection is dialed while the pool has
+// less connections than its size and all of them are busy. A Pool is safe
+// for concurrent use.
+type Pool struct {
+	dial        DialFunc
+	size        int
+	concurrency int
+	scpOptions  []ScpOption
+	retries     int
+	backoff     time.Duration
+
+	sem   chan struct{}
+	usage hostUsage
+
+	mu sync.Mutex
+	// dialed is signaled when a dial finishes.
+	dialed  *sync.Cond
+	conns   []*poolConn
+	dialing int
+	closed  bool
+	stats   PoolStats
+}
+
+type poolConn struct {
+	client *ssh.Client
+	active int
+}
+
+// NewPool creates a Pool which connects with dial. No connection is dialed
+// until the first operation. Call Close to close the connections.
+func NewPool(dial DialFunc, options ...PoolOption) *Pool {
+	p := &Pool{
+		dial:        dial,
+		size:        defaultPoolSize,
+		concurrency: defaultPoolConcurrency,
+	}
+	for _, option := range options {
+		option(p)
+	}
+	if p.size <= 0 {
+		p.size = 1
+	}
+	if p.concurrency <= 0 {
+		p.concurrency = 1
+	}
+	p.sem = make(chan struct{}, p.concurrency)
+	p.dialed = sync.NewCond(&p.mu)
+	return p
+}
+
+// Do runs fn with an SCP client on a connection of the pool. It waits while
+// the concurrency cap is reached or until ctx is done. The client is
+// created with ctx and the options set with WithPoolClientOptions, and is
+// closed when fn returns. fn may be called again for the retries set with
+// WithPoolRetry, so it must be safe to repeat.
+func (p *Pool) Do(ctx context.Context, fn func(s *SCP) error) error {
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.sem }()
+
+	broken, err := p.attempt(ctx, fn)
+	wait := p.backoff
+	for i := 0; i < p.retries && err != nil && broken && ctx.Err() == nil; i++ {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return p.finish(err)
+		}
+		wait *= 2
+		p.mu.Lock()
+		p.stats.Retries++
+		p.mu.Unlock()
+		broken, err = p.attempt(ctx, fn)
+	}
+	return p.finish(err)
+}
+
+// finish counts the finished operation.
+func (p *Pool) finish(err error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stats.Operations++
+	if err != nil {
+		p.stats.Failures++
+	}
+	return err
+}
+
+// attempt runs fn once. broken reports whether it failed because of
+// the connection.
+func (p *Pool) attempt(ctx context.Context, fn func(s *SCP) error) (broken bool, err error) {
+	conn, err := p.acquire(ctx)
+	if err != nil {
+		return !errors.Is(err, ErrPoolClosed), err
+	}
+	options := append([]ScpOption{WithContext(ctx)}, p.scpOptions...)
+	s := NewSCP(conn.client, options...)
+	s.usage = &p.usage
+	err = fn(s)
+	if closeErr := s.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	broken = err != nil && !isAlive(conn.client)
+	p.release(conn, broken)
+	return broken, err
+}
+
+// acquire returns the connection for an operation, dialing a new one if
+// all the connections are busy and the pool is not full.
+func (p *Pool) acquire(ctx context.Context) (*poolConn, error) {
+	p.mu.Lock()
+	for {
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		var idlest *poolConn
+		for _, conn := range p.conns {
+			if idlest == nil || conn.active < idlest.active {
+				idlest = conn
+			}
+		}
+		full := len(p.conns)+p.dialing >= p.size
+		if idlest != nil && (idlest.active == 0 || full) {
+			idlest.active++
+			p.mu.Unlock()
+			return idlest, nil
+		}
+		if !full {
+			break
+		}
+		// All the connections are being dialed.
+		p.dialed.Wait()
+	}
+	p.dialing++
+	p.stats.Dials++
+	p.mu.Unlock()
+
+	client, err := p.dial(ctx)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.dialed.Broadcast()
+	p.dialing--
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial: err=%w", err)
+	}
+	if p.closed {
+		client.Close()
+		return nil, ErrPoolClosed
+	}
+	conn := &poolConn{client: client, active: 1}
+	p.conns = append(p.conns, conn)
+	return conn, nil
+}
+
+// release returns the connection to the pool. A broken connection is
+// removed from the pool and closed.
+func (p *Pool) release(conn *poolConn, broken bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn.active--
+	if !broken {
+		return
+	}
+	for i, c := range p.conns {
+		if c == conn {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			conn.client.Close()
+			break
+		}
+	}
+}
+
+// isAlive reports whether the connection of client still responds.
+func isAlive(client *ssh.Client) bool {
+	_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+	return err == nil
+}
+
+// Stats returns the aggregate statistics of the pool.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Connections = len(p.conns)
+	for _, conn := range p.conns {
+		stats.Active += conn.active
+	}
+	stats.Usage = p.usage.snapshot()
+	return stats
+}
+
+// Close closes all the connections of the pool. The running operations
+// fail, and Do fails with ErrPoolClosed after it.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	var firstErr error
+	for _, conn := range p.conns {
+		if err := conn.client.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	p.conns = nil
+	return firstErr
+}
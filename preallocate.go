@@ -0,0 +1,29 @@
+package scp
+
+import (
+	"fmt"
+	"os"
+)
+
+// WithPreallocate makes receives allocate each local file to the size
+// announced in the file header before copying the body, which reduces
+// fragmentation and fails fast when the disk does not have enough space.
+// The space is reserved with fallocate on Linux, and the file is only
+// extended elsewhere. It has no effect with WithSparseFiles.
+func WithPreallocate() ScpOption {
+	return func(s *SCP) {
+		s.preallocate = true
+	}
+}
+
+// preallocateFile allocates the empty file to size if WithPreallocate
+// is set.
+func (s *SCP) preallocateFile(file *os.File, size int64) error {
+	if !s.preallocate || s.sparseFiles || size <= 0 {
+		return nil
+	}
+	if err := allocateFile(file, size); err != nil {
+		return fmt.Errorf("failed to preallocate destination file: err=%w", err)
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package scp
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// allocateFile reserves the space of size bytes for file with fallocate,
+// falling back to extending it on filesystems without fallocate.
+func allocateFile(file *os.File, size int64) error {
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return file.Truncate(size)
+	}
+	return err
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package scp
+
+import "os"
+
+// allocateFile extends file to size bytes, since the space cannot be
+// reserved portably.
+func allocateFile(file *os.File, size int64) error {
+	return file.Truncate(size)
+}
@@ -0,0 +1,90 @@
+package scp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// TransferTotals is the total of the files to be transferred, found by
+// the pre-scan enabled with WithPreScan.
+type TransferTotals struct {
+	// Files is the number of regular files.
+	Files int
+	// Bytes is the sum of the sizes of the regular files.
+	Bytes int64
+}
+
+// TotalsObserver is an optional interface implemented by a SourceObserver.
+// When the pre-scan is enabled with WithPreScan, the observer is notified
+// of the totals before the transfer starts, so progress percentages and
+// ETAs can be computed.
+type TotalsObserver interface {
+	OnTotals(totals TransferTotals)
+}
+
+// WithPreScan makes SendDir and ReceiveDir compute the total number and size
+// of the files before the transfer, by walking the local tree for SendDir
+// and by listing the remote tree with the find and stat commands for
+// ReceiveDir. The totals are notified to the observer set with
+// WithSourceObserver if it implements TotalsObserver, and sent as
+// EventTotals to the channel set with WithProgressEvents. They are counted
+// before filtering with acceptFn, WithExclude and WithSync, so they are
+// the upper bounds of the transfer.
+func WithPreScan() ScpOption {
+	return func(s *SCP) {
+		s.preScan = true
+	}
+}
+
+// preScanLocal notifies the totals of the local tree under srcDir if
+// the pre-scan is enabled.
+func (s *SCP) preScanLocal(srcDir string) error {
+	if !s.preScan {
+		return nil
+	}
+	var totals TransferTotals
+	err := filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			totals.Files++
+			totals.Bytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan source directory: err=%w", err)
+	}
+	s.notifyTotals(totals)
+	return nil
+}
+
+// preScanRemote notifies the totals of the remote tree under srcDir if
+// the pre-scan is enabled.
+func (s *SCP) preScanRemote(srcDir string) error {
+	if !s.preScan {
+		return nil
+	}
+	entries, err := s.listRemoteEntries(srcDir)
+	if err != nil {
+		return err
+	}
+	var totals TransferTotals
+	for _, e := range entries {
+		if !e.info.IsDir() {
+			totals.Files++
+			totals.Bytes += e.info.Size()
+		}
+	}
+	s.notifyTotals(totals)
+	return nil
+}
+
+func (s *SCP) notifyTotals(totals TransferTotals) {
+	if observer, ok := s.sourceObserver.(TotalsObserver); ok {
+		observer.OnTotals(totals)
+	}
+	s.progressSink().send(ProgressEvent{Type: EventTotals, Files: totals.Files, Bytes: totals.Bytes})
+}
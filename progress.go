@@ -0,0 +1,119 @@
+package scp
+
+import "context"
+
+// ProgressEventType is the type of a ProgressEvent.
+type ProgressEventType int
+
+const (
+	// EventFileStarted is sent when the transfer of a file starts.
+	EventFileStarted ProgressEventType = iota
+	// EventBytesCopied is sent when bytes of the content of a file
+	// are copied.
+	EventBytesCopied
+	// EventFileFinished is sent when the transfer of a file finishes,
+	// whether or not it succeeded.
+	EventFileFinished
+	// EventDirEntered is sent when a directory of a recursive transfer
+	// is entered.
+	EventDirEntered
+	// EventDirLeft is sent when a directory of a recursive transfer is left.
+	EventDirLeft
+	// EventWarning is sent for a non-fatal failure, which is also recorded
+	// to the collector set with WithWarnings.
+	EventWarning
+	// EventTotals is sent with the totals of the files before a recursive
+	// transfer when WithPreScan is set.
+	EventTotals
+)
+
+func (t ProgressEventType) String() string {
+	switch t {
+	case EventFileStarted:
+		return "file started"
+	case EventBytesCopied:
+		return "bytes copied"
+	case EventFileFinished:
+		return "file finished"
+	case EventDirEntered:
+		return "directory entered"
+	case EventDirLeft:
+		return "directory left"
+	case EventWarning:
+		return "warning"
+	case EventTotals:
+		return "totals"
+	default:
+		return "unknown"
+	}
+}
+
+// ProgressEvent is a progress of a transfer delivered on the channel set
+// with WithProgressEvents.
+type ProgressEvent struct {
+	Type      ProgressEventType
+	Direction Direction
+	// LocalPath is the local path of the file or directory. It is empty
+	// if the file is read from or written to an io.Reader or io.Writer.
+	LocalPath string
+	// RemotePath is the remote path of the file, as in AuditRecord.
+	// It is empty for the directory events.
+	RemotePath string
+	// Bytes is the number of content bytes of the file copied so far.
+	// For EventTotals, it is the total size of the files.
+	Bytes int64
+	// Files is the total number of the files of EventTotals.
+	Files int
+	// Err is the error of EventFileFinished, or nil if the file was
+	// copied successfully. For EventWarning, it is the error of the warning.
+	Err error
+	// Warning is the warning of EventWarning.
+	Warning Warning
+}
+
+// WithProgressEvents makes the transfers send ProgressEvents to ch, so that
+// a UI can render the progress without implementing SourceObserver.
+// The events are sent synchronously, so ch must be drained, and
+// the transfer waits for the receiver of ch except for EventBytesCopied,
+// which is dropped when ch is full since the next one carries the total.
+// The events stop when the context set with WithContext is done.
+func WithProgressEvents(ch chan<- ProgressEvent) ScpOption {
+	return func(s *SCP) {
+		s.progressEvents = ch
+	}
+}
+
+// progressSink sends the progress events. All the methods are no-op on a nil
+// progressSink, which is used when no channel is set.
+type progressSink struct {
+	ch  chan<- ProgressEvent
+	ctx context.Context
+}
+
+func (s *SCP) progressSink() *progressSink {
+	if s.progressEvents == nil {
+		return nil
+	}
+	return &progressSink{ch: s.progressEvents, ctx: s.ctx}
+}
+
+func (p *progressSink) send(e ProgressEvent) {
+	if p == nil {
+		return
+	}
+	if e.Type == EventBytesCopied {
+		select {
+		case p.ch <- e:
+		default:
+		}
+		return
+	}
+	select {
+	case p.ch <- e:
+	case <-p.ctx.Done():
+	}
+}
+
+func (p *progressSink) dir(t ProgressEventType, direction Direction, localPath string) {
+	p.send(ProgressEvent{Type: t, Direction: direction, LocalPath: localPath})
+}
@@ -7,25 +7,32 @@ import (
 	"os"
 	"path/filepath"
 	"time"
-)
-
-const (
-	msgCopyFile       = 'C'
-	msgStartDirectory = 'D'
-	msgEndDirectory   = 'E'
-	msgTime           = 'T'
-)
 
-const (
-	replyOK         = '\x00'
-	replyError      = '\x01'
-	replyFatalError = '\x02'
+	"github.com/ljun20160606/go-scp/scpwire"
 )
 
 type sourceProtocol struct {
 	remIn     io.WriteCloser
 	remOut    io.Reader
 	remReader *bufio.Reader
+
+	// tee receives a copy of the file bodies written if it is not nil.
+	tee io.Writer
+	// fileTimer bounds the time of each file.
+	fileTimer *fileTimer
+	// forcedMode replaces the permissions written if it is not nil.
+	forcedMode *forcedMode
+	// omitsTime is true when the remote scp runs without -p, so the times
+	// are not written.
+	omitsTime bool
+	// bufferSize is the size of the buffer copying the file bodies.
+	bufferSize int
+	// pipeline is the maximum number of outstanding replies, and pending
+	// is the number of them. Each reply is read before the next message if
+	// pipeline is zero.
+	pipeline, pending int
+	// log writes the messages and the replies if a logger is set.
+	log *sessionLog
 }
 
 func newSourceProtocol(remIn io.WriteCloser, remOut io.Reader) (*sourceProtocol, error) {
@@ -39,23 +46,23 @@ func newSourceProtocol(remIn io.WriteCloser, remOut io.Reader) (*sourceProtocol,
 }
 
 func (s *sourceProtocol) WriteFile(fileInfo *FileInfo, body io.ReadCloser) error {
-	if !fileInfo.modTime.IsZero() || !fileInfo.accessTime.IsZero() {
+	if !s.omitsTime && (!fileInfo.modTime.IsZero() || !fileInfo.accessTime.IsZero()) {
 		err := s.setTime(fileInfo.modTime, fileInfo.accessTime)
 		if err != nil {
 			return err
 		}
 	}
-	return s.writeFile(fileInfo.mode, fileInfo.size, fileInfo.name, body)
+	return s.writeFile(s.forcedMode.fileMode(fileInfo.mode), fileInfo.size, fileInfo.name, body)
 }
 
 func (s *sourceProtocol) StartDirectory(dirInfo *FileInfo) error {
-	if !dirInfo.modTime.IsZero() || !dirInfo.accessTime.IsZero() {
+	if !s.omitsTime && (!dirInfo.modTime.IsZero() || !dirInfo.accessTime.IsZero()) {
 		err := s.setTime(dirInfo.modTime, dirInfo.accessTime)
 		if err != nil {
 			return err
 		}
 	}
-	return s.startDirectory(dirInfo.mode, dirInfo.name)
+	return s.startDirectory(s.forcedMode.dirMode(dirInfo.mode), dirInfo.name)
 }
 
 func (s *sourceProtocol) EndDirectory() error {
@@ -63,86 +70,90 @@ func (s *sourceProtocol) EndDirectory() error {
 }
 
 func (s *sourceProtocol) setTime(mtime, atime time.Time) error {
-	ms, mus := toSecondsAndMicroseconds(mtime)
-	as, aus := toSecondsAndMicroseconds(atime)
-	_, err := fmt.Fprintf(s.remIn, "%c%d %d %d %d\n", msgTime, ms, mus, as, aus)
+	s.log.debug("scp: sending time message", "mtime", mtime, "atime", atime)
+	err := scpwire.WriteTime(s.remIn, mtime, atime)
 	if err != nil {
-		return fmt.Errorf("failed to write scp time header: err=%s", err)
+		return s.writeError(fmt.Errorf("failed to write scp time header: err=%w", err))
 	}
-	return s.readReply()
-}
-
-func toSecondsAndMicroseconds(t time.Time) (seconds int64, microseconds int) {
-	rounded := t.Round(time.Microsecond)
-	return rounded.Unix(), rounded.Nanosecond() / int(int64(time.Microsecond)/int64(time.Nanosecond))
+	return s.awaitReply()
 }
 
 func (s *sourceProtocol) writeFile(mode os.FileMode, length int64, filename string, body io.ReadCloser) error {
-	_, err := fmt.Fprintf(s.remIn, "%c%#4o %d %s\n", msgCopyFile, mode&os.ModePerm, length, filepath.Base(filename))
+	s.fileTimer.start()
+	defer s.fileTimer.stop()
+	start := time.Now()
+	s.log.debug("scp: sending file message", "mode", mode, "size", length, "name", filepath.Base(filename))
+	err := scpwire.WriteFileHeader(s.remIn, mode, length, filepath.Base(filename))
 	if err != nil {
-		return fmt.Errorf("failed to write scp file header: err=%s", err)
+		return s.writeError(fmt.Errorf("failed to write scp file header: err=%w", err))
+	}
+	var r io.Reader = body
+	if s.tee != nil {
+		r = io.TeeReader(body, s.tee)
 	}
-	_, err = io.Copy(s.remIn, body)
+	_, err = copyBuffer(s.remIn, r, s.bufferSize)
 	// NOTE: We close body whether or not copy fails and ignore an error from closing body.
 	body.Close()
 	if err != nil {
-		return fmt.Errorf("failed to write scp file body: err=%s", err)
+		return fmt.Errorf("failed to write scp file body: err=%w", err)
 	}
-	err = s.readReply()
+	err = s.awaitReply()
 	if err != nil {
 		return err
 	}
 
-	_, err = s.remIn.Write([]byte{replyOK})
+	err = scpwire.WriteOK(s.remIn)
 	if err != nil {
-		return fmt.Errorf("failed to write scp replyOK reply: err=%s", err)
+		return s.writeError(fmt.Errorf("failed to write scp replyOK reply: err=%w", err))
 	}
-	return s.readReply()
+	err = s.awaitReply()
+	s.log.debug("scp: sent file", "name", filepath.Base(filename), "size", length, "duration", time.Since(start), "err", err)
+	return err
 }
 
 func (s *sourceProtocol) startDirectory(mode os.FileMode, dirname string) error {
-	// length is not used.
-	length := 0
-	_, err := fmt.Fprintf(s.remIn, "%c%#4o %d %s\n", msgStartDirectory, mode&os.ModePerm, length, filepath.Base(dirname))
+	s.log.debug("scp: sending start directory message", "mode", mode, "name", filepath.Base(dirname))
+	err := scpwire.WriteStartDirectory(s.remIn, mode, filepath.Base(dirname))
 	if err != nil {
-		return fmt.Errorf("failed to write scp start directory header: err=%s", err)
+		return s.writeError(fmt.Errorf("failed to write scp start directory header: err=%w", err))
 	}
-	return s.readReply()
+	return s.awaitReply()
 }
 
 func (s *sourceProtocol) endDirectory() error {
-	_, err := fmt.Fprintf(s.remIn, "%c\n", msgEndDirectory)
+	s.log.debug("scp: sending end directory message")
+	err := scpwire.WriteEndDirectory(s.remIn)
 	if err != nil {
-		return fmt.Errorf("failed to write scp end directory header: err=%s", err)
+		return s.writeError(fmt.Errorf("failed to write scp end directory header: err=%w", err))
 	}
-	return s.readReply()
+	return s.awaitReply()
 }
 
 func (s *sourceProtocol) readReply() error {
-	b, err := s.remReader.ReadByte()
-	if err != nil {
-		return fmt.Errorf("failed to read scp reply type: err=%s", err)
-	}
-	if b == replyOK {
-		return nil
-	}
-	if b != replyError && b != replyFatalError {
-		return fmt.Errorf("unexpected scp reply type: %v", b)
-	}
-	line, err := s.remReader.ReadString('\n')
-	if err != nil {
-		return fmt.Errorf("failed to read scp reply message: err=%s", err)
-	}
-	return &protocolError{
-		msg:   line,
-		fatal: b == replyFatalError,
+	err := scpwire.ReadReply(s.remReader)
+	if err == nil {
+		s.log.debug("scp: received reply", "type", "ok")
+	} else if rerr, ok := err.(*RemoteError); ok {
+		s.log.debug("scp: received reply", "type", "error", "fatal", rerr.Fatal, "message", rerr.Msg)
 	}
+	return err
 }
 
 type resourceProtocol struct {
 	remIn     io.WriteCloser
 	remOut    io.Reader
 	remReader *bufio.Reader
+
+	// tee receives a copy of the file bodies read if it is not nil.
+	tee io.Writer
+	// fileTimer bounds the time of each file.
+	fileTimer *fileTimer
+	// forcedMode replaces the permissions read if it is not nil.
+	forcedMode *forcedMode
+	// bufferSize is the size of the buffer copying the file bodies.
+	bufferSize int
+	// log writes the messages and the replies if a logger is set.
+	log *sessionLog
 }
 
 func newResourceProtocol(remIn io.WriteCloser, remOut io.Reader) (*resourceProtocol, error) {
@@ -159,151 +170,121 @@ func newResourceProtocol(remIn io.WriteCloser, remOut io.Reader) (*resourceProto
 	return s, nil
 }
 
-type TimeMsgHeader struct {
-	Mtime time.Time
-	Atime time.Time
-}
-
-type StartDirectoryMsgHeader struct {
-	Mode os.FileMode
-	Name string
-}
+// TimeMsgHeader is the time message of the scp protocol.
+type TimeMsgHeader = scpwire.TimeMsgHeader
 
-type EndDirectoryMsgHeader struct{}
+// StartDirectoryMsgHeader is the message starting a directory.
+type StartDirectoryMsgHeader = scpwire.StartDirectoryMsgHeader
 
-type FileMsgHeader struct {
-	Mode os.FileMode
-	Size int64
-	Name string
-}
+// EndDirectoryMsgHeader is the message ending a directory.
+type EndDirectoryMsgHeader = scpwire.EndDirectoryMsgHeader
 
-type okMsg struct{}
+// FileMsgHeader is the message of a file.
+type FileMsgHeader = scpwire.FileMsgHeader
 
-func fromSecondsAndMicroseconds(seconds int64, microseconds int) time.Time {
-	return time.Unix(seconds, int64(microseconds)*(int64(time.Microsecond)/int64(time.Nanosecond)))
-}
+type okMsg = scpwire.OKMsg
 
 func (s *resourceProtocol) ReadHeaderOrReply() (interface{}, error) {
-	b, err := s.remReader.ReadByte()
-	if err == io.EOF {
-		return nil, err
-	} else if err != nil {
-		return nil, fmt.Errorf("failed to read scp message type: err=%s", err)
+	h, err := s.readHeader()
+	if err == nil {
+		s.log.debug("scp: received message", "header", h)
+	} else if rerr, ok := err.(*RemoteError); ok {
+		s.log.debug("scp: received reply", "type", "error", "fatal", rerr.Fatal, "message", rerr.Msg)
 	}
-	switch b {
-	case msgCopyFile:
-		var h FileMsgHeader
-		n, err := fmt.Fscanf(s.remReader, "%04o %d %s\n", &h.Mode, &h.Size, &h.Name)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read scp file message header: err=%s", err)
-		}
-		if n != 3 {
-			return nil, fmt.Errorf("unexpected count in reading file message header: n=%d", 3)
-		}
-
-		err = s.WriteReplyOK()
-		if err != nil {
-			return nil, fmt.Errorf("failed to write scp replyOK reply: err=%s", err)
-		}
-
-		return h, nil
-	case msgStartDirectory:
-		var h StartDirectoryMsgHeader
-		var dummySize int64
-		n, err := fmt.Fscanf(s.remReader, "%04o %d %s\n", &h.Mode, &dummySize, &h.Name)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read scp start directory message header: err=%s", err)
-		}
-		if n != 3 {
-			return nil, fmt.Errorf("unexpected count in reading start directory message header: n=%d", 3)
-		}
-
-		err = s.WriteReplyOK()
-		if err != nil {
-			return nil, fmt.Errorf("failed to write scp replyOK reply: err=%s", err)
+	if err != nil {
+		if rerr, ok := err.(*RemoteError); ok && !rerr.Fatal {
+			// The peer may have exited after the error, so the error of
+			// the reply is ignored in favor of the remote error.
+			_ = s.WriteReplyOK()
 		}
-
+		return nil, err
+	}
+	switch m := h.(type) {
+	case okMsg:
 		return h, nil
-	case msgEndDirectory:
-		_, err := s.remReader.ReadString('\n')
-		if err != nil {
-			return nil, fmt.Errorf("failed to read scp end directory message: err=%s", err)
-		}
-
-		err = s.WriteReplyOK()
-		if err != nil {
-			return nil, fmt.Errorf("failed to write scp replyOK reply: err=%s", err)
-		}
-
-		return EndDirectoryMsgHeader{}, nil
-	case msgTime:
-		var ms int64
-		var mus int
-		var as int64
-		var aus int
-		n, err := fmt.Fscanf(s.remReader, "%d %d %d %d\n", &ms, &mus, &as, &aus)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read scp time message header: err=%s", err)
-		}
-		if n != 4 {
-			return nil, fmt.Errorf("unexpected count in reading time message header: n=%d", 3)
-		}
-
-		err = s.WriteReplyOK()
-		if err != nil {
-			return nil, fmt.Errorf("failed to write scp replyOK reply: err=%s", err)
-		}
+	case FileMsgHeader:
+		m.Mode = s.forcedMode.fileMode(m.Mode)
+		h = m
+	case StartDirectoryMsgHeader:
+		m.Mode = s.forcedMode.dirMode(m.Mode)
+		h = m
+	}
 
-		h := TimeMsgHeader{
-			Mtime: fromSecondsAndMicroseconds(ms, mus),
-			Atime: fromSecondsAndMicroseconds(as, aus),
-		}
+	err = s.WriteReplyOK()
+	if err != nil {
+		return nil, fmt.Errorf("failed to write scp replyOK reply: err=%w", err)
+	}
+	return h, nil
+}
 
-		return h, nil
-	case replyOK:
-		return okMsg{}, nil
-	case replyError, replyFatalError:
-		line, err := s.remReader.ReadString('\n')
+// readFileHeaders reads the headers of a single file. The time header is
+// zero if the remote scp runs without -p and sends none.
+func (s *resourceProtocol) readFileHeaders() (TimeMsgHeader, FileMsgHeader, error) {
+	var timeHeader TimeMsgHeader
+	h, err := s.ReadHeaderOrReply()
+	if err != nil {
+		return timeHeader, FileMsgHeader{}, fmt.Errorf("failed to read scp message header: err=%w", err)
+	}
+	if t, ok := h.(TimeMsgHeader); ok {
+		timeHeader = t
+		h, err = s.ReadHeaderOrReply()
 		if err != nil {
-			return nil, fmt.Errorf("failed to read scp reply error message: err=%s", err)
-		}
-
-		if b == replyError {
-			err = s.WriteReplyOK()
-			if err != nil {
-				return nil, fmt.Errorf("failed to write scp replyOK reply: err=%s", err)
-			}
-		}
-
-		return nil, &protocolError{
-			msg:   line,
-			fatal: b == replyFatalError,
+			return timeHeader, FileMsgHeader{}, fmt.Errorf("failed to read scp message header: err=%w", err)
 		}
-	default:
-		return nil, fmt.Errorf("invalid scp message type: %v", b)
 	}
+	fileHeader, ok := h.(FileMsgHeader)
+	if !ok {
+		return timeHeader, FileMsgHeader{}, fmt.Errorf("expected file message header, got %+v", h)
+	}
+	return timeHeader, fileHeader, nil
+}
+
+// readHeader reads a message header or a reply without writing a reply.
+// An error reply is returned as *RemoteError.
+func (s *resourceProtocol) readHeader() (interface{}, error) {
+	return scpwire.ReadMessage(s.remReader)
 }
 
 func (s *resourceProtocol) CopyFileBodyTo(h FileMsgHeader, w io.Writer) error {
+	s.fileTimer.start()
+	defer s.fileTimer.stop()
 	lr := io.LimitReader(s.remReader, h.Size)
-	n, err := io.Copy(w, lr)
+	if s.tee != nil {
+		w = io.MultiWriter(w, s.tee)
+	}
+	start := time.Now()
+	n, err := copyBuffer(w, lr, s.bufferSize)
+	s.log.debug("scp: received file", "name", h.Name, "size", n, "duration", time.Since(start), "err", err)
 	if err == io.EOF {
 		if n != h.Size {
-			return fmt.Errorf("unexpected EOF in CopyFileBodyTo: err=%s", err)
+			return fmt.Errorf("unexpected EOF in CopyFileBodyTo: err=%w", err)
 		}
 	} else if err != nil {
-		return fmt.Errorf("failed to write copy file body: err=%s", err)
+		return fmt.Errorf("failed to write copy file body: err=%w", err)
 	}
 
 	err = s.WriteReplyOK()
 	if err != nil {
-		return fmt.Errorf("failed to write scp replyOK reply: err=%s", err)
+		return fmt.Errorf("failed to write scp replyOK reply: err=%w", err)
 	}
 
 	return nil
 }
 
 func (s *resourceProtocol) WriteReplyOK() error {
-	_, err := s.remIn.Write([]byte{replyOK})
-	return err
+	s.log.debug("scp: sending reply", "type", "ok")
+	return scpwire.WriteOK(s.remIn)
+}
+
+// WriteReplyError writes an error reply with the message.
+func (s *resourceProtocol) WriteReplyError(msg string, fatal bool) error {
+	s.log.debug("scp: sending reply", "type", "error", "fatal", fatal, "message", msg)
+	return scpwire.WriteError(s.remIn, msg, fatal)
+}
+
+// WriteError writes an error message to the sink, for example when
+// a requested file cannot be read.
+func (s *sourceProtocol) WriteError(msg string, fatal bool) error {
+	s.log.debug("scp: sending reply", "type", "error", "fatal", fatal, "message", msg)
+	return scpwire.WriteError(s.remIn, msg, fatal)
 }
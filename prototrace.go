@@ -0,0 +1,209 @@
+package scp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"unicode"
+
+	"github.com/ljun20160606/go-scp/scpwire"
+)
+
+// maxTracedLine is the maximum length of a message written by the protocol
+// trace. The rest of a longer message is truncated.
+const maxTracedLine = 1024
+
+// WithProtocolTrace makes the scp sessions dump the traffic of the protocol
+// to w in a readable format, for debugging the interoperability with scp
+// implementations of servers. Each line has the number of the session and
+// ">" for the bytes sent or "<" for the bytes received, followed by
+// a message header, "ok", "error: <message>" or "fatal: <message>" for
+// a reply, or the length of a file body, whose content is elided. The lines
+// of concurrent sessions are interleaved. The other remote commands, such as
+// with WithTarStream, are not traced.
+func WithProtocolTrace(w io.Writer) ScpOption {
+	return func(s *SCP) {
+		s.protocolTrace = &protocolTrace{w: w}
+	}
+}
+
+// protocolTrace writes the traffic of the sessions of an SCP client.
+// wrap returns the streams as is on a nil protocolTrace, which is used when
+// no writer is set.
+type protocolTrace struct {
+	mu       sync.Mutex
+	w        io.Writer
+	sessions int
+}
+
+func (t *protocolTrace) printf(format string, args ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(t.w, format, args...)
+}
+
+// wrap starts tracing the session running cmd, and returns stdin and
+// stdout which trace the bytes.
+func (t *protocolTrace) wrap(cmd string, stdin io.WriteCloser, stdout io.Reader) (io.WriteCloser, io.Reader) {
+	if t == nil {
+		return stdin, stdout
+	}
+	t.mu.Lock()
+	t.sessions++
+	id := t.sessions
+	t.mu.Unlock()
+	t.printf("[%d] session: %s\n", id, cmd)
+	return &tracingWriteCloser{WriteCloser: stdin, p: &traceParser{t: t, prefix: fmt.Sprintf("[%d] >", id)}},
+		&tracingReader{Reader: stdout, p: &traceParser{t: t, prefix: fmt.Sprintf("[%d] <", id)}}
+}
+
+// traceParser splits a stream of the scp protocol into messages, replies
+// and file bodies, and writes them to the trace.
+type traceParser struct {
+	t      *protocolTrace
+	prefix string
+	mu     sync.Mutex
+	// body is the number of bytes left of the current file body, whose
+	// length is bodySize.
+	body, bodySize int64
+	// inLine is true while line holds the beginning of a message.
+	inLine    bool
+	line      []byte
+	truncated bool
+	closed    bool
+}
+
+func (p *traceParser) feed(b []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(b) > 0 {
+		if p.body > 0 {
+			n := int64(len(b))
+			if n > p.body {
+				n = p.body
+			}
+			p.body -= n
+			b = b[n:]
+			if p.body == 0 {
+				p.emit(fmt.Sprintf("(%d bytes of file body)", p.bodySize))
+			}
+			continue
+		}
+		if !p.inLine {
+			if b[0] == scpwire.ReplyOK {
+				p.emit("ok")
+				b = b[1:]
+				continue
+			}
+			p.inLine = true
+		}
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			p.appendLine(b)
+			return
+		}
+		p.appendLine(b[:i])
+		b = b[i+1:]
+		p.endLine()
+	}
+}
+
+func (p *traceParser) appendLine(b []byte) {
+	if room := maxTracedLine - len(p.line); len(b) > room {
+		b = b[:room]
+		p.truncated = true
+	}
+	p.line = append(p.line, b...)
+}
+
+// endLine writes the message in line. A file message starts the body.
+func (p *traceParser) endLine() {
+	line := string(p.line)
+	p.line, p.inLine = p.line[:0], false
+	if p.truncated {
+		line += "...(truncated)"
+		p.truncated = false
+	}
+	if line == "" {
+		p.emit(`""`)
+		return
+	}
+	switch line[0] {
+	case scpwire.ReplyError:
+		p.emit("error: " + printable(line[1:]))
+	case scpwire.ReplyFatalError:
+		p.emit("fatal: " + printable(line[1:]))
+	case scpwire.MsgCopyFile:
+		p.emit(printable(line))
+		var mode uint32
+		var size int64
+		if _, err := fmt.Sscanf(line[1:], "%o %d", &mode, &size); err == nil && size > 0 {
+			p.body, p.bodySize = size, size
+		}
+	default:
+		p.emit(printable(line))
+	}
+}
+
+// close writes the end of the stream once.
+func (p *traceParser) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	if p.body > 0 {
+		p.emit(fmt.Sprintf("(incomplete file body: %d of %d bytes)", p.bodySize-p.body, p.bodySize))
+	}
+	if p.inLine && len(p.line) > 0 {
+		p.emit("(incomplete) " + printable(string(p.line)))
+	}
+	p.emit("(eof)")
+}
+
+func (p *traceParser) emit(msg string) {
+	p.t.printf("%s %s\n", p.prefix, msg)
+}
+
+// printable returns s quoted if it has characters which are not printable.
+func printable(s string) string {
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+type tracingWriteCloser struct {
+	io.WriteCloser
+	p *traceParser
+}
+
+func (w *tracingWriteCloser) Write(b []byte) (int, error) {
+	n, err := w.WriteCloser.Write(b)
+	w.p.feed(b[:n])
+	return n, err
+}
+
+func (w *tracingWriteCloser) Close() error {
+	w.p.close()
+	return w.WriteCloser.Close()
+}
+
+type tracingReader struct {
+	io.Reader
+	p *traceParser
+}
+
+func (r *tracingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.p.feed(b[:n])
+	if err == io.EOF {
+		r.p.close()
+	}
+	return n, err
+}
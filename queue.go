@@ -0,0 +1,323 @@
+package scp
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	// ErrJobCanceled is returned for a job canceled with QueuedJob.Cancel.
+	ErrJobCanceled = errors.New("scp: job canceled")
+	// ErrQueueClosed is returned by Queue.Enqueue after the queue is closed.
+	ErrQueueClosed = errors.New("scp: queue is closed")
+)
+
+// JobKind is the kind of the transfer of a Job.
+type JobKind int
+
+const (
+	// JobSendFile runs SendFile.
+	JobSendFile JobKind = iota
+	// JobSendDir runs SendDir.
+	JobSendDir
+	// JobReceiveFile runs ReceiveFile.
+	JobReceiveFile
+	// JobReceiveDir runs ReceiveDir.
+	JobReceiveDir
+)
+
+func (k JobKind) String() string {
+	switch k {
+	case JobSendFile:
+		return "send file"
+	case JobSendDir:
+		return "send dir"
+	case JobReceiveFile:
+		return "receive file"
+	case JobReceiveDir:
+		return "receive dir"
+	default:
+		return "unknown"
+	}
+}
+
+// Job is a transfer run by a Queue.
+type Job struct {
+	Kind JobKind
+	// Src and Dest are the source and the destination paths, which are
+	// local or remote depending on Kind.
+	Src  string
+	Dest string
+	// AcceptFn filters the files and directories of JobSendDir and
+	// JobReceiveDir as in SendDir and ReceiveDir.
+	AcceptFn AcceptFunc
+	// Priority is the priority of the job. The jobs with higher priorities
+	// run first, and the jobs with the same priority run in the order
+	// they are enqueued.
+	Priority int
+}
+
+// JobState is the state of a queued job.
+type JobState int
+
+const (
+	// JobQueued means the job waits in the queue.
+	JobQueued JobState = iota
+	// JobRunning means the job is running.
+	JobRunning
+	// JobSucceeded means the job finished successfully.
+	JobSucceeded
+	// JobFailed means the job finished with an error.
+	JobFailed
+	// JobCanceled means the job was canceled before or while running.
+	JobCanceled
+)
+
+func (s JobState) String() string {
+	switch s {
+	case JobQueued:
+		return "queued"
+	case JobRunning:
+		return "running"
+	case JobSucceeded:
+		return "succeeded"
+	case JobFailed:
+		return "failed"
+	case JobCanceled:
+		return "canceled"
+	default:
+		return "unknown"
+	}
+}
+
+// JobProgress is the progress of a queued job.
+type JobProgress struct {
+	State JobState
+	// Usage is the bytes sent and received by the job so far, including
+	// the protocol messages.
+	Usage HostUsage
+	// Report is the report of JobSendDir and JobReceiveDir. It is nil until
+	// the job finishes.
+	Report *TransferReport
+	// Err is the error of the job, or nil unless it failed or was canceled.
+	Err error
+}
+
+// QueuedJob is a job enqueued to a Queue.
+type QueuedJob struct {
+	Job Job
+
+	q     *Queue
+	seq   int64
+	index int
+	usage hostUsage
+	done  chan struct{}
+
+	// The fields below are guarded by q.mu.
+	state    JobState
+	cancel   context.CancelFunc
+	canceled bool
+	report   *TransferReport
+	err      error
+}
+
+// Cancel cancels the job. A queued job is removed from the queue, and
+// a running job is interrupted through its context. It does nothing if
+// the job already finished.
+func (j *QueuedJob) Cancel() {
+	q := j.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	switch j.state {
+	case JobQueued:
+		heap.Remove(&q.pending, j.index)
+		j.state = JobCanceled
+		j.err = ErrJobCanceled
+		close(j.done)
+	case JobRunning:
+		j.canceled = true
+		j.cancel()
+	}
+}
+
+// Done returns a channel which is closed when the job finishes.
+func (j *QueuedJob) Done() <-chan struct{} {
+	return j.done
+}
+
+// Wait waits for the job to finish and returns its error.
+func (j *QueuedJob) Wait() error {
+	<-j.done
+	j.q.mu.Lock()
+	defer j.q.mu.Unlock()
+	return j.err
+}
+
+// Progress returns the progress of the job.
+func (j *QueuedJob) Progress() JobProgress {
+	j.q.mu.Lock()
+	defer j.q.mu.Unlock()
+	return JobProgress{
+		State:  j.state,
+		Usage:  j.usage.snapshot(),
+		Report: j.report,
+		Err:    j.err,
+	}
+}
+
+// Queue runs transfer jobs with an SCP client in the order of their
+// priorities with bounded concurrency. A Queue is safe for concurrent use.
+type Queue struct {
+	s *SCP
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending jobHeap
+	seq     int64
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// NewQueue creates a Queue which runs up to concurrency jobs at the same
+// time with s. If concurrency is less than 1, 1 is used. Call Close to stop
+// the queue.
+func NewQueue(s *SCP, concurrency int) *Queue {
+	q := newQueue(s)
+	q.start(concurrency)
+	return q
+}
+
+func newQueue(s *SCP) *Queue {
+	q := &Queue{s: s}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// start starts n workers.
+func (q *Queue) start(n int) {
+	if n < 1 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+}
+
+// Enqueue adds job to the queue.
+func (q *Queue) Enqueue(job Job) (*QueuedJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+	q.seq++
+	j := &QueuedJob{Job: job, q: q, seq: q.seq, done: make(chan struct{})}
+	heap.Push(&q.pending, j)
+	q.cond.Signal()
+	return j, nil
+}
+
+// Close stops accepting new jobs and waits for the queued and running jobs
+// to finish. Cancel the jobs to stop them early.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	q.wg.Wait()
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.pending) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		j := heap.Pop(&q.pending).(*QueuedJob)
+		ctx, cancel := context.WithCancel(q.s.ctx)
+		j.state = JobRunning
+		j.cancel = cancel
+		q.mu.Unlock()
+
+		report, err := q.run(ctx, j)
+		cancel()
+
+		q.mu.Lock()
+		j.report = report
+		switch {
+		case j.canceled && err != nil:
+			j.state = JobCanceled
+			j.err = ErrJobCanceled
+		case err != nil:
+			j.state = JobFailed
+			j.err = err
+		default:
+			j.state = JobSucceeded
+		}
+		close(j.done)
+		q.mu.Unlock()
+	}
+}
+
+// run runs the transfer of j.
+func (q *Queue) run(ctx context.Context, j *QueuedJob) (*TransferReport, error) {
+	s := q.s.withContext(ctx)
+	s.usage = &j.usage
+	return s.runJob(j.Job)
+}
+
+// runJob runs the transfer of job.
+func (s *SCP) runJob(job Job) (*TransferReport, error) {
+	switch job.Kind {
+	case JobSendFile:
+		return nil, s.SendFile(job.Src, job.Dest)
+	case JobSendDir:
+		return s.SendDir(job.Src, job.Dest, job.AcceptFn)
+	case JobReceiveFile:
+		return nil, s.ReceiveFile(job.Src, job.Dest)
+	case JobReceiveDir:
+		return s.ReceiveDir(job.Src, job.Dest, job.AcceptFn)
+	}
+	return nil, fmt.Errorf("unknown job kind: %d", job.Kind)
+}
+
+// jobHeap orders the queued jobs by the priority and the order of Enqueue.
+type jobHeap []*QueuedJob
+
+func (h jobHeap) Len() int { return len(h) }
+
+func (h jobHeap) Less(i, j int) bool {
+	if h[i].Job.Priority != h[j].Job.Priority {
+		return h[i].Job.Priority > h[j].Job.Priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h jobHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *jobHeap) Push(x interface{}) {
+	j := x.(*QueuedJob)
+	j.index = len(*h)
+	*h = append(*h, j)
+}
+
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	j := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return j
+}
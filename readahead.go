@@ -0,0 +1,157 @@
+package scp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// readAheadFileSize is the maximum size read ahead from each file.
+const readAheadFileSize = 1 << 20
+
+// WithReadAhead makes SendDir read the next n files from the local disk
+// while the current file is written to the remote server, so the disk and
+// the network are used at the same time. Up to 1MiB of each file is read
+// ahead, so it uses up to n MiB of memory. In this mode, the tree is walked
+// and acceptFn is called for all the entries before the first file is sent.
+// With WithSparseFiles, the files are only opened ahead and not read, so
+// that their holes are skipped. It has no effect with WithTarStream and
+// WithMapFunc.
+func WithReadAhead(n int) ScpOption {
+	return func(s *SCP) {
+		s.readAhead = n
+	}
+}
+
+// queuedEntry is an entry recorded by queuedDirSender. dirInfo is nil for
+// a file, and the end of a directory has neither dirInfo nor fi.
+type queuedEntry struct {
+	dirInfo          *FileInfo
+	fi               *FileInfo
+	path, remotePath string
+}
+
+// queuedDirSender records the entries of a tree and sends them later with
+// the files read ahead.
+type queuedDirSender struct {
+	entries []queuedEntry
+}
+
+func (q *queuedDirSender) StartDirectory(dirInfo *FileInfo) error {
+	q.entries = append(q.entries, queuedEntry{dirInfo: dirInfo})
+	return nil
+}
+
+func (q *queuedDirSender) EndDirectory() error {
+	q.entries = append(q.entries, queuedEntry{})
+	return nil
+}
+
+func (q *queuedDirSender) sendFile(fi *FileInfo, path, remotePath string) error {
+	q.entries = append(q.entries, queuedEntry{fi: fi, path: path, remotePath: remotePath})
+	return nil
+}
+
+// readAheadFile is a file opened and partly read by the read-ahead stage.
+type readAheadFile struct {
+	body io.ReadCloser
+	err  error
+}
+
+// send sends the recorded entries over ss while the next files are read
+// ahead in another goroutine.
+func (q *queuedDirSender) send(s *SCP, ss *sinkSession) error {
+	files := make(chan readAheadFile, s.readAhead)
+	done := make(chan struct{})
+	go func() {
+		defer close(files)
+		for _, e := range q.entries {
+			if e.fi == nil {
+				continue
+			}
+			var body io.ReadCloser
+			var err error
+			if s.sparseFiles {
+				// writeFile reads the holes of *os.File.
+				var file *os.File
+				if file, err = os.Open(e.path); err == nil {
+					body = file
+				}
+			} else {
+				body, err = readAhead(e.path, e.fi.Size())
+			}
+			select {
+			case files <- readAheadFile{body: body, err: err}:
+			case <-done:
+				if body != nil {
+					body.Close()
+				}
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(done)
+		for f := range files {
+			if f.body != nil {
+				f.body.Close()
+			}
+		}
+	}()
+
+	for _, e := range q.entries {
+		var err error
+		switch {
+		case e.dirInfo != nil:
+			err = ss.StartDirectory(e.dirInfo)
+		case e.fi != nil:
+			f := <-files
+			if f.err != nil {
+				return f.err
+			}
+			err = s.writeFile(ss, e.fi, f.body, e.path, e.remotePath)
+		default:
+			err = ss.EndDirectory()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readAhead opens the file of size bytes and reads up to readAheadFileSize
+// bytes of it. The returned body reads the whole content.
+func readAhead(path string, size int64) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	n := size
+	if n > readAheadFileSize {
+		n = readAheadFileSize
+	}
+	buf := make([]byte, n)
+	read, err := io.ReadFull(file, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		file.Close()
+		return nil, err
+	}
+	buf = buf[:read]
+	if int64(read) < n || n == size {
+		file.Close()
+		return ioutil.NopCloser(bytes.NewReader(buf)), nil
+	}
+	return &readAheadBody{Reader: io.MultiReader(bytes.NewReader(buf), file), file: file}, nil
+}
+
+// readAheadBody reads the content read ahead and then the rest of the file.
+type readAheadBody struct {
+	io.Reader
+	file *os.File
+}
+
+func (b *readAheadBody) Close() error {
+	return b.file.Close()
+}
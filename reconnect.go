@@ -0,0 +1,90 @@
+package scp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// WithReconnect makes the client dial a new connection with dial when
+// the connection is lost, instead of failing all the later operations.
+// The ssh.Client passed to NewSCP may be nil, and then the first operation
+// dials. A session which cannot be opened is opened again on a new
+// connection, and an operation failing because the connection is lost
+// mid-transfer is retried as with WithRetry, where SendDir and ReceiveDir
+// resume from the files not copied yet. The number of the retries and
+// the backoff are the ones set with WithRetry, and a single retry without
+// a wait is made if it is not set. The connections dialed are closed by
+// Close.
+func WithReconnect(dial DialFunc) ScpOption {
+	return func(s *SCP) {
+		s.reconnect = &reconnector{dial: dial, client: s.client}
+	}
+}
+
+// reconnector holds the current connection of an SCP with WithReconnect.
+// It is shared by the copies of the SCP.
+type reconnector struct {
+	dial DialFunc
+
+	mu     sync.Mutex
+	client *ssh.Client
+	// owned is true if client was dialed by the reconnector.
+	owned bool
+}
+
+// current returns the current client, which is nil before the first dial.
+func (r *reconnector) current() *ssh.Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.client
+}
+
+// redial replaces broken, the client which failed, with a new connection.
+// If the client was already replaced by another operation, the replacement
+// is returned as is.
+func (r *reconnector) redial(ctx context.Context, broken *ssh.Client) (*ssh.Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.client != nil && r.client != broken {
+		return r.client, nil
+	}
+	if r.client != nil && r.owned {
+		r.client.Close()
+	}
+	r.client, r.owned = nil, false
+	client, err := r.dial(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reconnect: err=%w", err)
+	}
+	r.client, r.owned = client, true
+	return client, nil
+}
+
+// connectionLost reports whether err of opening a session on client is
+// caused by the lost connection. A rejection by the server, such as for
+// MaxSessions of sshd, is not, and the connection shared by the other
+// sessions must not be replaced for it.
+func connectionLost(client *ssh.Client, err error) bool {
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) {
+		return false
+	}
+	return errors.Is(err, io.EOF) || !isAlive(client)
+}
+
+// Close closes the current connection if it was dialed by the reconnector.
+func (r *reconnector) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.client == nil || !r.owned {
+		return nil
+	}
+	err := r.client.Close()
+	r.client, r.owned = nil, false
+	return err
+}
@@ -0,0 +1,96 @@
+package scp
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Relay copies srcPath on the host of srcClient to dstPath on the host of
+// dstClient through the local process, like scp -3. The data is streamed
+// without a temporary file. srcPath can be a file or a directory, which is
+// copied recursively, and dstPath is handled in the same way as the remote
+// scp does for SendDir: if it is an existing directory, srcPath is copied
+// under it. The options of s other than the client apply to both hosts.
+func (s *SCP) Relay(srcClient *ssh.Client, srcPath string, dstClient *ssh.Client, dstPath string) (err error) {
+	s, op := s.withTimeout()
+	defer op.finish(&err)
+	src, err := s.withClient(srcClient).OpenSource(srcPath, SessionOptions{Recursive: true})
+	if err != nil {
+		return fmt.Errorf("failed to open source session: err=%w", err)
+	}
+	dst, err := s.withClient(dstClient).OpenSink(dstPath, SessionOptions{Recursive: true})
+	if err != nil {
+		src.Close()
+		return fmt.Errorf("failed to open sink session: err=%w", err)
+	}
+
+	err = relayMessages(src, dst)
+	serr := src.Close()
+	derr := dst.Close()
+	if err != nil {
+		return err
+	}
+	if serr != nil {
+		return fmt.Errorf("failed to finish source session: err=%w", serr)
+	}
+	if derr != nil {
+		return fmt.Errorf("failed to finish sink session: err=%w", derr)
+	}
+	return nil
+}
+
+// withClient returns a shallow copy of s which uses client. The copy does
+// not reconnect, since the reconnection of s dials another host.
+func (s *SCP) withClient(client *ssh.Client) *SCP {
+	c := *s
+	c.client = client
+	c.reconnect = nil
+	return &c
+}
+
+// relayMessages writes the files and directories read from src to dst.
+func relayMessages(src *SourceSession, dst *SinkSession) error {
+	var timeHeader TimeMsgHeader
+	for {
+		h, err := src.ReadHeader()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read scp message header: err=%w", err)
+		}
+		switch h := h.(type) {
+		case TimeMsgHeader:
+			timeHeader = h
+		case StartDirectoryMsgHeader:
+			info := NewFileInfo(h.Name, 0, h.Mode|os.ModeDir, timeHeader.Mtime, timeHeader.Atime)
+			if err := dst.StartDirectory(info); err != nil {
+				return fmt.Errorf("failed to start directory: err=%w", err)
+			}
+		case EndDirectoryMsgHeader:
+			if err := dst.EndDirectory(); err != nil {
+				return fmt.Errorf("failed to end directory: err=%w", err)
+			}
+		case FileMsgHeader:
+			info := NewFileInfo(h.Name, h.Size, h.Mode, timeHeader.Mtime, timeHeader.Atime)
+			pr, pw := io.Pipe()
+			copyErr := make(chan error, 1)
+			go func() {
+				err := src.CopyBodyTo(h, pw)
+				pw.CloseWithError(err)
+				copyErr <- err
+			}()
+			err := dst.WriteFile(info, pr)
+			// Unblock the copy if the body was not read to the end.
+			pr.Close()
+			if cerr := <-copyErr; cerr != nil && err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return fmt.Errorf("failed to copy file: err=%w", err)
+			}
+		}
+	}
+}
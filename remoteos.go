@@ -0,0 +1,51 @@
+package scp
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// RemoteOS is the operating system of the remote server, which determines
+// the format of the remote paths.
+type RemoteOS int
+
+const (
+	// RemoteUnix is a Unix-like server. The remote paths are cleaned in the
+	// same way as the local paths and separated with slashes.
+	RemoteUnix RemoteOS = iota
+	// RemoteWindows is a Windows server such as Windows OpenSSH. Both
+	// backslashes and slashes are accepted as separators in the remote
+	// paths, which are cleaned and separated with slashes, so that drive
+	// letter paths such as C:\data are kept on any local OS.
+	RemoteWindows
+)
+
+// WithRemoteOS sets the operating system of the remote server. The default
+// is RemoteUnix. RemoteWindows also sets the quoting to QuotingCmd for
+// the default shell of Windows OpenSSH, which can be overridden with
+// WithShellQuoting after this option. The features using other remote
+// commands than scp, such as WithTarStream and WithSync, require a Unix-like
+// server.
+func WithRemoteOS(os RemoteOS) ScpOption {
+	return func(s *SCP) {
+		s.remoteOS = os
+		if os == RemoteWindows {
+			s.quoting = QuotingCmd
+		}
+	}
+}
+
+// cleanRemotePath returns the cleaned remote path p in the format of
+// the remote OS.
+func (s *SCP) cleanRemotePath(p string) string {
+	if s.remoteOS == RemoteWindows {
+		p = strings.Replace(p, `\`, "/", -1)
+		if strings.HasPrefix(p, "//") {
+			// Keep the prefix of a UNC path.
+			return "/" + path.Clean(p[1:])
+		}
+		return path.Clean(p)
+	}
+	return realPath(filepath.Clean(p))
+}
@@ -0,0 +1,105 @@
+package scp
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TransferReport summarizes a directory transfer with SendDir or ReceiveDir.
+// If the transfer fails, it describes the part done before the failure.
+type TransferReport struct {
+	// FilesCopied is the number of files copied successfully.
+	FilesCopied int
+	// FilesSkipped is the number of files rejected by acceptFn, WithExclude
+	// or WithSync. The files under a rejected directory are not counted.
+	FilesSkipped int
+	// DirsCreated is the number of directories copied, which are created or
+	// updated at the destination.
+	DirsCreated int
+	// Bytes is the number of content bytes of the copied files.
+	Bytes int64
+	// Duration is the elapsed time of the transfer.
+	Duration time.Duration
+	// Rate is the average rate in bytes per second.
+	Rate float64
+}
+
+// reporter builds the TransferReport of a directory transfer, which may
+// consist of several attempts with WithRetry.
+type reporter struct {
+	report TransferReport
+	start  time.Time
+	// copied is the local paths of the files copied in the attempts.
+	copied map[string]bool
+	// counted is the local paths of the directories and the skipped files
+	// counted in the attempts.
+	counted map[string]bool
+	// accepted is the local paths of the entries accepted in the attempts.
+	accepted map[string]bool
+}
+
+// withReporter returns a shallow copy of s and the reporter which counts
+// the files transferred with it from their audit records. The records are
+// not hashed for the reporter, unlike for the audit hook.
+func (s *SCP) withReporter() (*SCP, *reporter) {
+	r := &reporter{
+		start:    time.Now(),
+		copied:   make(map[string]bool),
+		counted:  make(map[string]bool),
+		accepted: make(map[string]bool),
+	}
+	c := *s
+	hook := s.reportHook
+	c.reportHook = func(record AuditRecord) {
+		if record.Err == nil {
+			r.report.Bytes += record.Bytes
+			r.report.FilesCopied++
+			if record.LocalPath != "" {
+				r.copied[record.LocalPath] = true
+			}
+		}
+		if hook != nil {
+			hook(record)
+		}
+	}
+	return &c, r
+}
+
+// accept returns acceptFn which counts the skipped files and the copied
+// directories, and records the accepted entries. It also rejects the files
+// copied in the previous attempts.
+func (r *reporter) accept(acceptFn AcceptFunc) AcceptFunc {
+	return func(parentDir string, info os.FileInfo) (bool, error) {
+		path := filepath.Join(parentDir, info.Name())
+		if !info.IsDir() && r.copied[path] {
+			return false, nil
+		}
+		accepted, err := acceptFn(parentDir, info)
+		if err != nil {
+			return accepted, err
+		}
+		if accepted {
+			r.accepted[path] = true
+		}
+		if info.IsDir() != accepted || r.counted[path] {
+			return accepted, nil
+		}
+		r.counted[path] = true
+		if accepted {
+			r.report.DirsCreated++
+		} else {
+			r.report.FilesSkipped++
+		}
+		return accepted, nil
+	}
+}
+
+// finish returns the report with the elapsed time.
+func (r *reporter) finish() *TransferReport {
+	r.report.Duration = time.Since(r.start)
+	if seconds := r.report.Duration.Seconds(); seconds > 0 {
+		r.report.Rate = float64(r.report.Bytes) / seconds
+	}
+	return &r.report
+}
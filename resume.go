@@ -0,0 +1,279 @@
+package scp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ljun20160606/go-scp/scpwire"
+)
+
+// statRemote returns the size, the permission and the times of the remote
+// file with the stat command. GNU and BSD stat are supported. If the file
+// does not exist, the error satisfies os.IsNotExist.
+func (s *SCP) statRemote(path string) (*FileInfo, error) {
+	p := escapeShellArg(path)
+	cmd := "if [ ! -e " + p + " ]; then echo -; exit 0; fi; " +
+		"if [ -d " + p + " ]; then printf 'd '; else printf 'f '; fi; " +
+		"stat -c '%s %a %Y %X' -- " + p + " 2>/dev/null || stat -f '%z %Mp%Lp %m %a' -- " + p
+	var out bytes.Buffer
+	if err := runCommandSession(s.sessionConfig(), cmd, nil, &out); err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(out.String())
+	if len(fields) == 1 && fields[0] == "-" {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("unexpected output of remote stat: %q", out.String())
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid size in remote stat: err=%w", err)
+	}
+	perm, err := strconv.ParseUint(fields[2], 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mode in remote stat: err=%w", err)
+	}
+	mtime, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modification time in remote stat: err=%w", err)
+	}
+	atime, err := strconv.ParseInt(fields[4], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access time in remote stat: err=%w", err)
+	}
+	mode := scpwire.FromUnixMode(uint32(perm))
+	if fields[0] == "d" {
+		mode |= os.ModeDir
+	}
+	return NewFileInfo(path, size, mode, time.Unix(mtime, 0), time.Unix(atime, 0)), nil
+}
+
+// ReceiveFileResume is like ReceiveFile but continues an interrupted receive.
+// If the local file exists and is smaller than the remote file, only the rest
+// of the remote file is received and appended to it. If the local file is
+// larger, the whole file is received again. The existing content is not
+// compared with the remote file. The time and permission are set as in
+// ReceiveFile, with the times in seconds. The remote server must have
+// the stat and tail commands.
+func (s *SCP) ReceiveFileResume(srcFile, destFile string) (err error) {
+	s, op := s.withTimeout()
+	defer op.finish(&err)
+	srcFile = s.cleanRemotePath(srcFile)
+	destFile = filepath.Clean(destFile)
+	fiDest, err := os.Stat(destFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to get information of destnation file: err=%w", err)
+	}
+	if err == nil && fiDest.IsDir() {
+		destFile = filepath.Join(destFile, s.nameNormalization.normalize(filepath.Base(srcFile)))
+		fiDest, err = os.Stat(destFile)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to get information of destnation file: err=%w", err)
+		}
+	}
+	var offset int64
+	if err == nil {
+		offset = fiDest.Size()
+	}
+
+	remote, err := s.statRemote(srcFile)
+	if err != nil {
+		return fmt.Errorf("failed to get information of source file: err=%w", err)
+	}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if offset > remote.Size() {
+		offset = 0
+		flag |= os.O_TRUNC
+	}
+
+	return s.receiveRemoteFile(srcFile, destFile, flag, offset, remote)
+}
+
+// receiveFileWithCommands receives the remote srcFile to the local destFile
+// with remote commands instead of scp.
+func (s *SCP) receiveFileWithCommands(srcFile, destFile string) error {
+	remote, err := s.statRemote(srcFile)
+	if err != nil {
+		return fmt.Errorf("failed to get information of source file: err=%w", err)
+	}
+	if remote.IsDir() {
+		return fmt.Errorf("source file is a directory: %s", srcFile)
+	}
+	return s.receiveRemoteFile(srcFile, destFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0, remote)
+}
+
+// receiveRemoteFile receives the content of the remote srcFile after offset
+// with remote commands and sets the time and permission of destFile.
+func (s *SCP) receiveRemoteFile(srcFile, destFile string, flag int, offset int64, remote *FileInfo) error {
+	fileInfo := NewFileInfo(destFile, remote.Size(), s.forcedMode.fileMode(remote.Mode()), remote.ModTime(), remote.AccessTime())
+	s.sourceObserver.OnFileInfo(fileInfo)
+	a := s.newAuditor(DirectionDownload, destFile, srcFile)
+	err := s.appendRemoteFile(srcFile, destFile, flag, offset, remote, a)
+	a.finish(err)
+	notifyFileDone(s.sourceObserver, fileInfo, err)
+	if err != nil {
+		return err
+	}
+
+	m := s.newMetadataApplier()
+	if err := m.chmod(destFile, fileInfo.Mode()); err != nil {
+		return fmt.Errorf("failed to change file mode: err=%w", err)
+	}
+	if err := m.chtimes(destFile, remote.AccessTime(), remote.ModTime()); err != nil {
+		return fmt.Errorf("failed to change file time: err=%w", err)
+	}
+	return s.extractReceived(destFile)
+}
+
+// appendRemoteFile appends the content of the remote srcFile after offset
+// to destFile.
+func (s *SCP) appendRemoteFile(srcFile, destFile string, flag int, offset int64, remote *FileInfo, a *auditor) error {
+	file, err := os.OpenFile(destFile, flag, remote.Mode())
+	if err != nil {
+		return fmt.Errorf("failed to open destination file: err=%w", err)
+	}
+	var written int64
+	wo := &writerProxy{
+		writer: file,
+		onWriterFunc: func(p []byte) {
+			written += int64(len(p))
+			if a != nil {
+				a.Write(p)
+			}
+			s.sourceObserver.OnWrite(p)
+		},
+	}
+	if offset < remote.Size() {
+		cmd := "cat -- " + escapeShellArg(srcFile)
+		if offset > 0 {
+			cmd = "tail -c +" + strconv.FormatInt(offset+1, 10) + " -- " + escapeShellArg(srcFile)
+		}
+		if s.base64Transfer {
+			d := newBase64Decoder(wo)
+			err = runCommandSession(s.sessionConfig(), cmd+" | base64", nil, d)
+			if derr := d.Close(); err == nil {
+				err = derr
+			}
+		} else {
+			err = runCommandSession(s.sessionConfig(), cmd, nil, wo)
+		}
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to copy file: err=%w", err)
+	}
+	if want := remote.Size() - offset; written != want {
+		return fmt.Errorf("unexpected size of resumed content: got=%d, want=%d", written, want)
+	}
+	return nil
+}
+
+// SendFileResume is like SendFile but continues an interrupted send.
+// If the remote file exists and is not larger than the local file, only
+// the rest of the local file is sent and appended to it. Otherwise the whole
+// file is sent again. The existing content is not compared with the local
+// file. Only the size of the local file when the send starts is sent, and
+// the size of the remote file is checked afterwards, since the input of
+// the remote command has no framing other than its end; a mismatch fails
+// the send. The time and permission are set as in SendFile, with the times
+// in seconds. The remote server must have the stat, cat, wc, chmod and
+// touch commands.
+func (s *SCP) SendFileResume(srcFile, destFile string) (err error) {
+	s, op := s.withTimeout()
+	defer op.finish(&err)
+	return s.sendRemoteFile(srcFile, destFile, true)
+}
+
+// sendRemoteFile sends the local srcFile with remote commands and sets
+// the time and permission of the remote file. If resume is true, the rest
+// of the file is appended to the remote file as in SendFileResume.
+func (s *SCP) sendRemoteFile(srcFile, destFile string, resume bool) error {
+	srcFile = filepath.Clean(srcFile)
+	destFile = s.cleanRemotePath(destFile)
+	fi, err := os.Stat(srcFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat source file: err=%w", err)
+	}
+	local := NewFileInfoFromOS(fi, "")
+
+	remote, err := s.statRemote(destFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to get information of destination file: err=%w", err)
+	}
+	if err == nil && remote.IsDir() {
+		destFile = path.Join(destFile, s.nameNormalization.normalize(filepath.Base(srcFile)))
+		remote, err = s.statRemote(destFile)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to get information of destination file: err=%w", err)
+		}
+	}
+	var offset int64
+	if resume && err == nil && !remote.IsDir() && remote.Size() <= local.Size() {
+		offset = remote.Size()
+	}
+
+	file, err := os.Open(srcFile)
+	if err != nil {
+		return fmt.Errorf("failed to open source file: err=%w", err)
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek source file: err=%w", err)
+	}
+
+	p := escapeShellArg(destFile)
+	cmd := "cat > " + p
+	if offset > 0 {
+		cmd = "cat >> " + p
+	}
+	if s.base64Transfer {
+		cmd = "base64 -d" + strings.TrimPrefix(cmd, "cat")
+	}
+	a := s.newAuditor(DirectionUpload, srcFile, destFile)
+	err = runCommandSession(s.sessionConfig(), cmd, func(w io.Writer) error {
+		var enc io.WriteCloser
+		if s.base64Transfer {
+			enc = base64.NewEncoder(base64.StdEncoding, w)
+			w = enc
+		}
+		if a != nil {
+			w = io.MultiWriter(w, a)
+		}
+		if _, err := io.CopyN(w, file, local.Size()-offset); err != nil {
+			return err
+		}
+		if enc != nil {
+			return enc.Close()
+		}
+		return nil
+	}, nil)
+	a.finish(err)
+	if err != nil {
+		return fmt.Errorf("failed to copy file: err=%w", err)
+	}
+
+	// The size is checked since the input has no framing other than
+	// its end.
+	cmd = fmt.Sprintf("[ \"$(wc -c < %s)\" -eq %d ]", p, local.Size())
+	if !s.noPreserve {
+		cmd += fmt.Sprintf(" && chmod %o %s && TZ=UTC touch -m -t %s %s && TZ=UTC touch -a -t %s %s",
+			scpwire.ToUnixMode(s.forcedMode.fileMode(local.Mode())), p,
+			local.ModTime().UTC().Format("200601021504.05"), p,
+			local.AccessTime().UTC().Format("200601021504.05"), p)
+	}
+	if err := runCommandSession(s.sessionConfig(), cmd, nil, nil); err != nil {
+		return fmt.Errorf("failed to check size and set file mode and time: err=%w", err)
+	}
+	return nil
+}
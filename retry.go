@@ -0,0 +1,110 @@
+package scp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// WithRetry makes SendFile, SendFiles, SendDir, ReceiveFile, ReceiveFiles
+// and ReceiveDir retry up to n times when they fail transiently, for example
+// because a session cannot be opened, the connection is reset or the
+// transfer stalls for WithIdleTimeout. The wait before the first retry is
+// backoff, and it doubles for each retry. SendDir and ReceiveDir retry only
+// the files which were not copied in the previous attempts. The errors
+// reported by the remote scp, such as a missing file, are not retried.
+func WithRetry(n int, backoff time.Duration) ScpOption {
+	return func(s *SCP) {
+		s.retries = n
+		s.retryBackoff = backoff
+	}
+}
+
+// retry calls fn until it succeeds, fails with an error which is not
+// transient, or the retries set with WithRetry are exhausted. A retry with
+// WithReconnect opens the sessions on a new connection if the connection
+// is lost.
+func (s *SCP) retry(fn func() error) error {
+	err := fn()
+	wait := s.retryBackoff
+	for i := 0; i < s.maxRetries() && err != nil && s.ctx.Err() == nil && isTransient(err); i++ {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.ctx.Done():
+			timer.Stop()
+			return err
+		}
+		wait *= 2
+		err = fn()
+	}
+	return err
+}
+
+// maxRetries returns the number of the retries made by retry. WithReconnect
+// makes a retry even if WithRetry is not set.
+func (s *SCP) maxRetries() int {
+	if s.reconnect != nil && s.retries == 0 {
+		return 1
+	}
+	return s.retries
+}
+
+// isTransient reports whether err may not occur on a retry.
+func isTransient(err error) bool {
+	var (
+		openErr    *ssh.OpenChannelError
+		missingErr *ssh.ExitMissingError
+		remoteErr  *RemoteError
+		protoErr   *ProtocolError
+		exitErr    *ssh.ExitError
+	)
+	switch {
+	case errors.As(err, &openErr), errors.As(err, &missingErr):
+		return true
+	case errors.Is(err, ErrIdleTimeout), errors.Is(err, ErrTimeout):
+		return true
+	case errors.As(err, &remoteErr), errors.As(err, &protoErr), errors.As(err, &exitErr):
+		return false
+	}
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// sendDirAttempt returns the function sending the tree under srcDir for
+// each attempt of SendDir. If destDir does not exist, an attempt creates it
+// as the top directory, so all the attempts send the top directory into
+// the parent of destDir with the name of destDir. Then a retry does not
+// place the tree under destDir created by the failed attempt.
+func (s *SCP) sendDirAttempt(srcDir, destDir string, acceptFn AcceptFunc, r *reporter) func() error {
+	if s.maxRetries() > 0 {
+		dest := s.cleanRemotePath(destDir)
+		if _, err := s.statRemote(dest); os.IsNotExist(err) {
+			c := *s
+			c.topDirName = path.Base(dest)
+			return func() error {
+				return c.sendDirTree(srcDir, path.Dir(dest), acceptFn, r)
+			}
+		}
+	}
+	return func() error {
+		return s.sendDirTree(srcDir, destDir, acceptFn, r)
+	}
+}
+
+// topDirBase returns the name of the top directory sent by SendDir.
+func (s *SCP) topDirBase(srcDir string) string {
+	if s.topDirName != "" {
+		return s.topDirName
+	}
+	return filepath.Base(srcDir)
+}
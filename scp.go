@@ -2,6 +2,11 @@ package scp
 
 import (
 	"context"
+	"crypto/ed25519"
+	"fmt"
+	"hash"
+	"time"
+
 	"golang.org/x/crypto/ssh"
 )
 
@@ -12,16 +17,134 @@ type SCP struct {
 	ctx context.Context
 
 	sourceObserver SourceObserver
+
+	warnings *Warnings
+
+	bestEffortMetadata bool
+
+	atomicWrites  bool
+	atomicUploads bool
+
+	overwritePolicy OverwritePolicy
+
+	backupSuffix string
+
+	forcedMode *forcedMode
+
+	noPreserve bool
+
+	sparseFiles bool
+	preallocate bool
+	syncWrites  bool
+
+	bufferSize int
+
+	pipeline  int
+	readAhead int
+
+	// pause blocks the sessions of a Transfer while it is paused.
+	pause *pauseGate
+
+	preserveOwner bool
+	ownerMapping  OwnerMapping
+
+	nameNormalization NameNormalization
+
+	newHash func() hash.Hash
+
+	linkDests []string
+
+	accounting *Accounting
+
+	// usage counts the bytes of this client only. It is used for
+	// the results of the operations on many hosts.
+	usage *hostUsage
+
+	subsystem string
+
+	scpPath string
+
+	sudo bool
+
+	commandFunc CommandFunc
+
+	quoting ShellQuoting
+
+	remoteOS RemoteOS
+
+	compat          Compat
+	compatDetection *compatDetection
+
+	catFallback    bool
+	base64Transfer bool
+
+	auditHook func(AuditRecord)
+	// reportHook is called with the audit record of each file for
+	// the TransferReport. The record has no hash.
+	reportHook func(AuditRecord)
+
+	logger debugLogger
+
+	protocolTrace *protocolTrace
+
+	tracer  Tracer
+	metrics Metrics
+	// observedOp is the span and the metrics of the running operation.
+	observedOp *observedOp
+
+	progressEvents chan<- ProgressEvent
+
+	preScan bool
+
+	manifestSigningKey ed25519.PrivateKey
+
+	autoExtract             bool
+	removeExtractedArchives bool
+
+	teardownTimeout time.Duration
+
+	idleTimeout time.Duration
+
+	timeout        time.Duration
+	perFileTimeout time.Duration
+
+	retries      int
+	retryBackoff time.Duration
+
+	// topDirName replaces the name of the top directory sent by SendDir
+	// if it is not empty.
+	topDirName string
+
+	persistent *persistentSink
+
+	tarStream bool
+
+	excludes []string
+
+	mapFunc MapFunc
+
+	sync SyncMode
+
+	delete bool
+
+	transport Transport
+
+	// dialed is the connection opened by Dial, which Close closes.
+	dialed *dialedConn
+
+	reconnect *reconnector
 }
 
 // NewSCP creates the SCP client.
 // It is caller's responsibility to call Dial for ssh.Client before
 // calling NewSCP and call Close for ssh.Client after using SCP.
+// SCP implements Client, which can be used to mock the transfers.
 func NewSCP(client *ssh.Client, options ...ScpOption) *SCP {
 	s := &SCP{
-		client: client,
-		ctx:    context.Background(),
-		sourceObserver: emptySourceObserver,
+		client:          client,
+		ctx:             context.Background(),
+		sourceObserver:  emptySourceObserver,
+		teardownTimeout: defaultTeardownTimeout,
 	}
 
 	for _, option := range options {
@@ -43,3 +166,224 @@ func WithSourceObserver(sourceObserver SourceObserver) ScpOption {
 		s.sourceObserver = sourceObserver
 	}
 }
+
+// WithWarnings sets the collector for non-fatal warnings. When it is set,
+// failures of changing the permission or the time of received files and
+// directories are recorded to w instead of aborting the receive.
+func WithWarnings(w *Warnings) ScpOption {
+	return func(s *SCP) {
+		s.warnings = w
+	}
+}
+
+// WithBestEffortMetadata makes receives tolerate destinations where the
+// receiving user is not allowed to change the permission or the time.
+// Once changing the permission or the time fails with EPERM or ENOTSUP,
+// that operation is skipped for the rest of the transfer. The first failure
+// of each operation is recorded to the collector set with WithWarnings.
+func WithBestEffortMetadata() ScpOption {
+	return func(s *SCP) {
+		s.bestEffortMetadata = true
+	}
+}
+
+// WithAtomicWrites makes receives write each file to a temporary file in
+// the same directory and rename it to the destination only when the file
+// is received completely, so an interrupted receive never leaves
+// an existing file truncated or half written. It has no effect on
+// ReceiveFileResume, ReceiveFileParallel and WithLinkDest.
+func WithAtomicWrites() ScpOption {
+	return func(s *SCP) {
+		s.atomicWrites = true
+	}
+}
+
+// WithoutPreserve makes transfers keep neither the permissions nor the times
+// of the source, like scp without the -p option, for destinations such as
+// NFS or CIFS mounts where changing them fails. The -p option is not passed
+// to the remote scp, and the received files and directories are not
+// changed with chmod and chtimes. New files are created with the permission
+// of the source masked by the umask. Since the remote scp then sends no
+// times on receives, the times reported for the received files are zero,
+// and WithSync and WithLinkDest do not find unchanged files by the time.
+func WithoutPreserve() ScpOption {
+	return func(s *SCP) {
+		s.noPreserve = true
+	}
+}
+
+// WithShellQuoting sets the quoting of the paths in the command line of
+// the remote scp for the shell of the remote server. The default is
+// QuotingPOSIX. The other remote commands, such as with WithTarStream and
+// WithSync, always use QuotingPOSIX, since they require a POSIX shell.
+func WithShellQuoting(q ShellQuoting) ScpOption {
+	return func(s *SCP) {
+		s.quoting = q
+	}
+}
+
+// WithNameNormalization sets the Unicode normalization form applied to
+// the names of files and directories received from and sent to the remote
+// server. It avoids files whose names differ only in normalization, for
+// example between macOS and Linux. The default is NormalizationNone.
+func WithNameNormalization(n NameNormalization) ScpOption {
+	return func(s *SCP) {
+		s.nameNormalization = n
+	}
+}
+
+// WithHash enables computing the digest of each file content while it is
+// copied. The digest is reported to the observer if it implements
+// HashObserver. For example, pass sha256.New to get SHA-256 digests.
+func WithHash(newHash func() hash.Hash) ScpOption {
+	return func(s *SCP) {
+		s.newHash = newHash
+	}
+}
+
+// WithLinkDest sets local directories holding previous snapshots of the
+// destination, like the --link-dest option of rsync. In ReceiveDir, when
+// a directory has a file at the same relative path with the same size,
+// permission and modification time, the file is hardlinked into the
+// destination instead of being received. The remote tree is listed with
+// the find and stat commands first, and only the other files are requested,
+// so the paths with newlines are not supported.
+func WithLinkDest(dirs ...string) ScpOption {
+	return func(s *SCP) {
+		s.linkDests = append(s.linkDests, dirs...)
+	}
+}
+
+// WithAccounting sets the Accounting which tracks the bytes and sessions
+// used for the remote host of this client.
+func WithAccounting(a *Accounting) ScpOption {
+	return func(s *SCP) {
+		s.accounting = a
+	}
+}
+
+// WithSubsystem makes the client run the scp protocol over the named SSH
+// subsystem instead of executing the scp command. Since a subsystem request
+// has no arguments, the command line which would be executed, such as
+// "scp -t /path", is sent as the first line of the input. ServeStdio
+// understands this convention.
+func WithSubsystem(name string) ScpOption {
+	return func(s *SCP) {
+		s.subsystem = name
+	}
+}
+
+// WithManifestSigningKey makes ReceiveDirObjects sign the manifest with key,
+// so consumers can check it with VerifySignedManifest.
+func WithManifestSigningKey(key ed25519.PrivateKey) ScpOption {
+	return func(s *SCP) {
+		s.manifestSigningKey = key
+	}
+}
+
+// WithAutoExtract makes ReceiveFile and ReceiveDir extract the received
+// files named *.tar, *.tar.gz, *.tgz and *.zip into the directory of each
+// archive. Entries with absolute paths or paths outside the directory are
+// rejected with ErrUnsafeArchivePath, and links and special files are skipped.
+func WithAutoExtract() ScpOption {
+	return func(s *SCP) {
+		s.autoExtract = true
+	}
+}
+
+// WithRemoveExtractedArchives makes the archives extracted with
+// WithAutoExtract be removed after the extraction.
+func WithRemoveExtractedArchives() ScpOption {
+	return func(s *SCP) {
+		s.removeExtractedArchives = true
+	}
+}
+
+// WithScpPath sets the path of the scp command on the remote server, for
+// hosts where scp is not found in PATH. It is used as is in the command
+// line. The default is "scp".
+func WithScpPath(path string) ScpOption {
+	return func(s *SCP) {
+		s.scpPath = path
+	}
+}
+
+// WithSudo makes the remote commands run with sudo, for example to write to
+// directories owned by root without a root login. sudo runs with -n, so it
+// never prompts for a password. The user must be allowed to run the commands
+// without a password (NOPASSWD), and otherwise the operation fails with
+// an error wrapping ErrSudoPasswordRequired. With WithSubsystem, the scp
+// subsystem is used without sudo.
+func WithSudo() ScpOption {
+	return func(s *SCP) {
+		s.sudo = true
+	}
+}
+
+// CommandFunc builds the command line of the remote scp from the options,
+// such as "-tp" or "-frp", and the paths quoted for the shell as set with
+// WithShellQuoting and joined with spaces.
+type CommandFunc func(opts, paths string) string
+
+// CommandTemplate returns a CommandFunc which formats tmpl with the options
+// and the paths, for example "doas /opt/bin/scp %s %s".
+func CommandTemplate(tmpl string) CommandFunc {
+	return func(opts, paths string) string {
+		return fmt.Sprintf(tmpl, opts, paths)
+	}
+}
+
+// WithCommandFunc sets the function building the command line of the remote
+// scp, for servers which need a wrapper around scp. It overrides WithScpPath.
+// The command line is still run with sudo if WithSudo is set.
+func WithCommandFunc(fn CommandFunc) ScpOption {
+	return func(s *SCP) {
+		s.commandFunc = fn
+	}
+}
+
+// With returns a shallow copy of s with the options applied, for overriding
+// the options per call, for example:
+//
+//	s.With(WithScpPath("/usr/local/bin/scp")).SendFile(srcFile, destFile)
+func (s *SCP) With(options ...ScpOption) *SCP {
+	c := *s
+	for _, option := range options {
+		option(&c)
+	}
+	return &c
+}
+
+// WithTeardownTimeout sets the maximum time to wait for the remote command
+// to exit after the input is closed. When it passes, or the context set with
+// WithContext is done while waiting, the session is closed and the operation
+// fails with ErrTeardownTimeout. The default is 30 seconds, and zero or
+// a negative value means no limit.
+func WithTeardownTimeout(d time.Duration) ScpOption {
+	return func(s *SCP) {
+		s.teardownTimeout = d
+	}
+}
+
+// WithIdleTimeout makes a transfer fail with ErrIdleTimeout if no bytes are
+// sent or received over a session for d, for example because the connection
+// is half dead. The session is closed when d passes. Waiting for the remote
+// command to exit after the transfer is bounded by WithTeardownTimeout
+// instead. Zero or a negative value, the default, means no limit.
+func WithIdleTimeout(d time.Duration) ScpOption {
+	return func(s *SCP) {
+		s.idleTimeout = d
+	}
+}
+
+// WithTarStream makes SendDir and ReceiveDir transfer the directory tree as
+// a gzipped tar stream through the tar command on the remote server instead
+// of the scp protocol, which is much faster for trees of many small files.
+// The acceptFn is applied on the local side, so the files rejected by
+// SendDir are not transferred at all. Only regular files and directories
+// are copied, and WithLinkDest has no effect in this mode.
+func WithTarStream() ScpOption {
+	return func(s *SCP) {
+		s.tarStream = true
+	}
+}
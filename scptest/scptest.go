@@ -0,0 +1,356 @@
+// Package scptest provides an SSH server serving scp for the tests of code
+// using the scp package. The server listens on a random port of the loopback
+// interface with an ephemeral host key, and serves the scp requests with
+// the server package, confined under a temporary root directory, so the tests
+// need neither an sshd nor an scp command.
+package scptest
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+
+	"github.com/ljun20160606/go-scp/server"
+	"golang.org/x/crypto/ssh"
+)
+
+// The credentials accepted by the server.
+const (
+	User     = "user1"
+	Password = "password1"
+)
+
+// Option is an option of NewServer.
+type Option func(*Server)
+
+// WithShell makes the server run the commands other than scp with
+// "shell -c command" in Root, for the code which runs remote commands
+// besides scp. Unlike scp, the commands are not confined under Root.
+// By default, the other commands fail with the exit status 127.
+func WithShell(shell string) Option {
+	return func(s *Server) {
+		s.shell = shell
+	}
+}
+
+// WithPolicy sets the policy deciding whether the scp requests are allowed.
+func WithPolicy(policy server.Policy) Option {
+	return func(s *Server) {
+		s.scp.Policy = policy
+	}
+}
+
+// WithTCPForwarding makes the server accept the direct-tcpip channels, so
+// that it can be used as a jump host.
+func WithTCPForwarding() Option {
+	return func(s *Server) {
+		s.tcpForwarding = true
+	}
+}
+
+// SubsystemHandler serves a session of a subsystem over r and w, which are
+// the input and the output of the session.
+type SubsystemHandler func(ctx context.Context, r io.Reader, w io.Writer) error
+
+// WithSubsystem makes the server serve the subsystem name with handler,
+// for the code running scp over a subsystem. An error of handler makes
+// the exit status 1. By default, the subsystem requests are rejected.
+func WithSubsystem(name string, handler SubsystemHandler) Option {
+	return func(s *Server) {
+		if s.subsystems == nil {
+			s.subsystems = make(map[string]SubsystemHandler)
+		}
+		s.subsystems[name] = handler
+	}
+}
+
+// Server is an SSH server serving scp for tests.
+type Server struct {
+	// Addr is the address the server listens on, such as "127.0.0.1:12345".
+	Addr string
+	// Root is the temporary directory under which the scp requests are
+	// confined, so the remote path "/a/b" means Root/a/b. It is removed
+	// by Close.
+	Root string
+	// HostKey is the public host key of the server.
+	HostKey ssh.PublicKey
+
+	l      net.Listener
+	config *ssh.ServerConfig
+	scp    *server.Server
+	shell  string
+	// tcpForwarding is true if the direct-tcpip channels are accepted.
+	tcpForwarding bool
+	subsystems    map[string]SubsystemHandler
+	ctx           context.Context
+	cancel        context.CancelFunc
+	wg            sync.WaitGroup
+}
+
+// NewServer starts a server. The caller must call Close when done.
+func NewServer(opts ...Option) (*Server, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate host key: err=%w", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create host key signer: err=%w", err)
+	}
+	root, err := ioutil.TempDir("", "go-scp-scptest")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create root directory: err=%w", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.RemoveAll(root)
+		return nil, fmt.Errorf("failed to listen: err=%w", err)
+	}
+
+	s := &Server{
+		Addr:    l.Addr().String(),
+		Root:    root,
+		HostKey: signer.PublicKey(),
+		l:       l,
+		scp:     &server.Server{Root: root},
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.config = &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == User && string(pass) == Password {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %q", c.User())
+		},
+	}
+	s.config.AddHostKey(signer)
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// ClientConfig returns the configuration of a client authenticating with
+// User and Password and accepting HostKey only.
+func (s *Server) ClientConfig() *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            User,
+		Auth:            []ssh.AuthMethod{ssh.Password(Password)},
+		HostKeyCallback: ssh.FixedHostKey(s.HostKey),
+	}
+}
+
+// Dial connects a client to the server.
+func (s *Server) Dial() (*ssh.Client, error) {
+	return ssh.Dial("tcp", s.Addr, s.ClientConfig())
+}
+
+// Close stops the server, waits for the connections to end, and removes
+// Root.
+func (s *Server) Close() error {
+	err := s.l.Close()
+	s.cancel()
+	s.wg.Wait()
+	if rerr := os.RemoveAll(s.Root); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer s.wg.Done()
+	// The connection is closed when the server is closed, which makes
+	// the channels and the sessions end.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+	var wg sync.WaitGroup
+	for newChannel := range chans {
+		if newChannel.ChannelType() == "direct-tcpip" && s.tcpForwarding {
+			wg.Add(1)
+			go func(newChannel ssh.NewChannel) {
+				defer wg.Done()
+				s.handleDirectTCPIP(newChannel)
+			}(newChannel)
+			continue
+		}
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handleSession(sconn, channel, requests)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *Server) handleSession(conn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		switch req.Type {
+		case "env":
+			_ = req.Reply(true, nil)
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+			status := s.exec(conn, channel, payload.Command)
+			_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		case "subsystem":
+			var payload struct{ Name string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			handler, ok := s.subsystems[payload.Name]
+			if !ok {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+			var status uint32
+			if err := handler(s.ctx, channel, channel); err != nil {
+				fmt.Fprintln(channel.Stderr(), err)
+				status = 1
+			}
+			_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		default:
+			_ = req.Reply(false, nil)
+		}
+	}
+}
+
+// exec runs command over channel and returns the exit status.
+func (s *Server) exec(conn *ssh.ServerConn, channel ssh.Channel, command string) uint32 {
+	if server.IsCommand(command) {
+		req, err := server.ParseCommand(command)
+		if err != nil {
+			fmt.Fprintln(channel.Stderr(), err)
+			return 1
+		}
+		req.User = conn.User()
+		req.RemoteAddr = conn.RemoteAddr().String()
+		if err := s.scp.Serve(s.ctx, req, channel, channel); err != nil {
+			return 1
+		}
+		return 0
+	}
+	if s.shell == "" {
+		fmt.Fprintf(channel.Stderr(), "%s: command not found\n", command)
+		return 127
+	}
+	cmd := exec.CommandContext(s.ctx, s.shell, "-c", command)
+	cmd.Dir = s.Root
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+	// The input is copied without waiting for its end, since the client may
+	// not close it.
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		fmt.Fprintln(channel.Stderr(), err)
+		return 127
+	}
+	go func() {
+		_, _ = io.Copy(stdin, channel)
+		stdin.Close()
+	}()
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return uint32(exitErr.ExitCode())
+		}
+		fmt.Fprintln(channel.Stderr(), err)
+		return 127
+	}
+	return 0
+}
+
+// handleDirectTCPIP connects to the address requested by the channel and
+// copies the data in both directions.
+func (s *Server) handleDirectTCPIP(newChannel ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, "invalid payload")
+		return
+	}
+	addr := net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer conn.Close()
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(conn, channel)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(channel, conn)
+		done <- struct{}{}
+	}()
+	select {
+	case <-done:
+	case <-s.ctx.Done():
+	}
+}
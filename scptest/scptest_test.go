@@ -0,0 +1,94 @@
+// +build !windows
+
+package scptest
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	scp "github.com/ljun20160606/go-scp"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestServer(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatalf("fail to create server; %s", err)
+	}
+	defer s.Close()
+
+	c, err := s.Dial()
+	if err != nil {
+		t.Fatalf("fail to dial; %s", err)
+	}
+	defer c.Close()
+
+	localDir, err := ioutil.TempDir("", "go-scp-TestServer-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+	localPath := filepath.Join(localDir, "src.dat")
+	if err := ioutil.WriteFile(localPath, []byte("content\n"), 0644); err != nil {
+		t.Fatalf("fail to write local file; %s", err)
+	}
+
+	if err := scp.NewSCP(c).SendFile(localPath, "/dest.dat"); err != nil {
+		t.Fatalf("fail to send file; %s", err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(s.Root, "dest.dat")); err != nil || string(content) != "content\n" {
+		t.Errorf("file must be sent under the root. content:%q, err:%v", content, err)
+	}
+
+	gotPath := filepath.Join(localDir, "got.dat")
+	if err := scp.NewSCP(c).ReceiveFile("/../dest.dat", gotPath); err != nil {
+		t.Fatalf("fail to receive file; %s", err)
+	}
+	if content, err := ioutil.ReadFile(gotPath); err != nil || string(content) != "content\n" {
+		t.Errorf("unmatch received file. content:%q, err:%v", content, err)
+	}
+
+	sess, err := c.NewSession()
+	if err != nil {
+		t.Fatalf("fail to create session; %s", err)
+	}
+	defer sess.Close()
+	var exitErr *ssh.ExitError
+	if err := sess.Run("echo hello"); !errors.As(err, &exitErr) || exitErr.ExitStatus() != 127 {
+		t.Errorf("command other than scp must fail. got:%v", err)
+	}
+}
+
+func TestWithShell(t *testing.T) {
+	s, err := NewServer(WithShell("sh"))
+	if err != nil {
+		t.Fatalf("fail to create server; %s", err)
+	}
+	defer s.Close()
+
+	c, err := s.Dial()
+	if err != nil {
+		t.Fatalf("fail to dial; %s", err)
+	}
+	defer c.Close()
+
+	sess, err := c.NewSession()
+	if err != nil {
+		t.Fatalf("fail to create session; %s", err)
+	}
+	defer sess.Close()
+	out, err := sess.Output("pwd")
+	if err != nil {
+		t.Fatalf("fail to run command; %s", err)
+	}
+	root, err := filepath.EvalSymlinks(s.Root)
+	if err != nil {
+		t.Fatalf("fail to resolve root; %s", err)
+	}
+	if got, err := filepath.EvalSymlinks(string(out[:len(out)-1])); err != nil || got != root {
+		t.Errorf("command must run in the root. got:%q, want:%q", out, root)
+	}
+}
@@ -0,0 +1,177 @@
+package scpwire
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Source is the side of the protocol sending files to a sink, such as
+// the remote "scp -t". Each method waits for the reply of the sink and
+// returns an error reply as *RemoteError.
+type Source struct {
+	w io.Writer
+	r *bufio.Reader
+}
+
+// NewSource creates a Source writing to w, the standard input of the sink,
+// and reading the replies from r, its standard output. It reads the first
+// reply, which the sink sends when it is ready.
+func NewSource(w io.Writer, r io.Reader) (*Source, error) {
+	s := &Source{w: w, r: bufio.NewReader(r)}
+	return s, ReadReply(s.r)
+}
+
+// WriteTime writes the time message for the next file or directory.
+func (s *Source) WriteTime(mtime, atime time.Time) error {
+	if err := WriteTime(s.w, mtime, atime); err != nil {
+		return fmt.Errorf("failed to write scp time header: err=%w", err)
+	}
+	return ReadReply(s.r)
+}
+
+// WriteFile writes a file named name with size bytes read from body.
+func (s *Source) WriteFile(mode os.FileMode, size int64, name string, body io.Reader) error {
+	if err := WriteFileHeader(s.w, mode, size, name); err != nil {
+		return fmt.Errorf("failed to write scp file header: err=%w", err)
+	}
+	if err := ReadReply(s.r); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(s.w, body, size); err != nil {
+		return fmt.Errorf("failed to write scp file body: err=%w", err)
+	}
+	if err := WriteOK(s.w); err != nil {
+		return fmt.Errorf("failed to write scp replyOK reply: err=%w", err)
+	}
+	return ReadReply(s.r)
+}
+
+// StartDirectory starts a directory named name. The files and directories
+// written until the matching EndDirectory are created in it.
+func (s *Source) StartDirectory(mode os.FileMode, name string) error {
+	if err := WriteStartDirectory(s.w, mode, name); err != nil {
+		return fmt.Errorf("failed to write scp start directory header: err=%w", err)
+	}
+	return ReadReply(s.r)
+}
+
+// EndDirectory ends the current directory.
+func (s *Source) EndDirectory() error {
+	if err := WriteEndDirectory(s.w); err != nil {
+		return fmt.Errorf("failed to write scp end directory header: err=%w", err)
+	}
+	return ReadReply(s.r)
+}
+
+// WriteError writes an error reply, for example when a file to send cannot
+// be read. A fatal error aborts the transfer.
+func (s *Source) WriteError(msg string, fatal bool) error {
+	return WriteError(s.w, msg, fatal)
+}
+
+// bodyBufferSize is the size of the buffer copying the file bodies.
+const bodyBufferSize = 32 * 1024
+
+// Sink is the side of the protocol receiving files from a source, such as
+// the remote "scp -f".
+type Sink struct {
+	w io.Writer
+	r *bufio.Reader
+}
+
+// NewSink creates a Sink writing the replies to w, the standard input of
+// the source, and reading the messages from r, its standard output. It
+// writes the first reply, which makes the source start sending.
+func NewSink(w io.Writer, r io.Reader) (*Sink, error) {
+	s := &Sink{w: w, r: bufio.NewReader(r)}
+	if err := WriteOK(s.w); err != nil {
+		return nil, fmt.Errorf("failed to write scp replyOK reply: err=%w", err)
+	}
+	return s, nil
+}
+
+// ReadMessage reads the next message and replies OK to it. It returns one
+// of TimeMsgHeader, FileMsgHeader, StartDirectoryMsgHeader and
+// EndDirectoryMsgHeader, and io.EOF after the last message. The body of
+// a FileMsgHeader must be read with CopyBody or CopyBodyN before the next
+// message. An error reply of the source is returned as *RemoteError.
+func (s *Sink) ReadMessage() (interface{}, error) {
+	for {
+		h, err := ReadMessage(s.r)
+		if err != nil {
+			if rerr, ok := err.(*RemoteError); ok && !rerr.Fatal {
+				// The source may have exited after the error, so the error
+				// of the reply is ignored in favor of the remote error.
+				_ = WriteOK(s.w)
+			}
+			return nil, err
+		}
+		if _, ok := h.(OKMsg); ok {
+			continue
+		}
+		if err := WriteOK(s.w); err != nil {
+			return nil, fmt.Errorf("failed to write scp replyOK reply: err=%w", err)
+		}
+		return h, nil
+	}
+}
+
+// CopyBody copies the body of the file of h, which is the header returned
+// by the last ReadMessage, to w.
+func (s *Sink) CopyBody(h FileMsgHeader, w io.Writer) error {
+	return s.CopyBodyN(h, w, h.Size)
+}
+
+// CopyBodyN copies the first n bytes of the body of the file of h, which is
+// the header returned by the last ReadMessage, to w, and discards the rest.
+// Since the protocol has no way to skip a body, the whole body is still
+// transferred. If writing to w fails, the rest of the body is discarded and
+// the error is replied to the source, which keeps the session usable for
+// the next messages.
+func (s *Sink) CopyBodyN(h FileMsgHeader, w io.Writer, n int64) error {
+	buf := make([]byte, bodyBufferSize)
+	var read, copied int64
+	var werr error
+	for read < h.Size {
+		chunk := int64(len(buf))
+		if rest := h.Size - read; rest < chunk {
+			chunk = rest
+		}
+		m, err := s.r.Read(buf[:chunk])
+		if werr == nil && copied < n {
+			k := int64(m)
+			if rest := n - copied; rest < k {
+				k = rest
+			}
+			if _, werr = w.Write(buf[:k]); werr == nil {
+				copied += k
+			}
+		}
+		read += int64(m)
+		if err == io.EOF && read < h.Size {
+			return fmt.Errorf("unexpected EOF in file body: err=%w", io.ErrUnexpectedEOF)
+		} else if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read file body: err=%w", err)
+		}
+	}
+	if err := ReadReply(s.r); err != nil {
+		return err
+	}
+	if werr != nil {
+		_ = WriteError(s.w, fmt.Sprintf("scp: %s: %s", h.Name, werr), false)
+		return fmt.Errorf("failed to write file body: err=%w", werr)
+	}
+	if err := WriteOK(s.w); err != nil {
+		return fmt.Errorf("failed to write scp replyOK reply: err=%w", err)
+	}
+	return nil
+}
+
+// WriteError writes an error reply, for example when a received file
+// cannot be written. A fatal error aborts the transfer.
+func (s *Sink) WriteError(msg string, fatal bool) error {
+	return WriteError(s.w, msg, fatal)
+}
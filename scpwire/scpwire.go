@@ -0,0 +1,281 @@
+// Package scpwire implements the messages and the replies of the scp
+// protocol, for building custom flows over an scp session, such as reading
+// only a part of the files or writing them to a custom sink, when the flows
+// of the scp package do not fit. Source and Sink run the two sides of
+// the protocol over the standard input and output of a remote scp, and
+// the functions writing and reading the messages can be used for flows
+// which need more control.
+package scpwire
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// The types of the messages.
+const (
+	MsgCopyFile       = 'C'
+	MsgStartDirectory = 'D'
+	MsgEndDirectory   = 'E'
+	MsgTime           = 'T'
+)
+
+// The types of the replies.
+const (
+	ReplyOK         = '\x00'
+	ReplyError      = '\x01'
+	ReplyFatalError = '\x02'
+)
+
+// TimeMsgHeader is the time message, which is sent before the file or
+// directory message it applies to.
+type TimeMsgHeader struct {
+	Mtime time.Time
+	Atime time.Time
+}
+
+// StartDirectoryMsgHeader is the message starting a directory.
+type StartDirectoryMsgHeader struct {
+	Mode os.FileMode
+	Name string
+}
+
+// EndDirectoryMsgHeader is the message ending the current directory.
+type EndDirectoryMsgHeader struct{}
+
+// FileMsgHeader is the message of a file, which is followed by Size bytes
+// of the body.
+type FileMsgHeader struct {
+	Mode os.FileMode
+	Size int64
+	Name string
+}
+
+// OKMsg is an OK reply read by ReadMessage.
+type OKMsg struct{}
+
+// RemoteError is an error reply sent by the peer scp, such as
+// "scp: /foo: No such file or directory". errors.Is reports whether it is
+// os.ErrNotExist or os.ErrPermission from the message.
+type RemoteError struct {
+	// Msg is the message of the reply.
+	Msg string
+	// Fatal is true if the peer aborted the transfer.
+	Fatal bool
+}
+
+func (e *RemoteError) Error() string { return e.Msg }
+
+// Is reports whether the reply means target.
+func (e *RemoteError) Is(target error) bool {
+	switch target {
+	case os.ErrNotExist:
+		return strings.Contains(e.Msg, "No such file or directory")
+	case os.ErrPermission:
+		return strings.Contains(e.Msg, "Permission denied")
+	}
+	return false
+}
+
+// ProtocolError is returned when the peer sends a message which does not
+// follow the scp protocol.
+type ProtocolError struct {
+	Msg string
+}
+
+func (e *ProtocolError) Error() string { return "scp: protocol error: " + e.Msg }
+
+// Unix mode bits of setuid, setgid and sticky in the file and directory
+// messages.
+const (
+	unixModeSetuid = 04000
+	unixModeSetgid = 02000
+	unixModeSticky = 01000
+)
+
+// ToUnixMode returns the Unix mode bits of the permission of mode.
+func ToUnixMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= unixModeSetuid
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= unixModeSetgid
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= unixModeSticky
+	}
+	return m
+}
+
+// FromUnixMode returns the os.FileMode of the Unix mode bits m.
+func FromUnixMode(m uint32) os.FileMode {
+	mode := os.FileMode(m).Perm()
+	if m&unixModeSetuid != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&unixModeSetgid != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&unixModeSticky != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+func toSecondsAndMicroseconds(t time.Time) (seconds int64, microseconds int) {
+	rounded := t.Round(time.Microsecond)
+	return rounded.Unix(), rounded.Nanosecond() / int(int64(time.Microsecond)/int64(time.Nanosecond))
+}
+
+func fromSecondsAndMicroseconds(seconds int64, microseconds int) time.Time {
+	return time.Unix(seconds, int64(microseconds)*(int64(time.Microsecond)/int64(time.Nanosecond)))
+}
+
+// WriteTime writes the time message.
+func WriteTime(w io.Writer, mtime, atime time.Time) error {
+	ms, mus := toSecondsAndMicroseconds(mtime)
+	as, aus := toSecondsAndMicroseconds(atime)
+	_, err := fmt.Fprintf(w, "%c%d %d %d %d\n", MsgTime, ms, mus, as, aus)
+	return err
+}
+
+// WriteFileHeader writes the message of a file, which must be followed by
+// size bytes of the body.
+func WriteFileHeader(w io.Writer, mode os.FileMode, size int64, name string) error {
+	_, err := fmt.Fprintf(w, "%c%04o %d %s\n", MsgCopyFile, ToUnixMode(mode), size, name)
+	return err
+}
+
+// WriteStartDirectory writes the message starting a directory.
+func WriteStartDirectory(w io.Writer, mode os.FileMode, name string) error {
+	// The length is not used.
+	_, err := fmt.Fprintf(w, "%c%04o %d %s\n", MsgStartDirectory, ToUnixMode(mode), 0, name)
+	return err
+}
+
+// WriteEndDirectory writes the message ending the current directory.
+func WriteEndDirectory(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "%c\n", MsgEndDirectory)
+	return err
+}
+
+// WriteOK writes an OK reply.
+func WriteOK(w io.Writer) error {
+	_, err := w.Write([]byte{ReplyOK})
+	return err
+}
+
+// WriteError writes an error reply with msg. A fatal error aborts
+// the transfer.
+func WriteError(w io.Writer, msg string, fatal bool) error {
+	b := byte(ReplyError)
+	if fatal {
+		b = ReplyFatalError
+	}
+	_, err := fmt.Fprintf(w, "%c%s\n", b, strings.TrimRight(msg, "\n"))
+	return err
+}
+
+// ReadReply reads a reply. An error reply is returned as *RemoteError.
+func ReadReply(r *bufio.Reader) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("failed to read scp reply type: err=%w", err)
+	}
+	if b == ReplyOK {
+		return nil
+	}
+	if b != ReplyError && b != ReplyFatalError {
+		return &ProtocolError{Msg: fmt.Sprintf("unexpected scp reply type: %v", b)}
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read scp reply message: err=%w", err)
+	}
+	return &RemoteError{
+		Msg:   strings.TrimSuffix(line, "\n"),
+		Fatal: b == ReplyFatalError,
+	}
+}
+
+// ReadMessage reads a message or a reply without writing a reply. It
+// returns one of TimeMsgHeader, FileMsgHeader, StartDirectoryMsgHeader,
+// EndDirectoryMsgHeader and OKMsg. An error reply is returned as
+// *RemoteError, and io.EOF is returned as is at the end of the input.
+func ReadMessage(r *bufio.Reader) (interface{}, error) {
+	b, err := r.ReadByte()
+	if err == io.EOF {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read scp message type: err=%w", err)
+	}
+	switch b {
+	case MsgCopyFile:
+		var h FileMsgHeader
+		var mode uint32
+		n, err := fmt.Fscanf(r, "%04o %d %s\n", &mode, &h.Size, &h.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read scp file message header: err=%w", err)
+		}
+		if n != 3 {
+			return nil, &ProtocolError{Msg: fmt.Sprintf("unexpected count in reading file message header: n=%d", n)}
+		}
+		h.Mode = FromUnixMode(mode)
+		return h, nil
+	case MsgStartDirectory:
+		var h StartDirectoryMsgHeader
+		var mode uint32
+		var dummySize int64
+		n, err := fmt.Fscanf(r, "%04o %d %s\n", &mode, &dummySize, &h.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read scp start directory message header: err=%w", err)
+		}
+		if n != 3 {
+			return nil, &ProtocolError{Msg: fmt.Sprintf("unexpected count in reading start directory message header: n=%d", n)}
+		}
+		h.Mode = FromUnixMode(mode)
+		return h, nil
+	case MsgEndDirectory:
+		_, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("failed to read scp end directory message: err=%w", err)
+		}
+		return EndDirectoryMsgHeader{}, nil
+	case MsgTime:
+		var ms int64
+		var mus int
+		var as int64
+		var aus int
+		n, err := fmt.Fscanf(r, "%d %d %d %d\n", &ms, &mus, &as, &aus)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read scp time message header: err=%w", err)
+		}
+		if n != 4 {
+			return nil, &ProtocolError{Msg: fmt.Sprintf("unexpected count in reading time message header: n=%d", n)}
+		}
+
+		h := TimeMsgHeader{
+			Mtime: fromSecondsAndMicroseconds(ms, mus),
+			Atime: fromSecondsAndMicroseconds(as, aus),
+		}
+		return h, nil
+	case ReplyOK:
+		return OKMsg{}, nil
+	case ReplyError, ReplyFatalError:
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("failed to read scp reply error message: err=%w", err)
+		}
+		return nil, &RemoteError{
+			Msg:   strings.TrimSuffix(line, "\n"),
+			Fatal: b == ReplyFatalError,
+		}
+	default:
+		return nil, &ProtocolError{Msg: fmt.Sprintf("invalid scp message type: %v", b)}
+	}
+}
@@ -0,0 +1,164 @@
+package scpwire
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newPipes returns a Source and a Sink connected with pipes. The Sink is
+// created in a goroutine since NewSource waits for its first reply.
+func newPipes(t *testing.T) (*Source, *Sink) {
+	// The messages flow from the source to the sink, and the replies flow
+	// back.
+	messagesR, messagesW := io.Pipe()
+	repliesR, repliesW := io.Pipe()
+	sinkc := make(chan *Sink, 1)
+	go func() {
+		sink, err := NewSink(repliesW, messagesR)
+		if err != nil {
+			t.Errorf("fail to create sink; %s", err)
+		}
+		sinkc <- sink
+	}()
+	source, err := NewSource(messagesW, repliesR)
+	if err != nil {
+		t.Fatalf("fail to create source; %s", err)
+	}
+	return source, <-sinkc
+}
+
+func TestSourceAndSink(t *testing.T) {
+	source, sink := newPipes(t)
+	mtime := time.Unix(1600000000, 123456000)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- func() error {
+			if err := source.WriteTime(mtime, mtime); err != nil {
+				return err
+			}
+			if err := source.StartDirectory(0755, "dir"); err != nil {
+				return err
+			}
+			if err := source.WriteFile(0644, 8, "file1", strings.NewReader("content\n")); err != nil {
+				return err
+			}
+			if err := source.WriteFile(0600, 8, "file2", strings.NewReader("content\n")); err != nil {
+				return err
+			}
+			return source.EndDirectory()
+		}()
+	}()
+
+	var got []interface{}
+	var bodies []string
+	for i := 0; i < 5; i++ {
+		h, err := sink.ReadMessage()
+		if err != nil {
+			t.Fatalf("fail to read message; %s", err)
+		}
+		got = append(got, h)
+		if fh, ok := h.(FileMsgHeader); ok {
+			var body bytes.Buffer
+			// Read a part of the second file only.
+			n := fh.Size
+			if fh.Name == "file2" {
+				n = 4
+			}
+			if err := sink.CopyBodyN(fh, &body, n); err != nil {
+				t.Fatalf("fail to copy body; %s", err)
+			}
+			bodies = append(bodies, body.String())
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("fail to send; %s", err)
+	}
+
+	want := []interface{}{
+		TimeMsgHeader{Mtime: mtime, Atime: mtime},
+		StartDirectoryMsgHeader{Mode: 0755, Name: "dir"},
+		FileMsgHeader{Mode: 0644, Size: 8, Name: "file1"},
+		FileMsgHeader{Mode: 0600, Size: 8, Name: "file2"},
+		EndDirectoryMsgHeader{},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unmatch messages.\ngot: %+v\nwant:%+v", got, want)
+	}
+	if want := []string{"content\n", "cont"}; !reflect.DeepEqual(bodies, want) {
+		t.Errorf("unmatch bodies. got:%q, want:%q", bodies, want)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, os.ErrPermission }
+
+func TestSinkError(t *testing.T) {
+	source, sink := newPipes(t)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- source.WriteFile(0644, 8, "file1", strings.NewReader("content\n"))
+	}()
+	h, err := sink.ReadMessage()
+	if err != nil {
+		t.Fatalf("fail to read message; %s", err)
+	}
+	if err := sink.CopyBody(h.(FileMsgHeader), failingWriter{}); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("unmatch error of CopyBody. got:%v, want:%v", err, os.ErrPermission)
+	}
+	err = <-errc
+	var rerr *RemoteError
+	if !errors.As(err, &rerr) || rerr.Fatal || rerr.Msg != "scp: file1: permission denied" {
+		t.Errorf("unmatch error of WriteFile. got:%#v", err)
+	}
+
+	// The session is still usable after the error.
+	go func() {
+		errc <- source.WriteFile(0644, 8, "file2", strings.NewReader("content\n"))
+	}()
+	h, err = sink.ReadMessage()
+	if err != nil {
+		t.Fatalf("fail to read message; %s", err)
+	}
+	var body bytes.Buffer
+	if err := sink.CopyBody(h.(FileMsgHeader), &body); err != nil {
+		t.Fatalf("fail to copy body; %s", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("fail to send; %s", err)
+	}
+	if body.String() != "content\n" {
+		t.Errorf("unmatch body. got:%q, want:%q", body.String(), "content\n")
+	}
+}
+
+func TestUnixMode(t *testing.T) {
+	testCases := []struct {
+		mode os.FileMode
+		want string
+	}{
+		{mode: 0644, want: "0644"},
+		{mode: 0755 | os.ModeSetuid, want: "4755"},
+		{mode: 0775 | os.ModeSetgid, want: "2775"},
+		{mode: 0777 | os.ModeSticky, want: "1777"},
+		{mode: 0750 | os.ModeSetuid | os.ModeSetgid | os.ModeSticky, want: "7750"},
+	}
+	for _, tc := range testCases {
+		got := fmt.Sprintf("%04o", ToUnixMode(tc.mode))
+		if got != tc.want {
+			t.Errorf("unmatch Unix mode for %s. got:%s, want:%s", tc.mode, got, tc.want)
+		}
+		if back := FromUnixMode(ToUnixMode(tc.mode)); back != tc.mode {
+			t.Errorf("unmatch mode after round trip. got:%s, want:%s", back, tc.mode)
+		}
+	}
+}
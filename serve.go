@@ -0,0 +1,73 @@
+package scp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ljun20160606/go-scp/server"
+)
+
+// Direction is the direction of a transfer or of a request served by
+// ServeStdio.
+type Direction = server.Direction
+
+const (
+	// DirectionUpload is a request to write files on the server (scp -t).
+	DirectionUpload = server.DirectionUpload
+	// DirectionDownload is a request to read files on the server (scp -f).
+	DirectionDownload = server.DirectionDownload
+)
+
+// ServeRequest describes an scp request served by ServeStdio.
+type ServeRequest = server.Request
+
+// Policy decides whether requests served by ServeStdio are allowed.
+// RestrictedPolicy implements the common restrictions.
+type Policy = server.Policy
+
+// ErrInvalidCommand is returned when the scp command line to serve is invalid.
+var ErrInvalidCommand = server.ErrInvalidCommand
+
+// ServeStdio serves an scp request over stdin and stdout, so that a Go program
+// can be used as an SSH ForceCommand acting as a locked-down scp endpoint.
+// The command line is taken from the SSH_ORIGINAL_COMMAND environment variable,
+// or from the first line of stdin if the variable is empty, which is the
+// convention of WithSubsystem. Both the sink (scp -t) and the source (scp -f)
+// sides are supported. All the paths are confined under root, so an absolute
+// path "/a/b" means root/a/b. The policy may be nil to allow all requests.
+func ServeStdio(ctx context.Context, stdin io.Reader, stdout io.Writer, root string, policy Policy) error {
+	r := bufio.NewReader(stdin)
+	cmdline := os.Getenv("SSH_ORIGINAL_COMMAND")
+	if cmdline == "" {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("failed to read command line: err=%w", err)
+		}
+		cmdline = strings.TrimRight(line, "\r\n")
+	}
+	req, err := ParseCommand(cmdline)
+	if err != nil {
+		return err
+	}
+	req.User = os.Getenv("USER")
+	if fields := strings.Fields(os.Getenv("SSH_CLIENT")); len(fields) >= 2 {
+		req.RemoteAddr = fields[0] + ":" + fields[1]
+	}
+	return Serve(ctx, req, r, stdout, root, policy)
+}
+
+// ParseCommand parses an scp command line such as "scp -t -- '/path'" into
+// a request. Only the flags used by scp for the remote side are supported.
+func ParseCommand(cmdline string) (*ServeRequest, error) {
+	return server.ParseCommand(cmdline)
+}
+
+// Serve serves the parsed request over r and w. See ServeStdio for the details.
+func Serve(ctx context.Context, req *ServeRequest, r io.Reader, w io.Writer, root string, policy Policy) error {
+	s := &server.Server{Root: root, Policy: policy}
+	return s.Serve(ctx, req, r, w)
+}
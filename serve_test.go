@@ -0,0 +1,273 @@
+// +build !windows
+
+package scp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ljun20160606/go-scp/scptest"
+)
+
+func TestParseCommand(t *testing.T) {
+	req, err := ParseCommand(`scp -tpr -- '/tmp/it'\''s dir'`)
+	if err != nil {
+		t.Fatalf("fail to parse command; %s", err)
+	}
+	want := &ServeRequest{
+		Direction: DirectionUpload,
+		Paths:     []string{"/tmp/it's dir"},
+		Recursive: true,
+		Preserve:  true,
+	}
+	if !reflect.DeepEqual(req, want) {
+		t.Errorf("unmatch request. got:%+v, want:%+v", req, want)
+	}
+
+	for _, cmdline := range []string{"ls -l", "scp /tmp", "scp -t", "scp -tf /tmp"} {
+		if _, err := ParseCommand(cmdline); err == nil {
+			t.Errorf("invalid command line %q must be rejected", cmdline)
+		}
+	}
+}
+
+// serveTestPipes starts Serve for req and returns the pipes for the client side.
+// OS pipes are used, since the source protocol writes a file body before
+// reading the reply for its header.
+func serveTestPipes(t *testing.T, req *ServeRequest, root string, policy Policy) (io.WriteCloser, io.Reader, <-chan error) {
+	clientR, serverW, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("fail to create pipe; %s", err)
+	}
+	serverR, clientW, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("fail to create pipe; %s", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		err := Serve(context.Background(), req, serverR, serverW, root, policy)
+		serverW.Close()
+		done <- err
+	}()
+	return clientW, clientR, done
+}
+
+func TestServe(t *testing.T) {
+	t.Run("upload", func(t *testing.T) {
+		root, err := ioutil.TempDir("", "go-scp-TestServe-root")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(root)
+
+		localDir, err := ioutil.TempDir("", "go-scp-TestServe-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		localName := "test1.dat"
+		localPath := filepath.Join(localDir, localName)
+		if err := generateRandomFile(localPath); err != nil {
+			t.Fatalf("fail to generate local file; %s", err)
+		}
+
+		req := &ServeRequest{Direction: DirectionUpload, Paths: []string{"/"}, Preserve: true}
+		w, r, done := serveTestPipes(t, req, root, nil)
+		p, err := newSourceProtocol(w, r)
+		if err != nil {
+			t.Fatalf("fail to start protocol; %s", err)
+		}
+		osFileInfo, err := os.Stat(localPath)
+		if err != nil {
+			t.Fatalf("fail to stat local file; %s", err)
+		}
+		file, err := os.Open(localPath)
+		if err != nil {
+			t.Fatalf("fail to open local file; %s", err)
+		}
+		if err := p.WriteFile(NewFileInfoFromOS(osFileInfo, ""), file); err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+		w.Close()
+		if err := <-done; err != nil {
+			t.Errorf("fail to serve; %s", err)
+		}
+		sameFileInfoAndContent(t, root, localDir, localName, localName)
+	})
+
+	t.Run("download", func(t *testing.T) {
+		root, err := ioutil.TempDir("", "go-scp-TestServe-root")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(root)
+
+		remoteName := "src.dat"
+		if err := generateRandomFile(filepath.Join(root, remoteName)); err != nil {
+			t.Fatalf("fail to generate remote file; %s", err)
+		}
+		localDir, err := ioutil.TempDir("", "go-scp-TestServe-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		req := &ServeRequest{Direction: DirectionDownload, Paths: []string{"/../" + remoteName}, Preserve: true}
+		w, r, done := serveTestPipes(t, req, root, nil)
+		p, err := newResourceProtocol(w, r)
+		if err != nil {
+			t.Fatalf("fail to start protocol; %s", err)
+		}
+		h, err := p.ReadHeaderOrReply()
+		if err != nil {
+			t.Fatalf("fail to read header; %s", err)
+		}
+		timeHeader := h.(TimeMsgHeader)
+		h, err = p.ReadHeaderOrReply()
+		if err != nil {
+			t.Fatalf("fail to read header; %s", err)
+		}
+		fileHeader := h.(FileMsgHeader)
+		localPath := filepath.Join(localDir, fileHeader.Name)
+		file, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE, fileHeader.Mode)
+		if err != nil {
+			t.Fatalf("fail to open local file; %s", err)
+		}
+		if err := p.CopyFileBodyTo(fileHeader, file); err != nil {
+			t.Fatalf("fail to copy body; %s", err)
+		}
+		file.Close()
+		if err := os.Chtimes(localPath, timeHeader.Atime, timeHeader.Mtime); err != nil {
+			t.Fatalf("fail to change times; %s", err)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("fail to serve; %s", err)
+		}
+		w.Close()
+		sameFileInfoAndContent(t, localDir, root, remoteName, remoteName)
+	})
+}
+
+func TestServeStdioSubsystem(t *testing.T) {
+	if os.Getenv("SSH_ORIGINAL_COMMAND") != "" {
+		t.Skip("SSH_ORIGINAL_COMMAND is set")
+	}
+	root, err := ioutil.TempDir("", "go-scp-TestServeStdioSubsystem-root")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	var mu sync.Mutex
+	var firstLines []string
+	handler := func(ctx context.Context, r io.Reader, w io.Writer) error {
+		// The first line of the input is recorded while ServeStdio reads it.
+		var input bytes.Buffer
+		err := ServeStdio(ctx, io.TeeReader(r, &input), w, root, nil)
+		line, _ := input.ReadString('\n')
+		mu.Lock()
+		firstLines = append(firstLines, line)
+		mu.Unlock()
+		return err
+	}
+	srv, err := scptest.NewServer(scptest.WithSubsystem("scp", handler))
+	if err != nil {
+		t.Fatalf("fail to create test server; %s", err)
+	}
+	defer srv.Close()
+	client, err := srv.Dial()
+	if err != nil {
+		t.Fatalf("fail to dial; %s", err)
+	}
+	defer client.Close()
+
+	localDir, err := ioutil.TempDir("", "go-scp-TestServeStdioSubsystem-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+	localName := "test1.dat"
+	if err := generateRandomFile(filepath.Join(localDir, localName)); err != nil {
+		t.Fatalf("fail to generate local file; %s", err)
+	}
+
+	s := NewSCP(client, WithSubsystem("scp"))
+	if err := s.SendFile(filepath.Join(localDir, localName), "/"+localName); err != nil {
+		t.Fatalf("fail to SendFile; %s", err)
+	}
+	sameFileInfoAndContent(t, root, localDir, localName, localName)
+	gotName := "got.dat"
+	if err := s.ReceiveFile("/"+localName, filepath.Join(localDir, gotName)); err != nil {
+		t.Fatalf("fail to ReceiveFile; %s", err)
+	}
+	sameFileInfoAndContent(t, localDir, root, gotName, localName)
+	if err := NewSCP(client, WithSubsystem("no-such-subsystem")).SendFile(filepath.Join(localDir, localName), "/"+localName); err == nil {
+		t.Errorf("SendFile must fail for unknown subsystem")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(firstLines) != 2 || !strings.HasPrefix(firstLines[0], "scp -t") || !strings.HasPrefix(firstLines[1], "scp -f") {
+		t.Fatalf("command lines must come first. got:%q", firstLines)
+	}
+	for _, line := range firstLines {
+		if !strings.HasSuffix(line, " '/"+localName+"'\n") {
+			t.Errorf("command line must end with the path and a newline. got:%q", line)
+		}
+	}
+}
+
+func TestRestrictedPolicy(t *testing.T) {
+	policy := &RestrictedPolicy{
+		AllowedPrefixes: []string{"/incoming"},
+		Access:          AccessWriteOnly,
+		MaxSize:         1024,
+		AllowedUsers:    []string{"alice"},
+	}
+	upload := func(user, path string) *ServeRequest {
+		return &ServeRequest{Direction: DirectionUpload, Paths: []string{path}, User: user}
+	}
+
+	testCases := []struct {
+		name    string
+		req     *ServeRequest
+		allowed bool
+	}{
+		{"allowed", upload("alice", "/incoming/a.dat"), true},
+		{"prefix itself", upload("alice", "incoming"), true},
+		{"unknown user", upload("bob", "/incoming/a.dat"), false},
+		{"outside prefix", upload("alice", "/incoming2/a.dat"), false},
+		{"escape prefix", upload("alice", "/incoming/../etc"), false},
+		{"download", &ServeRequest{Direction: DirectionDownload, Paths: []string{"/incoming/a.dat"}, User: "alice"}, false},
+	}
+	for _, tc := range testCases {
+		err := policy.CheckRequest(tc.req)
+		if tc.allowed && err != nil {
+			t.Errorf("%s: request must be allowed; %s", tc.name, err)
+		} else if !tc.allowed && !errors.Is(err, ErrPolicyDenied) {
+			t.Errorf("%s: request must be denied. got:%v", tc.name, err)
+		}
+	}
+
+	req := upload("alice", "/incoming")
+	if err := policy.CheckFile(req, "incoming/a.dat", NewFileInfo("a.dat", 1024, 0644, time.Time{}, time.Time{})); err != nil {
+		t.Errorf("file within the size limit must be allowed; %s", err)
+	}
+	if err := policy.CheckFile(req, "incoming/a.dat", NewFileInfo("a.dat", 1025, 0644, time.Time{}, time.Time{})); !errors.Is(err, ErrPolicyDenied) {
+		t.Errorf("file over the size limit must be denied. got:%v", err)
+	}
+	if err := policy.CheckFile(req, "other/a.dat", NewFileInfo("a.dat", 1, 0644, time.Time{}, time.Time{})); !errors.Is(err, ErrPolicyDenied) {
+		t.Errorf("file outside the prefixes must be denied. got:%v", err)
+	}
+}
@@ -0,0 +1,18 @@
+package server
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// accessTime returns the access time of fi, or its modification time if
+// the access time is not available.
+func accessTime(fi os.FileInfo) time.Time {
+	sysStat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.ModTime()
+	}
+	sec, nsec := sysStat.Atim.Unix()
+	return time.Unix(sec, nsec)
+}
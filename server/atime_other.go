@@ -0,0 +1,14 @@
+// +build !linux,!darwin,!windows
+
+package server
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime returns the modification time of fi, since the access time is
+// not read on this platform.
+func accessTime(fi os.FileInfo) time.Time {
+	return fi.ModTime()
+}
@@ -0,0 +1,17 @@
+package server
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// accessTime returns the access time of fi, or its modification time if
+// the access time is not available.
+func accessTime(fi os.FileInfo) time.Time {
+	sysStat, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return fi.ModTime()
+	}
+	return time.Unix(0, sysStat.LastAccessTime.Nanoseconds())
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ReadFS is a filesystem which a Server reads the downloaded files and
+// directories from, such as an in-memory filesystem or an object storage.
+// The names are slash separated paths relative to the served root, and
+// the root itself is ".", as in io/fs. IOFS adapts an fs.FS to ReadFS.
+type ReadFS interface {
+	Open(name string) (io.ReadCloser, error)
+	Stat(name string) (os.FileInfo, error)
+	// ReadDir returns the entries of the directory without following
+	// the symbolic links.
+	ReadDir(name string) ([]os.FileInfo, error)
+}
+
+// WriteFS is a filesystem which a Server writes the uploaded files and
+// directories to. The names are as in ReadFS. Stat is used to decide
+// whether the target of an upload is a directory.
+type WriteFS interface {
+	Stat(name string) (os.FileInfo, error)
+	MkdirAll(name string, perm os.FileMode) error
+	OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error)
+	Chtimes(name string, atime, mtime time.Time) error
+	Chmod(name string, mode os.FileMode) error
+}
+
+// osFS is the ReadFS and the WriteFS of the local directory root.
+type osFS struct {
+	root string
+}
+
+// path returns the local path of name. Since the paths are confined in
+// root only lexically, the path is resolved through the symbolic links and
+// rejected with os.ErrPermission if it leads out of root.
+func (fsys osFS) path(op, name string) (string, error) {
+	root, err := filepath.EvalSymlinks(fsys.root)
+	if err != nil {
+		return "", &os.PathError{Op: op, Path: name, Err: err}
+	}
+	resolved, err := evalSymlinks(filepath.Join(root, filepath.FromSlash(name)))
+	if err != nil {
+		return "", &os.PathError{Op: op, Path: name, Err: err}
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+	}
+	return resolved, nil
+}
+
+// evalSymlinks is filepath.EvalSymlinks for a path whose last elements may
+// not exist yet, such as the target of an upload. A dangling symbolic link
+// is rejected with os.ErrPermission, since creating the file would follow
+// it.
+func evalSymlinks(p string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(p)
+	if err == nil || !os.IsNotExist(err) {
+		return resolved, err
+	}
+	if _, lerr := os.Lstat(p); lerr == nil {
+		return "", os.ErrPermission
+	}
+	parent := filepath.Dir(p)
+	if parent == p {
+		return "", err
+	}
+	resolvedParent, err := evalSymlinks(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolvedParent, filepath.Base(p)), nil
+}
+
+func (fsys osFS) Open(name string) (io.ReadCloser, error) {
+	p, err := fsys.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (fsys osFS) Stat(name string) (os.FileInfo, error) {
+	p, err := fsys.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (fsys osFS) ReadDir(name string) ([]os.FileInfo, error) {
+	p, err := fsys.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadDir(p)
+}
+
+func (fsys osFS) MkdirAll(name string, perm os.FileMode) error {
+	p, err := fsys.path("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, perm)
+}
+
+func (fsys osFS) OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error) {
+	p, err := fsys.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, flag, perm)
+}
+
+func (fsys osFS) Chtimes(name string, atime, mtime time.Time) error {
+	p, err := fsys.path("chtimes", name)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(p, atime, mtime)
+}
+
+func (fsys osFS) Chmod(name string, mode os.FileMode) error {
+	p, err := fsys.path("chmod", name)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(p, mode)
+}
@@ -0,0 +1,137 @@
+// +build go1.16,!windows
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/ljun20160606/go-scp/scpwire"
+)
+
+// memWriteFS is a WriteFS keeping the files in memory.
+type memWriteFS struct {
+	files map[string]*bytes.Buffer
+	dirs  map[string]bool
+}
+
+type memFile struct {
+	*bytes.Buffer
+}
+
+func (memFile) Close() error { return nil }
+
+func (fsys *memWriteFS) Stat(name string) (os.FileInfo, error) {
+	if fsys.dirs[name] {
+		return &entryInfo{name: path.Base(name), mode: os.ModeDir | 0755}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func (fsys *memWriteFS) MkdirAll(name string, perm os.FileMode) error {
+	fsys.dirs[name] = true
+	return nil
+}
+
+func (fsys *memWriteFS) OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error) {
+	if !fsys.dirs[path.Dir(name)] {
+		return nil, os.ErrNotExist
+	}
+	buf := &bytes.Buffer{}
+	fsys.files[name] = buf
+	return memFile{buf}, nil
+}
+
+func (fsys *memWriteFS) Chtimes(name string, atime, mtime time.Time) error { return nil }
+
+func (fsys *memWriteFS) Chmod(name string, mode os.FileMode) error { return nil }
+
+func TestServerFS(t *testing.T) {
+	t.Run("read", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"dir/file": &fstest.MapFile{Data: []byte("content\n"), Mode: 0644},
+		}
+		w, r, done := serveTestPipes(&Server{ReadFS: IOFS(fsys)}, "scp -fr /dir")
+		sink, err := scpwire.NewSink(w, r)
+		if err != nil {
+			t.Fatalf("fail to start sink; %s", err)
+		}
+		var got []interface{}
+		var body bytes.Buffer
+		for {
+			h, err := sink.ReadMessage()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("fail to read message; %s", err)
+			}
+			if fh, ok := h.(scpwire.FileMsgHeader); ok {
+				if err := sink.CopyBody(fh, &body); err != nil {
+					t.Fatalf("fail to copy body; %s", err)
+				}
+			}
+			got = append(got, h)
+		}
+		w.Close()
+		if err := <-done; err != nil {
+			t.Errorf("fail to serve; %s", err)
+		}
+		want := []interface{}{
+			scpwire.StartDirectoryMsgHeader{Mode: 0555, Name: "dir"},
+			scpwire.FileMsgHeader{Mode: 0644, Size: 8, Name: "file"},
+			scpwire.EndDirectoryMsgHeader{},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("unmatch messages. got:%+v, want:%+v", got, want)
+		}
+		if body.String() != "content\n" {
+			t.Errorf("unmatch content. got:%q", body.String())
+		}
+	})
+
+	t.Run("write", func(t *testing.T) {
+		fsys := &memWriteFS{files: map[string]*bytes.Buffer{}, dirs: map[string]bool{".": true}}
+		w, r, done := serveTestPipes(&Server{WriteFS: fsys}, "scp -tr /")
+		source, err := scpwire.NewSource(w, r)
+		if err != nil {
+			t.Fatalf("fail to start source; %s", err)
+		}
+		if err := source.StartDirectory(0755, "dir"); err != nil {
+			t.Fatalf("fail to start directory; %s", err)
+		}
+		if err := source.WriteFile(0644, 8, "file", strings.NewReader("content\n")); err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+		if err := source.EndDirectory(); err != nil {
+			t.Fatalf("fail to end directory; %s", err)
+		}
+		w.Close()
+		if err := <-done; err != nil {
+			t.Errorf("fail to serve; %s", err)
+		}
+		if buf := fsys.files["dir/file"]; buf == nil || buf.String() != "content\n" {
+			t.Errorf("unmatch written files. got:%v", fsys.files)
+		}
+
+		// Downloads are rejected since only WriteFS is set.
+		w, r, done = serveTestPipes(&Server{WriteFS: fsys}, "scp -f /dir/file")
+		_, err = scpwire.ReadMessage(bufio.NewReader(r))
+		var rerr *scpwire.RemoteError
+		if !errors.As(err, &rerr) {
+			t.Errorf("download must be rejected. got:%v", err)
+		}
+		w.Close()
+		if err := <-done; err == nil {
+			t.Errorf("download must fail")
+		}
+	})
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ljun20160606/go-scp/scpwire"
+)
+
+// handler serves a single request.
+type handler struct {
+	req    *Request
+	rfs    ReadFS
+	wfs    WriteFS
+	policy Policy
+}
+
+// entryInfo is the os.FileInfo of an entry sent by the client.
+type entryInfo struct {
+	name string
+	size int64
+	mode os.FileMode
+}
+
+func (fi *entryInfo) Name() string       { return fi.name }
+func (fi *entryInfo) Size() int64        { return fi.size }
+func (fi *entryInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *entryInfo) ModTime() time.Time { return time.Time{} }
+func (fi *entryInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *entryInfo) Sys() interface{}   { return nil }
+
+// resolve returns the slash separated path relative to the served root
+// for the requested path.
+func resolve(name string) string {
+	rel := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+	if rel == "" {
+		rel = "."
+	}
+	return rel
+}
+
+func (h *handler) checkRequest() error {
+	if h.policy == nil {
+		return nil
+	}
+	return h.policy.CheckRequest(h.req)
+}
+
+func (h *handler) checkFile(name string, info os.FileInfo) error {
+	if h.policy == nil {
+		return nil
+	}
+	return h.policy.CheckFile(h.req, name, info)
+}
+
+func validEntryName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
+// sink receives files from the client.
+func (h *handler) sink(r io.Reader, w io.Writer) error {
+	reader, ok := r.(*bufio.Reader)
+	if !ok {
+		reader = bufio.NewReader(r)
+	}
+	if h.wfs == nil {
+		err := errors.New("uploads are not supported")
+		_ = scpwire.WriteError(w, "scp: "+err.Error(), true)
+		return err
+	}
+	if err := h.checkRequest(); err != nil {
+		_ = scpwire.WriteError(w, "scp: "+err.Error(), true)
+		return err
+	}
+	if err := scpwire.WriteOK(w); err != nil {
+		return fmt.Errorf("failed to write scp replyOK reply: err=%w", err)
+	}
+
+	target := resolve(h.req.Paths[0])
+	targetIsDir := h.req.TargetIsDir
+	if fi, err := h.wfs.Stat(target); err == nil && fi.IsDir() {
+		targetIsDir = true
+	} else if h.req.TargetIsDir {
+		msg := fmt.Sprintf("scp: %s: Not a directory", h.req.Paths[0])
+		_ = scpwire.WriteError(w, msg, true)
+		return errors.New(msg)
+	}
+
+	var timeHeader *scpwire.TimeMsgHeader
+	var dirs []string
+	var dirTimes []*scpwire.TimeMsgHeader
+	entryPath := func(name string) string {
+		if len(dirs) == 0 {
+			if targetIsDir {
+				return path.Join(target, name)
+			}
+			return target
+		}
+		return path.Join(dirs[len(dirs)-1], name)
+	}
+	for {
+		msg, err := scpwire.ReadMessage(reader)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch m := msg.(type) {
+		case scpwire.TimeMsgHeader:
+			timeHeader = &m
+			if err := scpwire.WriteOK(w); err != nil {
+				return err
+			}
+		case scpwire.StartDirectoryMsgHeader:
+			if !h.req.Recursive || !validEntryName(m.Name) {
+				msg := fmt.Sprintf("scp: %s: unexpected directory", m.Name)
+				_ = scpwire.WriteError(w, msg, true)
+				return errors.New(msg)
+			}
+			dir := entryPath(m.Name)
+			info := &entryInfo{name: m.Name, mode: m.Mode | os.ModeDir}
+			if err := h.checkFile(dir, info); err != nil {
+				_ = scpwire.WriteError(w, "scp: "+err.Error(), true)
+				return err
+			}
+			if err := h.wfs.MkdirAll(dir, m.Mode|0700); err != nil {
+				_ = scpwire.WriteError(w, "scp: "+err.Error(), true)
+				return err
+			}
+			if h.req.Preserve {
+				if err := h.wfs.Chmod(dir, m.Mode); err != nil {
+					_ = scpwire.WriteError(w, "scp: "+err.Error(), true)
+					return err
+				}
+			}
+			dirs = append(dirs, dir)
+			dirTimes = append(dirTimes, timeHeader)
+			timeHeader = nil
+			if err := scpwire.WriteOK(w); err != nil {
+				return err
+			}
+		case scpwire.EndDirectoryMsgHeader:
+			if len(dirs) == 0 {
+				_ = scpwire.WriteError(w, "scp: unexpected end of directory", true)
+				return &scpwire.ProtocolError{Msg: "unexpected end of directory"}
+			}
+			dir, t := dirs[len(dirs)-1], dirTimes[len(dirTimes)-1]
+			dirs, dirTimes = dirs[:len(dirs)-1], dirTimes[:len(dirTimes)-1]
+			if h.req.Preserve && t != nil {
+				if err := h.wfs.Chtimes(dir, t.Atime, t.Mtime); err != nil {
+					_ = scpwire.WriteError(w, "scp: "+err.Error(), true)
+					return err
+				}
+			}
+			if err := scpwire.WriteOK(w); err != nil {
+				return err
+			}
+		case scpwire.FileMsgHeader:
+			if !validEntryName(m.Name) {
+				msg := fmt.Sprintf("scp: %s: invalid file name", m.Name)
+				_ = scpwire.WriteError(w, msg, true)
+				return errors.New(msg)
+			}
+			if err := h.receiveFile(reader, w, entryPath(m.Name), m, timeHeader); err != nil {
+				return err
+			}
+			timeHeader = nil
+		case scpwire.OKMsg:
+			// do nothing
+		}
+	}
+}
+
+func (h *handler) receiveFile(r *bufio.Reader, w io.Writer, name string, m scpwire.FileMsgHeader, timeHeader *scpwire.TimeMsgHeader) error {
+	info := &entryInfo{name: m.Name, size: m.Size, mode: m.Mode}
+	if err := h.checkFile(name, info); err != nil {
+		_ = scpwire.WriteError(w, "scp: "+err.Error(), true)
+		return err
+	}
+	file, err := h.wfs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, m.Mode)
+	if err != nil {
+		_ = scpwire.WriteError(w, "scp: "+err.Error(), true)
+		return err
+	}
+	if err := scpwire.WriteOK(w); err != nil {
+		file.Close()
+		return err
+	}
+	body := io.LimitReader(r, m.Size)
+	_, err = io.Copy(file, body)
+	if err != nil {
+		// The rest of the body is drained, so that the reply after it is
+		// read and the error is sent in sync with the source.
+		_, _ = io.Copy(ioutil.Discard, body)
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	// The source sends a reply after the body.
+	if rerr := scpwire.ReadReply(r); rerr != nil {
+		return rerr
+	}
+	if err != nil {
+		_ = scpwire.WriteError(w, "scp: "+err.Error(), false)
+		return err
+	}
+	if h.req.Preserve {
+		if err := h.wfs.Chmod(name, m.Mode); err != nil {
+			_ = scpwire.WriteError(w, "scp: "+err.Error(), false)
+			return err
+		}
+		if timeHeader != nil {
+			if err := h.wfs.Chtimes(name, timeHeader.Atime, timeHeader.Mtime); err != nil {
+				_ = scpwire.WriteError(w, "scp: "+err.Error(), false)
+				return err
+			}
+		}
+	}
+	return scpwire.WriteOK(w)
+}
+
+// source sends files to the client.
+func (h *handler) source(r io.Reader, w io.Writer) error {
+	if h.rfs == nil {
+		err := errors.New("downloads are not supported")
+		_ = scpwire.WriteError(w, "scp: "+err.Error(), true)
+		return err
+	}
+	if err := h.checkRequest(); err != nil {
+		_ = scpwire.WriteError(w, "scp: "+err.Error(), true)
+		return err
+	}
+	s, err := scpwire.NewSource(w, r)
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for _, name := range h.req.Paths {
+		if err := h.sendEntry(s, resolve(name)); err != nil {
+			if _, ok := err.(*scpwire.RemoteError); ok {
+				return err
+			}
+			errs = append(errs, err.Error())
+			if werr := s.WriteError(fmt.Sprintf("scp: %s: %s", name, err), false); werr != nil {
+				return werr
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// writeTime writes the time message of fi if the times are preserved.
+func (h *handler) writeTime(s *scpwire.Source, fi os.FileInfo) error {
+	if !h.req.Preserve {
+		return nil
+	}
+	return s.WriteTime(fi.ModTime(), accessTime(fi))
+}
+
+func (h *handler) sendEntry(s *scpwire.Source, name string) error {
+	fi, err := h.rfs.Stat(name)
+	if err != nil {
+		return err
+	}
+	if err := h.checkFile(name, fi); err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if !h.req.Recursive {
+			return errors.New("not a regular file")
+		}
+		if err := h.writeTime(s, fi); err != nil {
+			return err
+		}
+		if err := s.StartDirectory(fi.Mode(), fi.Name()); err != nil {
+			return err
+		}
+		entries, err := h.rfs.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && !entry.Mode().IsRegular() {
+				continue
+			}
+			if err := h.sendEntry(s, path.Join(name, entry.Name())); err != nil {
+				if _, ok := err.(*scpwire.RemoteError); ok {
+					return err
+				}
+				if werr := s.WriteError(fmt.Sprintf("scp: %s: %s", name, err), false); werr != nil {
+					return werr
+				}
+			}
+		}
+		return s.EndDirectory()
+	}
+	if !fi.Mode().IsRegular() {
+		return errors.New("not a regular file")
+	}
+	file, err := h.rfs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := h.writeTime(s, fi); err != nil {
+		return err
+	}
+	return s.WriteFile(fi.Mode(), fi.Size(), fi.Name(), file)
+}
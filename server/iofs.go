@@ -0,0 +1,39 @@
+// +build go1.16
+
+package server
+
+import (
+	"io"
+	"io/fs"
+	"os"
+)
+
+// IOFS returns the ReadFS reading from fsys, such as an fstest.MapFS or
+// an embed.FS.
+func IOFS(fsys fs.FS) ReadFS {
+	return ioFS{fsys: fsys}
+}
+
+type ioFS struct {
+	fsys fs.FS
+}
+
+func (f ioFS) Open(name string) (io.ReadCloser, error) { return f.fsys.Open(name) }
+
+func (f ioFS) Stat(name string) (os.FileInfo, error) { return fs.Stat(f.fsys, name) }
+
+func (f ioFS) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := fs.ReadDir(f.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
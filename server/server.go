@@ -0,0 +1,277 @@
+// Package server implements the server side of the scp protocol, the sink
+// (scp -t) receiving files and the source (scp -f) sending files, so that
+// Go SSH servers can serve scp requests without a scp command. The messages
+// are read and written with the scpwire package, which the client in the scp
+// package uses as well. HandleSession serves the sessions of SSH servers
+// such as github.com/gliderlabs/ssh.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// Direction is the direction of a request.
+type Direction int
+
+const (
+	// DirectionUpload is a request to write files on the server (scp -t).
+	DirectionUpload Direction = iota
+	// DirectionDownload is a request to read files on the server (scp -f).
+	DirectionDownload
+)
+
+func (d Direction) String() string {
+	if d == DirectionUpload {
+		return "upload"
+	}
+	return "download"
+}
+
+// Request describes an scp request.
+type Request struct {
+	// Direction is the direction of the request.
+	Direction Direction
+	// Paths are the requested paths as sent by the client. An upload request
+	// has exactly one path.
+	Paths []string
+	// Recursive is true if the client requested a recursive copy (-r).
+	Recursive bool
+	// Preserve is true if the client requested to preserve times and modes (-p).
+	Preserve bool
+	// TargetIsDir is true if the client requires the upload target to be
+	// a directory (-d).
+	TargetIsDir bool
+	// User is the name of the user requesting, if known.
+	User string
+	// RemoteAddr is the address of the client, if known.
+	RemoteAddr string
+}
+
+// Policy decides whether requests are allowed.
+type Policy interface {
+	// CheckRequest is called once for each request before any file is read
+	// or written. A non-nil error rejects the whole request.
+	CheckRequest(req *Request) error
+	// CheckFile is called for each file or directory to be read or written.
+	// name is the slash separated path relative to the served root, and
+	// info has the size and the mode of the entry. A non-nil error rejects
+	// the entry and is sent to the client.
+	CheckFile(req *Request, name string, info os.FileInfo) error
+}
+
+// ErrInvalidCommand is returned when the scp command line to serve is invalid.
+var ErrInvalidCommand = errors.New("scp: invalid scp command line")
+
+// Server serves scp requests for the files under a root directory, or
+// from and into virtual filesystems.
+type Server struct {
+	// Root is the directory under which all the paths are confined, so
+	// an absolute path "/a/b" means Root/a/b.
+	Root string
+	// ReadFS, if not nil, is read by the downloads instead of Root.
+	ReadFS ReadFS
+	// WriteFS, if not nil, is written by the uploads instead of Root.
+	// If only one of ReadFS and WriteFS is set and Root is empty,
+	// the requests of the other direction are rejected.
+	WriteFS WriteFS
+	// Policy decides whether requests are allowed. If nil, all requests
+	// are allowed.
+	Policy Policy
+}
+
+// ServeCommand parses cmdline, the command requested by the client such as
+// "scp -t -- /path", and serves it over r and w, which are usually the
+// standard input and output of an SSH session channel.
+func (s *Server) ServeCommand(ctx context.Context, cmdline string, r io.Reader, w io.Writer) error {
+	req, err := ParseCommand(cmdline)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, req, r, w)
+}
+
+// Serve serves the parsed request over r and w. Both the sink (scp -t) and
+// the source (scp -f) sides are supported. It returns ctx.Err() when ctx is
+// done before the request is served. Then r and w are closed if they are
+// io.Closer to interrupt the request, and Serve returns after the request
+// stops using them.
+func (s *Server) Serve(ctx context.Context, req *Request, r io.Reader, w io.Writer) error {
+	h := &handler{req: req, rfs: s.ReadFS, wfs: s.WriteFS, policy: s.Policy}
+	if h.rfs == nil && (s.Root != "" || s.WriteFS == nil) {
+		h.rfs = osFS{root: s.Root}
+	}
+	if h.wfs == nil && (s.Root != "" || s.ReadFS == nil) {
+		h.wfs = osFS{root: s.Root}
+	}
+	streams := &stoppableStreams{r: r, w: w}
+	done := make(chan error, 1)
+	go func() {
+		if req.Direction == DirectionUpload {
+			done <- h.sink(streams, streams)
+		} else {
+			done <- h.source(streams, streams)
+		}
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		streams.stop()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// errStopped is returned by the stopped streams.
+var errStopped = errors.New("scp: request stopped")
+
+// stoppableStreams are the input and the output of a request, which fail
+// once stopped. stop closes them too, so that the blocked reads and writes
+// return.
+type stoppableStreams struct {
+	r       io.Reader
+	w       io.Writer
+	stopped int32
+}
+
+func (s *stoppableStreams) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&s.stopped) != 0 {
+		return 0, errStopped
+	}
+	return s.r.Read(p)
+}
+
+func (s *stoppableStreams) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&s.stopped) != 0 {
+		return 0, errStopped
+	}
+	return s.w.Write(p)
+}
+
+func (s *stoppableStreams) stop() {
+	atomic.StoreInt32(&s.stopped, 1)
+	if c, ok := s.r.(io.Closer); ok {
+		_ = c.Close()
+	}
+	if c, ok := s.w.(io.Closer); ok {
+		_ = c.Close()
+	}
+}
+
+// ParseCommand parses an scp command line such as "scp -t -- '/path'" into
+// a request. Only the flags used by scp for the remote side are supported.
+func ParseCommand(cmdline string) (*Request, error) {
+	args, err := splitCommandLine(cmdline)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 || !strings.HasSuffix(filepath.Base(args[0]), "scp") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidCommand, cmdline)
+	}
+	req := &Request{}
+	var to, from bool
+	i := 1
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			i++
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			break
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 't':
+				to = true
+			case 'f':
+				from = true
+			case 'r':
+				req.Recursive = true
+			case 'p':
+				req.Preserve = true
+			case 'd':
+				req.TargetIsDir = true
+			case 'v', 'q':
+				// ignored
+			default:
+				return nil, fmt.Errorf("%w: unsupported flag -%c", ErrInvalidCommand, c)
+			}
+		}
+	}
+	req.Paths = args[i:]
+	switch {
+	case to == from:
+		return nil, fmt.Errorf("%w: exactly one of -t and -f is required", ErrInvalidCommand)
+	case to:
+		req.Direction = DirectionUpload
+		if len(req.Paths) != 1 {
+			return nil, fmt.Errorf("%w: -t requires exactly one path", ErrInvalidCommand)
+		}
+	default:
+		req.Direction = DirectionDownload
+		if len(req.Paths) == 0 {
+			return nil, fmt.Errorf("%w: -f requires paths", ErrInvalidCommand)
+		}
+	}
+	return req, nil
+}
+
+// splitCommandLine splits a command line into arguments handling the POSIX
+// shell quotes and backslashes.
+func splitCommandLine(cmdline string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg := false
+	for i := 0; i < len(cmdline); i++ {
+		c := cmdline[i]
+		switch {
+		case c == '\'':
+			inArg = true
+			end := strings.IndexByte(cmdline[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unterminated quote", ErrInvalidCommand)
+			}
+			cur.WriteString(cmdline[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			inArg = true
+			i++
+			for ; i < len(cmdline) && cmdline[i] != '"'; i++ {
+				if cmdline[i] == '\\' && i+1 < len(cmdline) && strings.IndexByte("\"\\$`", cmdline[i+1]) >= 0 {
+					i++
+				}
+				cur.WriteByte(cmdline[i])
+			}
+			if i >= len(cmdline) {
+				return nil, fmt.Errorf("%w: unterminated quote", ErrInvalidCommand)
+			}
+		case c == '\\':
+			inArg = true
+			if i+1 < len(cmdline) {
+				i++
+				cur.WriteByte(cmdline[i])
+			}
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			inArg = true
+			cur.WriteByte(c)
+		}
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,386 @@
+// +build !windows
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ljun20160606/go-scp/scpwire"
+)
+
+func TestParseCommand(t *testing.T) {
+	req, err := ParseCommand(`scp -tpr -- '/tmp/it'\''s dir'`)
+	if err != nil {
+		t.Fatalf("fail to parse command; %s", err)
+	}
+	want := &Request{
+		Direction: DirectionUpload,
+		Paths:     []string{"/tmp/it's dir"},
+		Recursive: true,
+		Preserve:  true,
+	}
+	if !reflect.DeepEqual(req, want) {
+		t.Errorf("unmatch request. got:%+v, want:%+v", req, want)
+	}
+
+	for _, cmdline := range []string{"ls -l", "scp /tmp", "scp -t", "scp -tf /tmp"} {
+		if _, err := ParseCommand(cmdline); !errors.Is(err, ErrInvalidCommand) {
+			t.Errorf("invalid command line %q must be rejected. got:%v", cmdline, err)
+		}
+	}
+}
+
+// serveTestPipes starts serving cmdline and returns the pipes for the client
+// side.
+func serveTestPipes(s *Server, cmdline string) (io.WriteCloser, io.Reader, <-chan error) {
+	serverR, clientW := io.Pipe()
+	clientR, serverW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := s.ServeCommand(context.Background(), cmdline, serverR, serverW)
+		serverW.Close()
+		done <- err
+	}()
+	return clientW, clientR, done
+}
+
+func TestServer(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+
+	t.Run("upload", func(t *testing.T) {
+		root, err := ioutil.TempDir("", "go-scp-TestServer-root")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(root)
+
+		w, r, done := serveTestPipes(&Server{Root: root}, "scp -tpr /")
+		source, err := scpwire.NewSource(w, r)
+		if err != nil {
+			t.Fatalf("fail to start source; %s", err)
+		}
+		if err := source.StartDirectory(0755, "dir"); err != nil {
+			t.Fatalf("fail to start directory; %s", err)
+		}
+		if err := source.WriteTime(mtime, mtime); err != nil {
+			t.Fatalf("fail to write time; %s", err)
+		}
+		if err := source.WriteFile(0640, 8, "file", strings.NewReader("content\n")); err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+		if err := source.EndDirectory(); err != nil {
+			t.Fatalf("fail to end directory; %s", err)
+		}
+		w.Close()
+		if err := <-done; err != nil {
+			t.Errorf("fail to serve; %s", err)
+		}
+
+		path := filepath.Join(root, "dir", "file")
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("fail to read file; %s", err)
+		}
+		if string(content) != "content\n" {
+			t.Errorf("unmatch content. got:%q", content)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("fail to stat file; %s", err)
+		}
+		if fi.Mode() != 0640 || !fi.ModTime().Equal(mtime) {
+			t.Errorf("unmatch mode or time. got:%s %s", fi.Mode(), fi.ModTime())
+		}
+	})
+
+	t.Run("download", func(t *testing.T) {
+		root, err := ioutil.TempDir("", "go-scp-TestServer-root")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(root)
+
+		if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+			t.Fatalf("fail to create directory; %s", err)
+		}
+		path := filepath.Join(root, "dir", "file")
+		if err := ioutil.WriteFile(path, []byte("content\n"), 0600); err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatalf("fail to change times; %s", err)
+		}
+
+		w, r, done := serveTestPipes(&Server{Root: root}, "scp -fpr /../dir")
+		sink, err := scpwire.NewSink(w, r)
+		if err != nil {
+			t.Fatalf("fail to start sink; %s", err)
+		}
+		var got []interface{}
+		var body bytes.Buffer
+		for {
+			h, err := sink.ReadMessage()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("fail to read message; %s", err)
+			}
+			switch h := h.(type) {
+			case scpwire.TimeMsgHeader:
+				// The time of the directory depends on the test run.
+				continue
+			case scpwire.FileMsgHeader:
+				if err := sink.CopyBody(h, &body); err != nil {
+					t.Fatalf("fail to copy body; %s", err)
+				}
+			}
+			got = append(got, h)
+		}
+		w.Close()
+		if err := <-done; err != nil {
+			t.Errorf("fail to serve; %s", err)
+		}
+
+		want := []interface{}{
+			scpwire.StartDirectoryMsgHeader{Mode: 0755, Name: "dir"},
+			scpwire.FileMsgHeader{Mode: 0600, Size: 8, Name: "file"},
+			scpwire.EndDirectoryMsgHeader{},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("unmatch messages. got:%+v, want:%+v", got, want)
+		}
+		if body.String() != "content\n" {
+			t.Errorf("unmatch content. got:%q", body.String())
+		}
+	})
+
+	t.Run("policy", func(t *testing.T) {
+		root, err := ioutil.TempDir("", "go-scp-TestServer-root")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(root)
+
+		errDenied := errors.New("denied")
+		w, r, done := serveTestPipes(&Server{Root: root, Policy: denyPolicy{errDenied}}, "scp -t /")
+		_, err = scpwire.NewSource(w, r)
+		var rerr *scpwire.RemoteError
+		if !errors.As(err, &rerr) || !rerr.Fatal {
+			t.Errorf("request must be rejected with a fatal error. got:%v", err)
+		}
+		w.Close()
+		if err := <-done; !errors.Is(err, errDenied) {
+			t.Errorf("unmatch serve error. got:%v, want:%v", err, errDenied)
+		}
+	})
+}
+
+func TestServerCancel(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-scp-TestServer-root")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	serverR, clientW := io.Pipe()
+	clientR, serverW := io.Pipe()
+	defer clientW.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- (&Server{Root: root}).ServeCommand(ctx, "scp -t /", serverR, serverW)
+	}()
+	// The request waits for a message after the first reply.
+	if err := scpwire.ReadReply(bufio.NewReader(clientR)); err != nil {
+		t.Fatalf("fail to start upload; %s", err)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("unmatch serve error. got:%v, want:%v", err, context.Canceled)
+	}
+	// The streams are closed before Serve returns.
+	if _, err := clientW.Write([]byte("C0644 8 file\n")); err != io.ErrClosedPipe {
+		t.Errorf("input must be closed. got:%v", err)
+	}
+}
+
+func TestServerSymlinkOutsideRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-scp-TestServer-root")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(root)
+	outside, err := ioutil.TempDir("", "go-scp-TestServer-outside")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(outside)
+
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret\n"), 0600); err != nil {
+		t.Fatalf("fail to write file; %s", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatalf("fail to create symlink; %s", err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "new"), filepath.Join(root, "dangling")); err != nil {
+		t.Fatalf("fail to create symlink; %s", err)
+	}
+
+	var rerr *scpwire.RemoteError
+	w, r, done := serveTestPipes(&Server{Root: root}, "scp -f /link/secret")
+	if err := scpwire.WriteOK(w); err != nil {
+		t.Fatalf("fail to start download; %s", err)
+	}
+	if _, err := scpwire.ReadMessage(bufio.NewReader(r)); !errors.As(err, &rerr) {
+		t.Errorf("download through symlink must be rejected. got:%v", err)
+	}
+	w.Close()
+	<-done
+
+	for _, target := range []string{"/link/file", "/dangling"} {
+		w, r, done := serveTestPipes(&Server{Root: root}, "scp -t "+target)
+		reader := bufio.NewReader(r)
+		if err := scpwire.ReadReply(reader); err != nil {
+			t.Fatalf("fail to start upload; %s", err)
+		}
+		// The body is not written, since the server stops reading after
+		// the rejection.
+		if err := scpwire.WriteFileHeader(w, 0644, 8, path.Base(target)); err != nil {
+			t.Fatalf("fail to write file header; %s", err)
+		}
+		if err := scpwire.ReadReply(reader); !errors.As(err, &rerr) {
+			t.Errorf("upload through symlink %s must be rejected. got:%v", target, err)
+		}
+		w.Close()
+		<-done
+	}
+	for _, name := range []string{"file", "new"} {
+		if _, err := os.Stat(filepath.Join(outside, name)); !os.IsNotExist(err) {
+			t.Errorf("file must not be written outside root; %s: %v", name, err)
+		}
+	}
+}
+
+// failingFS is the WriteFS of a local directory where writing the files
+// fails.
+type failingFS struct {
+	osFS
+}
+
+func (fsys failingFS) OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error) {
+	file, err := fsys.osFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return failingWriter{file}, nil
+}
+
+type failingWriter struct {
+	io.WriteCloser
+}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("no space left") }
+
+func TestServerWriteError(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-scp-TestServer-root")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	w, r, done := serveTestPipes(&Server{WriteFS: failingFS{osFS{root: root}}}, "scp -t /")
+	reader := bufio.NewReader(r)
+	if err := scpwire.ReadReply(reader); err != nil {
+		t.Fatalf("fail to start upload; %s", err)
+	}
+	// The body is larger than a single read, so that its rest is left
+	// after the write fails.
+	body := bytes.Repeat([]byte("a"), 100000)
+	if err := scpwire.WriteFileHeader(w, 0644, int64(len(body)), "file"); err != nil {
+		t.Fatalf("fail to write file header; %s", err)
+	}
+	if err := scpwire.ReadReply(reader); err != nil {
+		t.Fatalf("fail to start file; %s", err)
+	}
+	go func() {
+		if _, err := w.Write(body); err == nil {
+			_ = scpwire.WriteOK(w)
+		}
+	}()
+	var rerr *scpwire.RemoteError
+	if err := scpwire.ReadReply(reader); !errors.As(err, &rerr) || !strings.Contains(rerr.Error(), "no space left") {
+		t.Errorf("write error must be replied after the body. got:%v", err)
+	}
+	w.Close()
+	<-done
+}
+
+type denyPolicy struct {
+	err error
+}
+
+func (p denyPolicy) CheckRequest(req *Request) error { return p.err }
+
+func (p denyPolicy) CheckFile(req *Request, name string, info os.FileInfo) error { return p.err }
+
+// testSession is a Session with a fixed command line.
+type testSession struct {
+	io.Reader
+	io.Writer
+	cmdline string
+	stderr  bytes.Buffer
+	status  int
+}
+
+func (s *testSession) Stderr() io.ReadWriter { return &s.stderr }
+func (s *testSession) RawCommand() string    { return s.cmdline }
+func (s *testSession) User() string          { return "alice" }
+func (s *testSession) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+}
+func (s *testSession) Context() context.Context { return context.Background() }
+func (s *testSession) Exit(code int) error      { s.status = code; return nil }
+
+func TestHandleSession(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-scp-TestHandleSession-root")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(root)
+	if err := ioutil.WriteFile(filepath.Join(root, "file"), []byte("content\n"), 0644); err != nil {
+		t.Fatalf("fail to write file; %s", err)
+	}
+
+	srv := &Server{Root: root}
+	if srv.HandleSession(&testSession{cmdline: "ls -l"}) {
+		t.Errorf("non scp command must not be handled")
+	}
+
+	sess := &testSession{cmdline: "scp -x /file"}
+	if !srv.HandleSession(sess) || sess.status != 1 || sess.stderr.Len() == 0 {
+		t.Errorf("invalid scp command must fail. status:%d, stderr:%q", sess.status, sess.stderr.String())
+	}
+
+	// The client replies are sent up front, since the source waits for each.
+	var out bytes.Buffer
+	sess = &testSession{Reader: bytes.NewReader([]byte{0, 0, 0}), Writer: &out, cmdline: "scp -f /file"}
+	if !srv.HandleSession(sess) || sess.status != 0 {
+		t.Errorf("scp command must succeed. status:%d", sess.status)
+	}
+	if want := "C0644 8 file\ncontent\n\x00"; out.String() != want {
+		t.Errorf("unmatch output. got:%q, want:%q", out.String(), want)
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// Session is an SSH session channel with an exec request. It is the subset
+// of ssh.Session of github.com/gliderlabs/ssh used by HandleSession, so the
+// sessions of that package can be passed as is without this package
+// depending on it.
+type Session interface {
+	io.ReadWriter
+	// Stderr returns the standard error of the session.
+	Stderr() io.ReadWriter
+	// RawCommand returns the command line of the exec request.
+	RawCommand() string
+	// User returns the name of the authenticated user.
+	User() string
+	// RemoteAddr returns the address of the client.
+	RemoteAddr() net.Addr
+	// Context returns the context of the session, which is done when
+	// the session is closed.
+	Context() context.Context
+	// Exit sends the exit status and closes the session.
+	Exit(code int) error
+}
+
+// IsCommand reports whether cmdline runs scp, so that it should be served
+// by a Server.
+func IsCommand(cmdline string) bool {
+	args, err := splitCommandLine(cmdline)
+	if err != nil || len(args) == 0 {
+		return false
+	}
+	return strings.HasSuffix(filepath.Base(args[0]), "scp")
+}
+
+// HandleSession serves the scp request of sess and exits the session with
+// the status of scp, 0 on success and 1 on failure, and returns true. If the
+// command of sess is not scp, it returns false without touching sess, so
+// the caller can handle the other commands. With github.com/gliderlabs/ssh,
+// a server serving scp only is:
+//
+//	srv := &server.Server{Root: "/srv/scp"}
+//	ssh.Handle(func(sess ssh.Session) {
+//		if !srv.HandleSession(sess) {
+//			fmt.Fprintln(sess.Stderr(), "only scp is allowed")
+//			sess.Exit(1)
+//		}
+//	})
+func (s *Server) HandleSession(sess Session) bool {
+	cmdline := sess.RawCommand()
+	if !IsCommand(cmdline) {
+		return false
+	}
+	req, err := ParseCommand(cmdline)
+	if err != nil {
+		fmt.Fprintln(sess.Stderr(), err)
+		_ = sess.Exit(1)
+		return true
+	}
+	req.User = sess.User()
+	if addr := sess.RemoteAddr(); addr != nil {
+		req.RemoteAddr = addr.String()
+	}
+	// The errors are sent to the client as the replies of the protocol.
+	if err := s.Serve(sess.Context(), req, sess, sess); err != nil {
+		_ = sess.Exit(1)
+		return true
+	}
+	_ = sess.Exit(0)
+	return true
+}
@@ -0,0 +1,327 @@
+package scp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sessionConfig holds the settings shared by sink and source sessions.
+type sessionConfig struct {
+	ctx               context.Context
+	client            *ssh.Client
+	scpPath           string
+	updatesPermission bool
+	accounting        *Accounting
+	usage             *hostUsage
+	subsystem         string
+	teardownTimeout   time.Duration
+	idleTimeout       time.Duration
+	perFileTimeout    time.Duration
+	sudo              bool
+	commandFunc       CommandFunc
+	quoting           ShellQuoting
+	compat            Compat
+	compatDetection   *compatDetection
+	forcedMode        *forcedMode
+	bufferSize        int
+	pipeline          int
+	pause             *pauseGate
+	logger            debugLogger
+	metrics           Metrics
+	protocolTrace     *protocolTrace
+	// forwardAgent requests agent forwarding for command sessions.
+	forwardAgent bool
+	// transport creates the sessions instead of client if it is not nil.
+	transport Transport
+	// reconnect replaces client when a session cannot be opened if it is
+	// not nil.
+	reconnect *reconnector
+}
+
+func (s *SCP) sessionConfig() *sessionConfig {
+	client := s.client
+	if s.reconnect != nil {
+		client = s.reconnect.current()
+	}
+	return &sessionConfig{
+		ctx:               s.ctx,
+		client:            client,
+		scpPath:           s.scpPath,
+		updatesPermission: !s.noPreserve,
+		accounting:        s.accounting,
+		usage:             s.usage,
+		subsystem:         s.subsystem,
+		teardownTimeout:   s.teardownTimeout,
+		idleTimeout:       s.idleTimeout,
+		perFileTimeout:    s.perFileTimeout,
+		sudo:              s.sudo,
+		commandFunc:       s.commandFunc,
+		quoting:           s.quoting,
+		compat:            s.compat,
+		compatDetection:   s.compatDetection,
+		forcedMode:        s.forcedMode,
+		bufferSize:        s.bufferSize,
+		pipeline:          s.pipeline,
+		pause:             s.pause,
+		logger:            s.logger,
+		metrics:           withExpvarMetrics(s.metrics),
+		protocolTrace:     s.protocolTrace,
+		transport:         s.transport,
+		reconnect:         s.reconnect,
+	}
+}
+
+// remoteAddr returns the address of the remote host used as the key for
+// per-host bookkeeping.
+func (c *sessionConfig) remoteAddr() string {
+	if c.client == nil || c.client.RemoteAddr() == nil {
+		return ""
+	}
+	return c.client.RemoteAddr().String()
+}
+
+// start starts the remote scp command. If a subsystem is set, the subsystem
+// is requested instead and the command line is written to stdin as the first
+// line, so the server can tell the direction and the path.
+func (c *sessionConfig) start(session Session, stdin io.Writer, cmd string, log *sessionLog) error {
+	log.debug("scp: starting session", "cmd", cmd, "subsystem", c.subsystem, "sudo", c.sudo)
+	if c.subsystem == "" {
+		return session.Start(c.sudoCommand(cmd))
+	}
+	ss, ok := session.(*subsystemSession)
+	if !ok {
+		return errNotSSHSession
+	}
+	if err := ss.requestSubsystem(c.subsystem); err != nil {
+		return fmt.Errorf("failed to request subsystem %q: err=%w", c.subsystem, err)
+	}
+	if _, err := fmt.Fprintf(stdin, "%s\n", cmd); err != nil {
+		return fmt.Errorf("failed to write command line to subsystem: err=%w", err)
+	}
+	return nil
+}
+
+// scpCommand returns the command line of the remote scp with the options
+// and the paths quoted with the quoting and joined with spaces.
+func (c *sessionConfig) scpCommand(scpPath, opts, paths string) string {
+	if c.commandFunc != nil {
+		return c.commandFunc(opts, paths)
+	}
+	return scpPath + " " + opts + " " + paths
+}
+
+// sudoCommand returns cmd run with sudo if WithSudo is set. The command is
+// run with sh -c, so that it can be a shell command line.
+func (c *sessionConfig) sudoCommand(cmd string) string {
+	if !c.sudo {
+		return cmd
+	}
+	return "sudo -n sh -c " + escapeShellArg(cmd)
+}
+
+// SessionOptions are the options of the sessions opened with OpenSource
+// and OpenSink.
+type SessionOptions struct {
+	// Recursive makes the session copy directories recursively (-r).
+	Recursive bool
+	// TargetIsDir makes the remote scp require the path to be a directory (-d).
+	TargetIsDir bool
+}
+
+// SourceSession is a session reading files from a remote scp source, for
+// building custom receive flows. Call ReadHeader until it returns io.EOF,
+// and CopyBodyTo for each FileMsgHeader before reading the next header.
+// A SourceSession must be closed with Close.
+type SourceSession struct {
+	scp       *SCP
+	rs        *resourceSession
+	srcPath   string
+	recursive bool
+	dirs      []string
+	done      chan struct{}
+	eof       bool
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// OpenSource starts a session which reads srcPath from the remote server.
+func (s *SCP) OpenSource(srcPath string, opts SessionOptions) (*SourceSession, error) {
+	srcPath = s.cleanRemotePath(srcPath)
+	rs, err := newResourceSession(s.sessionConfig(), srcPath, opts.TargetIsDir, opts.Recursive)
+	if err != nil {
+		return nil, err
+	}
+	ss := &SourceSession{
+		scp:       s,
+		rs:        rs,
+		srcPath:   srcPath,
+		recursive: opts.Recursive,
+		done:      make(chan struct{}),
+	}
+	go closeOnDone(s.ctx, ss.done, rs)
+	return ss, nil
+}
+
+// ReadHeader reads the next message header, which is one of TimeMsgHeader,
+// FileMsgHeader, StartDirectoryMsgHeader and EndDirectoryMsgHeader.
+// It returns io.EOF after the last message.
+func (ss *SourceSession) ReadHeader() (interface{}, error) {
+	for {
+		h, err := ss.rs.ReadHeaderOrReply()
+		if err == io.EOF {
+			ss.eof = true
+			return nil, err
+		} else if err != nil {
+			return nil, err
+		}
+		switch h := h.(type) {
+		case okMsg:
+			continue
+		case StartDirectoryMsgHeader:
+			h.Name = ss.scp.nameNormalization.normalize(h.Name)
+			ss.dirs = append(ss.dirs, h.Name)
+			return h, nil
+		case EndDirectoryMsgHeader:
+			if len(ss.dirs) > 0 {
+				ss.dirs = ss.dirs[:len(ss.dirs)-1]
+			}
+			return h, nil
+		case FileMsgHeader:
+			h.Name = ss.scp.nameNormalization.normalize(h.Name)
+			return h, nil
+		default:
+			return h, nil
+		}
+	}
+}
+
+// CopyBodyTo copies the body of the file of h, which is the header returned
+// by the last ReadHeader, to w. Pass ioutil.Discard to skip the file.
+func (ss *SourceSession) CopyBodyTo(h FileMsgHeader, w io.Writer) error {
+	remotePath := ss.srcPath
+	if ss.recursive {
+		remotePath = joinRemotePath(path.Dir(ss.srcPath), ss.dirs, h.Name)
+	}
+	a := ss.scp.newAuditor(DirectionDownload, "", remotePath)
+	a.attach(&ss.rs.tee)
+	err := ss.rs.CopyFileBodyTo(h, w)
+	a.finish(err)
+	return err
+}
+
+// Close closes the session. If all the messages were read, it waits for
+// the remote scp to exit and returns its error. Close may be called more
+// than once, and returns the same error.
+func (ss *SourceSession) Close() error {
+	ss.closeOnce.Do(func() {
+		close(ss.done)
+		if ss.eof {
+			ss.closeErr = ss.rs.Wait()
+		}
+		ss.rs.Close()
+	})
+	return ss.closeErr
+}
+
+// SinkSession is a session writing files to a remote scp sink, for building
+// custom send flows. A SinkSession must be closed with Close.
+type SinkSession struct {
+	scp       *SCP
+	ss        *sinkSession
+	destPath  string
+	dirs      []string
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// OpenSink starts a session which writes to destPath on the remote server.
+func (s *SCP) OpenSink(destPath string, opts SessionOptions) (*SinkSession, error) {
+	destPath = s.cleanRemotePath(destPath)
+	ss, err := newSinkSession(s.sessionConfig(), destPath, opts.TargetIsDir, opts.Recursive)
+	if err != nil {
+		return nil, err
+	}
+	sink := &SinkSession{
+		scp:      s,
+		ss:       ss,
+		destPath: destPath,
+		done:     make(chan struct{}),
+	}
+	go closeOnDone(s.ctx, sink.done, ss)
+	return sink, nil
+}
+
+// WriteFile writes a file with the information and the content read from
+// body. body is closed after copying.
+func (sink *SinkSession) WriteFile(info *FileInfo, body io.ReadCloser) error {
+	info = sink.scp.nameNormalization.normalizeFileInfo(info)
+	remotePath := joinRemotePath(sink.destPath, sink.dirs, info.Name())
+	return sink.scp.writeFile(sink.ss, info, body, "", remotePath)
+}
+
+// StartDirectory starts a directory with the information. The following
+// files and directories are written under it until EndDirectory is called.
+// The session must be opened with Recursive.
+func (sink *SinkSession) StartDirectory(info *FileInfo) error {
+	info = sink.scp.nameNormalization.normalizeFileInfo(info)
+	if err := sink.ss.StartDirectory(info); err != nil {
+		return err
+	}
+	sink.dirs = append(sink.dirs, info.Name())
+	return nil
+}
+
+// EndDirectory ends the directory started by the last StartDirectory.
+func (sink *SinkSession) EndDirectory() error {
+	if err := sink.ss.EndDirectory(); err != nil {
+		return err
+	}
+	if len(sink.dirs) > 0 {
+		sink.dirs = sink.dirs[:len(sink.dirs)-1]
+	}
+	return nil
+}
+
+// Close finishes writing, waits for the remote scp to exit and closes
+// the session. Close may be called more than once, and returns the same
+// error.
+func (sink *SinkSession) Close() error {
+	sink.closeOnce.Do(func() {
+		close(sink.done)
+		defer sink.ss.Close()
+		sink.closeErr = sink.finish()
+	})
+	return sink.closeErr
+}
+
+func (sink *SinkSession) finish() error {
+	if err := sink.ss.flush(); err != nil {
+		return err
+	}
+	if err := sink.ss.CloseStdin(); err != nil {
+		return err
+	}
+	return sink.ss.Wait()
+}
+
+// closeOnDone closes c when ctx is done before done is closed.
+func closeOnDone(ctx context.Context, done <-chan struct{}, c io.Closer) {
+	select {
+	case <-ctx.Done():
+		c.Close()
+	case <-done:
+	}
+}
+
+// joinRemotePath joins base, dirs and name with slashes.
+func joinRemotePath(base string, dirs []string, name string) string {
+	elems := append([]string{base}, dirs...)
+	return path.Join(append(elems, name)...)
+}
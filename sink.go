@@ -1,14 +1,16 @@
 package scp
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
-
-	"golang.org/x/crypto/ssh"
+	"time"
 )
 
 // Send reads a single local file content from the r,
@@ -16,13 +18,87 @@ import (
 // The time and permission will be set with the value of info.
 // The r will be closed after copying. If you don't want for r to be
 // closed, you can pass the result of ioutil.NopCloser(r).
-func (s *SCP) Send(info *FileInfo, r io.ReadCloser, destFile string) error {
-	destFile = filepath.Clean(destFile)
-	destFile = realPath(filepath.Dir(destFile))
+func (s *SCP) Send(info *FileInfo, r io.ReadCloser, destFile string) (err error) {
+	s, op := s.withTimeout()
+	defer op.finish(&err)
+	remotePath := s.cleanRemotePath(destFile)
+	destFile = path.Dir(remotePath)
+	info = s.nameNormalization.normalizeFileInfo(info)
+	if err := s.backupRemote(destFile, info.Name()); err != nil {
+		r.Close()
+		return err
+	}
+	if s.atomicUploads {
+		return s.sendAtomic(info, r, "", path.Join(destFile, info.Name()))
+	}
+
+	return s.runFileSinkSession(destFile, func(ss *sinkSession) error {
+		if err := s.writeFile(ss, info, r, "", remotePath); err != nil {
+			return fmt.Errorf("failed to copy file: err=%w", err)
+		}
+		return nil
+	})
+}
+
+// SendBytes copies data to the remote destFile with the permission mode,
+// for small files such as configuration files. The modification time is
+// set to the current time.
+func (s *SCP) SendBytes(data []byte, mode os.FileMode, destFile string) error {
+	now := time.Now()
+	info := NewFileInfo(path.Base(s.cleanRemotePath(destFile)), int64(len(data)), mode.Perm(), now, now)
+	return s.Send(info, ioutil.NopCloser(bytes.NewReader(data)), destFile)
+}
+
+// sendReaderMemoryLimit is the maximum size of the content which SendReader
+// holds in memory instead of a temporary file.
+const sendReaderMemoryLimit = 1 << 20
+
+// SendReader copies the content read from r until EOF to the remote destFile
+// with the permission mode, for content whose size is not known in advance,
+// such as the output of a command. Since the scp protocol requires the size
+// before the content, the content is held in memory, or in a temporary file
+// if it is larger than 1 MiB, before it is sent. The modification time is
+// set to the current time.
+func (s *SCP) SendReader(r io.Reader, mode os.FileMode, destFile string) error {
+	var buf bytes.Buffer
+	_, err := io.CopyN(&buf, r, sendReaderMemoryLimit+1)
+	if err == io.EOF {
+		return s.SendBytes(buf.Bytes(), mode, destFile)
+	} else if err != nil {
+		return fmt.Errorf("failed to read source: err=%w", err)
+	}
+
+	file, err := ioutil.TempFile("", "go-scp-spool-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: err=%w", err)
+	}
+	defer os.Remove(file.Name())
+	size, err := io.Copy(file, io.MultiReader(&buf, r))
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to spool source: err=%w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to seek temporary file: err=%w", err)
+	}
+	now := time.Now()
+	info := NewFileInfo(path.Base(s.cleanRemotePath(destFile)), size, mode.Perm(), now, now)
+	// NOTE: file will be closed by Send.
+	return s.Send(info, file, destFile)
+}
 
-	return runSinkSession(s.ctx, s.client, destFile, false, "", false, true, func(s *sinkSession) error {
-		if err := s.WriteFile(info, r); err != nil {
-			return fmt.Errorf("failed to copy file: err=%s", err)
+// sendToPath copies the content from r to the remote destFile in the same
+// way as SendFile, that is, the content is written to destFile itself or
+// under it with the name of info if destFile is an existing directory.
+// localPath is used only for the audit record.
+func (s *SCP) sendToPath(info *FileInfo, r io.ReadCloser, localPath, destFile string) error {
+	destFile = s.cleanRemotePath(destFile)
+	info = s.nameNormalization.normalizeFileInfo(info)
+
+	return s.runFileSinkSession(destFile, func(ss *sinkSession) error {
+		if err := s.writeFile(ss, info, r, localPath, destFile); err != nil {
+			return fmt.Errorf("failed to copy file: err=%w", err)
 		}
 		return nil
 	})
@@ -30,27 +106,115 @@ func (s *SCP) Send(info *FileInfo, r io.ReadCloser, destFile string) error {
 
 // SendFile copies a single local file to the remote server.
 // The time and permission will be set with the value of the source file.
-func (s *SCP) SendFile(srcFile, destFile string) error {
+func (s *SCP) SendFile(srcFile, destFile string) (err error) {
+	s, obs := s.observeOp("SendFile", srcFile, destFile)
+	defer obs.finish(&err)
+	s, op := s.withTimeout()
+	defer op.finish(&err)
+	// The backup is made once, since a failed attempt may leave a partial
+	// file.
+	if err := s.backupRemote(s.cleanRemotePath(destFile), s.nameNormalization.normalize(filepath.Base(srcFile))); err != nil {
+		return err
+	}
+	err = s.retry(func() error {
+		return s.sendFile(srcFile, destFile)
+	})
+	if err != nil || !s.preserveOwner {
+		return err
+	}
+	return s.chownRemoteFile(filepath.Clean(srcFile), s.cleanRemotePath(destFile))
+}
+
+// sendFile is SendFile without the retries.
+func (s *SCP) sendFile(srcFile, destFile string) error {
 	srcFile = filepath.Clean(srcFile)
-	destFile = realPath(filepath.Clean(destFile))
+	destFile = s.cleanRemotePath(destFile)
+	if s.base64Transfer {
+		return s.sendRemoteFile(srcFile, destFile, false)
+	}
+	if s.atomicUploads {
+		return s.sendFileAtomic(srcFile, destFile)
+	}
+	normalization := s.nameNormalization
+	scp := s
 
-	return runSinkSession(s.ctx, s.client, destFile, false, "", false, true, func(s *sinkSession) error {
+	err := s.runFileSinkSession(destFile, func(s *sinkSession) error {
 		osFileInfo, err := os.Stat(srcFile)
 		if err != nil {
-			return fmt.Errorf("failed to stat source file: err=%s", err)
+			return fmt.Errorf("failed to stat source file: err=%w", err)
 		}
-		fi := NewFileInfoFromOS(osFileInfo, "")
+		fi := normalization.normalizeFileInfo(NewFileInfoFromOS(osFileInfo, ""))
 
 		file, err := os.Open(srcFile)
 		if err != nil {
-			return fmt.Errorf("failed to open source file: err=%s", err)
+			return fmt.Errorf("failed to open source file: err=%w", err)
 		}
 		// NOTE: file will be closed by WriteFile.
-		if err := s.WriteFile(fi, file); err != nil {
-			return fmt.Errorf("failed to copy file: err=%s", err)
+		if err := scp.writeFile(s, fi, file, srcFile, destFile); err != nil {
+			return fmt.Errorf("failed to copy file: err=%w", err)
 		}
 		return nil
 	})
+	if s.fallsBackToCat(err) {
+		return s.sendRemoteFile(srcFile, destFile, false)
+	}
+	return err
+}
+
+// SendFiles copies the local files to the remote destDir in a single session,
+// which saves the cost of starting a session for each file. destDir must be
+// an existing directory. The time and permission will be set with the value
+// of each source file.
+func (s *SCP) SendFiles(srcFiles []string, destDir string) (err error) {
+	s, op := s.withTimeout()
+	defer op.finish(&err)
+	if s.backupSuffix != "" {
+		names := make([]string, len(srcFiles))
+		for i, srcFile := range srcFiles {
+			names[i] = s.nameNormalization.normalize(filepath.Base(srcFile))
+		}
+		if err := s.backupRemote(s.cleanRemotePath(destDir), names...); err != nil {
+			return err
+		}
+	}
+	return s.retry(func() error {
+		return s.sendFiles(srcFiles, destDir)
+	})
+}
+
+// sendFiles is SendFiles without the retries.
+func (s *SCP) sendFiles(srcFiles []string, destDir string) error {
+	destDir = s.cleanRemotePath(destDir)
+	return runSinkSession(s.sessionConfig(), destDir, true, false, func(ss *sinkSession) error {
+		for _, srcFile := range srcFiles {
+			srcFile = filepath.Clean(srcFile)
+			fi, file, err := s.openLocalFile(srcFile)
+			if err != nil {
+				return err
+			}
+			// NOTE: file will be closed by WriteFile.
+			if err := s.writeFile(ss, fi, file, srcFile, realPath(filepath.Join(destDir, fi.Name()))); err != nil {
+				return fmt.Errorf("failed to copy file: err=%w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// openLocalFile opens srcFile for sending and returns its normalized
+// information.
+func (s *SCP) openLocalFile(srcFile string) (*FileInfo, *os.File, error) {
+	osFileInfo, err := os.Stat(srcFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to stat source file: err=%w", err)
+	}
+	fi := s.nameNormalization.normalizeFileInfo(NewFileInfoFromOS(osFileInfo, ""))
+
+	file, err := os.Open(srcFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open source file: err=%w", err)
+	}
+	return fi, file, nil
 }
 
 // AcceptFunc is the type of the function called for each file or directory
@@ -67,102 +231,264 @@ func acceptAny(parentDir string, info os.FileInfo) (bool, error) {
 // to the remote destDir. You can filter the files and directories to be copied with acceptFn.
 // However this filtering is done at the receiver side, so all file bodies are transferred
 // over the network even if some files are filtered out. If you need more efficiency,
-// it is better to use another method like the tar command.
+// use WithTarStream to filter the files on the local side and send them with
+// the tar command.
 // If acceptFn is nil, all files and directories will be copied.
 // The time and permission will be set to the same value of the source file or directory.
-func (s *SCP) SendDir(srcDir, destDir string, acceptFn AcceptFunc) error {
+// The returned report summarizes the transfer, even if it fails.
+func (s *SCP) SendDir(srcDir, destDir string, acceptFn AcceptFunc) (report *TransferReport, err error) {
+	s, obs := s.observeOp("SendDir", srcDir, destDir)
+	defer obs.finish(&err)
+	s, op := s.withTimeout()
+	defer op.finish(&err)
+	s, r := s.withReporter()
+	if err := s.preScanLocal(srcDir); err != nil {
+		return r.finish(), err
+	}
+	err = s.retry(s.sendDirAttempt(srcDir, destDir, acceptFn, r))
+	return r.finish(), err
+}
+
+// sendDirTree is SendDir counting the entries with r.
+func (s *SCP) sendDirTree(srcDir, destDir string, acceptFn AcceptFunc, r *reporter) (err error) {
 	srcDir = filepath.Clean(srcDir)
-	destDir = realPath(filepath.Clean(destDir))
+	destDir = s.cleanRemotePath(destDir)
 	if acceptFn == nil {
 		acceptFn = acceptAny
 	}
+	acceptFn = s.excludeFilter(srcDir, acceptFn)
+	var top string
+	if s.sync != SyncNone || s.delete || s.preserveOwner {
+		if top, err = s.remoteTopDir(srcDir, destDir); err != nil {
+			return err
+		}
+	}
+	acceptFn, err = s.sendSyncFilter(srcDir, top, acceptFn)
+	if err != nil {
+		return err
+	}
+	acceptFn = r.accept(acceptFn)
+	if s.preserveOwner && s.mapFunc == nil {
+		owners := &ownerRecorder{top: srcDir, normalization: s.nameNormalization}
+		acceptFn = owners.record(acceptFn)
+		defer func() {
+			if err == nil {
+				err = s.chownRemote(top, owners.entries)
+			}
+		}()
+	}
+	if !s.delete {
+		return s.sendDir(srcDir, destDir, acceptFn)
+	}
 
-	return runSinkSession(s.ctx, s.client, destDir, false, "", true, true, func(s *sinkSession) error {
-		prevDirSkipped := false
+	m, err := s.newMirror(srcDir)
+	if err != nil {
+		return err
+	}
+	if err := s.sendDir(srcDir, destDir, m.record(acceptFn)); err != nil {
+		return err
+	}
+	return s.deleteRemoteExtraneous(top, m)
+}
 
-		endDirectories := func(prevDir, dir string) error {
-			rel, err := filepath.Rel(prevDir, dir)
-			if err != nil {
-				return err
-			}
-			for _, comp := range strings.Split(rel, string([]rune{filepath.Separator})) {
-				if comp == ".." {
-					if prevDirSkipped {
-						prevDirSkipped = false
-					} else {
-						err := s.EndDirectory()
-						if err != nil {
-							return err
-						}
-					}
-				}
-			}
-			return nil
+// sendDir sends the tree under srcDir with acceptFn in the mode set with
+// the options.
+func (s *SCP) sendDir(srcDir, destDir string, acceptFn AcceptFunc) error {
+	if s.tarStream {
+		return s.sendDirTar(srcDir, destDir, acceptFn)
+	}
+	if s.mapFunc != nil {
+		return s.sendDirMapped(srcDir, destDir, acceptFn)
+	}
+	return runSinkSession(s.sessionConfig(), destDir, false, true, func(ss *sinkSession) error {
+		if s.readAhead <= 0 {
+			return s.walkLocalDir(srcDir, destDir, acceptFn, &directDirSender{scp: s, ss: ss})
 		}
+		q := &queuedDirSender{}
+		if err := s.walkLocalDir(srcDir, destDir, acceptFn, q); err != nil {
+			return err
+		}
+		return q.send(s, ss)
+	})
+}
 
-		prevDir := srcDir
-		myWalkFn := func(path string, info os.FileInfo, err error) error {
-			// We must check err is not nil first.
-			// See https://golang.org/pkg/path/filepath/#WalkFunc
-			if err != nil {
-				return err
-			}
+// dirSender sends the entries found while walking a local tree with
+// walkLocalDir.
+type dirSender interface {
+	StartDirectory(dirInfo *FileInfo) error
+	EndDirectory() error
+	// sendFile sends the local file at path as remotePath.
+	sendFile(fi *FileInfo, path, remotePath string) error
+}
 
-			isDir := info.IsDir()
-			var dir string
-			if isDir {
-				dir = path
-			} else {
-				dir = filepath.Dir(path)
-			}
-			defer func() {
-				prevDir = dir
-			}()
+// directDirSender sends the entries over ss as they are found.
+type directDirSender struct {
+	scp *SCP
+	ss  *sinkSession
+}
 
-			if err := endDirectories(prevDir, dir); err != nil {
-				return err
-			}
+func (d *directDirSender) StartDirectory(dirInfo *FileInfo) error {
+	return d.ss.StartDirectory(dirInfo)
+}
 
-			scpFileInfo := NewFileInfoFromOS(info, "")
-			accepted, err := acceptFn(filepath.Dir(path), scpFileInfo)
-			if err != nil {
-				return err
-			}
+func (d *directDirSender) EndDirectory() error {
+	return d.ss.EndDirectory()
+}
 
-			if isDir {
-				if !accepted {
-					prevDirSkipped = true
-					return filepath.SkipDir
-				}
+func (d *directDirSender) sendFile(fi *FileInfo, path, remotePath string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return d.scp.writeFile(d.ss, fi, file, path, remotePath)
+}
 
-				if err := s.StartDirectory(scpFileInfo); err != nil {
-					return err
-				}
-			} else {
-				if accepted {
-					fi := NewFileInfoFromOS(info, "")
-					file, err := os.Open(path)
+// walkLocalDir walks the tree under srcDir and sends the accepted entries
+// with sender.
+func (s *SCP) walkLocalDir(srcDir, destDir string, acceptFn AcceptFunc, sender dirSender) error {
+	normalization := s.nameNormalization
+	prevDirSkipped := false
+	progress := s.progressSink()
+	// entered is the stack of the directories entered for the progress events.
+	var entered []string
+
+	endDirectories := func(prevDir, dir string) error {
+		rel, err := filepath.Rel(prevDir, dir)
+		if err != nil {
+			return err
+		}
+		for _, comp := range strings.Split(rel, string([]rune{filepath.Separator})) {
+			if comp == ".." {
+				if prevDirSkipped {
+					prevDirSkipped = false
+				} else {
+					err := sender.EndDirectory()
 					if err != nil {
 						return err
 					}
-					if err := s.WriteFile(fi, file); err != nil {
-						return err
+					if len(entered) > 0 {
+						progress.dir(EventDirLeft, DirectionUpload, entered[len(entered)-1])
+						entered = entered[:len(entered)-1]
 					}
 				}
 			}
-			return nil
 		}
-		if err := filepath.Walk(srcDir, myWalkFn); err != nil {
+		return nil
+	}
+
+	prevDir := srcDir
+	myWalkFn := func(path string, info os.FileInfo, err error) error {
+		// We must check err is not nil first.
+		// See https://golang.org/pkg/path/filepath/#WalkFunc
+		if err != nil {
+			return err
+		}
+
+		isDir := info.IsDir()
+		var dir string
+		if isDir {
+			dir = path
+		} else {
+			dir = filepath.Dir(path)
+		}
+		defer func() {
+			prevDir = dir
+		}()
+
+		if err := endDirectories(prevDir, dir); err != nil {
 			return err
 		}
 
-		return endDirectories(prevDir, srcDir)
-	})
+		scpFileInfo := NewFileInfoFromOS(info, "")
+		accepted, err := acceptFn(filepath.Dir(path), scpFileInfo)
+		if err != nil {
+			return err
+		}
+
+		if isDir {
+			if !accepted {
+				prevDirSkipped = true
+				return filepath.SkipDir
+			}
+
+			dirInfo := scpFileInfo
+			if path == srcDir && s.topDirName != "" {
+				dirInfo = NewFileInfoFromOS(info, s.topDirName)
+			}
+			if err := sender.StartDirectory(normalization.normalizeFileInfo(dirInfo)); err != nil {
+				return err
+			}
+			entered = append(entered, path)
+			progress.dir(EventDirEntered, DirectionUpload, path)
+		} else {
+			if accepted {
+				fi := normalization.normalizeFileInfo(NewFileInfoFromOS(info, ""))
+				rel, err := filepath.Rel(filepath.Dir(srcDir), path)
+				if err != nil {
+					return err
+				}
+				remotePath := realPath(filepath.Join(destDir, rel))
+				if err := sender.sendFile(fi, path, remotePath); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := filepath.Walk(srcDir, myWalkFn); err != nil {
+		return err
+	}
+
+	if err := endDirectories(prevDir, srcDir); err != nil {
+		return err
+	}
+	// The top directory is not ended in the protocol.
+	for i := len(entered) - 1; i >= 0; i-- {
+		progress.dir(EventDirLeft, DirectionUpload, entered[i])
+	}
+	return nil
+}
+
+// SendContext is like Send but uses ctx instead of the context set with
+// WithContext. When ctx is done, the session is closed and the send fails.
+func (s *SCP) SendContext(ctx context.Context, info *FileInfo, r io.ReadCloser, destFile string) error {
+	return s.withContext(ctx).Send(info, r, destFile)
+}
+
+// SendFileContext is like SendFile but uses ctx instead of the context set
+// with WithContext. When ctx is done, the session is closed and the send fails.
+func (s *SCP) SendFileContext(ctx context.Context, srcFile, destFile string) error {
+	return s.withContext(ctx).SendFile(srcFile, destFile)
+}
+
+// SendDirContext is like SendDir but uses ctx instead of the context set
+// with WithContext. When ctx is done, the session is closed and the send fails.
+func (s *SCP) SendDirContext(ctx context.Context, srcDir, destDir string, acceptFn AcceptFunc) (*TransferReport, error) {
+	return s.withContext(ctx).SendDir(srcDir, destDir, acceptFn)
+}
+
+// withContext returns a shallow copy of s which uses ctx.
+func (s *SCP) withContext(ctx context.Context) *SCP {
+	c := *s
+	c.ctx = ctx
+	return &c
+}
+
+// writeFile writes the file over ss and records it with the audit hook.
+// localPath and remotePath are used only for the audit record.
+func (s *SCP) writeFile(ss *sinkSession, fi *FileInfo, body io.ReadCloser, localPath, remotePath string) error {
+	if file, ok := body.(*os.File); ok && s.sparseFiles {
+		body = newSparseReader(file, fi.Size())
+	}
+	a := s.newAuditor(DirectionUpload, localPath, remotePath)
+	a.attach(&ss.tee)
+	err := ss.WriteFile(fi, body)
+	a.finish(err)
+	return err
 }
 
 type sinkSession struct {
-	client            *ssh.Client
-	session           *ssh.Session
+	session           Session
 	remoteDestPath    string
 	remoteDestIsDir   bool
 	scpPath           string
@@ -170,25 +496,31 @@ type sinkSession struct {
 	updatesPermission bool
 	stdin             io.WriteCloser
 	stdout            io.Reader
+	teardown          *teardown
 	*sourceProtocol
 }
 
-func newSinkSession(client *ssh.Client, remoteDestPath string, remoteDestIsDir bool, scpPath string, recursive, updatesPermission bool) (*sinkSession, error) {
+func newSinkSession(cfg *sessionConfig, remoteDestPath string, remoteDestIsDir, recursive bool) (*sinkSession, error) {
 	s := &sinkSession{
-		client:            client,
 		remoteDestPath:    remoteDestPath,
 		remoteDestIsDir:   remoteDestIsDir,
-		scpPath:           scpPath,
+		scpPath:           cfg.scpPath,
 		recursive:         recursive,
-		updatesPermission: updatesPermission,
+		updatesPermission: cfg.updatesPermission,
 	}
 
-	var err error
-	s.session, err = s.client.NewSession()
+	usage, err := cfg.accounting.startSession(cfg.remoteAddr())
 	if err != nil {
 		return nil, err
 	}
 
+	s.session, err = cfg.newScpSession()
+	if err != nil {
+		return nil, err
+	}
+	usage.started()
+	s.teardown = cfg.newTeardown(s.session)
+
 	s.stdout, err = s.session.StdoutPipe()
 	if err != nil {
 		_ = s.session.Close()
@@ -200,6 +532,11 @@ func newSinkSession(client *ssh.Client, remoteDestPath string, remoteDestIsDir b
 		_ = s.session.Close()
 		return nil, err
 	}
+	s.stdin, s.stdout = usage.wrap(s.stdin, s.stdout)
+	s.stdin, s.stdout = cfg.usage.wrap(s.stdin, s.stdout)
+	s.stdin, s.stdout = cfg.hostMetrics().wrap(s.stdin, s.stdout)
+	s.stdin, s.stdout = s.teardown.idle.wrap(s.stdin, s.stdout)
+	s.stdin, s.stdout = cfg.pause.wrap(s.stdin, s.stdout)
 
 	if s.scpPath == "" {
 		s.scpPath = "scp"
@@ -216,16 +553,27 @@ func newSinkSession(client *ssh.Client, remoteDestPath string, remoteDestIsDir b
 		opt = append(opt, 'd')
 	}
 
-	cmd := s.scpPath + " " + string(opt) + " " + escapeShellArg(s.remoteDestPath)
-	if err := s.session.Start(cmd); err != nil {
+	cmd := cfg.scpCommand(s.scpPath, cfg.scpOptions(opt), cfg.quoting.quote(s.remoteDestPath))
+	s.teardown.cmd = cmd
+	s.stdin, s.stdout = cfg.protocolTrace.wrap(cmd, s.stdin, s.stdout)
+	if err := cfg.start(s.session, s.stdin, cmd, s.teardown.log); err != nil {
 		_ = s.session.Close()
 		return nil, err
 	}
+	s.teardown.active = startExpvarSession()
 
 	s.sourceProtocol, err = newSourceProtocol(s.stdin, s.stdout)
 	if err != nil {
+		err = s.teardown.explain(s.session, err)
+		_ = s.Close()
 		return nil, err
 	}
+	s.sourceProtocol.fileTimer = s.teardown.file
+	s.sourceProtocol.forcedMode = cfg.forcedMode
+	s.sourceProtocol.omitsTime = !s.updatesPermission
+	s.sourceProtocol.bufferSize = cfg.bufferSize
+	s.sourceProtocol.pipeline = cfg.pipeline
+	s.sourceProtocol.log = s.teardown.log
 	return s, nil
 }
 
@@ -233,6 +581,7 @@ func (s *sinkSession) Close() error {
 	if s == nil || s.session == nil {
 		return nil
 	}
+	s.teardown.active.end()
 	return s.session.Close()
 }
 
@@ -240,7 +589,7 @@ func (s *sinkSession) Wait() error {
 	if s == nil || s.session == nil {
 		return nil
 	}
-	return s.session.Wait()
+	return s.teardown.wait(s.session)
 }
 
 func (s *sinkSession) CloseStdin() error {
@@ -250,14 +599,14 @@ func (s *sinkSession) CloseStdin() error {
 	return s.stdin.Close()
 }
 
-func runSinkSession(ctx context.Context, client *ssh.Client, remoteDestPath string, remoteDestIsDir bool, scpPath string, recursive, updatesPermission bool, handler func(s *sinkSession) error) error {
-	s, err := newSinkSession(client, remoteDestPath, remoteDestIsDir, scpPath, recursive, updatesPermission)
+func runSinkSession(cfg *sessionConfig, remoteDestPath string, remoteDestIsDir, recursive bool, handler func(s *sinkSession) error) error {
+	s, err := newSinkSession(cfg, remoteDestPath, remoteDestIsDir, recursive)
 	if err != nil {
 		return err
 	}
 	defer s.Close()
 	go func() {
-		done := ctx.Done()
+		done := cfg.ctx.Done()
 		// can never canceled
 		if done == nil {
 			return
@@ -270,9 +619,12 @@ func runSinkSession(ctx context.Context, client *ssh.Client, remoteDestPath stri
 	if err := func() error {
 		defer s.CloseStdin()
 
-		return handler(s)
+		if err := handler(s); err != nil {
+			return err
+		}
+		return s.flush()
 	}(); err != nil {
-		return err
+		return s.teardown.explain(s.session, err)
 	}
 	return s.Wait()
 }
@@ -3,26 +3,40 @@
 package scp
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/big"
 	"net"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/hnakamur/go-sshd"
+	"github.com/ljun20160606/go-scp/scptest"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 func TestSendFile(t *testing.T) {
@@ -68,6 +82,36 @@ func TestSendFile(t *testing.T) {
 		}
 	})
 
+	t.Run("Cancel send file with per-call context", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		localPath := filepath.Join(localDir, "test1.dat")
+		if err := generateRandomFile(localPath); err != nil {
+			t.Fatalf("fail to generate local file; %s", err)
+		}
+
+		s := NewSCP(c)
+		ctx, cancelFunc := context.WithCancel(context.Background())
+		cancelFunc()
+		if err := s.SendFileContext(ctx, localPath, remoteDir); err == nil {
+			t.Errorf("send with canceled context must fail")
+		}
+		if err := s.SendFileContext(context.Background(), localPath, remoteDir); err != nil {
+			t.Errorf("fail to SendFileContext; %s", err)
+		}
+		sameDirTreeContent(t, remoteDir, localDir)
+	})
+
 	t.Run("Random sized file", func(t *testing.T) {
 		localDir, err := ioutil.TempDir("", "go-scp-TestSendFile-local")
 		if err != nil {
@@ -148,514 +192,3352 @@ func TestSendFile(t *testing.T) {
 		}
 		sameDirTreeContent(t, localDir, remoteDir)
 	})
-}
-
-func TestSendDir(t *testing.T) {
-	s, l, err := newTestSshdServer()
-	if err != nil {
-		t.Fatalf("fail to create test sshd server; %s", err)
-	}
-	defer s.Close()
-	go s.Serve(l)
-
-	c, err := newTestSshClient(l.Addr().String())
-	if err != nil {
-		t.Fatalf("fail to serve test sshd server; %s", err)
-	}
-	defer c.Close()
 
-	t.Run("dest dir not exist", func(t *testing.T) {
-		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+	t.Run("Account usage per host", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendFile-local")
 		if err != nil {
 			t.Fatalf("fail to get tempdir; %s", err)
 		}
 		defer os.RemoveAll(localDir)
 
-		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
 		if err != nil {
 			t.Fatalf("fail to get tempdir; %s", err)
 		}
 		defer os.RemoveAll(remoteDir)
 
-		entries := []fileInfo{
-			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
-			{name: "bar", maxSize: testMaxFileSize, mode: 0600},
-			{name: "baz", isDir: true, mode: 0755,
-				entries: []fileInfo{
-					{name: "foo", maxSize: testMaxFileSize, mode: 0400},
-					{name: "hoge", maxSize: testMaxFileSize, mode: 0602},
-					{name: "emptyDir", isDir: true, mode: 0500},
-				},
-			},
+		localPath := filepath.Join(localDir, "test1.dat")
+		size := int64(4096)
+		if err := generateRandomFileWithSize(localPath, size); err != nil {
+			t.Fatalf("fail to generate local file; %s", err)
 		}
-		if err := generateRandomFiles(localDir, entries); err != nil {
-			t.Fatalf("fail to generate local files; %s", err)
+
+		accounting := NewAccounting()
+		addr := c.RemoteAddr().String()
+		if err := NewSCP(c, WithAccounting(accounting)).SendFile(localPath, remoteDir); err != nil {
+			t.Fatalf("fail to SendFile; %s", err)
+		}
+		usage := accounting.Usage(addr)
+		if usage.Sessions != 1 {
+			t.Errorf("unmatch session count. got:%d, want:1", usage.Sessions)
+		}
+		if usage.BytesSent < size {
+			t.Errorf("sent bytes must include the file body. got:%d, want>=%d", usage.BytesSent, size)
 		}
 
-		remoteDestDir := filepath.Join(remoteDir, "dest")
-		if err := NewSCP(c).SendDir(localDir, remoteDestDir, nil); err != nil {
-			t.Errorf("fail to SendDir; %s", err)
+		accounting.SetBudget(addr, size)
+		err = NewSCP(c, WithAccounting(accounting)).SendFile(localPath, remoteDir)
+		if err != ErrBudgetExceeded {
+			t.Errorf("unmatch error. got:%v, want:%v", err, ErrBudgetExceeded)
+		}
+
+		// A session which cannot be opened is not counted.
+		failing := NewAccounting()
+		if err := NewSCP(nil, WithTransport(failingTransport{}), WithAccounting(failing)).SendFile(localPath, remoteDir); !errors.Is(err, errNoSession) {
+			t.Errorf("unmatch error. got:%v, want:%v", err, errNoSession)
+		}
+		if sessions := failing.Usage("").Sessions; sessions != 0 {
+			t.Errorf("unmatch session count. got:%d, want:0", sessions)
 		}
-		sameDirTreeContent(t, localDir, remoteDestDir)
 	})
 
-	t.Run("dest dir exists", func(t *testing.T) {
-		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+	t.Run("Protocol trace", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendFile-local")
 		if err != nil {
 			t.Fatalf("fail to get tempdir; %s", err)
 		}
 		defer os.RemoveAll(localDir)
 
-		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
 		if err != nil {
 			t.Fatalf("fail to get tempdir; %s", err)
 		}
 		defer os.RemoveAll(remoteDir)
 
-		entries := []fileInfo{
-			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
-			{name: "bar", maxSize: testMaxFileSize, mode: 0600},
-			{name: "baz", isDir: true, mode: 0755,
-				entries: []fileInfo{
-					{name: "foo", maxSize: testMaxFileSize, mode: 0400},
-					{name: "hoge", maxSize: testMaxFileSize, mode: 0602},
-					{name: "emptyDir", isDir: true, mode: 0500},
-				},
-			},
+		localPath := filepath.Join(localDir, "test1.dat")
+		if err := ioutil.WriteFile(localPath, []byte("content\n"), 0644); err != nil {
+			t.Fatalf("fail to write file; %s", err)
 		}
-		if err := generateRandomFiles(localDir, entries); err != nil {
-			t.Fatalf("fail to generate local files; %s", err)
+		mtime := time.Unix(1600000000, 0)
+		if err := os.Chtimes(localPath, mtime, mtime); err != nil {
+			t.Fatalf("fail to change times; %s", err)
 		}
 
-		if err := NewSCP(c).SendDir(localDir, remoteDir, nil); err != nil {
-			t.Errorf("fail to SendDir; %s", err)
+		var trace bytes.Buffer
+		s := NewSCP(c, WithProtocolTrace(&trace))
+		if err := s.SendFile(localPath, remoteDir); err != nil {
+			t.Fatalf("fail to SendFile; %s", err)
+		}
+		if err := s.SendFile(localPath, filepath.Join(remoteDir, "missing", "test1.dat")); err == nil {
+			t.Fatalf("SendFile must fail for missing directory")
+		}
+		lines := strings.Split(trace.String(), "\n")
+		want := []string{
+			fmt.Sprintf("[1] session: scp -tp '%s'", remoteDir),
+			"[1] < ok",
+			"[1] > T1600000000 0 1600000000 0",
+			"[1] < ok",
+			"[1] > C0644 8 test1.dat",
+			"[1] > (8 bytes of file body)",
+			"[1] < ok",
+			"[1] > ok",
+			"[1] < ok",
+			"[1] > (eof)",
+		}
+		if len(lines) < len(want) || !reflect.DeepEqual(lines[:len(want)], want) {
+			t.Errorf("unmatch trace.\ngot: %q\nwant:%q", lines, want)
+		}
+		errLine := fmt.Sprintf("[2] < error: scp: %s: No such file or directory", filepath.Join(remoteDir, "missing", "test1.dat"))
+		if !strings.Contains(trace.String(), errLine+"\n") {
+			t.Errorf("trace must have the error reply %q. got:\n%s", errLine, trace.String())
 		}
-		localDirBase := filepath.Base(localDir)
-		remoteDestDir := filepath.Join(remoteDir, localDirBase)
-		sameDirTreeContent(t, localDir, remoteDestDir)
 	})
 
-	t.Run("send only files case #1 dest dir exists", func(t *testing.T) {
-		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+	t.Run("Persistent session", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendFile-local")
 		if err != nil {
 			t.Fatalf("fail to get tempdir; %s", err)
 		}
 		defer os.RemoveAll(localDir)
 
-		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
 		if err != nil {
 			t.Fatalf("fail to get tempdir; %s", err)
 		}
 		defer os.RemoveAll(remoteDir)
 
-		entries := []fileInfo{
-			{name: "01_file", maxSize: testMaxFileSize, mode: 0644},
-			{name: "02_file", maxSize: testMaxFileSize, mode: 0600},
-			{name: "03_dir", isDir: true, mode: 0755,
-				entries: []fileInfo{
-					{name: "01_file", maxSize: testMaxFileSize, mode: 0600},
-					{name: "02_file", maxSize: testMaxFileSize, mode: 0600},
-				},
-			},
-		}
-		if err := generateRandomFiles(localDir, entries); err != nil {
-			t.Fatalf("fail to generate local files; %s", err)
+		accounting := NewAccounting()
+		s := NewSCP(c, WithPersistentSession(), WithAccounting(accounting))
+		names := []string{"test1.dat", "test2.dat", "test3.dat"}
+		for _, name := range names {
+			localPath := filepath.Join(localDir, name)
+			if err := generateRandomFile(localPath); err != nil {
+				t.Fatalf("fail to generate local file; %s", err)
+			}
+			if err := s.SendFile(localPath, remoteDir); err != nil {
+				t.Fatalf("fail to SendFile; %s", err)
+			}
 		}
-
-		if err := NewSCP(c).SendDir(localDir, remoteDir, func(parentDir string, info os.FileInfo) (bool, error) {
-			current := filepath.Join(parentDir, info.Name())
-			return localDir == current || (localDir == parentDir && !info.IsDir()), nil
-		}); err != nil {
-			t.Errorf("fail to SendDir; %s", err)
+		if err := s.Close(); err != nil {
+			t.Errorf("fail to Close; %s", err)
 		}
-		localDirBase := filepath.Base(localDir)
-		remoteDestDir := filepath.Join(remoteDir, localDirBase)
-		if err := os.RemoveAll(filepath.Join(localDir, "03_dir")); err != nil {
-			t.Errorf("fail to remove directory; %s", err)
+		if sessions := accounting.Usage(c.RemoteAddr().String()).Sessions; sessions != 1 {
+			t.Errorf("unmatch session count. got:%d, want:1", sessions)
 		}
-		sameDirTreeContent(t, localDir, remoteDestDir)
+		sameDirTreeContent(t, remoteDir, localDir)
 	})
 
-	t.Run("send only files case #2 dest dir exists", func(t *testing.T) {
-		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+	t.Run("Send multiple files", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendFile-local")
 		if err != nil {
 			t.Fatalf("fail to get tempdir; %s", err)
 		}
 		defer os.RemoveAll(localDir)
 
-		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
 		if err != nil {
 			t.Fatalf("fail to get tempdir; %s", err)
 		}
 		defer os.RemoveAll(remoteDir)
 
-		entries := []fileInfo{
-			{name: "01_dir", isDir: true, mode: 0755,
-				entries: []fileInfo{
-					{name: "01_file", maxSize: testMaxFileSize, mode: 0600},
-					{name: "02_file", maxSize: testMaxFileSize, mode: 0600},
-				},
-			},
-			{name: "02_file", maxSize: testMaxFileSize, mode: 0644},
-			{name: "03_file", maxSize: testMaxFileSize, mode: 0600},
-		}
-		if err := generateRandomFiles(localDir, entries); err != nil {
-			t.Fatalf("fail to generate local files; %s", err)
+		var srcFiles []string
+		for _, name := range []string{"test1.dat", "test2.dat", "test3.dat"} {
+			localPath := filepath.Join(localDir, name)
+			if err := generateRandomFile(localPath); err != nil {
+				t.Fatalf("fail to generate local file; %s", err)
+			}
+			srcFiles = append(srcFiles, localPath)
 		}
 
-		if err := NewSCP(c).SendDir(localDir, remoteDir, func(parentDir string, info os.FileInfo) (bool, error) {
-			current := filepath.Join(parentDir, info.Name())
-			return localDir == current || (localDir == parentDir && !info.IsDir()), nil
-		}); err != nil {
-			t.Errorf("fail to SendDir; %s", err)
+		accounting := NewAccounting()
+		if err := NewSCP(c, WithAccounting(accounting)).SendFiles(srcFiles, remoteDir); err != nil {
+			t.Fatalf("fail to SendFiles; %s", err)
 		}
-		localDirBase := filepath.Base(localDir)
-		remoteDestDir := filepath.Join(remoteDir, localDirBase)
-		if err := os.RemoveAll(filepath.Join(localDir, "01_dir")); err != nil {
-			t.Errorf("fail to remove directory; %s", err)
+		if sessions := accounting.Usage(c.RemoteAddr().String()).Sessions; sessions != 1 {
+			t.Errorf("unmatch session count. got:%d, want:1", sessions)
 		}
-		sameDirTreeContent(t, localDir, remoteDestDir)
+		sameDirTreeContent(t, remoteDir, localDir)
 	})
-	t.Run("send only files case #3 dest dir not exists", func(t *testing.T) {
-		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+
+	t.Run("Send glob", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendFile-local")
 		if err != nil {
 			t.Fatalf("fail to get tempdir; %s", err)
 		}
 		defer os.RemoveAll(localDir)
 
-		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
 		if err != nil {
 			t.Fatalf("fail to get tempdir; %s", err)
 		}
 		defer os.RemoveAll(remoteDir)
-		remoteDir = filepath.Join(remoteDir, "dest")
 
-		entries := []fileInfo{
-			{name: "01_file", maxSize: testMaxFileSize, mode: 0644},
-			{name: "02_file", maxSize: testMaxFileSize, mode: 0600},
-			{name: "03_dir", isDir: true, mode: 0755,
-				entries: []fileInfo{
-					{name: "01_file", maxSize: testMaxFileSize, mode: 0600},
-					{name: "02_file", maxSize: testMaxFileSize, mode: 0600},
-				},
-			},
+		for _, name := range []string{"test1.dat", "test2.dat", "test3.log"} {
+			if err := generateRandomFile(filepath.Join(localDir, name)); err != nil {
+				t.Fatalf("fail to generate local file; %s", err)
+			}
 		}
-		if err := generateRandomFiles(localDir, entries); err != nil {
-			t.Fatalf("fail to generate local files; %s", err)
+		if err := os.Mkdir(filepath.Join(localDir, "dir.dat"), 0755); err != nil {
+			t.Fatalf("fail to create directory; %s", err)
 		}
 
-		if err := NewSCP(c).SendDir(localDir, remoteDir, func(parentDir string, info os.FileInfo) (bool, error) {
-			current := filepath.Join(parentDir, info.Name())
-			return localDir == current || (localDir == parentDir && !info.IsDir()), nil
-		}); err != nil {
-			t.Errorf("fail to SendDir; %s", err)
+		results, err := NewSCP(c).SendGlob(filepath.Join(localDir, "*.dat"), remoteDir)
+		if err != nil {
+			t.Fatalf("fail to SendGlob; %s", err)
 		}
-
-		if err := os.RemoveAll(filepath.Join(localDir, "03_dir")); err != nil {
-			t.Errorf("fail to remove directory; %s", err)
+		if len(results) != 3 {
+			t.Fatalf("unmatch result count. got:%d, want:3", len(results))
+		}
+		failed := results.Failed()
+		if len(failed) != 1 || failed[0].Path != filepath.Join(localDir, "dir.dat") {
+			t.Errorf("only the directory must fail. got:%+v", failed)
+		}
+		sameFileInfoAndContent(t, remoteDir, localDir, "test1.dat", "test1.dat")
+		sameFileInfoAndContent(t, remoteDir, localDir, "test2.dat", "test2.dat")
+		if _, err := os.Stat(filepath.Join(remoteDir, "test3.log")); !os.IsNotExist(err) {
+			t.Errorf("unmatched file must not be sent; %v", err)
 		}
-		sameDirTreeContent(t, localDir, remoteDir)
 	})
 
-	t.Run("send only files case #4 dest dir not exists", func(t *testing.T) {
-		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+	t.Run("Resume", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendFile-local")
 		if err != nil {
 			t.Fatalf("fail to get tempdir; %s", err)
 		}
 		defer os.RemoveAll(localDir)
 
-		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
 		if err != nil {
 			t.Fatalf("fail to get tempdir; %s", err)
 		}
 		defer os.RemoveAll(remoteDir)
-		remoteDir = filepath.Join(remoteDir, "dest")
 
-		entries := []fileInfo{
-			{name: "01_dir", isDir: true, mode: 0755,
-				entries: []fileInfo{
-					{name: "01_file", maxSize: testMaxFileSize, mode: 0600},
-					{name: "02_file", maxSize: testMaxFileSize, mode: 0600},
-				},
-			},
-			{name: "02_file", maxSize: testMaxFileSize, mode: 0644},
-			{name: "03_file", maxSize: testMaxFileSize, mode: 0600},
+		localName := "test1.dat"
+		localPath := filepath.Join(localDir, localName)
+		if err := generateRandomFileWithSizeAndMode(localPath, 4096, 0640); err != nil {
+			t.Fatalf("fail to generate local file; %s", err)
 		}
-		if err := generateRandomFiles(localDir, entries); err != nil {
-			t.Fatalf("fail to generate local files; %s", err)
+		data, err := ioutil.ReadFile(localPath)
+		if err != nil {
+			t.Fatalf("fail to read local file; %s", err)
 		}
-
-		if err := NewSCP(c).SendDir(localDir, remoteDir, func(parentDir string, info os.FileInfo) (bool, error) {
-			current := filepath.Join(parentDir, info.Name())
-			return localDir == current || (localDir == parentDir && !info.IsDir()), nil
-		}); err != nil {
-			t.Errorf("fail to SendDir; %s", err)
+		if err := ioutil.WriteFile(filepath.Join(remoteDir, localName), data[:1000], 0600); err != nil {
+			t.Fatalf("fail to write partial remote file; %s", err)
 		}
 
-		if err := os.RemoveAll(filepath.Join(localDir, "01_dir")); err != nil {
-			t.Errorf("fail to remove directory; %s", err)
+		accounting := NewAccounting()
+		if err := NewSCP(c, WithAccounting(accounting)).SendFileResume(localPath, remoteDir); err != nil {
+			t.Fatalf("fail to SendFileResume; %s", err)
+		}
+		sameFileInfoAndContent(t, remoteDir, localDir, localName, localName)
+		if sent := accounting.Usage(c.RemoteAddr().String()).BytesSent; sent >= int64(len(data)) {
+			t.Errorf("sent bytes must exclude the existing content. got:%d", sent)
 		}
-		sameDirTreeContent(t, localDir, remoteDir)
 	})
-}
 
-var (
-	testMaxFileSize  = int64(1024 * 1024)
-	testSshdUser     = "user1"
-	testSshdPassword = "password1"
-	testSshdShell    = "sh"
-)
+	t.Run("Teardown timeout", func(t *testing.T) {
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
 
-func newTestSshdServer() (*sshd.Server, net.Listener, error) {
-	config := &ssh.ServerConfig{
-		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			if c.User() == testSshdUser && string(pass) == testSshdPassword {
-				return nil, nil
-			}
-			return nil, fmt.Errorf("password rejected for %q", c.User())
-		},
-	}
-	testSshdKey, err := generateTestSshdKey()
-	if err != nil {
-		return nil, nil, err
-	}
-	private, err := ssh.ParsePrivateKey(testSshdKey)
-	if err != nil {
-		return nil, nil, err
-	}
+		s := NewSCP(c, WithTeardownTimeout(200*time.Millisecond))
+		cfg := s.sessionConfig()
+		// The remote command keeps running after scp exits.
+		cfg.scpPath = `sh -c 'scp "$@"; sleep 5' sh`
+		content := []byte("content\n")
+		info := NewFileInfo("dest.dat", int64(len(content)), 0644, time.Now(), time.Now())
+		start := time.Now()
+		err = runSinkSession(cfg, remoteDir, false, false, func(s *sinkSession) error {
+			return s.WriteFile(info, ioutil.NopCloser(bytes.NewReader(content)))
+		})
+		if !errors.Is(err, ErrTeardownTimeout) {
+			t.Fatalf("unmatch error. got:%v, want:%v", err, ErrTeardownTimeout)
+		}
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("teardown must not wait for the remote command. elapsed:%s", elapsed)
+		}
+	})
 
-	config.AddHostKey(private)
+	t.Run("Idle timeout", func(t *testing.T) {
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
 
-	server := sshd.NewServer(testSshdShell, config, nil)
-	l, err := net.Listen("tcp", ":0")
-	if err != nil {
-		return nil, nil, err
-	}
-	return server, l, err
-}
+		s := NewSCP(c, WithIdleTimeout(200*time.Millisecond))
+		cfg := s.sessionConfig()
+		// The remote command never replies.
+		cfg.scpPath = `sh -c 'sleep 5' sh`
+		start := time.Now()
+		err = runSinkSession(cfg, remoteDir, false, false, func(s *sinkSession) error {
+			return nil
+		})
+		if !errors.Is(err, ErrIdleTimeout) {
+			t.Fatalf("unmatch error. got:%v, want:%v", err, ErrIdleTimeout)
+		}
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("transfer must be aborted at the idle timeout. elapsed:%s", elapsed)
+		}
+	})
 
-func generateTestSshdKey() ([]byte, error) {
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
+	t.Run("Timeout", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		localPath := filepath.Join(localDir, "test1.dat")
+		if err := generateRandomFile(localPath); err != nil {
+			t.Fatalf("fail to generate local file; %s", err)
+		}
+		// The remote scp blocks in opening the FIFO without a reader.
+		remotePath := filepath.Join(remoteDir, "fifo")
+		if err := syscall.Mkfifo(remotePath, 0644); err != nil {
+			t.Fatalf("fail to create fifo; %s", err)
+		}
+		defer func() {
+			// Unblock the remote scp.
+			if f, err := os.OpenFile(remotePath, os.O_RDONLY|syscall.O_NONBLOCK, 0); err == nil {
+				f.Close()
+			}
+		}()
+
+		for _, option := range []ScpOption{
+			WithTimeout(200 * time.Millisecond),
+			WithPerFileTimeout(200 * time.Millisecond),
+		} {
+			start := time.Now()
+			err := NewSCP(c, option).SendFile(localPath, remotePath)
+			if !errors.Is(err, ErrTimeout) {
+				t.Errorf("unmatch error. got:%v, want:%v", err, ErrTimeout)
+			}
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("transfer must be aborted at the timeout. elapsed:%s", elapsed)
+			}
+		}
+	})
+
+	t.Run("Scp path", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		localName := "test1.dat"
+		localPath := filepath.Join(localDir, localName)
+		if err := generateRandomFile(localPath); err != nil {
+			t.Fatalf("fail to generate local file; %s", err)
+		}
+
+		s := NewSCP(c, WithScpPath("go-scp-no-such-command"))
+		err = s.SendFile(localPath, remoteDir)
+		var cmdErr *CommandError
+		if !errors.As(err, &cmdErr) || !strings.HasPrefix(cmdErr.Cmd, "go-scp-no-such-command ") {
+			t.Errorf("scp path must be used. got:%v", err)
+		}
+
+		scpPath, err := exec.LookPath("scp")
+		if err != nil {
+			t.Fatalf("fail to find scp; %s", err)
+		}
+		if err := s.With(WithScpPath(scpPath)).SendFile(localPath, remoteDir); err != nil {
+			t.Errorf("fail to SendFile; %s", err)
+		}
+		sameFileInfoAndContent(t, remoteDir, localDir, localName, localName)
+	})
+
+	t.Run("Cat fallback", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		localName := "test1.dat"
+		localPath := filepath.Join(localDir, localName)
+		if err := generateRandomFile(localPath); err != nil {
+			t.Fatalf("fail to generate local file; %s", err)
+		}
+
+		s := NewSCP(c, WithScpPath("go-scp-no-such-command"), WithCatFallback())
+		if err := s.SendFile(localPath, remoteDir); err != nil {
+			t.Fatalf("fail to SendFile; %s", err)
+		}
+		sameFileInfoAndContent(t, remoteDir, localDir, localName, localName)
+
+		receivedName := "test2.dat"
+		if err := s.ReceiveFile(filepath.Join(remoteDir, localName), filepath.Join(localDir, receivedName)); err != nil {
+			t.Fatalf("fail to ReceiveFile; %s", err)
+		}
+		sameFileInfoAndContent(t, remoteDir, localDir, localName, receivedName)
+
+		err = s.ReceiveFile(filepath.Join(remoteDir, "not-exist.dat"), localDir)
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("must be not exist error. got:%v", err)
+		}
+	})
+
+	t.Run("Base64 transfer", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		localName := "test1.dat"
+		localPath := filepath.Join(localDir, localName)
+		if err := generateRandomFile(localPath); err != nil {
+			t.Fatalf("fail to generate local file; %s", err)
+		}
+
+		// scp is never run in this mode.
+		s := NewSCP(c, WithScpPath("go-scp-no-such-command"), WithBase64Transfer())
+		if err := s.SendFile(localPath, remoteDir); err != nil {
+			t.Fatalf("fail to SendFile; %s", err)
+		}
+		sameFileInfoAndContent(t, remoteDir, localDir, localName, localName)
+
+		receivedName := "test2.dat"
+		if err := s.ReceiveFile(filepath.Join(remoteDir, localName), filepath.Join(localDir, receivedName)); err != nil {
+			t.Fatalf("fail to ReceiveFile; %s", err)
+		}
+		sameFileInfoAndContent(t, remoteDir, localDir, localName, receivedName)
+	})
+
+	t.Run("Bytes", func(t *testing.T) {
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		data := []byte("key = value\n")
+		remotePath := filepath.Join(remoteDir, "config.toml")
+		s := NewSCP(c)
+		if err := s.SendBytes(data, 0600, remotePath); err != nil {
+			t.Fatalf("fail to SendBytes; %s", err)
+		}
+		got, fi, err := s.ReceiveBytes(remotePath)
+		if err != nil {
+			t.Fatalf("fail to ReceiveBytes; %s", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("unmatch content. got:%q, want:%q", got, data)
+		}
+		if fi.Name() != "config.toml" || fi.Mode().Perm() != 0600 || fi.Size() != int64(len(data)) {
+			t.Errorf("unmatch file info. got:%s %s %d", fi.Name(), fi.Mode(), fi.Size())
+		}
+	})
+
+	t.Run("Reader", func(t *testing.T) {
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		s := NewSCP(c)
+		for _, size := range []int64{100, sendReaderMemoryLimit + 100} {
+			data := make([]byte, size)
+			if _, err := rand.Read(data); err != nil {
+				t.Fatalf("fail to generate data; %s", err)
+			}
+			remotePath := filepath.Join(remoteDir, "out.dat")
+			// Hide the size of bytes.Reader.
+			r := io.MultiReader(bytes.NewReader(data))
+			if err := s.SendReader(r, 0644, remotePath); err != nil {
+				t.Fatalf("fail to SendReader; %s", err)
+			}
+			got, err := ioutil.ReadFile(remotePath)
+			if err != nil {
+				t.Fatalf("fail to read remote file; %s", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("unmatch content of size %d", size)
+			}
+		}
+	})
+
+	t.Run("Atomic uploads", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		localName := "test1.dat"
+		localPath := filepath.Join(localDir, localName)
+		if err := generateRandomFile(localPath); err != nil {
+			t.Fatalf("fail to generate local file; %s", err)
+		}
+
+		s := NewSCP(c, WithAtomicUploads())
+		if err := s.SendFile(localPath, remoteDir); err != nil {
+			t.Fatalf("fail to SendFile; %s", err)
+		}
+		sameFileInfoAndContent(t, remoteDir, localDir, localName, localName)
+		if err := s.SendFile(localPath, filepath.Join(remoteDir, "test2.dat")); err != nil {
+			t.Fatalf("fail to SendFile; %s", err)
+		}
+		sameFileInfoAndContent(t, remoteDir, localDir, "test2.dat", localName)
+
+		// A failed upload must keep the existing file.
+		info := NewFileInfo("test2.dat", 1<<20, 0644, time.Now(), time.Now())
+		r := ioutil.NopCloser(io.MultiReader(strings.NewReader("partial"), iotest.TimeoutReader(strings.NewReader("x"))))
+		if err := s.Send(info, r, filepath.Join(remoteDir, "test2.dat")); err == nil {
+			t.Errorf("upload of short content must fail")
+		}
+		sameFileInfoAndContent(t, remoteDir, localDir, "test2.dat", localName)
+		infos, err := ioutil.ReadDir(remoteDir)
+		if err != nil {
+			t.Fatalf("fail to read remote dir; %s", err)
+		}
+		if len(infos) != 2 {
+			t.Errorf("temporary file must be removed. got:%d files", len(infos))
+		}
+	})
+
+	t.Run("Backup", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		localPath := filepath.Join(localDir, "conf")
+		remotePath := filepath.Join(remoteDir, "conf")
+		if err := ioutil.WriteFile(remotePath, []byte("old remote\n"), 0644); err != nil {
+			t.Fatalf("fail to write remote file; %s", err)
+		}
+		if err := ioutil.WriteFile(localPath, []byte("new\n"), 0644); err != nil {
+			t.Fatalf("fail to write local file; %s", err)
+		}
+
+		s := NewSCP(c, WithBackup(""))
+		if err := s.SendFile(localPath, remoteDir); err != nil {
+			t.Fatalf("fail to SendFile; %s", err)
+		}
+		if err := s.SendBytes([]byte("newer\n"), 0644, remotePath); err != nil {
+			t.Fatalf("fail to SendBytes; %s", err)
+		}
+		if err := ioutil.WriteFile(localPath, []byte("old local\n"), 0644); err != nil {
+			t.Fatalf("fail to write local file; %s", err)
+		}
+		if err := s.ReceiveFile(remotePath, localPath); err != nil {
+			t.Fatalf("fail to ReceiveFile; %s", err)
+		}
+		for name, want := range map[string]string{
+			remotePath:       "newer\n",
+			remotePath + "~": "new\n",
+			localPath:        "newer\n",
+			localPath + "~":  "old local\n",
+		} {
+			got, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatalf("fail to read file; %s", err)
+			}
+			if string(got) != want {
+				t.Errorf("unmatch content of %s. got:%q, want:%q", name, got, want)
+			}
+		}
+	})
+
+	t.Run("Buffer size", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		want := bytes.Repeat([]byte("0123456789"), 10*1024)
+		localPath := filepath.Join(localDir, "data")
+		if err := ioutil.WriteFile(localPath, want, 0644); err != nil {
+			t.Fatalf("fail to write local file; %s", err)
+		}
+		for _, size := range []int{1021, 1 << 20} {
+			s := NewSCP(c, WithBufferSize(size))
+			remotePath := filepath.Join(remoteDir, fmt.Sprintf("data-%d", size))
+			if err := s.SendFile(localPath, remotePath); err != nil {
+				t.Fatalf("fail to SendFile; %s", err)
+			}
+			receivedPath := filepath.Join(localDir, fmt.Sprintf("received-%d", size))
+			if err := s.ReceiveFile(remotePath, receivedPath); err != nil {
+				t.Fatalf("fail to ReceiveFile; %s", err)
+			}
+			for _, name := range []string{remotePath, receivedPath} {
+				got, err := ioutil.ReadFile(name)
+				if err != nil {
+					t.Fatalf("fail to read file; %s", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("unmatch content of %s", name)
+				}
+			}
+		}
+	})
+
+	t.Run("Without preserve", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		oldTime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+		localPath := filepath.Join(localDir, "sent")
+		if err := ioutil.WriteFile(localPath, []byte("sent\n"), 0644); err != nil {
+			t.Fatalf("fail to write local file; %s", err)
+		}
+		if err := os.Chtimes(localPath, oldTime, oldTime); err != nil {
+			t.Fatalf("fail to change time; %s", err)
+		}
+		remotePath := filepath.Join(remoteDir, "received")
+		if err := ioutil.WriteFile(remotePath, []byte("received\n"), 0600); err != nil {
+			t.Fatalf("fail to write remote file; %s", err)
+		}
+		if err := os.Chtimes(remotePath, oldTime, oldTime); err != nil {
+			t.Fatalf("fail to change time; %s", err)
+		}
+		receivedPath := filepath.Join(localDir, "received")
+		if err := ioutil.WriteFile(receivedPath, nil, 0644); err != nil {
+			t.Fatalf("fail to write local file; %s", err)
+		}
+
+		s := NewSCP(c, WithoutPreserve())
+		if err := s.SendFile(localPath, remoteDir); err != nil {
+			t.Fatalf("fail to SendFile; %s", err)
+		}
+		if err := s.ReceiveFile(remotePath, receivedPath); err != nil {
+			t.Fatalf("fail to ReceiveFile; %s", err)
+		}
+		for _, name := range []string{filepath.Join(remoteDir, "sent"), receivedPath} {
+			fi, err := os.Stat(name)
+			if err != nil {
+				t.Fatalf("fail to stat file; %s", err)
+			}
+			if fi.ModTime().Equal(oldTime) {
+				t.Errorf("modification time of %s must not be preserved", name)
+			}
+		}
+		fi, err := os.Stat(receivedPath)
+		if err != nil {
+			t.Fatalf("fail to stat file; %s", err)
+		}
+		if got := fi.Mode().Perm(); got != 0644 {
+			t.Errorf("unmatch mode. got:%o, want:%o", got, 0644)
+		}
+		got, err := ioutil.ReadFile(receivedPath)
+		if err != nil {
+			t.Fatalf("fail to read file; %s", err)
+		}
+		if string(got) != "received\n" {
+			t.Errorf("unmatch content. got:%q, want:%q", got, "received\n")
+		}
+	})
+
+	t.Run("Command func", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		localName := "test1.dat"
+		localPath := filepath.Join(localDir, localName)
+		if err := generateRandomFile(localPath); err != nil {
+			t.Fatalf("fail to generate local file; %s", err)
+		}
+
+		err = NewSCP(c, WithCommandFunc(CommandTemplate("go-scp-no-such-command %s %s"))).SendFile(localPath, remoteDir)
+		var cmdErr *CommandError
+		if want := "go-scp-no-such-command -tp '" + remoteDir + "'"; !errors.As(err, &cmdErr) || cmdErr.Cmd != want {
+			t.Errorf("command func must be used. got:%v, want command:%q", err, want)
+		}
+
+		s := NewSCP(c, WithCommandFunc(CommandTemplate("env scp %s %s")))
+		if err := s.SendFile(localPath, remoteDir); err != nil {
+			t.Errorf("fail to SendFile; %s", err)
+		}
+		sameFileInfoAndContent(t, remoteDir, localDir, localName, localName)
+	})
+
+	t.Run("Remote Windows paths", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		localName := "test1.dat"
+		remoteName := "dest.dat"
+		if err := generateRandomFile(filepath.Join(localDir, localName)); err != nil {
+			t.Fatalf("fail to generate local file; %s", err)
+		}
+
+		// The test server is not Windows, so only the separators are
+		// checked with the POSIX quoting.
+		s := NewSCP(c, WithRemoteOS(RemoteWindows), WithShellQuoting(QuotingPOSIX))
+		remotePath := remoteDir + `\sub\..\` + remoteName
+		if err := s.SendFile(filepath.Join(localDir, localName), remotePath); err != nil {
+			t.Errorf("fail to SendFile; %s", err)
+		}
+		sameFileInfoAndContent(t, remoteDir, localDir, remoteName, localName)
+
+		for path, want := range map[string]string{
+			`C:\data\sub\..\file`: "C:/data/file",
+			`C:/data/`:            "C:/data",
+			`\\server\share\dir`:  "//server/share/dir",
+		} {
+			if got := s.cleanRemotePath(path); got != want {
+				t.Errorf("unmatch cleaned path of %q. got:%q, want:%q", path, got, want)
+			}
+		}
+	})
+
+	t.Run("Remote command error", func(t *testing.T) {
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		cfg := NewSCP(c).sessionConfig()
+		cfg.scpPath = "go-scp-no-such-command"
+		err = runSinkSession(cfg, remoteDir, false, false, func(s *sinkSession) error {
+			return nil
+		})
+		var cmdErr *CommandError
+		if !errors.As(err, &cmdErr) {
+			t.Fatalf("error must be *CommandError. got:%v", err)
+		}
+		if !strings.HasPrefix(cmdErr.Cmd, cfg.scpPath+" -t") {
+			t.Errorf("unmatch command. got:%q", cmdErr.Cmd)
+		}
+		var exitErr *ssh.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 127 {
+			t.Errorf("error must wrap exit status 127. got:%v", err)
+		}
+	})
+
+	t.Run("Audit hook", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		localPath := filepath.Join(localDir, "test1.dat")
+		remotePath := filepath.Join(remoteDir, "dest.dat")
+		size := int64(4096)
+		if err := generateRandomFileWithSize(localPath, size); err != nil {
+			t.Fatalf("fail to generate local file; %s", err)
+		}
+		data, err := ioutil.ReadFile(localPath)
+		if err != nil {
+			t.Fatalf("fail to read local file; %s", err)
+		}
+
+		var records []AuditRecord
+		hook := func(r AuditRecord) { records = append(records, r) }
+		if err := NewSCP(c, WithAuditHook(hook)).SendFile(localPath, remotePath); err != nil {
+			t.Fatalf("fail to SendFile; %s", err)
+		}
+		if len(records) != 1 {
+			t.Fatalf("unmatch record count. got:%d, want:1", len(records))
+		}
+		r := records[0]
+		if r.Direction != DirectionUpload || r.LocalPath != localPath || r.RemotePath != remotePath {
+			t.Errorf("unmatch record. got:%+v", r)
+		}
+		if r.RemoteAddr != c.RemoteAddr().String() {
+			t.Errorf("unmatch remote address. got:%s, want:%s", r.RemoteAddr, c.RemoteAddr())
+		}
+		if r.Bytes != size || r.Err != nil {
+			t.Errorf("unmatch bytes or error. got:%d, %v, want:%d, nil", r.Bytes, r.Err, size)
+		}
+		if sum := sha256.Sum256(data); !bytes.Equal(r.Hash, sum[:]) {
+			t.Errorf("unmatch hash. got:%x, want:%x", r.Hash, sum)
+		}
+	})
+}
+
+func TestSendDir(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	t.Run("dest dir not exist", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+			{name: "bar", maxSize: testMaxFileSize, mode: 0600},
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "foo", maxSize: testMaxFileSize, mode: 0400},
+					{name: "hoge", maxSize: testMaxFileSize, mode: 0602},
+					{name: "emptyDir", isDir: true, mode: 0500},
+				},
+			},
+		}
+		if err := generateRandomFiles(localDir, entries); err != nil {
+			t.Fatalf("fail to generate local files; %s", err)
+		}
+
+		remoteDestDir := filepath.Join(remoteDir, "dest")
+		if _, err := NewSCP(c).SendDir(localDir, remoteDestDir, nil); err != nil {
+			t.Errorf("fail to SendDir; %s", err)
+		}
+		sameDirTreeContent(t, localDir, remoteDestDir)
+	})
+
+	t.Run("dest dir exists", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+			{name: "bar", maxSize: testMaxFileSize, mode: 0600},
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "foo", maxSize: testMaxFileSize, mode: 0400},
+					{name: "hoge", maxSize: testMaxFileSize, mode: 0602},
+					{name: "emptyDir", isDir: true, mode: 0500},
+				},
+			},
+		}
+		if err := generateRandomFiles(localDir, entries); err != nil {
+			t.Fatalf("fail to generate local files; %s", err)
+		}
+
+		if _, err := NewSCP(c).SendDir(localDir, remoteDir, nil); err != nil {
+			t.Errorf("fail to SendDir; %s", err)
+		}
+		localDirBase := filepath.Base(localDir)
+		remoteDestDir := filepath.Join(remoteDir, localDirBase)
+		sameDirTreeContent(t, localDir, remoteDestDir)
+	})
+
+	t.Run("send only files case #1 dest dir exists", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "01_file", maxSize: testMaxFileSize, mode: 0644},
+			{name: "02_file", maxSize: testMaxFileSize, mode: 0600},
+			{name: "03_dir", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "01_file", maxSize: testMaxFileSize, mode: 0600},
+					{name: "02_file", maxSize: testMaxFileSize, mode: 0600},
+				},
+			},
+		}
+		if err := generateRandomFiles(localDir, entries); err != nil {
+			t.Fatalf("fail to generate local files; %s", err)
+		}
+
+		if _, err := NewSCP(c).SendDir(localDir, remoteDir, func(parentDir string, info os.FileInfo) (bool, error) {
+			current := filepath.Join(parentDir, info.Name())
+			return localDir == current || (localDir == parentDir && !info.IsDir()), nil
+		}); err != nil {
+			t.Errorf("fail to SendDir; %s", err)
+		}
+		localDirBase := filepath.Base(localDir)
+		remoteDestDir := filepath.Join(remoteDir, localDirBase)
+		if err := os.RemoveAll(filepath.Join(localDir, "03_dir")); err != nil {
+			t.Errorf("fail to remove directory; %s", err)
+		}
+		sameDirTreeContent(t, localDir, remoteDestDir)
+	})
+
+	t.Run("send only files case #2 dest dir exists", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "01_dir", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "01_file", maxSize: testMaxFileSize, mode: 0600},
+					{name: "02_file", maxSize: testMaxFileSize, mode: 0600},
+				},
+			},
+			{name: "02_file", maxSize: testMaxFileSize, mode: 0644},
+			{name: "03_file", maxSize: testMaxFileSize, mode: 0600},
+		}
+		if err := generateRandomFiles(localDir, entries); err != nil {
+			t.Fatalf("fail to generate local files; %s", err)
+		}
+
+		if _, err := NewSCP(c).SendDir(localDir, remoteDir, func(parentDir string, info os.FileInfo) (bool, error) {
+			current := filepath.Join(parentDir, info.Name())
+			return localDir == current || (localDir == parentDir && !info.IsDir()), nil
+		}); err != nil {
+			t.Errorf("fail to SendDir; %s", err)
+		}
+		localDirBase := filepath.Base(localDir)
+		remoteDestDir := filepath.Join(remoteDir, localDirBase)
+		if err := os.RemoveAll(filepath.Join(localDir, "01_dir")); err != nil {
+			t.Errorf("fail to remove directory; %s", err)
+		}
+		sameDirTreeContent(t, localDir, remoteDestDir)
+	})
+	t.Run("send only files case #3 dest dir not exists", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+		remoteDir = filepath.Join(remoteDir, "dest")
+
+		entries := []fileInfo{
+			{name: "01_file", maxSize: testMaxFileSize, mode: 0644},
+			{name: "02_file", maxSize: testMaxFileSize, mode: 0600},
+			{name: "03_dir", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "01_file", maxSize: testMaxFileSize, mode: 0600},
+					{name: "02_file", maxSize: testMaxFileSize, mode: 0600},
+				},
+			},
+		}
+		if err := generateRandomFiles(localDir, entries); err != nil {
+			t.Fatalf("fail to generate local files; %s", err)
+		}
+
+		if _, err := NewSCP(c).SendDir(localDir, remoteDir, func(parentDir string, info os.FileInfo) (bool, error) {
+			current := filepath.Join(parentDir, info.Name())
+			return localDir == current || (localDir == parentDir && !info.IsDir()), nil
+		}); err != nil {
+			t.Errorf("fail to SendDir; %s", err)
+		}
+
+		if err := os.RemoveAll(filepath.Join(localDir, "03_dir")); err != nil {
+			t.Errorf("fail to remove directory; %s", err)
+		}
+		sameDirTreeContent(t, localDir, remoteDir)
+	})
+
+	t.Run("send only files case #4 dest dir not exists", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+		remoteDir = filepath.Join(remoteDir, "dest")
+
+		entries := []fileInfo{
+			{name: "01_dir", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "01_file", maxSize: testMaxFileSize, mode: 0600},
+					{name: "02_file", maxSize: testMaxFileSize, mode: 0600},
+				},
+			},
+			{name: "02_file", maxSize: testMaxFileSize, mode: 0644},
+			{name: "03_file", maxSize: testMaxFileSize, mode: 0600},
+		}
+		if err := generateRandomFiles(localDir, entries); err != nil {
+			t.Fatalf("fail to generate local files; %s", err)
+		}
+
+		if _, err := NewSCP(c).SendDir(localDir, remoteDir, func(parentDir string, info os.FileInfo) (bool, error) {
+			current := filepath.Join(parentDir, info.Name())
+			return localDir == current || (localDir == parentDir && !info.IsDir()), nil
+		}); err != nil {
+			t.Errorf("fail to SendDir; %s", err)
+		}
+
+		if err := os.RemoveAll(filepath.Join(localDir, "01_dir")); err != nil {
+			t.Errorf("fail to remove directory; %s", err)
+		}
+		sameDirTreeContent(t, localDir, remoteDir)
+	})
+
+	t.Run("tar stream", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+			{name: "bar", maxSize: testMaxFileSize, mode: 0600},
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "foo", maxSize: testMaxFileSize, mode: 0400},
+					{name: "hoge", maxSize: testMaxFileSize, mode: 0602},
+					{name: "emptyDir", isDir: true, mode: 0500},
+				},
+			},
+		}
+		if err := generateRandomFiles(localDir, entries); err != nil {
+			t.Fatalf("fail to generate local files; %s", err)
+		}
+
+		s := NewSCP(c, WithTarStream())
+		remoteDestDir := filepath.Join(remoteDir, "dest")
+		if _, err := s.SendDir(localDir, remoteDestDir, nil); err != nil {
+			t.Errorf("fail to SendDir; %s", err)
+		}
+		sameDirTreeContent(t, localDir, remoteDestDir)
+
+		if _, err := s.SendDir(localDir, remoteDestDir, func(parentDir string, info os.FileInfo) (bool, error) {
+			return info.Name() != "baz", nil
+		}); err != nil {
+			t.Errorf("fail to SendDir; %s", err)
+		}
+		if err := os.RemoveAll(filepath.Join(localDir, "baz")); err != nil {
+			t.Errorf("fail to remove directory; %s", err)
+		}
+		sameDirTreeContent(t, localDir, filepath.Join(remoteDestDir, filepath.Base(localDir)))
+	})
+
+	t.Run("exclude patterns", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+			{name: "foo.log", maxSize: testMaxFileSize, mode: 0644},
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "bar.log", maxSize: testMaxFileSize, mode: 0644},
+					{name: "node_modules", isDir: true, mode: 0755,
+						entries: []fileInfo{
+							{name: "hoge", maxSize: testMaxFileSize, mode: 0644},
+						},
+					},
+				},
+			},
+		}
+		if err := generateRandomFiles(localDir, entries); err != nil {
+			t.Fatalf("fail to generate local files; %s", err)
+		}
+
+		remoteDestDir := filepath.Join(remoteDir, "dest")
+		s := NewSCP(c, WithExclude("*.log", "**/node_modules/**"))
+		if _, err := s.SendDir(localDir, remoteDestDir, nil); err != nil {
+			t.Errorf("fail to SendDir; %s", err)
+		}
+		for _, name := range []string{"foo.log", "baz/bar.log", "baz/node_modules"} {
+			if err := os.RemoveAll(filepath.Join(localDir, name)); err != nil {
+				t.Errorf("fail to remove excluded entry; %s", err)
+			}
+		}
+		sameDirTreeContent(t, localDir, remoteDestDir)
+	})
+
+	t.Run("map func", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "foo.txt", maxSize: testMaxFileSize, mode: 0644},
+			{name: "bar.dat", maxSize: testMaxFileSize, mode: 0600},
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "hoge.txt", maxSize: testMaxFileSize, mode: 0644},
+				},
+			},
+		}
+		if err := generateRandomFiles(localDir, entries); err != nil {
+			t.Fatalf("fail to generate local files; %s", err)
+		}
+
+		byExt := func(relPath string, info os.FileInfo) (string, error) {
+			return path.Ext(relPath)[1:] + "/" + path.Base(relPath), nil
+		}
+		for _, tarStream := range []bool{false, true} {
+			options := []ScpOption{WithMapFunc(byExt)}
+			if tarStream {
+				options = append(options, WithTarStream())
+			}
+			remoteDestDir := filepath.Join(remoteDir, fmt.Sprintf("dest-%v", tarStream))
+			if _, err := NewSCP(c, options...).SendDir(localDir, remoteDestDir, nil); err != nil {
+				t.Errorf("fail to SendDir; %s", err)
+			}
+			sameFileInfoAndContent(t, filepath.Join(remoteDestDir, "txt"), localDir, "foo.txt", "foo.txt")
+			sameFileInfoAndContent(t, filepath.Join(remoteDestDir, "txt"), filepath.Join(localDir, "baz"), "hoge.txt", "hoge.txt")
+			sameFileInfoAndContent(t, filepath.Join(remoteDestDir, "dat"), localDir, "bar.dat", "bar.dat")
+			if _, err := os.Stat(filepath.Join(remoteDestDir, "baz")); !os.IsNotExist(err) {
+				t.Errorf("source directory must not be created; %v", err)
+			}
+		}
+	})
+
+	t.Run("sync", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+			{name: "bar", maxSize: testMaxFileSize, mode: 0600},
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "hoge", maxSize: testMaxFileSize, mode: 0644},
+				},
+			},
+		}
+		if err := generateRandomFiles(localDir, entries); err != nil {
+			t.Fatalf("fail to generate local files; %s", err)
+		}
+
+		if _, err := NewSCP(c).SendDir(localDir, remoteDir, nil); err != nil {
+			t.Fatalf("fail to SendDir; %s", err)
+		}
+		changed := filepath.Join(localDir, "baz", "hoge")
+		if err := generateRandomFileWithSizeAndMode(changed, 100, 0644); err != nil {
+			t.Fatalf("fail to generate local file; %s", err)
+		}
+		mtime := time.Now().Add(time.Hour)
+		if err := os.Chtimes(changed, mtime, mtime); err != nil {
+			t.Fatalf("fail to change file time; %s", err)
+		}
+
+		var sent []string
+		hook := func(r AuditRecord) { sent = append(sent, r.LocalPath) }
+		if _, err := NewSCP(c, WithSync(SyncSizeAndTime), WithAuditHook(hook)).SendDir(localDir, remoteDir, nil); err != nil {
+			t.Errorf("fail to SendDir; %s", err)
+		}
+		if len(sent) != 1 || sent[0] != changed {
+			t.Errorf("only the changed file must be sent. got:%v", sent)
+		}
+		sameDirTreeContent(t, localDir, filepath.Join(remoteDir, filepath.Base(localDir)))
+	})
+
+	t.Run("sync by checksum", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "hoge", maxSize: testMaxFileSize, mode: 0644},
+				},
+			},
+		}
+		if err := generateRandomFiles(localDir, entries); err != nil {
+			t.Fatalf("fail to generate local files; %s", err)
+		}
+		if _, err := NewSCP(c).SendDir(localDir, remoteDir, nil); err != nil {
+			t.Fatalf("fail to SendDir; %s", err)
+		}
+
+		// Only the time of foo is changed, and only the content of hoge
+		// is changed.
+		mtime := time.Now().Add(time.Hour)
+		if err := os.Chtimes(filepath.Join(localDir, "foo"), mtime, mtime); err != nil {
+			t.Fatalf("fail to change file time; %s", err)
+		}
+		changed := filepath.Join(localDir, "baz", "hoge")
+		fi, err := os.Stat(changed)
+		if err != nil {
+			t.Fatalf("fail to stat file; %s", err)
+		}
+		if err := generateRandomFileWithSizeAndMode(changed, fi.Size(), 0644); err != nil {
+			t.Fatalf("fail to generate local file; %s", err)
+		}
+		if err := os.Chtimes(changed, fi.ModTime(), fi.ModTime()); err != nil {
+			t.Fatalf("fail to change file time; %s", err)
+		}
+
+		var sent []string
+		hook := func(r AuditRecord) { sent = append(sent, r.LocalPath) }
+		if _, err := NewSCP(c, WithSync(SyncChecksum), WithAuditHook(hook)).SendDir(localDir, remoteDir, nil); err != nil {
+			t.Errorf("fail to SendDir; %s", err)
+		}
+		if len(sent) != 1 || sent[0] != changed {
+			t.Errorf("only the changed file must be sent. got:%v", sent)
+		}
+		sameFileContent(t, filepath.Join(remoteDir, filepath.Base(localDir), "baz"), filepath.Join(localDir, "baz"), "hoge", "hoge")
+	})
+
+	t.Run("delete extraneous files", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		entries := []fileInfo{
+			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "hoge", maxSize: testMaxFileSize, mode: 0644},
+				},
+			},
+		}
+		if err := generateRandomFiles(localDir, entries); err != nil {
+			t.Fatalf("fail to generate local files; %s", err)
+		}
+		// The directories are dated in the past, so that a removal changing
+		// their times is found regardless of the timing.
+		past := time.Unix(1600000000, 0)
+		for _, dir := range []string{localDir, filepath.Join(localDir, "baz")} {
+			if err := os.Chtimes(dir, past, past); err != nil {
+				t.Fatalf("fail to change times; %s", err)
+			}
+		}
+
+		for _, tarStream := range []bool{false, true} {
+			remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+			if err != nil {
+				t.Fatalf("fail to get tempdir; %s", err)
+			}
+			defer os.RemoveAll(remoteDir)
+
+			extraneous := []fileInfo{
+				{name: "stale", maxSize: testMaxFileSize, mode: 0644},
+				{name: "keep.log", maxSize: testMaxFileSize, mode: 0644},
+				{name: "baz", isDir: true, mode: 0755,
+					entries: []fileInfo{
+						{name: "old", isDir: true, mode: 0755,
+							entries: []fileInfo{
+								{name: "fuga", maxSize: testMaxFileSize, mode: 0644},
+							},
+						},
+					},
+				},
+			}
+			// remoteDir exists, so the tree is placed under it.
+			top := filepath.Join(remoteDir, filepath.Base(localDir))
+			if err := os.Mkdir(top, 0755); err != nil {
+				t.Fatalf("fail to create directory; %s", err)
+			}
+			if err := generateRandomFiles(top, extraneous); err != nil {
+				t.Fatalf("fail to generate remote files; %s", err)
+			}
+
+			options := []ScpOption{WithDelete(), WithExclude("*.log")}
+			if tarStream {
+				options = append(options, WithTarStream())
+			}
+			if _, err := NewSCP(c, options...).SendDir(localDir, remoteDir, nil); err != nil {
+				t.Fatalf("fail to SendDir; %s", err)
+			}
+			if _, err := os.Stat(filepath.Join(top, "keep.log")); err != nil {
+				t.Errorf("excluded file must be kept; %s", err)
+			}
+			// The kept file is removed for the comparison, keeping the time of
+			// its directory.
+			removeKeepingDirTime(t, filepath.Join(top, "keep.log"))
+			sameDirTreeContent(t, localDir, top)
+		}
+	})
+
+	t.Run("retry failed files", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+			{name: "zzz", maxSize: testMaxFileSize, mode: 0644},
+		}
+		if err := generateRandomFiles(localDir, entries); err != nil {
+			t.Fatalf("fail to generate local files; %s", err)
+		}
+		// The remote scp blocks in opening the FIFO without a reader, which
+		// fails every attempt with the per-file timeout.
+		top := filepath.Join(remoteDir, filepath.Base(localDir))
+		if err := os.Mkdir(top, 0755); err != nil {
+			t.Fatalf("fail to create directory; %s", err)
+		}
+		fifo := filepath.Join(top, "zzz")
+		if err := syscall.Mkfifo(fifo, 0644); err != nil {
+			t.Fatalf("fail to create fifo; %s", err)
+		}
+		defer func() {
+			// Unblock the remote scp.
+			if f, err := os.OpenFile(fifo, os.O_RDONLY|syscall.O_NONBLOCK, 0); err == nil {
+				f.Close()
+			}
+		}()
+
+		attempts := make(map[string]int)
+		hook := func(r AuditRecord) { attempts[filepath.Base(r.LocalPath)]++ }
+		s := NewSCP(c, WithRetry(2, 10*time.Millisecond), WithPerFileTimeout(200*time.Millisecond), WithAuditHook(hook))
+		report, err := s.SendDir(localDir, remoteDir, nil)
+		if !errors.Is(err, ErrTimeout) {
+			t.Errorf("unmatch error. got:%v, want:%v", err, ErrTimeout)
+		}
+		if attempts["foo"] != 1 || attempts["zzz"] != 3 {
+			t.Errorf("only the failed file must be retried. got:%v", attempts)
+		}
+		if report.FilesCopied != 1 {
+			t.Errorf("unmatch copied files. got:%d, want:1", report.FilesCopied)
+		}
+		sameFileContent(t, top, localDir, "foo", "foo")
+	})
+
+	t.Run("report", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+			{name: "bar", maxSize: testMaxFileSize, mode: 0600},
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "hoge", maxSize: testMaxFileSize, mode: 0644},
+				},
+			},
+		}
+		if err := generateRandomFiles(localDir, entries); err != nil {
+			t.Fatalf("fail to generate local files; %s", err)
+		}
+		var wantBytes int64
+		for _, name := range []string{"foo", filepath.Join("baz", "hoge")} {
+			fi, err := os.Stat(filepath.Join(localDir, name))
+			if err != nil {
+				t.Fatalf("fail to stat file; %s", err)
+			}
+			wantBytes += fi.Size()
+		}
+
+		report, err := NewSCP(c).SendDir(localDir, remoteDir, func(parentDir string, info os.FileInfo) (bool, error) {
+			return info.Name() != "bar", nil
+		})
+		if err != nil {
+			t.Fatalf("fail to SendDir; %s", err)
+		}
+		want := TransferReport{FilesCopied: 2, FilesSkipped: 1, DirsCreated: 2, Bytes: wantBytes}
+		got := *report
+		got.Duration, got.Rate = 0, 0
+		if got != want {
+			t.Errorf("unmatch report. got:%+v, want:%+v", got, want)
+		}
+		if report.Duration <= 0 {
+			t.Errorf("duration must be positive. got:%s", report.Duration)
+		}
+	})
+
+	t.Run("Pipelining", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		srcDir := filepath.Join(localDir, "src")
+		var names []string
+		for i := 0; i < 30; i++ {
+			name := filepath.Join(fmt.Sprintf("dir%d", i%3), fmt.Sprintf("file%d", i))
+			if err := os.MkdirAll(filepath.Join(srcDir, filepath.Dir(name)), 0755); err != nil {
+				t.Fatalf("fail to create directory; %s", err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(srcDir, name), []byte(name), 0644); err != nil {
+				t.Fatalf("fail to write file; %s", err)
+			}
+			names = append(names, name)
+		}
+
+		s := NewSCP(c, WithPipelining(8))
+		if _, err := s.SendDir(srcDir, remoteDir, nil); err != nil {
+			t.Fatalf("fail to SendDir; %s", err)
+		}
+		for _, name := range names {
+			got, err := ioutil.ReadFile(filepath.Join(remoteDir, "src", name))
+			if err != nil {
+				t.Fatalf("fail to read file; %s", err)
+			}
+			if string(got) != name {
+				t.Errorf("unmatch content of %s. got:%q, want:%q", name, got, name)
+			}
+		}
+
+		// An error reply to an earlier message is returned.
+		if err := os.Mkdir(filepath.Join(remoteDir, "file0"), 0755); err != nil {
+			t.Fatalf("fail to create directory; %s", err)
+		}
+		err = s.SendFiles([]string{filepath.Join(srcDir, names[0]), filepath.Join(srcDir, names[1])}, remoteDir)
+		var rerr *RemoteError
+		if !errors.As(err, &rerr) || !strings.Contains(rerr.Msg, "Is a directory") {
+			t.Errorf("unmatch error. got:%v", err)
+		}
+	})
+
+	t.Run("Read ahead", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		srcDir := filepath.Join(localDir, "src")
+		contents := map[string][]byte{
+			"empty":                         nil,
+			"small":                         []byte("small\n"),
+			filepath.Join("a", "large"):     bytes.Repeat([]byte("0123456789abcdef"), 80*1024),
+			filepath.Join("a", "b", "tail"): []byte("tail\n"),
+		}
+		for name, content := range contents {
+			if err := os.MkdirAll(filepath.Join(srcDir, filepath.Dir(name)), 0755); err != nil {
+				t.Fatalf("fail to create directory; %s", err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(srcDir, name), content, 0644); err != nil {
+				t.Fatalf("fail to write file; %s", err)
+			}
+		}
+
+		// With WithSparseFiles, the files are opened ahead without reading.
+		for i, options := range [][]ScpOption{
+			{WithReadAhead(2)},
+			{WithReadAhead(2), WithSparseFiles()},
+		} {
+			destDir := filepath.Join(remoteDir, strconv.Itoa(i))
+			if err := os.Mkdir(destDir, 0755); err != nil {
+				t.Fatalf("fail to create directory; %s", err)
+			}
+			report, err := NewSCP(c, options...).SendDir(srcDir, destDir, nil)
+			if err != nil {
+				t.Fatalf("fail to SendDir; %s", err)
+			}
+			if report.FilesCopied != len(contents) {
+				t.Errorf("unmatch copied files. got:%d, want:%d", report.FilesCopied, len(contents))
+			}
+			for name, want := range contents {
+				got, err := ioutil.ReadFile(filepath.Join(destDir, "src", name))
+				if err != nil {
+					t.Fatalf("fail to read file; %s", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("unmatch content of %s", name)
+				}
+			}
+		}
+	})
+
+	t.Run("Progress events", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		srcDir := filepath.Join(localDir, "src")
+		if err := os.MkdirAll(filepath.Join(srcDir, "a"), 0755); err != nil {
+			t.Fatalf("fail to create directory; %s", err)
+		}
+		content := []byte("content\n")
+		if err := ioutil.WriteFile(filepath.Join(srcDir, "a", "file"), content, 0644); err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+
+		events := make(chan ProgressEvent, 100)
+		if _, err := NewSCP(c, WithProgressEvents(events)).SendDir(srcDir, remoteDir, nil); err != nil {
+			t.Fatalf("fail to SendDir; %s", err)
+		}
+		close(events)
+		var got []string
+		for e := range events {
+			if e.Type == EventBytesCopied {
+				continue
+			}
+			if e.Direction != DirectionUpload {
+				t.Errorf("unmatch direction of %s. got:%s, want:%s", e.Type, e.Direction, DirectionUpload)
+			}
+			got = append(got, fmt.Sprintf("%s %s", e.Type, e.LocalPath))
+			if e.Type == EventFileFinished && (e.Bytes != int64(len(content)) || e.Err != nil) {
+				t.Errorf("unmatch finished file. got:%d bytes, err:%v, want:%d bytes", e.Bytes, e.Err, len(content))
+			}
+		}
+		want := []string{
+			"directory entered " + srcDir,
+			"directory entered " + filepath.Join(srcDir, "a"),
+			"file started " + filepath.Join(srcDir, "a", "file"),
+			"file finished " + filepath.Join(srcDir, "a", "file"),
+			"directory left " + filepath.Join(srcDir, "a"),
+			"directory left " + srcDir,
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("unmatch events.\ngot: %q\nwant:%q", got, want)
+		}
+	})
+
+	t.Run("Tracing", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		srcDir := filepath.Join(localDir, "src")
+		if err := os.MkdirAll(srcDir, 0755); err != nil {
+			t.Fatalf("fail to create directory; %s", err)
+		}
+		for _, name := range []string{"file1", "file2"} {
+			if err := ioutil.WriteFile(filepath.Join(srcDir, name), []byte("content\n"), 0644); err != nil {
+				t.Fatalf("fail to write file; %s", err)
+			}
+		}
+
+		tracer := &testTracer{}
+		if _, err := NewSCP(c, WithTracer(tracer)).SendDir(srcDir, remoteDir, nil); err != nil {
+			t.Fatalf("fail to SendDir; %s", err)
+		}
+		var got []string
+		for _, span := range tracer.spans {
+			if !span.ended || span.err != nil {
+				t.Errorf("span %s must end successfully. got:%v", span.name, span.err)
+			}
+			if _, ok := span.attrs[AttrDuration].(time.Duration); !ok {
+				t.Errorf("span %s must have duration", span.name)
+			}
+			got = append(got, fmt.Sprintf("%s %s %d parent:%s", span.name, span.attrs[AttrLocalPath], span.attrs[AttrBytes], span.parent))
+		}
+		want := []string{
+			fmt.Sprintf("scp.SendDir %s 16 parent:", srcDir),
+			fmt.Sprintf("scp.file %s 8 parent:scp.SendDir", filepath.Join(srcDir, "file1")),
+			fmt.Sprintf("scp.file %s 8 parent:scp.SendDir", filepath.Join(srcDir, "file2")),
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("unmatch spans.\ngot: %q\nwant:%q", got, want)
+		}
+	})
+
+	t.Run("Parallel", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		srcDir := filepath.Join(localDir, "src")
+		if err := os.MkdirAll(filepath.Join(srcDir, "empty"), 0755); err != nil {
+			t.Fatalf("fail to create directory; %s", err)
+		}
+		var names []string
+		for i := 0; i < 40; i++ {
+			name := filepath.Join(fmt.Sprintf("dir%d", i%4), fmt.Sprintf("sub%d", i%3), fmt.Sprintf("file%d", i))
+			if err := os.MkdirAll(filepath.Join(srcDir, filepath.Dir(name)), 0755); err != nil {
+				t.Fatalf("fail to create directory; %s", err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(srcDir, name), []byte(name), 0644); err != nil {
+				t.Fatalf("fail to write file; %s", err)
+			}
+			names = append(names, name)
+		}
+		dirTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		if err := os.Chtimes(filepath.Join(srcDir, "dir0"), dirTime, dirTime); err != nil {
+			t.Fatalf("fail to change time; %s", err)
+		}
+
+		destDir := filepath.Join(remoteDir, "dest")
+		report, err := NewSCP(c).SendDirParallel(srcDir, destDir, 4, nil)
+		if err != nil {
+			t.Fatalf("fail to SendDirParallel; %s", err)
+		}
+		if report.FilesCopied != len(names) {
+			t.Errorf("unmatch copied files. got:%d, want:%d", report.FilesCopied, len(names))
+		}
+		for _, name := range names {
+			got, err := ioutil.ReadFile(filepath.Join(destDir, name))
+			if err != nil {
+				t.Fatalf("fail to read file; %s", err)
+			}
+			if string(got) != name {
+				t.Errorf("unmatch content of %s. got:%q, want:%q", name, got, name)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(destDir, "empty")); err != nil {
+			t.Errorf("fail to stat empty directory; %s", err)
+		}
+		fi, err := os.Stat(filepath.Join(destDir, "dir0"))
+		if err != nil {
+			t.Fatalf("fail to stat directory; %s", err)
+		}
+		if !fi.ModTime().Equal(dirTime) {
+			t.Errorf("unmatch modification time of directory. got:%s, want:%s", fi.ModTime(), dirTime)
+		}
+	})
+
+	t.Run("Force mode", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		receivedDir, err := ioutil.TempDir("", "go-scp-TestSendDir-received")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(receivedDir)
+
+		srcDir := filepath.Join(localDir, "assets")
+		if err := os.MkdirAll(filepath.Join(srcDir, "css"), 0700); err != nil {
+			t.Fatalf("fail to create directory; %s", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(srcDir, "css", "site.css"), []byte("body{}\n"), 0602); err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+		for _, name := range []string{"", "css"} {
+			if err := os.Chmod(filepath.Join(srcDir, name), 0700); err != nil {
+				t.Fatalf("fail to change mode; %s", err)
+			}
+		}
+
+		if _, err := NewSCP(c, WithForceMode(0644, 0755)).SendDir(srcDir, remoteDir, nil); err != nil {
+			t.Fatalf("fail to SendDir; %s", err)
+		}
+		if _, err := NewSCP(c, WithForceMode(0640, 0750)).ReceiveDir(filepath.Join(remoteDir, "assets"), receivedDir, nil); err != nil {
+			t.Fatalf("fail to ReceiveDir; %s", err)
+		}
+		for dir, want := range map[string][2]os.FileMode{
+			remoteDir:   {0644, 0755},
+			receivedDir: {0640, 0750},
+		} {
+			for name, wantMode := range map[string]os.FileMode{
+				"assets":              want[1],
+				"assets/css":          want[1],
+				"assets/css/site.css": want[0],
+			} {
+				fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+				if err != nil {
+					t.Fatalf("fail to stat file; %s", err)
+				}
+				if got := fi.Mode().Perm(); got != wantMode {
+					t.Errorf("unmatch mode of %s. got:%o, want:%o", name, got, wantMode)
+				}
+			}
+		}
+	})
+
+	t.Run("Special mode bits", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		receivedDir, err := ioutil.TempDir("", "go-scp-TestSendDir-received")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(receivedDir)
+
+		srcDir := filepath.Join(localDir, "bin")
+		if err := os.Mkdir(srcDir, 0755); err != nil {
+			t.Fatalf("fail to create directory; %s", err)
+		}
+		toolPath := filepath.Join(srcDir, "tool")
+		if err := ioutil.WriteFile(toolPath, []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+		wantModes := map[string]os.FileMode{
+			"bin":      0775 | os.ModeSetgid | os.ModeDir,
+			"bin/tool": 0755 | os.ModeSetuid,
+		}
+		if err := os.Chmod(toolPath, wantModes["bin/tool"]); err != nil {
+			t.Fatalf("fail to change mode; %s", err)
+		}
+		if err := os.Chmod(srcDir, wantModes["bin"]); err != nil {
+			t.Fatalf("fail to change mode; %s", err)
+		}
+
+		s := NewSCP(c)
+		if _, err := s.SendDir(srcDir, remoteDir, nil); err != nil {
+			t.Fatalf("fail to SendDir; %s", err)
+		}
+		if _, err := s.ReceiveDir(filepath.Join(remoteDir, "bin"), receivedDir, nil); err != nil {
+			t.Fatalf("fail to ReceiveDir; %s", err)
+		}
+		for _, dir := range []string{remoteDir, receivedDir} {
+			for name, want := range wantModes {
+				fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+				if err != nil {
+					t.Fatalf("fail to stat file; %s", err)
+				}
+				if got := fi.Mode(); got != want {
+					t.Errorf("unmatch mode of %s in %s. got:%s, want:%s", name, dir, got, want)
+				}
+			}
+		}
+	})
+
+	t.Run("Preserve owner", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("changing owners requires root")
+		}
+		localDir, err := ioutil.TempDir("", "go-scp-TestSendDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestSendDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		receivedDir, err := ioutil.TempDir("", "go-scp-TestSendDir-received")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(receivedDir)
+
+		srcDir := filepath.Join(localDir, "data")
+		if err := os.MkdirAll(filepath.Join(srcDir, "sub"), 0755); err != nil {
+			t.Fatalf("fail to create directory; %s", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(srcDir, "sub", "foo"), []byte("foo\n"), 0644); err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+		const uid, gid = 4321, 8765
+		for _, name := range []string{"", "sub", filepath.Join("sub", "foo")} {
+			if err := os.Lchown(filepath.Join(srcDir, name), uid, gid); err != nil {
+				t.Fatalf("fail to change owner; %s", err)
+			}
+		}
+
+		s := NewSCP(c, WithPreserveOwner(OwnerByID))
+		if _, err := s.SendDir(srcDir, remoteDir, nil); err != nil {
+			t.Fatalf("fail to SendDir; %s", err)
+		}
+		if _, err := s.ReceiveDir(filepath.Join(remoteDir, "data"), receivedDir, nil); err != nil {
+			t.Fatalf("fail to ReceiveDir; %s", err)
+		}
+		for _, dir := range []string{remoteDir, receivedDir} {
+			for _, name := range []string{"data", "data/sub", "data/sub/foo"} {
+				fi, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(name)))
+				if err != nil {
+					t.Fatalf("fail to stat file; %s", err)
+				}
+				gotUID, gotGID, _ := fileOwner(fi)
+				if gotUID != uid || gotGID != gid {
+					t.Errorf("unmatch owner of %s. got:%d:%d, want:%d:%d", name, gotUID, gotGID, uid, gid)
+				}
+			}
+		}
+
+		// The local file which is not received keeps its owner.
+		remoteBar := filepath.Join(remoteDir, "data", "sub", "bar")
+		if err := ioutil.WriteFile(remoteBar, []byte("bar\n"), 0644); err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+		if err := os.Lchown(remoteBar, uid, gid); err != nil {
+			t.Fatalf("fail to change owner; %s", err)
+		}
+		localBar := filepath.Join(receivedDir, "data", "sub", "bar")
+		if err := ioutil.WriteFile(localBar, []byte("local\n"), 0644); err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+		_, err = s.ReceiveDir(filepath.Join(remoteDir, "data"), receivedDir, func(parentDir string, info os.FileInfo) (bool, error) {
+			return info.Name() != "bar", nil
+		})
+		if err != nil {
+			t.Fatalf("fail to ReceiveDir; %s", err)
+		}
+		fi, err := os.Lstat(localBar)
+		if err != nil {
+			t.Fatalf("fail to stat file; %s", err)
+		}
+		if gotUID, gotGID, _ := fileOwner(fi); gotUID != 0 || gotGID != 0 {
+			t.Errorf("owner of skipped file must not change. got:%d:%d", gotUID, gotGID)
+		}
+	})
+}
+
+var (
+	testMaxFileSize  = int64(1024 * 1024)
+	testSshdUser     = "user1"
+	testSshdPassword = "password1"
+	testSshdShell    = "sh"
+)
+
+func TestReporterWithoutHash(t *testing.T) {
+	s, r := NewSCP(nil).withReporter()
+	a := s.newAuditor(DirectionUpload, "/local/file", "/remote/file")
+	if a == nil || a.hash != nil {
+		t.Fatalf("the reporter must count the file without hashing it. auditor:%+v", a)
+	}
+	if _, err := a.Write([]byte("content\n")); err != nil {
+		t.Fatalf("fail to write; %s", err)
+	}
+	a.finish(nil)
+
+	// The bytes of a failed file are not counted.
+	a = s.newAuditor(DirectionUpload, "/local/failed", "/remote/failed")
+	if _, err := a.Write([]byte("partial")); err != nil {
+		t.Fatalf("fail to write; %s", err)
+	}
+	a.finish(io.ErrUnexpectedEOF)
+	if report := r.finish(); report.FilesCopied != 1 || report.Bytes != 8 {
+		t.Errorf("unmatch report. got:%+v", report)
+	}
+}
+
+func TestSendTarAsDir(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestSendTarAsDir-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	entries := []struct {
+		name    string
+		mode    int64
+		content string
+	}{
+		{name: "a/", mode: 0750},
+		{name: "a/foo", mode: 0640, content: "foo content\n"},
+		// The parent directories are missing in the archive.
+		{name: "b/c/bar", mode: 0600, content: "bar content\n"},
+		{name: "a/baz", mode: 0644, content: "baz content\n"},
+		{name: "top", mode: 0644, content: "top content\n"},
+	}
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Mode: e.mode, ModTime: mtime, Size: int64(len(e.content)), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(e.name, "/") {
+			h.Typeflag = tar.TypeDir
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("fail to write tar header; %s", err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatalf("fail to write tar content; %s", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("fail to close tar writer; %s", err)
+	}
+
+	if err := NewSCP(c).SendTarAsDir(tar.NewReader(&buf), remoteDir); err != nil {
+		t.Fatalf("fail to SendTarAsDir; %s", err)
+	}
+	for _, e := range entries {
+		name := filepath.Join(remoteDir, filepath.FromSlash(e.name))
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Errorf("fail to stat %s; %s", e.name, err)
+			continue
+		}
+		if fi.Mode().Perm() != os.FileMode(e.mode) {
+			t.Errorf("unmatch mode of %s. got:%s, want:%s", e.name, fi.Mode().Perm(), os.FileMode(e.mode))
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("unmatch modification time of %s. got:%s, want:%s", e.name, fi.ModTime(), mtime)
+		}
+		if fi.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("fail to read %s; %s", e.name, err)
+		}
+		if string(data) != e.content {
+			t.Errorf("unmatch content of %s. got:%q, want:%q", e.name, data, e.content)
+		}
+	}
+
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "../escape", Mode: 0644, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatalf("fail to write tar header; %s", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("fail to close tar writer; %s", err)
+	}
+	if err := NewSCP(c).SendTarAsDir(tar.NewReader(&buf), remoteDir); !errors.Is(err, ErrUnsafeArchivePath) {
+		t.Errorf("unsafe path must be rejected. got:%v", err)
+	}
+}
+
+func TestShellQuoting(t *testing.T) {
+	testCases := []struct {
+		quoting ShellQuoting
+		arg     string
+		want    string
+	}{
+		{quoting: QuotingPOSIX, arg: "a b", want: `'a b'`},
+		{quoting: QuotingPOSIX, arg: "it's", want: `'it'\''s'`},
+		{quoting: QuotingCsh, arg: "it's!", want: `'it'\''s\!'`},
+		{quoting: QuotingCsh, arg: "a\nb", want: "'a\\\nb'"},
+		{quoting: QuotingCmd, arg: `C:\Program Files\`, want: `"C:\Program Files\\"`},
+		{quoting: QuotingCmd, arg: `a"b`, want: `"a\"b"`},
+		{quoting: QuotingCmd, arg: `a\"b`, want: `"a\\\"b"`},
+		{quoting: QuotingPowerShell, arg: "it's $x", want: `'it''s $x'`},
+	}
+	for _, tc := range testCases {
+		if got := tc.quoting.quote(tc.arg); got != tc.want {
+			t.Errorf("unmatch result for quoting %d and argument %q. got:%s, want:%s", tc.quoting, tc.arg, got, tc.want)
+		}
+	}
+}
+
+func TestMatchExclude(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		rel     string
+		want    bool
+	}{
+		{pattern: "*.log", rel: "a.log", want: true},
+		{pattern: "*.log", rel: "dir/a.log", want: true},
+		{pattern: "*.log", rel: "a.txt", want: false},
+		{pattern: "node_modules/**", rel: "node_modules", want: true},
+		{pattern: "node_modules/**", rel: "node_modules/a/b", want: true},
+		{pattern: "node_modules/**", rel: "sub/node_modules", want: false},
+		{pattern: "**/testdata", rel: "a/b/testdata", want: true},
+		{pattern: "**/testdata", rel: "testdata", want: true},
+		{pattern: "a/*/c", rel: "a/b/c", want: true},
+		{pattern: "a/*/c", rel: "a/b/b/c", want: false},
+	}
+	for _, tc := range testCases {
+		if got := matchExclude(tc.pattern, tc.rel); got != tc.want {
+			t.Errorf("unmatch result for pattern %q and path %q. got:%v, want:%v", tc.pattern, tc.rel, got, tc.want)
+		}
+	}
+}
+
+func TestAcceptFuncs(t *testing.T) {
+	now := time.Now()
+	small := NewFileInfo("small.log", 10, 0644, now, now)
+	large := NewFileInfo("large.dat", 1000, 0644, now.Add(-time.Hour), now)
+	dir := NewFileInfo("dir", 0, os.ModeDir|0755, now.Add(-time.Hour), now)
+
+	testCases := []struct {
+		name string
+		fn   AcceptFunc
+		want []bool // for small, large and dir
+	}{
+		{name: "glob", fn: AcceptByGlob("*.log"), want: []bool{true, false, true}},
+		{name: "regexp", fn: AcceptByRegexp(regexp.MustCompile(`^large`)), want: []bool{false, true, true}},
+		{name: "max size", fn: AcceptMaxSize(100), want: []bool{true, false, true}},
+		{name: "modified after", fn: AcceptModifiedAfter(now.Add(-time.Minute)), want: []bool{true, false, true}},
+		{name: "and", fn: AcceptAnd(AcceptByGlob("*.dat"), AcceptMaxSize(100)), want: []bool{false, false, true}},
+		{name: "or", fn: AcceptOr(AcceptByGlob("*.dat"), AcceptMaxSize(100)), want: []bool{true, true, true}},
+		{name: "not", fn: AcceptNot(AcceptByGlob("*.log")), want: []bool{false, true, true}},
+	}
+	for _, tc := range testCases {
+		for i, info := range []*FileInfo{small, large, dir} {
+			got, err := tc.fn("parent", info)
+			if err != nil {
+				t.Errorf("%s: unexpected error; %s", tc.name, err)
+			}
+			if got != tc.want[i] {
+				t.Errorf("%s: unmatch result for %s. got:%v, want:%v", tc.name, info.Name(), got, tc.want[i])
+			}
+		}
+	}
+}
+
+func TestDeployDir(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	localDir, err := ioutil.TempDir("", "go-scp-TestDeployDir-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestDeployDir-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	entries := []fileInfo{
+		{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+		{name: "bar", maxSize: testMaxFileSize, mode: 0600},
+		{name: "baz", isDir: true, mode: 0755,
+			entries: []fileInfo{
+				{name: "foo", maxSize: testMaxFileSize, mode: 0400},
+				{name: "hoge", maxSize: testMaxFileSize, mode: 0602},
+				{name: "emptyDir", isDir: true, mode: 0500},
+			},
+		},
+	}
+	if err := generateRandomFiles(localDir, entries); err != nil {
+		t.Fatalf("fail to generate local files; %s", err)
+	}
+
+	remoteDestDir := filepath.Join(remoteDir, "dest")
+	if err := NewSCP(c).DeployDir(localDir, remoteDestDir, WithDeployVerify()); err != nil {
+		t.Fatalf("fail to DeployDir; %s", err)
+	}
+	sameDirTreeContent(t, localDir, remoteDestDir)
+
+	t.Run("accept func", func(t *testing.T) {
+		remoteDestDir := filepath.Join(remoteDir, "filtered")
+		acceptFn := func(parentDir string, info os.FileInfo) (bool, error) {
+			return info.Name() != "baz", nil
+		}
+		if err := NewSCP(c).DeployDir(localDir, remoteDestDir, WithDeployAcceptFunc(acceptFn)); err != nil {
+			t.Fatalf("fail to DeployDir; %s", err)
+		}
+		if _, err := os.Stat(filepath.Join(remoteDestDir, "baz")); !os.IsNotExist(err) {
+			t.Errorf("rejected directory must not be deployed; %v", err)
+		}
+		sameFileInfoAndContent(t, remoteDestDir, localDir, "foo", "foo")
+	})
+}
+
+func TestCopyToHost(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	binDir, err := ioutil.TempDir("", "go-scp-TestCopyToHost-bin")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(binDir)
+
+	// The scp on the remote server is replaced with a script which records
+	// its arguments, since the test cannot reach another host.
+	argsFile := filepath.Join(binDir, "args")
+	script := "#!/bin/sh\nfor a in \"$@\"; do echo \"$a\"; done > " + argsFile + "\n"
+	if err := ioutil.WriteFile(filepath.Join(binDir, "scp"), []byte(script), 0755); err != nil {
+		t.Fatalf("fail to write script; %s", err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	err = NewSCP(c).CopyToHost("/tmp/src dir", "user@example.com", "/tmp/dest",
+		WithHostCopyPort(2222), WithHostCopySSHOptions("StrictHostKeyChecking=no"))
+	if err != nil {
+		t.Fatalf("fail to CopyToHost; %s", err)
+	}
+	got, err := ioutil.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("fail to read arguments; %s", err)
+	}
+	want := "-r\n-p\n-o\nBatchMode=yes\n-P\n2222\n-o\nStrictHostKeyChecking=no\n--\n/tmp/src dir\nuser@example.com:/tmp/dest\n"
+	if string(got) != want {
+		t.Errorf("unmatch arguments. got:%q, want:%q", got, want)
+	}
+}
+
+func TestSudo(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	binDir, err := ioutil.TempDir("", "go-scp-TestSudo-bin")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(binDir)
+
+	// sudo on the remote server is replaced with a script which records
+	// its arguments and runs the command as the same user.
+	argsFile := filepath.Join(binDir, "args")
+	script := "#!/bin/sh\nprintf '%s\\n' \"$*\" >> " + argsFile + "\n[ \"$1\" = -n ] || exit 1\nshift\nexec \"$@\"\n"
+	if err := ioutil.WriteFile(filepath.Join(binDir, "sudo"), []byte(script), 0755); err != nil {
+		t.Fatalf("fail to write script; %s", err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	localDir, err := ioutil.TempDir("", "go-scp-TestSudo-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestSudo-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	localName := "test1.dat"
+	if err := generateRandomFile(filepath.Join(localDir, localName)); err != nil {
+		t.Fatalf("fail to generate local file; %s", err)
+	}
+	if err := NewSCP(c, WithSudo()).SendFile(filepath.Join(localDir, localName), remoteDir); err != nil {
+		t.Fatalf("fail to SendFile; %s", err)
+	}
+	sameFileInfoAndContent(t, remoteDir, localDir, localName, localName)
+
+	got, err := ioutil.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("fail to read arguments; %s", err)
+	}
+	if want := "-n sh -c scp -tp '" + remoteDir + "'\n"; string(got) != want {
+		t.Errorf("unmatch arguments. got:%q, want:%q", got, want)
+	}
+}
+
+func TestCompat(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	binDir, err := ioutil.TempDir("", "go-scp-TestCompat-bin")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(binDir)
+
+	// scp on the remote server is replaced with a link to a script named
+	// busybox which rejects the -d option like the scp applet of BusyBox.
+	realScp, err := exec.LookPath("scp")
+	if err != nil {
+		t.Fatalf("fail to find scp; %s", err)
+	}
+	script := "#!/bin/sh\ncase \"$1\" in *d*) exit 1;; esac\nexec " + realScp + " \"$@\"\n"
+	if err := ioutil.WriteFile(filepath.Join(binDir, "busybox"), []byte(script), 0755); err != nil {
+		t.Fatalf("fail to write script; %s", err)
+	}
+	scpPath := filepath.Join(binDir, "scp")
+	if err := os.Symlink(filepath.Join(binDir, "busybox"), scpPath); err != nil {
+		t.Fatalf("fail to create symlink; %s", err)
+	}
+
+	localDir, err := ioutil.TempDir("", "go-scp-TestCompat-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestCompat-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	localName := "test1.dat"
+	localPath := filepath.Join(localDir, localName)
+	if err := generateRandomFile(localPath); err != nil {
+		t.Fatalf("fail to generate local file; %s", err)
+	}
+
+	if err := NewSCP(c, WithScpPath(scpPath)).SendFiles([]string{localPath}, remoteDir); err == nil {
+		t.Errorf("-d option must be rejected")
+	}
+	for _, compat := range []Compat{CompatBusyBox, CompatDropbear, CompatAuto} {
+		if err := NewSCP(c, WithScpPath(scpPath), WithCompat(compat)).SendFiles([]string{localPath}, remoteDir); err != nil {
+			t.Errorf("fail to SendFiles with compat %d; %s", compat, err)
+		}
+		sameFileInfoAndContent(t, remoteDir, localDir, localName, localName)
+	}
+
+	cfg := NewSCP(c, WithScpPath(scpPath), WithCompat(CompatAuto)).sessionConfig()
+	if got := cfg.compatMode(); got != CompatBusyBox {
+		t.Errorf("unmatch compat. got:%d, want:%d", got, CompatBusyBox)
+	}
+	if got, want := cfg.scpOptions([]byte("-tpd")), "-tp"; got != want {
+		t.Errorf("unmatch options. got:%q, want:%q", got, want)
+	}
+	cfg.compat = CompatDropbear
+	if got, want := cfg.scpOptions([]byte("-tpd")), "-t"; got != want {
+		t.Errorf("unmatch options. got:%q, want:%q", got, want)
+	}
+	if got, want := cfg.scpOptions([]byte("-fpd")), "-fp"; got != want {
+		t.Errorf("unmatch options. got:%q, want:%q", got, want)
+	}
+}
+
+func newTestSshdServer() (*sshd.Server, net.Listener, error) {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == testSshdUser && string(pass) == testSshdPassword {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %q", c.User())
+		},
+	}
+	testSshdKey, err := generateTestSshdKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	private, err := ssh.ParsePrivateKey(testSshdKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config.AddHostKey(private)
+
+	server := sshd.NewServer(testSshdShell, config, nil)
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return nil, nil, err
+	}
+	return server, l, err
+}
+
+func generateTestSshdKey() ([]byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
 		return nil, err
 	}
-	pemdata := pem.EncodeToMemory(
-		&pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: x509.MarshalPKCS1PrivateKey(key),
-		},
-	)
-	return pemdata, nil
-}
+	pemdata := pem.EncodeToMemory(
+		&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		},
+	)
+	return pemdata, nil
+}
+
+func newTestSshClient(addr string) (*ssh.Client, error) {
+	config := &ssh.ClientConfig{
+		User:            testSshdUser,
+		Auth:            []ssh.AuthMethod{ssh.Password(testSshdPassword)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	return ssh.Dial("tcp", addr, config)
+}
+
+type fileInfo struct {
+	name    string
+	isDir   bool
+	mode    os.FileMode
+	maxSize int64
+	entries []fileInfo
+}
+
+func generateRandomFiles(dir string, entries []fileInfo) error {
+	for _, entry := range entries {
+		if filepath.Base(entry.name) != entry.name {
+			return fmt.Errorf("fileInfo name must not contain path separator; %s", entry.name)
+		}
+		path := filepath.Join(dir, entry.name)
+		if entry.isDir {
+			err := os.MkdirAll(path, entry.mode)
+			if err != nil {
+				return err
+			}
+			err = generateRandomFiles(path, entry.entries)
+			if err != nil {
+				return err
+			}
+		} else {
+			err := generateRandomFileWithMaxSizeAndMode(path, entry.maxSize, entry.mode)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func generateRandomFile(filename string) error {
+	return generateRandomFileWithMaxSizeAndMode(filename, testMaxFileSize, 0644)
+}
+
+func generateRandomFileWithMaxSizeAndMode(filename string, maxSize int64, mode os.FileMode) error {
+	size, err := generateRandomFileSize(maxSize)
+	if err != nil {
+		return err
+	}
+
+	return generateRandomFileWithSizeAndMode(filename, size, mode)
+}
+
+func generateRandomFileWithSize(filename string, size int64) error {
+	return generateRandomFileWithSizeAndMode(filename, size, 0666)
+}
+
+func generateRandomFileWithSizeAndMode(filename string, size int64, mode os.FileMode) error {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := io.LimitReader(rand.Reader, size)
+	_, err = io.Copy(file, reader)
+	return err
+}
+
+func generateRandomFileSize(maxSize int64) (int64, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(maxSize))
+	if err != nil {
+		return 0, err
+	}
+	return n.Int64(), nil
+}
+
+// removeKeepingDirTime removes the file at path and restores the times of
+// its directory.
+func removeKeepingDirTime(t *testing.T, path string) {
+	dir := filepath.Dir(path)
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatalf("fail to stat directory; %s", err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("fail to remove file; %s", err)
+	}
+	if err := os.Chtimes(dir, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatalf("fail to change times; %s", err)
+	}
+}
+
+func sameDirTreeContent(t *testing.T, gotDir, wantDir string) bool {
+	gotNames, err := filepath.Glob(filepath.Join(gotDir, "*"))
+	if err != nil {
+		t.Fatalf("failed to glob under dir %s; %s", gotDir, err)
+	}
+	wantNames, err := filepath.Glob(filepath.Join(wantDir, "*"))
+	if err != nil {
+		t.Fatalf("failed to glob under dir %s; %s", wantDir, err)
+	}
+	if len(gotNames) != len(wantNames) {
+		t.Errorf("unmatch entry count. got:%d, want:%d", len(gotNames), len(wantNames))
+		return false
+	}
+	sort.Strings(gotNames)
+	sort.Strings(wantNames)
+	for i := 0; i < len(gotNames); i++ {
+		gotName := filepath.Base(gotNames[i])
+		wantName := filepath.Base(wantNames[i])
+		gotPath := filepath.Join(gotDir, gotName)
+		wantPath := filepath.Join(wantDir, wantName)
+		gotFileInfo, err := os.Stat(gotPath)
+		if err != nil {
+			t.Fatalf("cannot stat file; %s", err)
+			return false
+		}
+		wantFileInfo, err := os.Stat(wantPath)
+		if err != nil {
+			t.Fatalf("cannot stat file; %s", err)
+			return false
+		}
+
+		same := sameDirOrFile(t, gotDir, wantDir, gotFileInfo, wantFileInfo)
+		if !same {
+			return false
+		}
+
+		if gotFileInfo.IsDir() {
+			same = sameDirTreeContent(t, filepath.Join(gotDir, gotName), filepath.Join(wantDir, wantName))
+			if !same {
+				return false
+			}
+		}
+	}
+
+	return false
+}
+
+func sameDirOrFile(t *testing.T, gotDir, wantDir string, gotFileInfo, wantFileInfo os.FileInfo) bool {
+	if !sameFileInfo(t, gotDir, wantDir, gotFileInfo, wantFileInfo) {
+		return false
+	}
+	if gotFileInfo.IsDir() {
+		return true
+	}
+	return sameFileContent(t, gotDir, wantDir, gotFileInfo.Name(), wantFileInfo.Name())
+}
+
+func sameFileInfoAndContent(t *testing.T, gotDir, wantDir, gotFilename, wantFilename string) bool {
+	wantPath := filepath.Join(wantDir, wantFilename)
+	wantFileInfo, err := os.Stat(wantPath)
+	if err != nil {
+		t.Fatalf("fail to stat file %s; %s", wantPath, err)
+	}
+	gotPath := filepath.Join(gotDir, gotFilename)
+	gotFileInfo, err := os.Stat(gotPath)
+	if err != nil {
+		t.Fatalf("fail to stat file %s; %s", gotPath, err)
+	}
+	return sameFileInfo(t, gotDir, wantDir, gotFileInfo, wantFileInfo) &&
+		sameFileContent(t, gotDir, wantDir, gotFilename, wantFilename)
+}
+
+func sameFileInfo(t *testing.T, gotDir, wantDir string, gotFileInfo, wantFileInfo os.FileInfo) bool {
+	same := true
+	if gotFileInfo.Size() != wantFileInfo.Size() {
+		t.Errorf("unmatch size. wantDir:%s; gotFileInfo:%d; wantFileInfo:%d", wantDir, gotFileInfo.Size(), wantFileInfo.Size())
+		same = false
+	}
+	if gotFileInfo.Mode() != wantFileInfo.Mode() {
+		t.Errorf("unmatch mode. wantDir:%s; gotFileInfo:%s; wantFileInfo:%s", wantDir, gotFileInfo.Mode(), wantFileInfo.Mode())
+		same = false
+	}
+	gotModTime := gotFileInfo.ModTime().Truncate(time.Second)
+	wantModTime := wantFileInfo.ModTime().Truncate(time.Second)
+	if gotModTime != wantModTime {
+		t.Errorf("unmatch modification time. wantDir:%s; gotFileInfo:%s; wantFileInfo:%s", wantDir, gotModTime, wantModTime)
+		same = false
+	}
+	if gotFileInfo.IsDir() != wantFileInfo.IsDir() {
+		t.Errorf("unmatch isDir. wantDir:%s; gotFileInfo:%v; wantFileInfo:%v", wantDir, gotFileInfo.IsDir(), wantFileInfo.IsDir())
+		same = false
+	}
+	return same
+}
+
+func sameFileContent(t *testing.T, gotDir, wantDir, gotFilename, wantFilename string) bool {
+	wantPath := filepath.Join(wantDir, wantFilename)
+	wantFile, err := os.Open(wantPath)
+	if err != nil {
+		t.Fatalf("failed to open file %s; %s", wantPath, err)
+	}
+	defer wantFile.Close()
+
+	gotPath := filepath.Join(gotDir, gotFilename)
+	gotFile, err := os.Open(gotPath)
+	if err != nil {
+		t.Fatalf("failed to open file %s; %s", gotPath, err)
+	}
+	defer gotFile.Close()
+
+	wantBuf := make([]byte, 4096)
+	gotBuf := make([]byte, 4096)
+	for {
+		n, err := wantFile.Read(wantBuf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read file %s; %s", wantPath, err)
+		}
+		_, err = io.ReadFull(gotFile, gotBuf[:n])
+		if err != nil {
+			t.Fatalf("failed to read file %s; %s", gotPath, err)
+		}
+		if !bytes.Equal(gotBuf[:n], wantBuf[:n]) {
+			t.Errorf("unmatch file content. wantDir:%s, got:%s, want:%s", wantDir, gotFilename, wantFilename)
+			return false
+		}
+	}
+	return true
+}
+
+func TestQueue(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	localDir, err := ioutil.TempDir("", "go-scp-TestQueue-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestQueue-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	localName := "test1.dat"
+	localPath := filepath.Join(localDir, localName)
+	if err := generateRandomFile(localPath); err != nil {
+		t.Fatalf("fail to generate local file; %s", err)
+	}
+
+	var mu sync.Mutex
+	var order []string
+	hook := func(record AuditRecord) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, filepath.Base(record.RemotePath))
+	}
+	q := newQueue(NewSCP(c, WithAuditHook(hook)))
+	var jobs []*QueuedJob
+	for i, priority := range []int{0, 2, 1, 2} {
+		j, err := q.Enqueue(Job{
+			Kind:     JobSendFile,
+			Src:      localPath,
+			Dest:     filepath.Join(remoteDir, fmt.Sprintf("%d.dat", i)),
+			Priority: priority,
+		})
+		if err != nil {
+			t.Fatalf("fail to enqueue; %s", err)
+		}
+		jobs = append(jobs, j)
+	}
+	jobs[2].Cancel()
+	q.start(1)
+	q.Close()
+
+	want := []string{"1.dat", "3.dat", "0.dat"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("unmatch order. got:%v, want:%v", order, want)
+	}
+	for _, i := range []int{0, 1, 3} {
+		if err := jobs[i].Wait(); err != nil {
+			t.Errorf("fail to run job %d; %s", i, err)
+		}
+		progress := jobs[i].Progress()
+		if progress.State != JobSucceeded {
+			t.Errorf("unmatch state of job %d. got:%s, want:%s", i, progress.State, JobSucceeded)
+		}
+		if progress.Usage.BytesSent == 0 {
+			t.Errorf("bytes of job %d must be counted", i)
+		}
+		sameFileContent(t, remoteDir, localDir, fmt.Sprintf("%d.dat", i), localName)
+	}
+	if err := jobs[2].Wait(); !errors.Is(err, ErrJobCanceled) {
+		t.Errorf("unmatch error. got:%v, want:%v", err, ErrJobCanceled)
+	}
+	if state := jobs[2].Progress().State; state != JobCanceled {
+		t.Errorf("unmatch state. got:%s, want:%s", state, JobCanceled)
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, "2.dat")); !os.IsNotExist(err) {
+		t.Errorf("canceled job must not run; %v", err)
+	}
+	if _, err := q.Enqueue(Job{Kind: JobSendFile, Src: localPath, Dest: remoteDir}); !errors.Is(err, ErrQueueClosed) {
+		t.Errorf("unmatch error. got:%v, want:%v", err, ErrQueueClosed)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	localDir, err := ioutil.TempDir("", "go-scp-TestTransfer-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestTransfer-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	localName := "test1.dat"
+	localPath := filepath.Join(localDir, localName)
+	if err := generateRandomFile(localPath); err != nil {
+		t.Fatalf("fail to generate local file; %s", err)
+	}
+
+	t.Run("Wait", func(t *testing.T) {
+		transfer := NewSCP(c).StartSendFile(localPath, remoteDir)
+		if _, err := transfer.Wait(); err != nil {
+			t.Fatalf("fail to SendFile; %s", err)
+		}
+		sameFileInfoAndContent(t, remoteDir, localDir, localName, localName)
+		stats := transfer.Stats()
+		if !stats.Done {
+			t.Errorf("transfer must be done")
+		}
+		if stats.Usage.BytesSent == 0 {
+			t.Errorf("bytes must be counted")
+		}
+
+		localDestDir := filepath.Join(localDir, "dest")
+		report, err := NewSCP(c).StartReceiveDir(remoteDir, localDestDir, nil).Wait()
+		if err != nil {
+			t.Fatalf("fail to ReceiveDir; %s", err)
+		}
+		if report == nil || report.FilesCopied != 1 {
+			t.Errorf("unmatch report. got:%+v, want 1 file copied", report)
+		}
+		sameFileInfoAndContent(t, localDestDir, remoteDir, localName, localName)
+	})
+
+	t.Run("Pause", func(t *testing.T) {
+		destName := "paused.dat"
+		transfer := NewSCP(c, WithIdleTimeout(100*time.Millisecond)).StartSendFile(localPath, filepath.Join(remoteDir, destName))
+		transfer.Pause()
+		time.Sleep(300 * time.Millisecond)
+		stats := transfer.Stats()
+		if stats.Done || !stats.Paused {
+			t.Fatalf("transfer must be paused. got:%+v", stats)
+		}
+		transfer.Resume()
+		if _, err := transfer.Wait(); err != nil {
+			t.Fatalf("fail to SendFile; %s", err)
+		}
+		sameFileInfoAndContent(t, remoteDir, localDir, destName, localName)
+	})
+
+	t.Run("Cancel paused", func(t *testing.T) {
+		transfer := NewSCP(c).StartSendFile(localPath, filepath.Join(remoteDir, "canceled.dat"))
+		transfer.Pause()
+		transfer.Cancel()
+		if _, err := transfer.Wait(); !errors.Is(err, ErrTransferCanceled) {
+			t.Errorf("unmatch error. got:%v, want:%v", err, ErrTransferCanceled)
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		transfer := NewSCP(c).StartSendFile(localPath, filepath.Join(remoteDir, "canceled.dat"))
+		transfer.Cancel()
+		if _, err := transfer.Wait(); !errors.Is(err, ErrTransferCanceled) {
+			t.Errorf("unmatch error. got:%v, want:%v", err, ErrTransferCanceled)
+		}
+		if !transfer.Stats().Done {
+			t.Errorf("transfer must be done")
+		}
+	})
+}
+
+type testSpanKey struct{}
+
+type testSpan struct {
+	name   string
+	parent string
+	attrs  map[string]interface{}
+	ended  bool
+	err    error
+}
+
+func (s *testSpan) SetAttribute(key string, value interface{}) {
+	s.attrs[key] = value
+}
+
+func (s *testSpan) End(err error) {
+	s.ended = true
+	s.err = err
+}
+
+// testTracer records the spans in the order they are started.
+type testTracer struct {
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &testSpan{name: name, attrs: map[string]interface{}{}}
+	if parent, ok := ctx.Value(testSpanKey{}).(*testSpan); ok {
+		span.parent = parent.name
+	}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, testSpanKey{}, span), span
+}
+
+func TestPublishExpvar(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	localDir, err := ioutil.TempDir("", "go-scp-TestPublishExpvar-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
 
-func newTestSshClient(addr string) (*ssh.Client, error) {
-	config := &ssh.ClientConfig{
-		User:            testSshdUser,
-		Auth:            []ssh.AuthMethod{ssh.Password(testSshdPassword)},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestPublishExpvar-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
 	}
+	defer os.RemoveAll(remoteDir)
 
-	return ssh.Dial("tcp", addr, config)
-}
+	content := []byte("content\n")
+	localPath := filepath.Join(localDir, "src.dat")
+	if err := ioutil.WriteFile(localPath, content, 0644); err != nil {
+		t.Fatalf("fail to write file; %s", err)
+	}
 
-type fileInfo struct {
-	name    string
-	isDir   bool
-	mode    os.FileMode
-	maxSize int64
-	entries []fileInfo
-}
+	PublishExpvar()
+	PublishExpvar()
+	vars := expvar.Get("scp").(*expvar.Map)
+	value := func(key string) int64 {
+		return vars.Get(key).(*expvar.Int).Value()
+	}
+	sent, started, active, failures := value("bytes_sent"), value("sessions_started"), value("sessions_active"), value("failures")
 
-func generateRandomFiles(dir string, entries []fileInfo) error {
-	for _, entry := range entries {
-		if filepath.Base(entry.name) != entry.name {
-			return fmt.Errorf("fileInfo name must not contain path separator; %s", entry.name)
-		}
-		path := filepath.Join(dir, entry.name)
-		if entry.isDir {
-			err := os.MkdirAll(path, entry.mode)
-			if err != nil {
-				return err
-			}
-			err = generateRandomFiles(path, entry.entries)
-			if err != nil {
-				return err
-			}
-		} else {
-			err := generateRandomFileWithMaxSizeAndMode(path, entry.maxSize, entry.mode)
-			if err != nil {
-				return err
-			}
-		}
+	if err := NewSCP(c).SendFile(localPath, filepath.Join(remoteDir, "dest.dat")); err != nil {
+		t.Fatalf("fail to SendFile; %s", err)
+	}
+	if err := NewSCP(c).SendFile(localPath, filepath.Join(remoteDir, "missing", "dest.dat")); err == nil {
+		t.Fatalf("SendFile must fail for missing directory")
 	}
-	return nil
-}
 
-func generateRandomFile(filename string) error {
-	return generateRandomFileWithMaxSizeAndMode(filename, testMaxFileSize, 0644)
+	if got := value("bytes_sent") - sent; got < int64(len(content)) {
+		t.Errorf("sent bytes must include the content. got:%d, want:>=%d", got, len(content))
+	}
+	if got := value("sessions_started") - started; got < 2 {
+		t.Errorf("unmatch started sessions. got:%d, want:>=2", got)
+	}
+	if got := value("sessions_active"); got != active {
+		t.Errorf("unmatch active sessions. got:%d, want:%d", got, active)
+	}
+	if got := value("failures") - failures; got != 1 {
+		t.Errorf("unmatch failures. got:%d, want:1", got)
+	}
 }
 
-func generateRandomFileWithMaxSizeAndMode(filename string, maxSize int64, mode os.FileMode) error {
-	size, err := generateRandomFileSize(maxSize)
+func TestCommandTransport(t *testing.T) {
+	localDir, err := ioutil.TempDir("", "go-scp-TestCommandTransport-local")
 	if err != nil {
-		return err
+		t.Fatalf("fail to get tempdir; %s", err)
 	}
+	defer os.RemoveAll(localDir)
 
-	return generateRandomFileWithSizeAndMode(filename, size, mode)
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestCommandTransport-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	localName := "test1.dat"
+	if err := generateRandomFile(filepath.Join(localDir, localName)); err != nil {
+		t.Fatalf("fail to generate local file; %s", err)
+	}
+
+	// The local shell stands for "docker exec -i container sh -c".
+	s := NewSCP(nil, WithTransport(NewCommandTransport("sh", "-c")))
+	if err := s.SendFile(filepath.Join(localDir, localName), filepath.Join(remoteDir, localName)); err != nil {
+		t.Fatalf("fail to SendFile; %s", err)
+	}
+	sameFileInfoAndContent(t, remoteDir, localDir, localName, localName)
+
+	gotName := "got.dat"
+	if err := s.ReceiveFile(filepath.Join(remoteDir, localName), filepath.Join(localDir, gotName)); err != nil {
+		t.Fatalf("fail to ReceiveFile; %s", err)
+	}
+	sameFileInfoAndContent(t, localDir, remoteDir, gotName, localName)
+
+	if err := s.SendFile(filepath.Join(localDir, localName), filepath.Join(remoteDir, "missing", localName)); err == nil {
+		t.Errorf("SendFile must fail for missing directory")
+	}
+	err = NewSCP(nil, WithTransport(NewCommandTransport("sh", "-c")), WithScpPath("no-such-scp")).SendFile(filepath.Join(localDir, localName), remoteDir)
+	var cerr *CommandError
+	if !errors.As(err, &cerr) || cerr.Stderr == "" {
+		t.Errorf("SendFile must fail with the standard error of the command. got:%v", err)
+	}
+
+	if err := NewSCP(nil, WithTransport(NewCommandTransport("sh", "-c")), WithSubsystem("sftp")).SendFile(filepath.Join(localDir, localName), remoteDir); !errors.Is(err, errNotSSHSession) {
+		t.Errorf("subsystem must require an ssh session. got:%v", err)
+	}
 }
 
-func generateRandomFileWithSize(filename string, size int64) error {
-	return generateRandomFileWithSizeAndMode(filename, size, 0666)
+var errNoSession = errors.New("no session")
+
+// failingTransport is the Transport which cannot open sessions.
+type failingTransport struct{}
+
+func (failingTransport) NewSession() (Session, error) { return nil, errNoSession }
+
+// startHookTransport is the local shell transport passing each command
+// line through onStart before running it.
+type startHookTransport struct {
+	onStart func(cmd string) string
 }
 
-func generateRandomFileWithSizeAndMode(filename string, size int64, mode os.FileMode) error {
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+func (t *startHookTransport) NewSession() (Session, error) {
+	sess, err := NewCommandTransport("sh", "-c").NewSession()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer file.Close()
+	return &startHookSession{Session: sess, onStart: t.onStart}, nil
+}
 
-	reader := io.LimitReader(rand.Reader, size)
-	_, err = io.Copy(file, reader)
-	return err
+type startHookSession struct {
+	Session
+	onStart func(cmd string) string
 }
 
-func generateRandomFileSize(maxSize int64) (int64, error) {
-	n, err := rand.Int(rand.Reader, big.NewInt(maxSize))
-	if err != nil {
-		return 0, err
-	}
-	return n.Int64(), nil
+func (s *startHookSession) Start(cmd string) error {
+	return s.Session.Start(s.onStart(cmd))
 }
 
-func sameDirTreeContent(t *testing.T, gotDir, wantDir string) bool {
-	gotNames, err := filepath.Glob(filepath.Join(gotDir, "*"))
+func TestSendFileResumeSize(t *testing.T) {
+	localDir, err := ioutil.TempDir("", "go-scp-TestSendFileResumeSize-local")
 	if err != nil {
-		t.Fatalf("failed to glob under dir %s; %s", gotDir, err)
+		t.Fatalf("fail to get tempdir; %s", err)
 	}
-	wantNames, err := filepath.Glob(filepath.Join(wantDir, "*"))
+	defer os.RemoveAll(localDir)
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestSendFileResumeSize-remote")
 	if err != nil {
-		t.Fatalf("failed to glob under dir %s; %s", wantDir, err)
-	}
-	if len(gotNames) != len(wantNames) {
-		t.Errorf("unmatch entry count. got:%d, want:%d", len(gotNames), len(wantNames))
-		return false
+		t.Fatalf("fail to get tempdir; %s", err)
 	}
-	sort.Strings(gotNames)
-	sort.Strings(wantNames)
-	for i := 0; i < len(gotNames); i++ {
-		gotName := filepath.Base(gotNames[i])
-		wantName := filepath.Base(wantNames[i])
-		gotPath := filepath.Join(gotDir, gotName)
-		wantPath := filepath.Join(wantDir, wantName)
-		gotFileInfo, err := os.Stat(gotPath)
-		if err != nil {
-			t.Fatalf("cannot stat file; %s", err)
-			return false
-		}
-		wantFileInfo, err := os.Stat(wantPath)
-		if err != nil {
-			t.Fatalf("cannot stat file; %s", err)
-			return false
-		}
+	defer os.RemoveAll(remoteDir)
 
-		same := sameDirOrFile(t, gotDir, wantDir, gotFileInfo, wantFileInfo)
-		if !same {
-			return false
-		}
+	localName := "test1.dat"
+	localPath := filepath.Join(localDir, localName)
+	if err := generateRandomFileWithSizeAndMode(localPath, 4096, 0640); err != nil {
+		t.Fatalf("fail to generate local file; %s", err)
+	}
+	data, err := ioutil.ReadFile(localPath)
+	if err != nil {
+		t.Fatalf("fail to read local file; %s", err)
+	}
 
-		if gotFileInfo.IsDir() {
-			same = sameDirTreeContent(t, filepath.Join(gotDir, gotName), filepath.Join(wantDir, wantName))
-			if !same {
-				return false
+	// The local file grows after the send starts, and only its size at
+	// the start is sent.
+	grow := func(cmd string) string {
+		if strings.HasPrefix(cmd, "cat > ") {
+			f, err := os.OpenFile(localPath, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatalf("fail to open local file; %s", err)
+			}
+			defer f.Close()
+			if _, err := f.Write([]byte("appended\n")); err != nil {
+				t.Fatalf("fail to append to local file; %s", err)
 			}
 		}
+		return cmd
+	}
+	if err := NewSCP(nil, WithTransport(&startHookTransport{onStart: grow})).SendFileResume(localPath, remoteDir); err != nil {
+		t.Fatalf("fail to SendFileResume; %s", err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(remoteDir, localName))
+	if err != nil {
+		t.Fatalf("fail to read remote file; %s", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("only the content at the start must be sent. got:%d bytes, want:%d bytes", len(got), len(data))
 	}
 
-	return false
+	// The remote file is left empty, which the size check finds.
+	discard := func(cmd string) string {
+		if strings.HasPrefix(cmd, "cat > ") {
+			return "cat >/dev/null; : > " + strings.TrimPrefix(cmd, "cat > ")
+		}
+		return cmd
+	}
+	destPath := filepath.Join(remoteDir, "test2.dat")
+	if err := NewSCP(nil, WithTransport(&startHookTransport{onStart: discard})).SendFileResume(localPath, destPath); err == nil {
+		t.Errorf("SendFileResume must fail for a remote file of another size")
+	}
 }
 
-func sameDirOrFile(t *testing.T, gotDir, wantDir string, gotFileInfo, wantFileInfo os.FileInfo) bool {
-	if !sameFileInfo(t, gotDir, wantDir, gotFileInfo, wantFileInfo) {
-		return false
+func TestTimeoutErrorUnwrap(t *testing.T) {
+	cause := io.ErrUnexpectedEOF
+
+	timer := &fileTimer{timeout: time.Second, expired: true}
+	watch := &idleWatch{timeout: time.Second, stalled: 1}
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-ctx.Done()
+	op := &operation{parent: context.Background(), ctx: ctx, cancel: cancel, timeout: time.Second}
+	opErr := error(cause)
+	op.finish(&opErr)
+
+	tests := []struct {
+		err  error
+		kind error
+		msg  string
+	}{
+		{timer.err(cause), ErrTimeout, "scp: timeout: file transfer took longer than 1s: err=unexpected EOF"},
+		{watch.err(cause), ErrIdleTimeout, "scp: transfer stalled for idle timeout: 1s: err=unexpected EOF"},
+		{opErr, ErrTimeout, "scp: timeout: operation took longer than 1s: err=unexpected EOF"},
 	}
-	if gotFileInfo.IsDir() {
-		return true
+	for _, tt := range tests {
+		if !errors.Is(tt.err, tt.kind) {
+			t.Errorf("unmatch error. got:%v, want:%v", tt.err, tt.kind)
+		}
+		if !errors.Is(tt.err, cause) {
+			t.Errorf("underlying error must be reachable. got:%v, want:%v", tt.err, cause)
+		}
+		if tt.err.Error() != tt.msg {
+			t.Errorf("unmatch message. got:%q, want:%q", tt.err.Error(), tt.msg)
+		}
 	}
-	return sameFileContent(t, gotDir, wantDir, gotFileInfo.Name(), wantFileInfo.Name())
 }
 
-func sameFileInfoAndContent(t *testing.T, gotDir, wantDir, gotFilename, wantFilename string) bool {
-	wantPath := filepath.Join(wantDir, wantFilename)
-	wantFileInfo, err := os.Stat(wantPath)
+func TestDial(t *testing.T) {
+	srv, err := scptest.NewServer()
 	if err != nil {
-		t.Fatalf("fail to stat file %s; %s", wantPath, err)
+		t.Fatalf("fail to create test server; %s", err)
 	}
-	gotPath := filepath.Join(gotDir, gotFilename)
-	gotFileInfo, err := os.Stat(gotPath)
+	defer srv.Close()
+
+	knownHosts := filepath.Join(srv.Root, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(srv.Addr)}, srv.HostKey)
+	if err := ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatalf("fail to write known_hosts; %s", err)
+	}
+
+	s, err := Dial(srv.Addr, scptest.User, WithPassword(scptest.Password), WithKnownHostsFiles(knownHosts))
 	if err != nil {
-		t.Fatalf("fail to stat file %s; %s", gotPath, err)
+		t.Fatalf("fail to dial; %s", err)
+	}
+	if err := s.SendBytes([]byte("content\n"), 0644, "/dest.dat"); err != nil {
+		t.Fatalf("fail to SendBytes; %s", err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(srv.Root, "dest.dat")); err != nil || string(content) != "content\n" {
+		t.Errorf("unmatch sent file. content:%q, err:%v", content, err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("fail to close; %s", err)
+	}
+	if err := s.SendBytes([]byte("content\n"), 0644, "/dest.dat"); err == nil {
+		t.Errorf("SendBytes must fail after Close")
 	}
-	return sameFileInfo(t, gotDir, wantDir, gotFileInfo, wantFileInfo) &&
-		sameFileContent(t, gotDir, wantDir, gotFilename, wantFilename)
-}
 
-func sameFileInfo(t *testing.T, gotDir, wantDir string, gotFileInfo, wantFileInfo os.FileInfo) bool {
-	same := true
-	if gotFileInfo.Size() != wantFileInfo.Size() {
-		t.Errorf("unmatch size. wantDir:%s; gotFileInfo:%d; wantFileInfo:%d", wantDir, gotFileInfo.Size(), wantFileInfo.Size())
-		same = false
+	if _, err := Dial(srv.Addr, scptest.User, WithPassword("wrong"), WithKnownHostsFiles(knownHosts)); err == nil {
+		t.Errorf("Dial must fail with a wrong password")
 	}
-	if gotFileInfo.Mode() != wantFileInfo.Mode() {
-		t.Errorf("unmatch mode. wantDir:%s; gotFileInfo:%s; wantFileInfo:%s", wantDir, gotFileInfo.Mode(), wantFileInfo.Mode())
-		same = false
+	otherKnownHosts := filepath.Join(srv.Root, "other_known_hosts")
+	if err := ioutil.WriteFile(otherKnownHosts, nil, 0600); err != nil {
+		t.Fatalf("fail to write known_hosts; %s", err)
 	}
-	gotModTime := gotFileInfo.ModTime().Truncate(time.Second)
-	wantModTime := wantFileInfo.ModTime().Truncate(time.Second)
-	if gotModTime != wantModTime {
-		t.Errorf("unmatch modification time. wantDir:%s; gotFileInfo:%s; wantFileInfo:%s", wantDir, gotModTime, wantModTime)
-		same = false
+	// The handshake error does not wrap the *knownhosts.KeyError.
+	if _, err := Dial(srv.Addr, scptest.User, WithPassword(scptest.Password), WithKnownHostsFiles(otherKnownHosts)); err == nil || !strings.Contains(err.Error(), "key is unknown") {
+		t.Errorf("Dial must fail with an unknown host key. got:%v", err)
 	}
-	if gotFileInfo.IsDir() != wantFileInfo.IsDir() {
-		t.Errorf("unmatch isDir. wantDir:%s; gotFileInfo:%v; wantFileInfo:%v", wantDir, gotFileInfo.IsDir(), wantFileInfo.IsDir())
-		same = false
+	if _, err := Dial(srv.Addr, scptest.User, WithKnownHostsFiles(knownHosts)); err == nil {
+		t.Errorf("Dial must fail without authentication methods")
 	}
-	return same
 }
 
-func sameFileContent(t *testing.T, gotDir, wantDir, gotFilename, wantFilename string) bool {
-	wantPath := filepath.Join(wantDir, wantFilename)
-	wantFile, err := os.Open(wantPath)
+func TestDialTimeout(t *testing.T) {
+	// The server accepts the connection and never starts the handshake.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		t.Fatalf("failed to open file %s; %s", wantPath, err)
+		t.Fatalf("fail to listen; %s", err)
 	}
-	defer wantFile.Close()
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := Dial(l.Addr().String(), "user", WithPassword("password"),
+			WithHostKeyCallback(ssh.InsecureIgnoreHostKey()), WithDialTimeout(100*time.Millisecond))
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if err == nil || !strings.Contains(err.Error(), "timed out") {
+			t.Errorf("Dial must time out in the handshake. got:%v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Dial must not hang in the handshake")
+	}
+}
 
-	gotPath := filepath.Join(gotDir, gotFilename)
-	gotFile, err := os.Open(gotPath)
+func TestProxyJump(t *testing.T) {
+	jump, err := scptest.NewServer(scptest.WithTCPForwarding())
 	if err != nil {
-		t.Fatalf("failed to open file %s; %s", gotPath, err)
+		t.Fatalf("fail to create jump server; %s", err)
 	}
-	defer gotFile.Close()
+	defer jump.Close()
+	target, err := scptest.NewServer()
+	if err != nil {
+		t.Fatalf("fail to create target server; %s", err)
+	}
+	defer target.Close()
 
-	wantBuf := make([]byte, 4096)
-	gotBuf := make([]byte, 4096)
-	for {
-		n, err := wantFile.Read(wantBuf)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			t.Fatalf("failed to read file %s; %s", wantPath, err)
+	// Both of the servers are checked with the same callback.
+	hostKeyCallback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if bytes.Equal(key.Marshal(), jump.HostKey.Marshal()) || bytes.Equal(key.Marshal(), target.HostKey.Marshal()) {
+			return nil
 		}
-		_, err = io.ReadFull(gotFile, gotBuf[:n])
-		if err != nil {
-			t.Fatalf("failed to read file %s; %s", gotPath, err)
+		return fmt.Errorf("unknown host key for %s", hostname)
+	}
+	s, err := Dial(target.Addr, scptest.User,
+		WithPassword(scptest.Password),
+		WithHostKeyCallback(hostKeyCallback),
+		WithProxyJump(scptest.User+"@"+jump.Addr))
+	if err != nil {
+		t.Fatalf("fail to dial through jump host; %s", err)
+	}
+	defer s.Close()
+	if err := s.SendBytes([]byte("content\n"), 0644, "/dest.dat"); err != nil {
+		t.Fatalf("fail to SendBytes; %s", err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(target.Root, "dest.dat")); err != nil || string(content) != "content\n" {
+		t.Errorf("file must be sent to the target. content:%q, err:%v", content, err)
+	}
+
+	// The target does not forward connections.
+	if _, err := Dial(jump.Addr, scptest.User,
+		WithPassword(scptest.Password),
+		WithHostKeyCallback(hostKeyCallback),
+		WithProxyJump(target.Addr)); err == nil {
+		t.Errorf("Dial must fail through a host without forwarding")
+	}
+
+	for host, want := range map[string][2]string{
+		"bastion":              {"", "bastion:22"},
+		"user@bastion:2222":    {"user", "bastion:2222"},
+		"user@[2001:db8::1]":   {"user", "[2001:db8::1]:22"},
+		"a@b@[2001:db8::1]:23": {"a@b", "[2001:db8::1]:23"},
+	} {
+		if user, addr := splitJumpHost(host); user != want[0] || addr != want[1] {
+			t.Errorf("unmatch split of %s. got:%s %s, want:%s %s", host, user, addr, want[0], want[1])
 		}
-		if !bytes.Equal(gotBuf[:n], wantBuf[:n]) {
-			t.Errorf("unmatch file content. wantDir:%s, got:%s, want:%s", wantDir, gotFilename, wantFilename)
-			return false
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	srv, err := scptest.NewServer()
+	if err != nil {
+		t.Fatalf("fail to create test server; %s", err)
+	}
+	defer srv.Close()
+
+	dials := 0
+	dial := func(ctx context.Context) (*ssh.Client, error) {
+		dials++
+		return srv.Dial()
+	}
+	s := NewSCP(nil, WithReconnect(dial))
+	defer s.Close()
+	// SendDir sends into the parent of a missing destination for the retry.
+	if n := s.maxRetries(); n != 1 {
+		t.Errorf("WithReconnect must retry once without WithRetry. got:%d", n)
+	}
+
+	if err := s.SendBytes([]byte("first\n"), 0644, "/first.dat"); err != nil {
+		t.Fatalf("fail to SendBytes; %s", err)
+	}
+	// A session rejected by the server does not replace the connection.
+	rejected := &ssh.OpenChannelError{Reason: ssh.Prohibited, Message: "open failed"}
+	if connectionLost(s.reconnect.current(), rejected) {
+		t.Errorf("rejected session must not be taken as the lost connection")
+	}
+	// Lose the connection.
+	s.reconnect.current().Close()
+	if err := s.SendBytes([]byte("second\n"), 0644, "/second.dat"); err != nil {
+		t.Fatalf("fail to SendBytes after the connection is lost; %s", err)
+	}
+	if dials != 2 {
+		t.Errorf("unmatch dial count. got:%d, want:2", dials)
+	}
+	for name, want := range map[string]string{"first.dat": "first\n", "second.dat": "second\n"} {
+		if content, err := ioutil.ReadFile(filepath.Join(srv.Root, name)); err != nil || string(content) != want {
+			t.Errorf("unmatch sent file %s. content:%q, err:%v", name, content, err)
 		}
 	}
-	return true
+
+	client := s.reconnect.current()
+	if err := s.Close(); err != nil {
+		t.Errorf("fail to close; %s", err)
+	}
+	if _, err := client.NewSession(); err == nil {
+		t.Errorf("the dialed connection must be closed by Close")
+	}
+}
+
+func TestPing(t *testing.T) {
+	srv, err := scptest.NewServer()
+	if err != nil {
+		t.Fatalf("fail to create test server; %s", err)
+	}
+	defer srv.Close()
+
+	client, err := srv.Dial()
+	if err != nil {
+		t.Fatalf("fail to dial; %s", err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+
+	if err := NewSCP(client).Ping(ctx); err != nil {
+		t.Errorf("fail to ping; %s", err)
+	}
+	var perr *PingError
+	if err := NewSCP(client, WithScpPath("no-such-command")).Ping(ctx); !errors.As(err, &perr) || perr.Stage != PingScp {
+		t.Errorf("Ping must fail at scp stage without scp. got:%v", err)
+	}
+	client.Close()
+	if err := NewSCP(client).Ping(ctx); !errors.As(err, &perr) || perr.Stage != PingConnection {
+		t.Errorf("Ping must fail at connection stage on a closed connection. got:%v", err)
+	}
 }
@@ -1,15 +1,16 @@
 package scp
 
 import (
-	"context"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
-
-	"golang.org/x/crypto/ssh"
 )
 
 var (
@@ -31,81 +32,210 @@ func (e EmptySourceObserver) OnFileInfo(fileInfo *FileInfo) {
 func (e EmptySourceObserver) OnWrite(p []byte) {
 }
 
+// FileDoneObserver is an optional interface implemented by a SourceObserver.
+// The observer is notified of the files received from the remote source,
+// and this interface adds the notification of the end of each file, for
+// example to complete or fail a progress bar.
+type FileDoneObserver interface {
+	// OnFileDone is called after the file notified with OnFileInfo is
+	// copied, with the error of the copy or nil if it succeeded.
+	OnFileDone(fileInfo *FileInfo, err error)
+}
+
+func notifyFileDone(observer SourceObserver, fileInfo *FileInfo, err error) {
+	if doneObserver, ok := observer.(FileDoneObserver); ok {
+		doneObserver.OnFileDone(fileInfo, err)
+	}
+}
+
 // Receive copies a single remote file to the specified writer
 // and returns the file information. The actual type of the file information is
 // scp.FileInfo, and you can get the access time with fileInfo.(*scp.FileInfo).AccessTime().
-func (s *SCP) Receive(srcFile string, dest io.Writer) (os.FileInfo, error) {
+func (s *SCP) Receive(srcFile string, dest io.Writer) (fi os.FileInfo, err error) {
+	s, op := s.withTimeout()
+	defer op.finish(&err)
 	var info os.FileInfo
-	srcFile = realPath(filepath.Clean(srcFile))
-	err := runResourceSession(s.ctx, s.client, srcFile, false, "", false, true, func(s *resourceSession) error {
-		var timeHeader TimeMsgHeader
-		h, err := s.ReadHeaderOrReply()
+	srcFile = s.cleanRemotePath(srcFile)
+	scp := s
+	err = runResourceSession(s.sessionConfig(), srcFile, false, false, func(s *resourceSession) error {
+		timeHeader, fileHeader, err := s.readFileHeaders()
 		if err != nil {
-			return fmt.Errorf("failed to read scp message header: err=%s", err)
+			return err
 		}
-		var ok bool
-		timeHeader, ok = h.(TimeMsgHeader)
-		if !ok {
-			return fmt.Errorf("expected time message header, got %+v", h)
+		fileInfo := NewFileInfo(srcFile, fileHeader.Size, fileHeader.Mode, timeHeader.Mtime, timeHeader.Atime)
+		scp.sourceObserver.OnFileInfo(fileInfo)
+		wo := &writerProxy{
+			writer:       dest,
+			onWriterFunc: scp.sourceObserver.OnWrite,
 		}
-
-		h, err = s.ReadHeaderOrReply()
+		a := scp.newAuditor(DirectionDownload, "", srcFile)
+		a.attach(&s.tee)
+		err = s.CopyFileBodyTo(fileHeader, wo)
+		a.finish(err)
+		notifyFileDone(scp.sourceObserver, fileInfo, err)
 		if err != nil {
-			return fmt.Errorf("failed to read scp message header: err=%s", err)
-		}
-		fileHeader, ok := h.(FileMsgHeader)
-		if !ok {
-			return fmt.Errorf("expected file message header, got %+v", h)
-		}
-		if err := s.CopyFileBodyTo(fileHeader, dest); err != nil {
-			return fmt.Errorf("failed to copy file: err=%s", err)
+			return fmt.Errorf("failed to copy file: err=%w", err)
 		}
 
-		info = NewFileInfo(srcFile, fileHeader.Size, fileHeader.Mode, timeHeader.Mtime, timeHeader.Atime)
+		info = fileInfo
 		return nil
 	})
 	return info, err
 }
 
+// ReceiveBytes copies a single remote file into memory and returns its
+// content and information, for small files such as configuration files.
+// The actual type of the file information is scp.FileInfo as in Receive.
+func (s *SCP) ReceiveBytes(srcFile string) ([]byte, os.FileInfo, error) {
+	var buf bytes.Buffer
+	fi, err := s.Receive(srcFile, &buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), fi, nil
+}
+
 // ReceiveFile copies a single remote file to the local machine with
 // the specified name. The time and permission will be set to the same value
 // of the source file.
-func (s *SCP) ReceiveFile(srcFile, destFile string) error {
-	srcFile = realPath(filepath.Clean(srcFile))
+func (s *SCP) ReceiveFile(srcFile, destFile string) (err error) {
+	s, obs := s.observeOp("ReceiveFile", destFile, srcFile)
+	defer obs.finish(&err)
+	s, op := s.withTimeout()
+	defer op.finish(&err)
+	return s.retry(func() error {
+		return s.receiveFile(srcFile, destFile)
+	})
+}
+
+// receiveFile is ReceiveFile without the retries.
+func (s *SCP) receiveFile(srcFile, destFile string) error {
+	srcFile = s.cleanRemotePath(srcFile)
 	destFile = filepath.Clean(destFile)
 	fiDest, err := os.Stat(destFile)
 	if err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to get information of destnation file: err=%s", err)
+		return fmt.Errorf("failed to get information of destnation file: err=%w", err)
 	}
 	if err == nil && fiDest.IsDir() {
-		destFile = filepath.Join(destFile, filepath.Base(srcFile))
+		destFile = filepath.Join(destFile, s.nameNormalization.normalize(filepath.Base(srcFile)))
 	}
+	if s.base64Transfer {
+		err = s.receiveFileWithCommands(srcFile, destFile)
+	} else {
+		err = s.receiveFileWithScp(srcFile, destFile)
+	}
+	if err != nil {
+		return err
+	}
+	return s.chownLocalFromRemote(srcFile, destFile, nil)
+}
 
-	return runResourceSession(s.ctx, s.client, srcFile, false, "", false, true, func(rs *resourceSession) error {
-		h, err := rs.ReadHeaderOrReply()
+// receiveFileWithScp receives srcFile to destFile with the scp protocol.
+func (s *SCP) receiveFileWithScp(srcFile, destFile string) error {
+	err := runResourceSession(s.sessionConfig(), srcFile, false, false, func(rs *resourceSession) error {
+		timeHeader, fileHeader, err := rs.readFileHeaders()
 		if err != nil {
-			return fmt.Errorf("failed to read scp message header: err=%s", err)
-		}
-		timeHeader, ok := h.(TimeMsgHeader)
-		if !ok {
-			return fmt.Errorf("expected time message header, got %+v", h)
+			return err
 		}
 
-		h, err = rs.ReadHeaderOrReply()
-		if err != nil {
-			return fmt.Errorf("failed to read scp message header: err=%s", err)
+		if kept, err := s.discardIfKept(rs, destFile, timeHeader, fileHeader); err != nil || kept {
+			return err
 		}
-		fileHeader, ok := h.(FileMsgHeader)
-		if !ok {
-			return fmt.Errorf("expected file message header, got %+v", h)
+		a := s.newAuditor(DirectionDownload, destFile, srcFile)
+		a.attach(&rs.tee)
+		err = s.copyFileBodyFromRemote(rs, s.newMetadataApplier(), destFile, timeHeader, fileHeader)
+		a.finish(err)
+		if err != nil {
+			return err
 		}
+		return s.extractReceived(destFile)
+	})
+	if s.fallsBackToCat(err) {
+		return s.receiveFileWithCommands(srcFile, destFile)
+	}
+	return err
+}
 
-		return s.copyFileBodyFromRemote(rs, destFile, timeHeader, fileHeader)
+// ReceiveFiles copies the remote files to the local destDir in a single
+// session, which saves the cost of starting a session for each file.
+// destDir must be an existing directory. The time and permission will be set
+// to the same value of each source file.
+func (s *SCP) ReceiveFiles(srcFiles []string, destDir string) (err error) {
+	s, op := s.withTimeout()
+	defer op.finish(&err)
+	return s.retry(func() error {
+		return s.receiveFiles(srcFiles, destDir)
+	})
+}
+
+// receiveFiles is ReceiveFiles without the retries.
+func (s *SCP) receiveFiles(srcFiles []string, destDir string) error {
+	if len(srcFiles) == 0 {
+		return nil
+	}
+	destDir = filepath.Clean(destDir)
+	fiDest, err := os.Stat(destDir)
+	if err != nil {
+		return fmt.Errorf("failed to get information of destination directory: err=%w", err)
+	}
+	if !fiDest.IsDir() {
+		return fmt.Errorf("destination is not a directory: %s", destDir)
+	}
+	remotePaths := make([]string, len(srcFiles))
+	for i, srcFile := range srcFiles {
+		remotePaths[i] = s.cleanRemotePath(srcFile)
+	}
+
+	m := s.newMetadataApplier()
+	return runResourceSessionPaths(s.sessionConfig(), remotePaths, false, false, func(rs *resourceSession) error {
+		var timeHeader TimeMsgHeader
+		i := 0
+		for {
+			h, err := rs.ReadHeaderOrReply()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("failed to read scp message header: err=%w", err)
+			}
+			switch h := h.(type) {
+			case TimeMsgHeader:
+				timeHeader = h
+			case FileMsgHeader:
+				if i >= len(remotePaths) {
+					return fmt.Errorf("unexpected file message header, got %+v", h)
+				}
+				localFilename := filepath.Join(destDir, s.nameNormalization.normalize(h.Name))
+				kept, err := s.discardIfKept(rs, localFilename, timeHeader, h)
+				if err != nil {
+					return err
+				}
+				if kept {
+					i++
+					continue
+				}
+				a := s.newAuditor(DirectionDownload, localFilename, remotePaths[i])
+				a.attach(&rs.tee)
+				err = s.copyFileBodyFromRemote(rs, m, localFilename, timeHeader, h)
+				a.finish(err)
+				if err != nil {
+					return err
+				}
+				if err := s.extractReceived(localFilename); err != nil {
+					return err
+				}
+				i++
+			case okMsg:
+				// do nothing
+			default:
+				return fmt.Errorf("expected file message header, got %+v", h)
+			}
+		}
+		return nil
 	})
 }
 
 type writerProxy struct {
-	writer io.Writer
+	writer       io.Writer
 	onWriterFunc func(p []byte)
 }
 
@@ -115,163 +245,445 @@ func (w *writerProxy) Write(p []byte) (n int, err error) {
 	return
 }
 
-func(s *SCP) copyFileBodyFromRemote(rs *resourceSession, localFilename string, timeHeader TimeMsgHeader, fileHeader FileMsgHeader) error {
+func (s *SCP) copyFileBodyFromRemote(rs *resourceSession, m *metadataApplier, localFilename string, timeHeader TimeMsgHeader, fileHeader FileMsgHeader) error {
 	fileInfo := NewFileInfo(localFilename, fileHeader.Size, fileHeader.Mode, timeHeader.Mtime, timeHeader.Atime)
+	return s.writeReceivedFile(m, localFilename, fileInfo, func(w io.Writer) error {
+		return rs.CopyFileBodyTo(fileHeader, w)
+	})
+}
+
+// createLocalTemp creates a temporary file for localFilename in the same
+// directory. Unlike ioutil.TempFile, the file is created with perm masked
+// by the umask, as the destination file would be.
+func createLocalTemp(localFilename string, perm os.FileMode) (*os.File, error) {
+	for {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		name := filepath.Join(filepath.Dir(localFilename), "."+filepath.Base(localFilename)+".tmp-"+hex.EncodeToString(b))
+		file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) {
+			continue
+		}
+		return file, err
+	}
+}
+
+// writeReceivedFile writes the body copied by copyFn to localFilename and
+// sets the permission and the times of fileInfo.
+func (s *SCP) writeReceivedFile(m *metadataApplier, localFilename string, fileInfo *FileInfo, copyFn func(w io.Writer) error) (err error) {
 	s.sourceObserver.OnFileInfo(fileInfo)
+	defer func() {
+		notifyFileDone(s.sourceObserver, fileInfo, err)
+	}()
 
-	file, err := os.OpenFile(localFilename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fileHeader.Mode)
-	if err != nil {
-		return fmt.Errorf("failed to open destination file: err=%s", err)
+	var file *os.File
+	destFilename := localFilename
+	if s.atomicWrites {
+		file, err = createLocalTemp(localFilename, fileInfo.Mode())
+		if err != nil {
+			return fmt.Errorf("failed to create temporary file: err=%w", err)
+		}
+		localFilename = file.Name()
+		defer func() {
+			if err != nil {
+				os.Remove(localFilename)
+			}
+		}()
+	} else {
+		var backedUp bool
+		backedUp, err = s.backupLocal(localFilename)
+		if err != nil {
+			return err
+		}
+		if backedUp {
+			// Restore the backup on failure, so that a retry does not
+			// replace it with the partial file.
+			defer func() {
+				if err != nil {
+					s.restoreLocal(localFilename)
+				}
+			}()
+		}
+		file, err = os.OpenFile(localFilename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fileInfo.Mode())
+		if err != nil {
+			return fmt.Errorf("failed to open destination file: err=%w", err)
+		}
 	}
 
+	if err := s.preallocateFile(file, fileInfo.Size()); err != nil {
+		file.Close()
+		return err
+	}
+
+	var sparse *sparseWriter
 	wo := &writerProxy{
 		writer:       file,
 		onWriterFunc: s.sourceObserver.OnWrite,
 	}
+	if s.sparseFiles {
+		sparse = &sparseWriter{file: file}
+		wo.writer = sparse
+	}
+	hasher := s.newContentHasher(fileInfo, s.sourceObserver)
+	if hasher != nil {
+		wo.onWriterFunc = func(p []byte) {
+			hasher.write(p)
+			s.sourceObserver.OnWrite(p)
+		}
+	}
 
-	if err := rs.CopyFileBodyTo(fileHeader, wo); err != nil {
+	if err := copyFn(wo); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to copy file: err=%w", err)
+	}
+	if sparse != nil {
+		if err := sparse.finish(); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to set file size: err=%w", err)
+		}
+	}
+	if err := s.syncFile(file); err != nil {
 		file.Close()
-		return fmt.Errorf("failed to copy file: err=%s", err)
+		return err
 	}
 	file.Close()
+	if hasher != nil {
+		hasher.done()
+	}
 
-	if err := os.Chmod(localFilename, fileHeader.Mode); err != nil {
-		return fmt.Errorf("failed to change file mode: err=%s", err)
+	if err := m.chmod(localFilename, fileInfo.Mode()); err != nil {
+		return fmt.Errorf("failed to change file mode: err=%w", err)
 	}
 
-	if err := os.Chtimes(localFilename, timeHeader.Atime, timeHeader.Mtime); err != nil {
-		return fmt.Errorf("failed to change file time: err=%s", err)
+	if err := m.chtimes(localFilename, fileInfo.AccessTime(), fileInfo.ModTime()); err != nil {
+		return fmt.Errorf("failed to change file time: err=%w", err)
 	}
 
-	return nil
+	if localFilename != destFilename {
+		if _, err := s.backupLocal(destFilename); err != nil {
+			return err
+		}
+		if err := os.Rename(localFilename, destFilename); err != nil {
+			return fmt.Errorf("failed to rename temporary file: err=%w", err)
+		}
+	}
+	return s.syncParentDir(destFilename)
 }
 
 // ReceiveDir copies files and directories under a remote srcDir to
 // to the destDir on the local machine. You can filter the files and directories
 // to be copied with acceptFn. If acceptFn is nil, all files and directories will
 // be copied. The time and permission will be set to the same value of the source
-// file or directory.
-func (s *SCP) ReceiveDir(srcDir, destDir string, acceptFn AcceptFunc) error {
-	srcDir = realPath(filepath.Clean(srcDir))
+// file or directory. The returned report summarizes the transfer, even if
+// it fails.
+func (s *SCP) ReceiveDir(srcDir, destDir string, acceptFn AcceptFunc) (report *TransferReport, err error) {
+	s, obs := s.observeOp("ReceiveDir", destDir, srcDir)
+	defer obs.finish(&err)
+	s, op := s.withTimeout()
+	defer op.finish(&err)
+	s, r := s.withReporter()
+	srcDir = s.cleanRemotePath(srcDir)
 	destDir = filepath.Clean(destDir)
-	_, err := os.Stat(destDir)
+	if err := s.preScanRemote(srcDir); err != nil {
+		return r.finish(), err
+	}
+	_, err = os.Stat(destDir)
 	if err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to get information of destination directory: err=%s", err)
+		return r.finish(), fmt.Errorf("failed to get information of destination directory: err=%w", err)
 	}
+	// The placement is decided before the first attempt, since the attempt
+	// creates destDir.
 	var skipsFirstDirectory bool
 	if os.IsNotExist(err) {
 		skipsFirstDirectory = true
 		if err := os.MkdirAll(destDir, 0777); err != nil {
-			return fmt.Errorf("failed to create destination directory: err=%s", err)
+			return r.finish(), fmt.Errorf("failed to create destination directory: err=%w", err)
 		}
 	}
+	err = s.retry(func() error {
+		return s.receiveDirTree(srcDir, destDir, skipsFirstDirectory, acceptFn, r)
+	})
+	return r.finish(), err
+}
 
+// receiveDirTree is ReceiveDir counting the entries with r. If
+// skipsFirstDirectory is true, the entries under srcDir are placed directly
+// under destDir.
+func (s *SCP) receiveDirTree(srcDir, destDir string, skipsFirstDirectory bool, acceptFn AcceptFunc, r *reporter) error {
+	var err error
 	if acceptFn == nil {
 		acceptFn = acceptAny
 	}
+	root := destDir
+	if !skipsFirstDirectory {
+		root = filepath.Join(destDir, s.nameNormalization.normalize(filepath.Base(srcDir)))
+	}
+	acceptFn, err = s.receiveSyncFilter(srcDir, root, s.excludeFilter(root, acceptFn))
+	if err != nil {
+		return err
+	}
+	acceptFn = r.accept(acceptFn)
+	var m *mirror
+	if s.delete {
+		if m, err = s.newMirror(root); err != nil {
+			return err
+		}
+		acceptFn = m.record(acceptFn)
+	}
 
-	return runResourceSession(s.ctx, s.client, srcDir, false, "", true, true, func(rs *resourceSession) error {
-		curDir := destDir
-		var timeHeader TimeMsgHeader
-		var timeHeaders []TimeMsgHeader
-		isFirstStartDirectory := true
-		var skipBaseDir string
-		for {
-			h, err := rs.ReadHeaderOrReply()
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				return fmt.Errorf("failed to read scp message header: err=%s", err)
-			}
-			switch h.(type) {
-			case TimeMsgHeader:
-				timeHeader = h.(TimeMsgHeader)
-			case StartDirectoryMsgHeader:
-				dirHeader := h.(StartDirectoryMsgHeader)
-
-				if isFirstStartDirectory {
-					isFirstStartDirectory = false
-					if skipsFirstDirectory {
-						continue
-					}
-				}
+	switch {
+	case s.sync != SyncNone || !s.tarStream && len(s.linkDests) > 0:
+		// The tree is listed first, so that the unchanged files are not
+		// requested.
+		err = s.receiveListedTree(srcDir, destDir, root, skipsFirstDirectory, 1, acceptFn)
+	case s.tarStream:
+		err = s.receiveDirTar(srcDir, destDir, skipsFirstDirectory, acceptFn)
+	default:
+		receiver := &localDirReceiver{scp: s, root: destDir, top: root, metadata: s.newMetadataApplier()}
+		err = runResourceSession(s.sessionConfig(), srcDir, false, true, func(rs *resourceSession) error {
+			return s.walkRemoteDir(rs, destDir, skipsFirstDirectory, acceptFn, receiver)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		if err := deleteLocalExtraneous(root, m); err != nil {
+			return err
+		}
+	}
+	if skipsFirstDirectory {
+		// root is destDir created for the top directory.
+		r.accepted[root] = true
+	}
+	return s.chownLocalFromRemote(srcDir, root, r.accepted)
+}
 
-				curDir = filepath.Join(curDir, dirHeader.Name)
-				timeHeaders = append(timeHeaders, timeHeader)
+// dirReceiver handles the entries accepted while walking a recursive receive
+// with walkRemoteDir. The paths are destDir joined with the remote relative paths.
+type dirReceiver interface {
+	// startDirectory is called when entering a directory with the time
+	// header of the directory.
+	startDirectory(dir string, timeHeader TimeMsgHeader, dirHeader StartDirectoryMsgHeader) error
+	// endDirectory is called when leaving a directory with the time header
+	// of the directory.
+	endDirectory(dir string, timeHeader TimeMsgHeader) error
+	// receiveFile is called for a file and must consume the file body from rs.
+	receiveFile(rs *resourceSession, path string, timeHeader TimeMsgHeader, fileHeader FileMsgHeader) error
+}
 
-				if skipBaseDir != "" {
-					continue
-				}
+// localDirReceiver writes the received files and directories to the local
+// filesystem.
+type localDirReceiver struct {
+	scp  *SCP
+	root string
+	// top is the local top directory of the copied tree for WithMapFunc.
+	top      string
+	metadata *metadataApplier
+}
 
-				info := NewFileInfo(dirHeader.Name, 0, dirHeader.Mode|os.ModeDir, timeHeader.Mtime, timeHeader.Atime)
-				accepted, err := acceptFn(filepath.Dir(curDir), info)
-				if err != nil {
-					return fmt.Errorf("error from accessFn: err=%s", err)
-				}
-				if !accepted {
-					skipBaseDir = curDir
+func (r *localDirReceiver) startDirectory(dir string, timeHeader TimeMsgHeader, dirHeader StartDirectoryMsgHeader) error {
+	if r.scp.mapFunc != nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, dirHeader.Mode); err != nil {
+		return fmt.Errorf("failed to create directory: err=%w", err)
+	}
+
+	if err := r.metadata.chmod(dir, dirHeader.Mode); err != nil {
+		return fmt.Errorf("failed to change directory mode: err=%w", err)
+	}
+	return nil
+}
+
+func (r *localDirReceiver) endDirectory(dir string, timeHeader TimeMsgHeader) error {
+	if r.scp.mapFunc != nil {
+		return nil
+	}
+	if err := r.metadata.chtimes(dir, timeHeader.Atime, timeHeader.Mtime); err != nil {
+		return fmt.Errorf("failed to change directory time: err=%w", err)
+	}
+	return r.scp.syncParentDir(dir)
+}
+
+func (r *localDirReceiver) receiveFile(rs *resourceSession, path string, timeHeader TimeMsgHeader, fileHeader FileMsgHeader) error {
+	path, err := r.localPath(path, timeHeader, fileHeader)
+	if err != nil {
+		return err
+	}
+	if kept, err := r.scp.discardIfKept(rs, path, timeHeader, fileHeader); err != nil || kept {
+		return err
+	}
+	if err := r.scp.copyFileBodyFromRemote(rs, r.metadata, path, timeHeader, fileHeader); err != nil {
+		return err
+	}
+	return r.scp.extractReceived(path)
+}
+
+// localPath returns the path of the file at path mapped with WithMapFunc.
+func (r *localDirReceiver) localPath(path string, timeHeader TimeMsgHeader, fileHeader FileMsgHeader) (string, error) {
+	if r.scp.mapFunc == nil {
+		return path, nil
+	}
+	info := NewFileInfo(fileHeader.Name, fileHeader.Size, fileHeader.Mode, timeHeader.Mtime, timeHeader.Atime)
+	return r.scp.mapLocalPath(r.top, path, info)
+}
+
+// linkFile hardlinks the file at path from the link destination directories
+// if it is unchanged there, so that it needs not to be received. The file
+// kept by WithOverwritePolicy is not linked.
+func (r *localDirReceiver) linkFile(path string, timeHeader TimeMsgHeader, fileHeader FileMsgHeader) (bool, error) {
+	path, err := r.localPath(path, timeHeader, fileHeader)
+	if err != nil {
+		return false, err
+	}
+	incoming := NewFileInfo(path, fileHeader.Size, fileHeader.Mode, timeHeader.Mtime, timeHeader.Atime)
+	if kept, err := r.scp.keepsExisting(path, incoming); err != nil || kept {
+		return false, err
+	}
+	rel, err := filepath.Rel(r.root, path)
+	if err != nil {
+		return false, fmt.Errorf("failed to get relative path: err=%w", err)
+	}
+	linked, err := r.scp.linkFromLinkDest(rel, path, timeHeader, fileHeader)
+	if err != nil || !linked {
+		return false, err
+	}
+	return true, r.scp.extractReceived(path)
+}
+
+// walkRemoteDir reads the messages of a recursive receive and passes
+// the entries accepted by acceptFn to receiver. If skipsFirstDirectory is true,
+// the entries under the top directory are placed directly under destDir.
+func (s *SCP) walkRemoteDir(rs *resourceSession, destDir string, skipsFirstDirectory bool, acceptFn AcceptFunc, receiver dirReceiver) error {
+	if acceptFn == nil {
+		acceptFn = acceptAny
+	}
+
+	// remotePath returns the remote path corresponding to the local path
+	// under destDir for the audit record.
+	remoteBase := rs.remoteSrcPath
+	if !skipsFirstDirectory {
+		remoteBase = path.Dir(remoteBase)
+	}
+	remotePath := func(localPath string) string {
+		rel, err := filepath.Rel(destDir, localPath)
+		if err != nil {
+			return ""
+		}
+		return path.Join(remoteBase, filepath.ToSlash(rel))
+	}
+
+	progress := s.progressSink()
+	curDir := destDir
+	var timeHeader TimeMsgHeader
+	var timeHeaders []TimeMsgHeader
+	isFirstStartDirectory := true
+	var skipBaseDir string
+	for {
+		h, err := rs.ReadHeaderOrReply()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read scp message header: err=%w", err)
+		}
+		switch h.(type) {
+		case TimeMsgHeader:
+			timeHeader = h.(TimeMsgHeader)
+		case StartDirectoryMsgHeader:
+			dirHeader := h.(StartDirectoryMsgHeader)
+			dirHeader.Name = s.nameNormalization.normalize(dirHeader.Name)
+
+			if isFirstStartDirectory {
+				isFirstStartDirectory = false
+				if skipsFirstDirectory {
 					continue
 				}
+			}
 
-				if err := os.MkdirAll(curDir, dirHeader.Mode); err != nil {
-					return fmt.Errorf("failed to create directory: err=%s", err)
-				}
+			curDir = filepath.Join(curDir, dirHeader.Name)
+			timeHeaders = append(timeHeaders, timeHeader)
 
-				if err := os.Chmod(curDir, dirHeader.Mode); err != nil {
-					return fmt.Errorf("failed to change directory mode: err=%s", err)
-				}
-			case EndDirectoryMsgHeader:
-				if len(timeHeaders) > 0 {
-					timeHeader = timeHeaders[len(timeHeaders)-1]
-					timeHeaders = timeHeaders[:len(timeHeaders)-1]
-					if skipBaseDir == "" {
-						if err := os.Chtimes(curDir, timeHeader.Atime, timeHeader.Mtime); err != nil {
-							return fmt.Errorf("failed to change directory time: err=%s", err)
-						}
-					}
-				}
-				curDir = filepath.Dir(curDir)
-				if skipBaseDir != "" {
-					var sub bool
-					if curDir == "" {
-						sub = true
-					} else {
-						var err error
-						sub, err = isSubdirectory(skipBaseDir, curDir)
-						if err != nil {
-							return fmt.Errorf("failed to check directory is subdirectory: err=%s", err)
-						}
-					}
-					if !sub {
-						skipBaseDir = ""
-					}
-				}
-			case FileMsgHeader:
-				fileHeader := h.(FileMsgHeader)
+			if skipBaseDir != "" {
+				continue
+			}
+
+			info := NewFileInfo(dirHeader.Name, 0, dirHeader.Mode|os.ModeDir, timeHeader.Mtime, timeHeader.Atime)
+			accepted, err := acceptFn(filepath.Dir(curDir), info)
+			if err != nil {
+				return fmt.Errorf("error from accessFn: err=%w", err)
+			}
+			if !accepted {
+				skipBaseDir = curDir
+				continue
+			}
+
+			if err := receiver.startDirectory(curDir, timeHeader, dirHeader); err != nil {
+				return err
+			}
+			progress.dir(EventDirEntered, DirectionDownload, curDir)
+		case EndDirectoryMsgHeader:
+			if len(timeHeaders) > 0 {
+				timeHeader = timeHeaders[len(timeHeaders)-1]
+				timeHeaders = timeHeaders[:len(timeHeaders)-1]
 				if skipBaseDir == "" {
-					info := NewFileInfo(fileHeader.Name, fileHeader.Size, fileHeader.Mode, timeHeader.Mtime, timeHeader.Atime)
-					accepted, err := acceptFn(curDir, info)
-					if err != nil {
-						return fmt.Errorf("error from accessFn: err=%s", err)
-					}
-					if !accepted {
-						continue
-					}
-					localFilename := filepath.Join(curDir, fileHeader.Name)
-					if err = s.copyFileBodyFromRemote(rs, localFilename, timeHeader, fileHeader); err != nil {
+					if err := receiver.endDirectory(curDir, timeHeader); err != nil {
 						return err
 					}
+					progress.dir(EventDirLeft, DirectionDownload, curDir)
+				}
+			}
+			curDir = filepath.Dir(curDir)
+			if skipBaseDir != "" {
+				var sub bool
+				if curDir == "" {
+					sub = true
 				} else {
+					var err error
+					sub, err = isSubdirectory(skipBaseDir, curDir)
+					if err != nil {
+						return fmt.Errorf("failed to check directory is subdirectory: err=%w", err)
+					}
+				}
+				if !sub {
+					skipBaseDir = ""
+				}
+			}
+		case FileMsgHeader:
+			fileHeader := h.(FileMsgHeader)
+			fileHeader.Name = s.nameNormalization.normalize(fileHeader.Name)
+			if skipBaseDir == "" {
+				info := NewFileInfo(fileHeader.Name, fileHeader.Size, fileHeader.Mode, timeHeader.Mtime, timeHeader.Atime)
+				accepted, err := acceptFn(curDir, info)
+				if err != nil {
+					return fmt.Errorf("error from accessFn: err=%w", err)
+				}
+				if !accepted {
 					if err := rs.CopyFileBodyTo(fileHeader, ioutil.Discard); err != nil {
 						return err
 					}
+					continue
+				}
+				localFilename := filepath.Join(curDir, fileHeader.Name)
+				a := s.newAuditor(DirectionDownload, localFilename, remotePath(localFilename))
+				a.attach(&rs.tee)
+				err = receiver.receiveFile(rs, localFilename, timeHeader, fileHeader)
+				a.finish(err)
+				if err != nil {
+					return err
+				}
+			} else {
+				if err := rs.CopyFileBodyTo(fileHeader, ioutil.Discard); err != nil {
+					return err
 				}
-			case okMsg:
-				// do nothing
 			}
+		case okMsg:
+			// do nothing
 		}
-		return nil
-	})
+	}
+	return nil
 }
 
 func isSubdirectory(basepath, targetpath string) (bool, error) {
@@ -279,12 +691,11 @@ func isSubdirectory(basepath, targetpath string) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	return !strings.HasPrefix(rel, ".."+string([]rune{filepath.Separator})), nil
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string([]rune{filepath.Separator})), nil
 }
 
 type resourceSession struct {
-	client            *ssh.Client
-	session           *ssh.Session
+	session           Session
 	remoteSrcPath     string
 	remoteSrcIsDir    bool
 	scpPath           string
@@ -292,25 +703,36 @@ type resourceSession struct {
 	updatesPermission bool
 	stdin             io.WriteCloser
 	stdout            io.Reader
+	teardown          *teardown
 	*resourceProtocol
 }
 
-func newResourceSession(client *ssh.Client, remoteSrcPath string, remoteSrcIsDir bool, scpPath string, recursive, updatesPermission bool) (*resourceSession, error) {
+func newResourceSession(cfg *sessionConfig, remoteSrcPath string, remoteSrcIsDir, recursive bool) (*resourceSession, error) {
+	return newResourceSessionPaths(cfg, []string{remoteSrcPath}, remoteSrcIsDir, recursive)
+}
+
+// newResourceSessionPaths starts a session sending all of remoteSrcPaths
+// in order. remoteSrcPath of the session is the first path.
+func newResourceSessionPaths(cfg *sessionConfig, remoteSrcPaths []string, remoteSrcIsDir, recursive bool) (*resourceSession, error) {
 	s := &resourceSession{
-		client:            client,
-		remoteSrcPath:     remoteSrcPath,
+		remoteSrcPath:     remoteSrcPaths[0],
 		remoteSrcIsDir:    remoteSrcIsDir,
-		scpPath:           scpPath,
+		scpPath:           cfg.scpPath,
 		recursive:         recursive,
-		updatesPermission: updatesPermission,
+		updatesPermission: cfg.updatesPermission,
 	}
 
-	var err error
-	s.session, err = s.client.NewSession()
+	usage, err := cfg.accounting.startSession(cfg.remoteAddr())
+	if err != nil {
+		return nil, err
+	}
+
+	s.session, err = cfg.newScpSession()
 	if err != nil {
-		_ = s.session.Close()
 		return nil, err
 	}
+	usage.started()
+	s.teardown = cfg.newTeardown(s.session)
 
 	s.stdout, err = s.session.StdoutPipe()
 	if err != nil {
@@ -323,6 +745,11 @@ func newResourceSession(client *ssh.Client, remoteSrcPath string, remoteSrcIsDir
 		_ = s.session.Close()
 		return nil, err
 	}
+	s.stdin, s.stdout = usage.wrap(s.stdin, s.stdout)
+	s.stdin, s.stdout = cfg.usage.wrap(s.stdin, s.stdout)
+	s.stdin, s.stdout = cfg.hostMetrics().wrap(s.stdin, s.stdout)
+	s.stdin, s.stdout = s.teardown.idle.wrap(s.stdin, s.stdout)
+	s.stdin, s.stdout = cfg.pause.wrap(s.stdin, s.stdout)
 
 	if s.scpPath == "" {
 		s.scpPath = "scp"
@@ -339,17 +766,29 @@ func newResourceSession(client *ssh.Client, remoteSrcPath string, remoteSrcIsDir
 		opt = append(opt, 'd')
 	}
 
-	cmd := s.scpPath + " " + string(opt) + " " + escapeShellArg(s.remoteSrcPath)
-	if err := s.session.Start(cmd); err != nil {
+	paths := make([]string, len(remoteSrcPaths))
+	for i, p := range remoteSrcPaths {
+		paths[i] = cfg.quoting.quote(p)
+	}
+	cmd := cfg.scpCommand(s.scpPath, cfg.scpOptions(opt), strings.Join(paths, " "))
+	s.teardown.cmd = cmd
+	s.stdin, s.stdout = cfg.protocolTrace.wrap(cmd, s.stdin, s.stdout)
+	if err := cfg.start(s.session, s.stdin, cmd, s.teardown.log); err != nil {
 		_ = s.session.Close()
 		return nil, err
 	}
+	s.teardown.active = startExpvarSession()
 
 	s.resourceProtocol, err = newResourceProtocol(s.stdin, s.stdout)
 	if err != nil {
-		_ = s.session.Close()
+		err = s.teardown.explain(s.session, err)
+		_ = s.Close()
 		return nil, err
 	}
+	s.resourceProtocol.fileTimer = s.teardown.file
+	s.resourceProtocol.forcedMode = cfg.forcedMode
+	s.resourceProtocol.bufferSize = cfg.bufferSize
+	s.resourceProtocol.log = s.teardown.log
 	return s, nil
 }
 
@@ -357,6 +796,7 @@ func (s *resourceSession) Close() error {
 	if s == nil || s.session == nil {
 		return nil
 	}
+	s.teardown.active.end()
 	return s.session.Close()
 }
 
@@ -364,17 +804,21 @@ func (s *resourceSession) Wait() error {
 	if s == nil || s.session == nil {
 		return nil
 	}
-	return s.session.Wait()
+	return s.teardown.wait(s.session)
 }
 
-func runResourceSession(ctx context.Context, client *ssh.Client, remoteSrcPath string, remoteSrcIsDir bool, scpPath string, recursive, updatesPermission bool, handler func(s *resourceSession) error) error {
-	s, err := newResourceSession(client, remoteSrcPath, remoteSrcIsDir, scpPath, recursive, updatesPermission)
+func runResourceSession(cfg *sessionConfig, remoteSrcPath string, remoteSrcIsDir, recursive bool, handler func(s *resourceSession) error) error {
+	return runResourceSessionPaths(cfg, []string{remoteSrcPath}, remoteSrcIsDir, recursive, handler)
+}
+
+func runResourceSessionPaths(cfg *sessionConfig, remoteSrcPaths []string, remoteSrcIsDir, recursive bool, handler func(s *resourceSession) error) error {
+	s, err := newResourceSessionPaths(cfg, remoteSrcPaths, remoteSrcIsDir, recursive)
 	if err != nil {
 		return err
 	}
 	defer s.Close()
 	go func() {
-		done := ctx.Done()
+		done := cfg.ctx.Done()
 		// can never canceled
 		if done == nil {
 			return
@@ -386,7 +830,7 @@ func runResourceSession(ctx context.Context, client *ssh.Client, remoteSrcPath s
 	}()
 
 	if err := handler(s); err != nil {
-		return err
+		return s.teardown.explain(s.session, err)
 	}
 
 	return s.Wait()
@@ -3,10 +3,26 @@
 package scp
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestReceiveFile(t *testing.T) {
@@ -50,6 +66,50 @@ func TestReceiveFile(t *testing.T) {
 		sameFileInfoAndContent(t, localDir, remoteDir, localName, remoteName)
 	})
 
+	t.Run("Metrics", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		content := []byte("content\n")
+		remotePath := filepath.Join(remoteDir, "src.dat")
+		if err := ioutil.WriteFile(remotePath, content, 0644); err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+
+		metrics := &testMetrics{bytes: map[Direction]int64{}}
+		s := NewSCP(c, WithMetrics(metrics))
+		if err := s.ReceiveFile(remotePath, filepath.Join(localDir, "dest.dat")); err != nil {
+			t.Fatalf("fail to ReceiveFile; %s", err)
+		}
+		err = s.ReceiveFile(filepath.Join(remoteDir, "missing.dat"), filepath.Join(localDir, "missing.dat"))
+		if err == nil {
+			t.Fatalf("ReceiveFile must fail for missing file")
+		}
+
+		want := []string{"ReceiveFile ", "ReceiveFile not_found"}
+		if !reflect.DeepEqual(metrics.transfers, want) {
+			t.Errorf("unmatch transfers. got:%q, want:%q", metrics.transfers, want)
+		}
+		if got := metrics.bytes[DirectionDownload]; got < int64(len(content)) {
+			t.Errorf("received bytes must include the content. got:%d, want:>=%d", got, len(content))
+		}
+		if metrics.bytes[DirectionUpload] == 0 {
+			t.Errorf("sent bytes must be counted")
+		}
+		if metrics.host != c.RemoteAddr().String() {
+			t.Errorf("unmatch host. got:%s, want:%s", metrics.host, c.RemoteAddr())
+		}
+	})
+
 	t.Run("Empty file", func(t *testing.T) {
 		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-local")
 		if err != nil {
@@ -101,90 +161,1987 @@ func TestReceiveFile(t *testing.T) {
 		}
 		sameDirTreeContent(t, remoteDir, localDir)
 	})
-}
 
-func TestReceiveDir(t *testing.T) {
-	s, l, err := newTestSshdServer()
-	if err != nil {
-		t.Fatalf("fail to create test sshd server; %s", err)
-	}
-	defer s.Close()
-	go s.Serve(l)
+	t.Run("Report content hash", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
 
-	c, err := newTestSshClient(l.Addr().String())
-	if err != nil {
-		t.Fatalf("fail to serve test sshd server; %s", err)
-	}
-	defer c.Close()
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
 
-	t.Run("dest dir not exist", func(t *testing.T) {
-		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-local")
+		remoteName := "src.dat"
+		localName := "dest.dat"
+		remotePath := filepath.Join(remoteDir, remoteName)
+		localPath := filepath.Join(localDir, localName)
+		if err := generateRandomFile(remotePath); err != nil {
+			t.Fatalf("fail to generate remote file; %s", err)
+		}
+
+		observer := &testHashObserver{}
+		if err := NewSCP(c, WithSourceObserver(observer), WithHash(sha256.New)).ReceiveFile(remotePath, localPath); err != nil {
+			t.Errorf("fail to ReceiveFile; %s", err)
+		}
+		data, err := ioutil.ReadFile(remotePath)
+		if err != nil {
+			t.Fatalf("fail to read remote file; %s", err)
+		}
+		want := sha256.Sum256(data)
+		if !bytes.Equal(observer.sum, want[:]) {
+			t.Errorf("unmatch hash. got:%x, want:%x", observer.sum, want)
+		}
+	})
+
+	t.Run("Receive multiple files", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-local")
 		if err != nil {
 			t.Fatalf("fail to get tempdir; %s", err)
 		}
 		defer os.RemoveAll(localDir)
 
-		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-remote")
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-remote")
 		if err != nil {
 			t.Fatalf("fail to get tempdir; %s", err)
 		}
 		defer os.RemoveAll(remoteDir)
 
-		entries := []fileInfo{
-			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
-			{name: "bar", maxSize: testMaxFileSize, mode: 0600},
-			{name: "baz", isDir: true, mode: 0755,
-				entries: []fileInfo{
-					{name: "foo", maxSize: testMaxFileSize, mode: 0400},
-					{name: "hoge", maxSize: testMaxFileSize, mode: 0602},
-					{name: "emptyDir", isDir: true, mode: 0500},
-				},
-			},
+		var srcFiles []string
+		for _, name := range []string{"src1.dat", "src2.dat", "src3.dat"} {
+			remotePath := filepath.Join(remoteDir, name)
+			if err := generateRandomFile(remotePath); err != nil {
+				t.Fatalf("fail to generate remote file; %s", err)
+			}
+			srcFiles = append(srcFiles, remotePath)
 		}
-		if err := generateRandomFiles(remoteDir, entries); err != nil {
-			t.Fatalf("fail to generate remote files; %s", err)
+
+		accounting := NewAccounting()
+		if err := NewSCP(c, WithAccounting(accounting)).ReceiveFiles(srcFiles, localDir); err != nil {
+			t.Fatalf("fail to ReceiveFiles; %s", err)
+		}
+		if sessions := accounting.Usage(c.RemoteAddr().String()).Sessions; sessions != 1 {
+			t.Errorf("unmatch session count. got:%d, want:1", sessions)
 		}
+		sameDirTreeContent(t, localDir, remoteDir)
+	})
 
-		localDestDir := filepath.Join(localDir, "dest")
-		if err := NewSCP(c).ReceiveDir(remoteDir, localDestDir, nil); err != nil {
-			t.Errorf("fail to ReceiveDir; %s", err)
+	t.Run("Resume", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		remoteName := "src.dat"
+		remotePath := filepath.Join(remoteDir, remoteName)
+		if err := generateRandomFileWithSizeAndMode(remotePath, 4096, 0640); err != nil {
+			t.Fatalf("fail to generate remote file; %s", err)
+		}
+		data, err := ioutil.ReadFile(remotePath)
+		if err != nil {
+			t.Fatalf("fail to read remote file; %s", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(localDir, remoteName), data[:1000], 0600); err != nil {
+			t.Fatalf("fail to write partial local file; %s", err)
+		}
+
+		accounting := NewAccounting()
+		if err := NewSCP(c, WithAccounting(accounting)).ReceiveFileResume(remotePath, localDir); err != nil {
+			t.Fatalf("fail to ReceiveFileResume; %s", err)
+		}
+		sameFileInfoAndContent(t, localDir, remoteDir, remoteName, remoteName)
+		if received := accounting.Usage(c.RemoteAddr().String()).BytesReceived; received >= int64(len(data)) {
+			t.Errorf("received bytes must exclude the existing content. got:%d", received)
 		}
-		sameDirTreeContent(t, remoteDir, localDestDir)
 	})
 
-	t.Run("dest dir exists", func(t *testing.T) {
-		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-local")
+	t.Run("Parallel", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-local")
 		if err != nil {
 			t.Fatalf("fail to get tempdir; %s", err)
 		}
 		defer os.RemoveAll(localDir)
 
-		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-remote")
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-remote")
 		if err != nil {
 			t.Fatalf("fail to get tempdir; %s", err)
 		}
 		defer os.RemoveAll(remoteDir)
 
-		entries := []fileInfo{
-			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
-			{name: "bar", maxSize: testMaxFileSize, mode: 0600},
-			{name: "baz", isDir: true, mode: 0755,
-				entries: []fileInfo{
-					{name: "foo", maxSize: testMaxFileSize, mode: 0400},
-					{name: "hoge", maxSize: testMaxFileSize, mode: 0602},
-					{name: "emptyDir", isDir: true, mode: 0500},
-				},
-			},
+		remoteName := "src.dat"
+		remotePath := filepath.Join(remoteDir, remoteName)
+		if err := generateRandomFileWithSizeAndMode(remotePath, 5*parallelBlockSize-100, 0640); err != nil {
+			t.Fatalf("fail to generate remote file; %s", err)
 		}
-		if err := generateRandomFiles(remoteDir, entries); err != nil {
-			t.Fatalf("fail to generate remote files; %s", err)
+
+		accounting := NewAccounting()
+		if err := NewSCP(c, WithAccounting(accounting)).ReceiveFileParallel(remotePath, localDir, 3); err != nil {
+			t.Fatalf("fail to ReceiveFileParallel; %s", err)
+		}
+		sameFileInfoAndContent(t, localDir, remoteDir, remoteName, remoteName)
+		// A session for stat and a session for each of the 3 chunks.
+		if sessions := accounting.Usage(c.RemoteAddr().String()).Sessions; sessions != 4 {
+			t.Errorf("unmatch session count. got:%d, want:4", sessions)
+		}
+	})
+
+	t.Run("Report file done", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
 		}
+		defer os.RemoveAll(localDir)
 
-		if err := NewSCP(c).ReceiveDir(remoteDir, localDir, nil); err != nil {
-			t.Errorf("fail to ReceiveDir; %s", err)
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		remotePath := filepath.Join(remoteDir, "src.dat")
+		size := int64(4096)
+		if err := generateRandomFileWithSize(remotePath, size); err != nil {
+			t.Fatalf("fail to generate remote file; %s", err)
+		}
+
+		observer := &testProgressObserver{}
+		s := NewSCP(c, WithSourceObserver(observer))
+		if err := s.ReceiveFile(remotePath, localDir); err != nil {
+			t.Errorf("fail to ReceiveFile; %s", err)
+		}
+		var buf bytes.Buffer
+		if _, err := s.Receive(remotePath, &buf); err != nil {
+			t.Errorf("fail to Receive; %s", err)
+		}
+		if observer.started != 2 || observer.done != 2 || observer.failed != 0 {
+			t.Errorf("unmatch notifications. got:%+v", observer)
+		}
+		if observer.written != 2*size {
+			t.Errorf("unmatch written bytes. got:%d, want:%d", observer.written, 2*size)
+		}
+	})
+
+	t.Run("Sparse files", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		const size = 512 * 1024
+		localPath := filepath.Join(localDir, "disk.img")
+		file, err := os.Create(localPath)
+		if err != nil {
+			t.Fatalf("fail to create file; %s", err)
+		}
+		if err := file.Truncate(size); err != nil {
+			t.Fatalf("fail to truncate file; %s", err)
+		}
+		if _, err := file.WriteAt([]byte("head"), 0); err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+		if _, err := file.WriteAt([]byte("middle"), size/2); err != nil {
+			t.Fatalf("fail to write file; %s", err)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatalf("fail to close file; %s", err)
+		}
+
+		s := NewSCP(c, WithSparseFiles())
+		if err := s.SendFile(localPath, remoteDir); err != nil {
+			t.Fatalf("fail to SendFile; %s", err)
+		}
+		receivedPath := filepath.Join(localDir, "received.img")
+		if err := s.ReceiveFile(filepath.Join(remoteDir, "disk.img"), receivedPath); err != nil {
+			t.Fatalf("fail to ReceiveFile; %s", err)
+		}
+
+		want, err := ioutil.ReadFile(localPath)
+		if err != nil {
+			t.Fatalf("fail to read file; %s", err)
+		}
+		for _, name := range []string{filepath.Join(remoteDir, "disk.img"), receivedPath} {
+			got, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatalf("fail to read file; %s", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("unmatch content of %s", name)
+			}
+		}
+		fi, err := os.Stat(receivedPath)
+		if err != nil {
+			t.Fatalf("fail to stat file; %s", err)
+		}
+		if allocated := fi.Sys().(*syscall.Stat_t).Blocks * 512; allocated >= size {
+			t.Errorf("received file must be sparse. allocated:%d, size:%d", allocated, size)
+		}
+	})
+
+	t.Run("Preallocate", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		want := bytes.Repeat([]byte("0123456789abcdef"), 16*1024)
+		remotePath := filepath.Join(remoteDir, "data")
+		if err := ioutil.WriteFile(remotePath, want, 0644); err != nil {
+			t.Fatalf("fail to write remote file; %s", err)
+		}
+		localPath := filepath.Join(localDir, "data")
+		if err := ioutil.WriteFile(localPath, []byte("previous content longer than nothing"), 0644); err != nil {
+			t.Fatalf("fail to write local file; %s", err)
+		}
+
+		if err := NewSCP(c, WithPreallocate()).ReceiveFile(remotePath, localPath); err != nil {
+			t.Fatalf("fail to ReceiveFile; %s", err)
+		}
+		got, err := ioutil.ReadFile(localPath)
+		if err != nil {
+			t.Fatalf("fail to read file; %s", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("unmatch content. got %d bytes, want %d bytes", len(got), len(want))
+		}
+	})
+
+	t.Run("Sync writes", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		if err := os.Mkdir(filepath.Join(remoteDir, "sub"), 0755); err != nil {
+			t.Fatalf("fail to create directory; %s", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(remoteDir, "sub", "backup.db"), []byte("data\n"), 0600); err != nil {
+			t.Fatalf("fail to write remote file; %s", err)
+		}
+
+		s := NewSCP(c, WithSyncWrites())
+		if _, err := s.ReceiveDir(remoteDir, filepath.Join(localDir, "dir"), nil); err != nil {
+			t.Fatalf("fail to ReceiveDir; %s", err)
+		}
+		if err := s.ReceiveFile(filepath.Join(remoteDir, "sub", "backup.db"), localDir); err != nil {
+			t.Fatalf("fail to ReceiveFile; %s", err)
+		}
+		for _, name := range []string{filepath.Join(localDir, "dir", "sub", "backup.db"), filepath.Join(localDir, "backup.db")} {
+			got, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatalf("fail to read file; %s", err)
+			}
+			if string(got) != "data\n" {
+				t.Errorf("unmatch content of %s. got:%q, want:%q", name, got, "data\n")
+			}
 		}
-		remoteDirBase := filepath.Base(remoteDir)
-		localDestDir := filepath.Join(localDir, remoteDirBase)
-		sameDirTreeContent(t, remoteDir, localDestDir)
 	})
+
+	t.Run("Atomic writes", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		remotePath := filepath.Join(remoteDir, "src.dat")
+		if err := generateRandomFileWithSize(remotePath, 8<<20); err != nil {
+			t.Fatalf("fail to generate remote file; %s", err)
+		}
+		localPath := filepath.Join(localDir, "src.dat")
+		content := []byte("old content\n")
+		if err := ioutil.WriteFile(localPath, content, 0644); err != nil {
+			t.Fatalf("fail to write local file; %s", err)
+		}
+
+		// The receive is interrupted after the first write.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		observer := &testCancelObserver{cancel: cancel}
+		err = NewSCP(c, WithContext(ctx), WithSourceObserver(observer), WithAtomicWrites()).ReceiveFile(remotePath, localPath)
+		if err == nil {
+			t.Fatalf("interrupted receive must fail")
+		}
+		got, err := ioutil.ReadFile(localPath)
+		if err != nil {
+			t.Fatalf("fail to read local file; %s", err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("existing file must be kept")
+		}
+		infos, err := ioutil.ReadDir(localDir)
+		if err != nil {
+			t.Fatalf("fail to read local dir; %s", err)
+		}
+		if len(infos) != 1 {
+			t.Errorf("temporary file must be removed. got:%d files", len(infos))
+		}
+
+		if err := NewSCP(c, WithAtomicWrites()).ReceiveFile(remotePath, localPath); err != nil {
+			t.Fatalf("fail to ReceiveFile; %s", err)
+		}
+		sameFileInfoAndContent(t, remoteDir, localDir, "src.dat", "src.dat")
+
+		// Without the permission preserved, the file is created with
+		// the permission masked by the umask as without WithAtomicWrites.
+		plainPath := filepath.Join(localDir, "plain.dat")
+		if err := NewSCP(c, WithoutPreserve()).ReceiveFile(remotePath, plainPath); err != nil {
+			t.Fatalf("fail to ReceiveFile; %s", err)
+		}
+		atomicPath := filepath.Join(localDir, "atomic.dat")
+		if err := NewSCP(c, WithoutPreserve(), WithAtomicWrites()).ReceiveFile(remotePath, atomicPath); err != nil {
+			t.Fatalf("fail to ReceiveFile; %s", err)
+		}
+		plain, err := os.Stat(plainPath)
+		if err != nil {
+			t.Fatalf("fail to stat file; %s", err)
+		}
+		atomic, err := os.Stat(atomicPath)
+		if err != nil {
+			t.Fatalf("fail to stat file; %s", err)
+		}
+		if atomic.Mode() != plain.Mode() {
+			t.Errorf("unmatch permission. got:%s, want:%s", atomic.Mode(), plain.Mode())
+		}
+	})
+
+	t.Run("Overwrite policy", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		remotePath := filepath.Join(remoteDir, "src.dat")
+		if err := ioutil.WriteFile(remotePath, []byte("remote\n"), 0644); err != nil {
+			t.Fatalf("fail to write remote file; %s", err)
+		}
+		localPath := filepath.Join(localDir, "src.dat")
+		writeLocal := func(mtime time.Time) {
+			if err := ioutil.WriteFile(localPath, []byte("local\n"), 0644); err != nil {
+				t.Fatalf("fail to write local file; %s", err)
+			}
+			if err := os.Chtimes(localPath, mtime, mtime); err != nil {
+				t.Fatalf("fail to change local file time; %s", err)
+			}
+		}
+		readLocal := func() string {
+			data, err := ioutil.ReadFile(localPath)
+			if err != nil {
+				t.Fatalf("fail to read local file; %s", err)
+			}
+			return string(data)
+		}
+
+		writeLocal(time.Now().Add(time.Hour))
+		if err := NewSCP(c, WithOverwritePolicy(OverwriteNewerOnly)).ReceiveFile(remotePath, localPath); err != nil {
+			t.Fatalf("fail to ReceiveFile; %s", err)
+		}
+		if got := readLocal(); got != "local\n" {
+			t.Errorf("newer local file must be kept. got:%q", got)
+		}
+		if err := NewSCP(c, WithOverwritePolicy(OverwriteSkip)).ReceiveFile(remotePath, localDir); err != nil {
+			t.Fatalf("fail to ReceiveFile; %s", err)
+		}
+		if got := readLocal(); got != "local\n" {
+			t.Errorf("local file must be kept. got:%q", got)
+		}
+		err = NewSCP(c, WithOverwritePolicy(OverwriteErrorIfExists)).ReceiveFile(remotePath, localPath)
+		if !errors.Is(err, ErrFileExists) {
+			t.Errorf("must be file exists error. got:%v", err)
+		}
+
+		// ReceiveDir places the files under the directory of the same name.
+		if err := os.Mkdir(filepath.Join(localDir, filepath.Base(remoteDir)), 0755); err != nil {
+			t.Fatalf("fail to create local dir; %s", err)
+		}
+		localPath = filepath.Join(localDir, filepath.Base(remoteDir), "src.dat")
+		writeLocal(time.Now().Add(-time.Hour))
+		if _, err := NewSCP(c, WithOverwritePolicy(OverwriteNewerOnly)).ReceiveDir(remoteDir, localDir, nil); err != nil {
+			t.Fatalf("fail to ReceiveDir; %s", err)
+		}
+		if got := readLocal(); got != "remote\n" {
+			t.Errorf("older local file must be replaced. got:%q", got)
+		}
+	})
+
+	t.Run("Remote file not exist", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		err = NewSCP(c).ReceiveFile(filepath.Join(remoteDir, "missing.dat"), filepath.Join(localDir, "dest.dat"))
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("error must be os.ErrNotExist. got:%v", err)
+		}
+		var remoteErr *RemoteError
+		if !errors.As(err, &remoteErr) {
+			t.Errorf("error must be *RemoteError. got:%T", err)
+		}
+	})
+
+	t.Run("Auto extract tar.gz", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveFile-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		content := []byte("extracted content\n")
+		remotePath := filepath.Join(remoteDir, "src.tar.gz")
+		if err := writeTestTarGz(remotePath, "sub/foo.txt", content); err != nil {
+			t.Fatalf("fail to write remote archive; %s", err)
+		}
+
+		if err := NewSCP(c, WithAutoExtract(), WithRemoveExtractedArchives()).ReceiveFile(remotePath, localDir); err != nil {
+			t.Fatalf("fail to ReceiveFile; %s", err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(localDir, "sub", "foo.txt"))
+		if err != nil {
+			t.Fatalf("fail to read extracted file; %s", err)
+		}
+		if !bytes.Equal(data, content) {
+			t.Errorf("unmatch extracted content. got:%q, want:%q", data, content)
+		}
+		if _, err := os.Stat(filepath.Join(localDir, "src.tar.gz")); !os.IsNotExist(err) {
+			t.Errorf("extracted archive must be removed; %v", err)
+		}
+	})
+}
+
+func writeTestTarGz(filename, name string, content []byte) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gw := gzip.NewWriter(file)
+	tw := tar.NewWriter(gw)
+	h := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(h); err != nil {
+		return err
+	}
+	if _, err := tw.Write(content); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func TestExtractArchiveZipSlip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-scp-TestExtractArchiveZipSlip")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"../evil.txt", "/evil.txt", "a/../../evil.txt"} {
+		archive := filepath.Join(dir, "slip.zip")
+		file, err := os.Create(archive)
+		if err != nil {
+			t.Fatalf("fail to create archive; %s", err)
+		}
+		zw := zip.NewWriter(file)
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("fail to create archive entry; %s", err)
+		}
+		w.Write([]byte("evil"))
+		zw.Close()
+		file.Close()
+
+		destDir := filepath.Join(dir, "dest")
+		if err := extractArchive(archive, destDir, archiveZip); !errors.Is(err, ErrUnsafeArchivePath) {
+			t.Errorf("unsafe entry %q must be rejected. got:%v", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "evil.txt")); !os.IsNotExist(err) {
+			t.Errorf("unsafe entry %q must not be written", name)
+		}
+	}
+}
+
+func TestReceiveDir(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	t.Run("dest dir not exist", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+			{name: "bar", maxSize: testMaxFileSize, mode: 0600},
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "foo", maxSize: testMaxFileSize, mode: 0400},
+					{name: "hoge", maxSize: testMaxFileSize, mode: 0602},
+					{name: "emptyDir", isDir: true, mode: 0500},
+				},
+			},
+		}
+		if err := generateRandomFiles(remoteDir, entries); err != nil {
+			t.Fatalf("fail to generate remote files; %s", err)
+		}
+
+		localDestDir := filepath.Join(localDir, "dest")
+		if _, err := NewSCP(c).ReceiveDir(remoteDir, localDestDir, nil); err != nil {
+			t.Errorf("fail to ReceiveDir; %s", err)
+		}
+		t.Log("same", sameDirTreeContent(t, remoteDir, localDestDir))
+	})
+
+	t.Run("dest dir exists", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+			{name: "bar", maxSize: testMaxFileSize, mode: 0600},
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "foo", maxSize: testMaxFileSize, mode: 0400},
+					{name: "hoge", maxSize: testMaxFileSize, mode: 0602},
+					{name: "emptyDir", isDir: true, mode: 0500},
+				},
+			},
+		}
+		if err := generateRandomFiles(remoteDir, entries); err != nil {
+			t.Fatalf("fail to generate remote files; %s", err)
+		}
+
+		if _, err := NewSCP(c).ReceiveDir(remoteDir, localDir, nil); err != nil {
+			t.Errorf("fail to ReceiveDir; %s", err)
+		}
+		remoteDirBase := filepath.Base(remoteDir)
+		localDestDir := filepath.Join(localDir, remoteDirBase)
+		t.Log("same", sameDirTreeContent(t, remoteDir, localDestDir))
+	})
+	t.Run("skip directory", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "a", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+				},
+			},
+			{name: "b", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "bar", maxSize: testMaxFileSize, mode: 0644},
+				},
+			},
+			{name: "c", maxSize: testMaxFileSize, mode: 0644},
+		}
+		if err := generateRandomFiles(remoteDir, entries); err != nil {
+			t.Fatalf("fail to generate remote files; %s", err)
+		}
+
+		localDestDir := filepath.Join(localDir, "dest")
+		acceptFn := func(parentDir string, info os.FileInfo) (bool, error) {
+			return info.Name() != "a", nil
+		}
+		if _, err := NewSCP(c).ReceiveDir(remoteDir, localDestDir, acceptFn); err != nil {
+			t.Errorf("fail to ReceiveDir; %s", err)
+		}
+		if _, err := os.Stat(filepath.Join(localDestDir, "a")); !os.IsNotExist(err) {
+			t.Errorf("skipped directory must not exist; %v", err)
+		}
+		sameFileInfoAndContent(t, filepath.Join(localDestDir, "b"), filepath.Join(remoteDir, "b"), "bar", "bar")
+		sameFileInfoAndContent(t, localDestDir, remoteDir, "c", "c")
+	})
+
+	t.Run("skip files and nested directory", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "foo.skip", maxSize: testMaxFileSize, mode: 0644},
+			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "skip", isDir: true, mode: 0755,
+						entries: []fileInfo{
+							{name: "fuga", maxSize: testMaxFileSize, mode: 0644},
+						},
+					},
+					{name: "hoge.skip", maxSize: testMaxFileSize, mode: 0644},
+					{name: "hoge", maxSize: testMaxFileSize, mode: 0644},
+				},
+			},
+		}
+		if err := generateRandomFiles(remoteDir, entries); err != nil {
+			t.Fatalf("fail to generate remote files; %s", err)
+		}
+
+		// The bodies of the rejected files must be consumed, and leaving
+		// the skipped directory must not skip the rest of its parent.
+		localDestDir := filepath.Join(localDir, "dest")
+		acceptFn := func(parentDir string, info os.FileInfo) (bool, error) {
+			return info.Name() != "skip" && filepath.Ext(info.Name()) != ".skip", nil
+		}
+		if _, err := NewSCP(c).ReceiveDir(remoteDir, localDestDir, acceptFn); err != nil {
+			t.Errorf("fail to ReceiveDir; %s", err)
+		}
+		for _, name := range []string{"foo.skip", filepath.Join("baz", "skip"), filepath.Join("baz", "hoge.skip")} {
+			if _, err := os.Stat(filepath.Join(localDestDir, name)); !os.IsNotExist(err) {
+				t.Errorf("skipped entry %s must not exist; %v", name, err)
+			}
+		}
+		sameFileInfoAndContent(t, localDestDir, remoteDir, "foo", "foo")
+		sameFileInfoAndContent(t, filepath.Join(localDestDir, "baz"), filepath.Join(remoteDir, "baz"), "hoge", "hoge")
+	})
+
+	t.Run("metadata warnings", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		if err := generateRandomFileWithSizeAndMode(filepath.Join(remoteDir, "foo"), 1000, 0644); err != nil {
+			t.Fatalf("fail to generate remote file; %s", err)
+		}
+		entries := []fileInfo{
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "hoge", maxSize: testMaxFileSize, mode: 0644},
+				},
+			},
+		}
+		if err := generateRandomFiles(remoteDir, entries); err != nil {
+			t.Fatalf("fail to generate remote files; %s", err)
+		}
+
+		// foo is removed while it is written, so that changing its
+		// permission and time fails.
+		localDestDir := filepath.Join(localDir, "dest")
+		removed := filepath.Join(localDestDir, "foo")
+		observer := &testRemoveObserver{path: removed}
+		if _, err := NewSCP(c, WithSourceObserver(observer)).ReceiveDir(remoteDir, localDestDir, nil); err == nil {
+			t.Errorf("ReceiveDir must fail without warning collector")
+		}
+
+		os.RemoveAll(localDestDir)
+		warnings := &Warnings{}
+		if _, err := NewSCP(c, WithSourceObserver(observer), WithWarnings(warnings)).ReceiveDir(remoteDir, localDestDir, nil); err != nil {
+			t.Fatalf("fail to ReceiveDir; %s", err)
+		}
+		var ops []string
+		for _, w := range warnings.List() {
+			if w.Path != removed || !os.IsNotExist(w.Err) {
+				t.Errorf("unexpected warning; %s", w)
+			}
+			ops = append(ops, w.Op)
+		}
+		if want := []string{"chmod", "chtimes"}; !reflect.DeepEqual(ops, want) {
+			t.Errorf("unmatch warnings. got:%v, want:%v", ops, want)
+		}
+		sameFileInfoAndContent(t, filepath.Join(localDestDir, "baz"), filepath.Join(remoteDir, "baz"), "hoge", "hoge")
+	})
+
+	t.Run("tar stream", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+			{name: "bar", maxSize: testMaxFileSize, mode: 0600},
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "foo", maxSize: testMaxFileSize, mode: 0400},
+					{name: "hoge", maxSize: testMaxFileSize, mode: 0602},
+					{name: "emptyDir", isDir: true, mode: 0500},
+				},
+			},
+		}
+		if err := generateRandomFiles(remoteDir, entries); err != nil {
+			t.Fatalf("fail to generate remote files; %s", err)
+		}
+
+		// tar archives the second name of a file as a hard link entry.
+		if err := os.Link(filepath.Join(remoteDir, "foo"), filepath.Join(remoteDir, "baz", "link")); err != nil {
+			t.Fatalf("fail to create hard link; %s", err)
+		}
+
+		s := NewSCP(c, WithTarStream())
+		localDestDir := filepath.Join(localDir, "dest")
+		if _, err := s.ReceiveDir(remoteDir, localDestDir, nil); err != nil {
+			t.Errorf("fail to ReceiveDir; %s", err)
+		}
+		sameDirTreeContent(t, remoteDir, localDestDir)
+		wantLink, err := ioutil.ReadFile(filepath.Join(remoteDir, "foo"))
+		if err != nil {
+			t.Fatalf("fail to read file; %s", err)
+		}
+		if gotLink, err := ioutil.ReadFile(filepath.Join(localDestDir, "baz", "link")); err != nil || !bytes.Equal(gotLink, wantLink) {
+			t.Errorf("unmatch hard link content. size:%d, want:%d, err:%v", len(gotLink), len(wantLink), err)
+		}
+
+		acceptFn := func(parentDir string, info os.FileInfo) (bool, error) {
+			return info.Name() != "baz", nil
+		}
+		if _, err := s.ReceiveDir(remoteDir, localDestDir, acceptFn); err != nil {
+			t.Errorf("fail to ReceiveDir; %s", err)
+		}
+		gotDir := filepath.Join(localDestDir, filepath.Base(remoteDir))
+		if _, err := os.Stat(filepath.Join(gotDir, "baz")); !os.IsNotExist(err) {
+			t.Errorf("skipped directory must not exist; %v", err)
+		}
+		sameFileInfoAndContent(t, gotDir, remoteDir, "foo", "foo")
+		sameFileInfoAndContent(t, gotDir, remoteDir, "bar", "bar")
+	})
+
+	t.Run("parallel", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+			{name: "bar", maxSize: testMaxFileSize, mode: 0600},
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "foo", maxSize: testMaxFileSize, mode: 0400},
+					{name: "hoge", maxSize: testMaxFileSize, mode: 0602},
+					{name: "emptyDir", isDir: true, mode: 0500},
+				},
+			},
+			{name: "qux", isDir: true, mode: 0700,
+				entries: []fileInfo{
+					{name: "fuga", maxSize: testMaxFileSize, mode: 0644},
+					{name: "piyo", maxSize: testMaxFileSize, mode: 0644},
+				},
+			},
+		}
+		if err := generateRandomFiles(remoteDir, entries); err != nil {
+			t.Fatalf("fail to generate remote files; %s", err)
+		}
+
+		localDestDir := filepath.Join(localDir, "dest")
+		report, err := NewSCP(c).ReceiveDirParallel(remoteDir, localDestDir, 3, nil)
+		if err != nil {
+			t.Fatalf("fail to ReceiveDirParallel; %s", err)
+		}
+		if report.FilesCopied != 6 {
+			t.Errorf("unmatch copied files. got:%d, want:%d", report.FilesCopied, 6)
+		}
+		t.Log("same", sameDirTreeContent(t, remoteDir, localDestDir))
+
+		acceptFn := func(parentDir string, info os.FileInfo) (bool, error) {
+			return info.Name() != "baz", nil
+		}
+		if _, err := NewSCP(c).ReceiveDirParallel(remoteDir, localDestDir, 3, acceptFn); err != nil {
+			t.Fatalf("fail to ReceiveDirParallel; %s", err)
+		}
+		gotDir := filepath.Join(localDestDir, filepath.Base(remoteDir))
+		if _, err := os.Stat(filepath.Join(gotDir, "baz")); !os.IsNotExist(err) {
+			t.Errorf("skipped directory must not exist; %v", err)
+		}
+		sameFileInfoAndContent(t, gotDir, remoteDir, "foo", "foo")
+		sameFileInfoAndContent(t, filepath.Join(gotDir, "qux"), filepath.Join(remoteDir, "qux"), "piyo", "piyo")
+	})
+
+	t.Run("pre-scan", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "hoge", maxSize: testMaxFileSize, mode: 0644},
+					{name: "emptyDir", isDir: true, mode: 0755},
+				},
+			},
+		}
+		if err := generateRandomFiles(remoteDir, entries); err != nil {
+			t.Fatalf("fail to generate remote files; %s", err)
+		}
+		var want TransferTotals
+		for _, name := range []string{"foo", filepath.Join("baz", "hoge")} {
+			fi, err := os.Stat(filepath.Join(remoteDir, name))
+			if err != nil {
+				t.Fatalf("fail to stat file; %s", err)
+			}
+			want.Files++
+			want.Bytes += fi.Size()
+		}
+
+		observer := &testTotalsObserver{}
+		localDestDir := filepath.Join(localDir, "dest")
+		if _, err := NewSCP(c, WithPreScan(), WithSourceObserver(observer)).ReceiveDir(remoteDir, localDestDir, nil); err != nil {
+			t.Fatalf("fail to ReceiveDir; %s", err)
+		}
+		if !reflect.DeepEqual(observer.totals, []TransferTotals{want}) {
+			t.Errorf("unmatch totals. got:%+v, want:%+v", observer.totals, want)
+		}
+		if observer.written != want.Bytes {
+			t.Errorf("unmatch written bytes. got:%d, want:%d", observer.written, want.Bytes)
+		}
+
+		events := make(chan ProgressEvent, 100)
+		if _, err := NewSCP(c, WithPreScan(), WithProgressEvents(events)).SendDir(localDestDir, remoteDir, nil); err != nil {
+			t.Fatalf("fail to SendDir; %s", err)
+		}
+		e := <-events
+		if e.Type != EventTotals || e.Files != want.Files || e.Bytes != want.Bytes {
+			t.Errorf("unmatch first event. got:%+v, want:%+v", e, want)
+		}
+	})
+
+	t.Run("map func", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "hoge", maxSize: testMaxFileSize, mode: 0600},
+				},
+			},
+		}
+		if err := generateRandomFiles(remoteDir, entries); err != nil {
+			t.Fatalf("fail to generate remote files; %s", err)
+		}
+
+		flatten := func(relPath string, info os.FileInfo) (string, error) {
+			return strings.Replace(relPath, "/", "_", -1) + ".bak", nil
+		}
+		for _, tarStream := range []bool{false, true} {
+			options := []ScpOption{WithMapFunc(flatten)}
+			if tarStream {
+				options = append(options, WithTarStream())
+			}
+			localDestDir := filepath.Join(localDir, fmt.Sprintf("dest-%v", tarStream))
+			if _, err := NewSCP(c, options...).ReceiveDir(remoteDir, localDestDir, nil); err != nil {
+				t.Errorf("fail to ReceiveDir; %s", err)
+			}
+			sameFileInfoAndContent(t, localDestDir, remoteDir, "foo.bak", "foo")
+			sameFileInfoAndContent(t, localDestDir, filepath.Join(remoteDir, "baz"), "baz_hoge.bak", "hoge")
+			if _, err := os.Stat(filepath.Join(localDestDir, "baz")); !os.IsNotExist(err) {
+				t.Errorf("source directory must not be created; %v", err)
+			}
+		}
+	})
+
+	t.Run("sync", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "hoge", maxSize: testMaxFileSize, mode: 0644},
+				},
+			},
+		}
+		if err := generateRandomFiles(remoteDir, entries); err != nil {
+			t.Fatalf("fail to generate remote files; %s", err)
+		}
+		// The unchanged file is large enough to find whether it is received.
+		const unchangedSize = 100000
+		if err := generateRandomFileWithSizeAndMode(filepath.Join(remoteDir, "foo"), unchangedSize, 0644); err != nil {
+			t.Fatalf("fail to generate remote file; %s", err)
+		}
+
+		// The destination exists, so the tree is placed under it.
+		if _, err := NewSCP(c).ReceiveDir(remoteDir, localDir, nil); err != nil {
+			t.Fatalf("fail to ReceiveDir; %s", err)
+		}
+		changed := filepath.Join(remoteDir, "baz", "hoge")
+		for i, mode := range []struct {
+			sync      SyncMode
+			tarStream bool
+		}{
+			{sync: SyncSizeAndTime},
+			{sync: SyncSizeAndTime, tarStream: true},
+			{sync: SyncChecksum},
+		} {
+			if err := generateRandomFileWithSizeAndMode(changed, int64(100*(i+1)), 0644); err != nil {
+				t.Fatalf("fail to generate remote file; %s", err)
+			}
+			mtime := time.Now().Add(time.Hour)
+			if err := os.Chtimes(changed, mtime, mtime); err != nil {
+				t.Fatalf("fail to change file time; %s", err)
+			}
+
+			var received []string
+			hook := func(r AuditRecord) { received = append(received, r.RemotePath) }
+			accounting := NewAccounting()
+			options := []ScpOption{WithSync(mode.sync), WithAuditHook(hook), WithAccounting(accounting)}
+			if mode.tarStream {
+				options = append(options, WithTarStream())
+			}
+			if _, err := NewSCP(c, options...).ReceiveDir(remoteDir, localDir, nil); err != nil {
+				t.Errorf("fail to ReceiveDir; %s", err)
+			}
+			if len(received) != 1 || received[0] != changed {
+				t.Errorf("only the changed file must be received. got:%v", received)
+			}
+			if bytes := accounting.Usage(c.RemoteAddr().String()).BytesReceived; bytes >= unchangedSize {
+				t.Errorf("unchanged file must not be transferred. received:%d", bytes)
+			}
+			sameDirTreeContent(t, remoteDir, filepath.Join(localDir, filepath.Base(remoteDir)))
+		}
+	})
+
+	t.Run("delete extraneous files", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "hoge", maxSize: testMaxFileSize, mode: 0644},
+				},
+			},
+		}
+		if err := generateRandomFiles(remoteDir, entries); err != nil {
+			t.Fatalf("fail to generate remote files; %s", err)
+		}
+		// The directories are dated in the past, so that a removal changing
+		// their times is found regardless of the timing.
+		past := time.Unix(1600000000, 0)
+		for _, dir := range []string{remoteDir, filepath.Join(remoteDir, "baz")} {
+			if err := os.Chtimes(dir, past, past); err != nil {
+				t.Fatalf("fail to change times; %s", err)
+			}
+		}
+		extraneous := []fileInfo{
+			{name: "stale", maxSize: testMaxFileSize, mode: 0644},
+			{name: "keep.log", maxSize: testMaxFileSize, mode: 0644},
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "old", isDir: true, mode: 0755,
+						entries: []fileInfo{
+							{name: "fuga", maxSize: testMaxFileSize, mode: 0644},
+						},
+					},
+				},
+			},
+		}
+		// localDir exists, so the tree is placed under it.
+		top := filepath.Join(localDir, filepath.Base(remoteDir))
+		if err := os.Mkdir(top, 0755); err != nil {
+			t.Fatalf("fail to create directory; %s", err)
+		}
+		if err := generateRandomFiles(top, extraneous); err != nil {
+			t.Fatalf("fail to generate local files; %s", err)
+		}
+
+		if _, err := NewSCP(c, WithDelete(), WithExclude("*.log")).ReceiveDir(remoteDir, localDir, nil); err != nil {
+			t.Fatalf("fail to ReceiveDir; %s", err)
+		}
+		if _, err := os.Stat(filepath.Join(top, "keep.log")); err != nil {
+			t.Errorf("excluded file must be kept; %s", err)
+		}
+		// The kept file is removed for the comparison, keeping the time of
+		// its directory.
+		removeKeepingDirTime(t, filepath.Join(top, "keep.log"))
+		sameDirTreeContent(t, remoteDir, top)
+	})
+
+	t.Run("hardlink unchanged files", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "hoge", maxSize: testMaxFileSize, mode: 0600},
+				},
+			},
+		}
+		if err := generateRandomFiles(remoteDir, entries); err != nil {
+			t.Fatalf("fail to generate remote files; %s", err)
+		}
+		// The unchanged file is large enough to find whether it is received.
+		const unchangedSize = 100000
+		if err := generateRandomFileWithSizeAndMode(filepath.Join(remoteDir, "baz", "hoge"), unchangedSize, 0600); err != nil {
+			t.Fatalf("fail to generate remote file; %s", err)
+		}
+
+		prevDir := filepath.Join(localDir, "prev")
+		if _, err := NewSCP(c).ReceiveDir(remoteDir, prevDir, nil); err != nil {
+			t.Fatalf("fail to ReceiveDir; %s", err)
+		}
+		if err := generateRandomFile(filepath.Join(remoteDir, "foo")); err != nil {
+			t.Fatalf("fail to regenerate remote file; %s", err)
+		}
+		if err := os.Chtimes(filepath.Join(remoteDir, "foo"), time.Now(), time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("fail to change remote file time; %s", err)
+		}
+
+		nextDir := filepath.Join(localDir, "next")
+		accounting := NewAccounting()
+		if _, err := NewSCP(c, WithLinkDest(prevDir), WithAccounting(accounting)).ReceiveDir(remoteDir, nextDir, nil); err != nil {
+			t.Fatalf("fail to ReceiveDir; %s", err)
+		}
+		fi, err := os.Stat(filepath.Join(remoteDir, "foo"))
+		if err != nil {
+			t.Fatalf("fail to stat file; %s", err)
+		}
+		if received := accounting.Usage(c.RemoteAddr().String()).BytesReceived; received >= fi.Size()+unchangedSize {
+			t.Errorf("unchanged file must not be received. received:%d", received)
+		}
+		sameFileInfoAndContent(t, nextDir, remoteDir, "foo", "foo")
+		sameFileInfoAndContent(t, filepath.Join(nextDir, "baz"), filepath.Join(remoteDir, "baz"), "hoge", "hoge")
+
+		isSame := func(name string) bool {
+			prev, err := os.Stat(filepath.Join(prevDir, name))
+			if err != nil {
+				t.Fatalf("fail to stat file; %s", err)
+			}
+			next, err := os.Stat(filepath.Join(nextDir, name))
+			if err != nil {
+				t.Fatalf("fail to stat file; %s", err)
+			}
+			return os.SameFile(prev, next)
+		}
+		if isSame("foo") {
+			t.Errorf("changed file must not be linked")
+		}
+		if !isSame(filepath.Join("baz", "hoge")) {
+			t.Errorf("unchanged file must be linked")
+		}
+
+		// The destination itself may be one of the link destinations.
+		if _, err := NewSCP(c, WithLinkDest(localDir)).ReceiveDir(remoteDir, localDir, nil); err != nil {
+			t.Fatalf("fail to ReceiveDir; %s", err)
+		}
+		if _, err := NewSCP(c, WithLinkDest(localDir)).ReceiveDir(remoteDir, localDir, nil); err != nil {
+			t.Fatalf("fail to ReceiveDir; %s", err)
+		}
+		top := filepath.Join(localDir, filepath.Base(remoteDir))
+		sameFileInfoAndContent(t, top, remoteDir, "foo", "foo")
+		sameFileInfoAndContent(t, filepath.Join(top, "baz"), filepath.Join(remoteDir, "baz"), "hoge", "hoge")
+	})
+
+	t.Run("normalize names to NFC", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		nfdName := "cafe\u0301.txt"
+		nfcName := "caf\u00e9.txt"
+		if err := generateRandomFile(filepath.Join(remoteDir, nfdName)); err != nil {
+			t.Fatalf("fail to generate remote file; %s", err)
+		}
+
+		localDestDir := filepath.Join(localDir, "dest")
+		if _, err := NewSCP(c, WithNameNormalization(NormalizationNFC)).ReceiveDir(remoteDir, localDestDir, nil); err != nil {
+			t.Errorf("fail to ReceiveDir; %s", err)
+		}
+		sameFileInfoAndContent(t, localDestDir, remoteDir, nfcName, nfdName)
+	})
+
+	t.Run("audit hook", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-local")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(localDir)
+
+		remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDir-remote")
+		if err != nil {
+			t.Fatalf("fail to get tempdir; %s", err)
+		}
+		defer os.RemoveAll(remoteDir)
+
+		entries := []fileInfo{
+			{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+			{name: "baz", isDir: true, mode: 0755,
+				entries: []fileInfo{
+					{name: "hoge", maxSize: testMaxFileSize, mode: 0644},
+				},
+			},
+		}
+		if err := generateRandomFiles(remoteDir, entries); err != nil {
+			t.Fatalf("fail to generate remote files; %s", err)
+		}
+
+		var records []AuditRecord
+		hook := func(r AuditRecord) { records = append(records, r) }
+		if _, err := NewSCP(c, WithAuditHook(hook)).ReceiveDir(remoteDir, localDir, nil); err != nil {
+			t.Fatalf("fail to ReceiveDir; %s", err)
+		}
+		if len(records) != 2 {
+			t.Fatalf("unmatch record count. got:%d, want:2", len(records))
+		}
+		for _, r := range records {
+			if r.Direction != DirectionDownload || r.Err != nil {
+				t.Errorf("unmatch record. got:%+v", r)
+			}
+			data, err := ioutil.ReadFile(r.RemotePath)
+			if err != nil {
+				t.Errorf("fail to read remote path of record; %s", err)
+				continue
+			}
+			if sum := sha256.Sum256(data); r.Bytes != int64(len(data)) || !bytes.Equal(r.Hash, sum[:]) {
+				t.Errorf("unmatch bytes or hash for %s. got:%d, %x", r.RemotePath, r.Bytes, r.Hash)
+			}
+			rel, _ := filepath.Rel(filepath.Dir(remoteDir), r.RemotePath)
+			if want := filepath.Join(localDir, rel); r.LocalPath != want {
+				t.Errorf("unmatch local path. got:%s, want:%s", r.LocalPath, want)
+			}
+		}
+	})
+}
+
+type testProgressObserver struct {
+	started int
+	written int64
+	done    int
+	failed  int
+}
+
+func (o *testProgressObserver) OnFileInfo(fileInfo *FileInfo) { o.started++ }
+
+func (o *testProgressObserver) OnWrite(p []byte) { o.written += int64(len(p)) }
+
+func (o *testProgressObserver) OnFileDone(fileInfo *FileInfo, err error) {
+	o.done++
+	if err != nil {
+		o.failed++
+	}
+}
+
+// testMetrics records the transfers as "op kind" and the bytes of
+// the sessions.
+type testMetrics struct {
+	mu        sync.Mutex
+	host      string
+	bytes     map[Direction]int64
+	transfers []string
+}
+
+func (m *testMetrics) AddBytes(host string, direction Direction, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytes[direction] += n
+}
+
+func (m *testMetrics) ObserveTransfer(host, op string, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.host = host
+	m.transfers = append(m.transfers, op+" "+ErrorKind(err))
+}
+
+type testTotalsObserver struct {
+	testProgressObserver
+	totals []TransferTotals
+}
+
+func (o *testTotalsObserver) OnTotals(totals TransferTotals) { o.totals = append(o.totals, totals) }
+
+type testCancelObserver struct {
+	EmptySourceObserver
+	cancel context.CancelFunc
+}
+
+func (o *testCancelObserver) OnWrite(p []byte) { o.cancel() }
+
+// testRemoveObserver removes the local file at path when it is written.
+type testRemoveObserver struct {
+	EmptySourceObserver
+	path    string
+	current string
+}
+
+func (o *testRemoveObserver) OnFileInfo(fileInfo *FileInfo) { o.current = fileInfo.Name() }
+
+func (o *testRemoveObserver) OnWrite(p []byte) {
+	if o.current == filepath.Base(o.path) {
+		os.Remove(o.path)
+	}
+}
+
+type testHashObserver struct {
+	EmptySourceObserver
+	sum []byte
+}
+
+func (o *testHashObserver) OnHash(fileInfo *FileInfo, sum []byte, done bool) {
+	if done {
+		o.sum = sum
+	}
+}
+
+func TestReceiveDirObjects(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	localDir, err := ioutil.TempDir("", "go-scp-TestReceiveDirObjects-local")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(localDir)
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDirObjects-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	content := []byte("same content\n")
+	if err := os.Mkdir(filepath.Join(remoteDir, "sub"), 0755); err != nil {
+		t.Fatalf("fail to create remote dir; %s", err)
+	}
+	for _, name := range []string{"foo", filepath.Join("sub", "bar")} {
+		if err := ioutil.WriteFile(filepath.Join(remoteDir, name), content, 0644); err != nil {
+			t.Fatalf("fail to write remote file; %s", err)
+		}
+	}
+
+	m, err := NewSCP(c).ReceiveDirObjects(remoteDir, localDir, nil)
+	if err != nil {
+		t.Fatalf("fail to ReceiveDirObjects; %s", err)
+	}
+	if len(m.Entries) != 2 {
+		t.Fatalf("unmatch entry count. got:%d, want:2", len(m.Entries))
+	}
+	paths := []string{m.Entries[0].Path, m.Entries[1].Path}
+	sort.Strings(paths)
+	if paths[0] != "foo" || paths[1] != "sub/bar" {
+		t.Errorf("unmatch paths. got:%v", paths)
+	}
+	if m.Entries[0].SHA256 != m.Entries[1].SHA256 {
+		t.Errorf("unmatch digests for the same content")
+	}
+	objects, err := ioutil.ReadDir(filepath.Join(localDir, ObjectsDirName))
+	if err != nil {
+		t.Fatalf("fail to read objects dir; %s", err)
+	}
+	if len(objects) != 1 {
+		t.Errorf("unmatch object count. got:%d, want:1", len(objects))
+	}
+	data, err := ioutil.ReadFile(m.Entries[0].ObjectPath(localDir))
+	if err != nil {
+		t.Fatalf("fail to read object; %s", err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Errorf("unmatch object content. got:%q, want:%q", data, content)
+	}
+
+	read, err := ReadManifest(filepath.Join(localDir, ManifestFileName))
+	if err != nil {
+		t.Fatalf("fail to read manifest; %s", err)
+	}
+	if len(read.Entries) != len(m.Entries) {
+		t.Errorf("unmatch manifest entry count. got:%d, want:%d", len(read.Entries), len(m.Entries))
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("fail to generate key; %s", err)
+	}
+	signedDir := filepath.Join(localDir, "signed")
+	if _, err := NewSCP(c, WithManifestSigningKey(privateKey)).ReceiveDirObjects(remoteDir, signedDir, nil); err != nil {
+		t.Fatalf("fail to ReceiveDirObjects; %s", err)
+	}
+	manifestFile := filepath.Join(signedDir, ManifestFileName)
+	verified, err := VerifySignedManifest(manifestFile, publicKey)
+	if err != nil {
+		t.Fatalf("fail to verify manifest; %s", err)
+	}
+	if len(verified.Entries) != len(m.Entries) {
+		t.Errorf("unmatch verified entry count. got:%d, want:%d", len(verified.Entries), len(m.Entries))
+	}
+	verified.Entries = verified.Entries[:1]
+	if err := verified.WriteFile(manifestFile); err != nil {
+		t.Fatalf("fail to write manifest; %s", err)
+	}
+	if _, err := VerifySignedManifest(manifestFile, publicKey); !errors.Is(err, ErrInvalidManifestSignature) {
+		t.Errorf("tampered manifest must be rejected. got:%v", err)
+	}
+}
+
+func TestReceiveDirStream(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDirStream-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	if err := os.Mkdir(filepath.Join(remoteDir, "sub"), 0755); err != nil {
+		t.Fatalf("fail to create remote dir; %s", err)
+	}
+	contents := map[string]string{
+		"foo":     "foo content\n",
+		"sub/bar": "bar content\n",
+		"sub/baz": "baz content\n",
+	}
+	for name, content := range contents {
+		if err := ioutil.WriteFile(filepath.Join(remoteDir, filepath.FromSlash(name)), []byte(content), 0644); err != nil {
+			t.Fatalf("fail to write remote file; %s", err)
+		}
+	}
+
+	got := map[string]string{}
+	err = NewSCP(c).ReceiveDirStream(remoteDir, func(path string, info os.FileInfo, body io.Reader) error {
+		if path == "sub/baz" {
+			// The unread body must be discarded.
+			return nil
+		}
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		if int64(len(data)) != info.Size() {
+			t.Errorf("unmatch size of %s. got:%d, want:%d", path, len(data), info.Size())
+		}
+		got[path] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("fail to ReceiveDirStream; %s", err)
+	}
+	delete(contents, "sub/baz")
+	if !reflect.DeepEqual(got, contents) {
+		t.Errorf("unmatch contents. got:%v, want:%v", got, contents)
+	}
+
+	errStop := errors.New("stop")
+	err = NewSCP(c).ReceiveDirStream(remoteDir, func(path string, info os.FileInfo, body io.Reader) error {
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Errorf("error from StreamFunc must be returned. got:%v", err)
+	}
+}
+
+func TestReceiveDirIter(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDirIter-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	if err := os.Mkdir(filepath.Join(remoteDir, "sub"), 0755); err != nil {
+		t.Fatalf("fail to create remote dir; %s", err)
+	}
+	contents := map[string]string{
+		"foo":     "foo content\n",
+		"sub/bar": "bar content\n",
+		"sub/baz": "baz content\n",
+	}
+	for name, content := range contents {
+		if err := ioutil.WriteFile(filepath.Join(remoteDir, filepath.FromSlash(name)), []byte(content), 0644); err != nil {
+			t.Fatalf("fail to write remote file; %s", err)
+		}
+	}
+
+	t.Run("all files", func(t *testing.T) {
+		it := NewSCP(c).ReceiveDirIter(remoteDir)
+		defer it.Close()
+		got := map[string]string{}
+		for it.Next() {
+			data, err := ioutil.ReadAll(it.Body())
+			if err != nil {
+				t.Fatalf("fail to read body; %s", err)
+			}
+			if int64(len(data)) != it.Info().Size() {
+				t.Errorf("unmatch size of %s. got:%d, want:%d", it.Path(), len(data), it.Info().Size())
+			}
+			got[it.Path()] = string(data)
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("fail to iterate; %s", err)
+		}
+		if !reflect.DeepEqual(got, contents) {
+			t.Errorf("unmatch contents. got:%v, want:%v", got, contents)
+		}
+		if err := it.Close(); err != nil {
+			t.Errorf("fail to close; %s", err)
+		}
+	})
+
+	t.Run("stop early", func(t *testing.T) {
+		it := NewSCP(c).ReceiveDirIter(remoteDir)
+		if !it.Next() {
+			t.Fatalf("fail to get first file; %v", it.Err())
+		}
+		if err := it.Close(); err != nil {
+			t.Errorf("fail to close; %s", err)
+		}
+		if it.Next() {
+			t.Errorf("closed iterator must not have next")
+		}
+	})
+}
+
+// testMemFS is an in-memory WriteFS.
+type testMemFS struct {
+	files map[string]*bytes.Buffer
+	modes map[string]os.FileMode
+	times map[string]time.Time
+}
+
+func newTestMemFS() *testMemFS {
+	return &testMemFS{
+		files: map[string]*bytes.Buffer{},
+		modes: map[string]os.FileMode{},
+		times: map[string]time.Time{},
+	}
+}
+
+func (fs *testMemFS) MkdirAll(path string, perm os.FileMode) error {
+	for p := path; p != "." && p != "/"; p = filepath.Dir(p) {
+		if _, ok := fs.modes[p]; !ok {
+			fs.modes[p] = perm | os.ModeDir
+		}
+	}
+	return nil
+}
+
+type nopBufferCloser struct{ *bytes.Buffer }
+
+func (nopBufferCloser) Close() error { return nil }
+
+func (fs *testMemFS) OpenFile(name string, flag int, perm os.FileMode) (io.WriteCloser, error) {
+	if _, ok := fs.modes[filepath.Dir(name)]; !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	buf := &bytes.Buffer{}
+	fs.files[name] = buf
+	fs.modes[name] = perm
+	return nopBufferCloser{buf}, nil
+}
+
+func (fs *testMemFS) Chtimes(name string, atime, mtime time.Time) error {
+	fs.times[name] = mtime
+	return nil
+}
+
+func (fs *testMemFS) Chmod(name string, mode os.FileMode) error {
+	fs.modes[name] = mode | fs.modes[name]&os.ModeDir
+	return nil
+}
+
+func TestReceiveDirFS(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDirFS-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	if err := os.Mkdir(filepath.Join(remoteDir, "sub"), 0750); err != nil {
+		t.Fatalf("fail to create remote dir; %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(remoteDir, "sub", "foo"), []byte("foo content\n"), 0640); err != nil {
+		t.Fatalf("fail to write remote file; %s", err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(remoteDir, "sub", "foo"), mtime, mtime); err != nil {
+		t.Fatalf("fail to change remote file time; %s", err)
+	}
+
+	fs := newTestMemFS()
+	if err := NewSCP(c).ReceiveDirFS(remoteDir, fs, "/dest", nil); err != nil {
+		t.Fatalf("fail to ReceiveDirFS; %s", err)
+	}
+	name := filepath.Join("/dest", "sub", "foo")
+	if buf := fs.files[name]; buf == nil || buf.String() != "foo content\n" {
+		t.Errorf("unmatch content of %s. got:%v", name, buf)
+	}
+	if got := fs.modes[name]; got != 0640 {
+		t.Errorf("unmatch file mode. got:%s, want:%s", got, os.FileMode(0640))
+	}
+	if got := fs.modes[filepath.Join("/dest", "sub")]; got != 0750|os.ModeDir {
+		t.Errorf("unmatch directory mode. got:%s", got)
+	}
+	if got := fs.times[name]; !got.Equal(mtime) {
+		t.Errorf("unmatch modification time. got:%s, want:%s", got, mtime)
+	}
+}
+
+func TestReceiveDirToTar(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestReceiveDirToTar-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	if err := os.Mkdir(filepath.Join(remoteDir, "sub"), 0750); err != nil {
+		t.Fatalf("fail to create remote dir; %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(remoteDir, "sub", "foo"), []byte("foo content\n"), 0640); err != nil {
+		t.Fatalf("fail to write remote file; %s", err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(remoteDir, "sub", "foo"), mtime, mtime); err != nil {
+		t.Fatalf("fail to change remote file time; %s", err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := NewSCP(c).ReceiveDirToTar(remoteDir, tw, nil); err != nil {
+		t.Fatalf("fail to ReceiveDirToTar; %s", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("fail to close tar writer; %s", err)
+	}
+
+	tr := tar.NewReader(&buf)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("fail to read tar; %s", err)
+		}
+		names = append(names, hdr.Name)
+		switch hdr.Name {
+		case "sub/":
+			if hdr.Typeflag != tar.TypeDir || hdr.Mode != 0750 {
+				t.Errorf("unmatch directory entry. got:%+v", hdr)
+			}
+		case "sub/foo":
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatalf("fail to read tar entry; %s", err)
+			}
+			if string(data) != "foo content\n" || hdr.Mode != 0640 || !hdr.ModTime.Equal(mtime) {
+				t.Errorf("unmatch file entry. got:%+v, content:%q", hdr, data)
+			}
+		}
+	}
+	if want := []string{"sub/", "sub/foo"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("unmatch entries. got:%v, want:%v", names, want)
+	}
+}
+
+func TestOpenSinkAndSource(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestOpenSinkAndSource-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	content := []byte("incremental content\n")
+	now := time.Now()
+	sink, err := NewSCP(c).OpenSink(remoteDir, SessionOptions{Recursive: true, TargetIsDir: true})
+	if err != nil {
+		t.Fatalf("fail to OpenSink; %s", err)
+	}
+	if err := sink.StartDirectory(NewFileInfo("sub", 0, os.ModeDir|0755, now, now)); err != nil {
+		t.Fatalf("fail to StartDirectory; %s", err)
+	}
+	info := NewFileInfo("foo", int64(len(content)), 0644, now, now)
+	if err := sink.WriteFile(info, ioutil.NopCloser(bytes.NewReader(content))); err != nil {
+		t.Fatalf("fail to WriteFile; %s", err)
+	}
+	if err := sink.EndDirectory(); err != nil {
+		t.Fatalf("fail to EndDirectory; %s", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("fail to close sink; %s", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Errorf("second Close of sink must return the same result; %s", err)
+	}
+
+	source, err := NewSCP(c).OpenSource(filepath.Join(remoteDir, "sub"), SessionOptions{Recursive: true})
+	if err != nil {
+		t.Fatalf("fail to OpenSource; %s", err)
+	}
+	var names []string
+	var got bytes.Buffer
+	for {
+		h, err := source.ReadHeader()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("fail to ReadHeader; %s", err)
+		}
+		switch h := h.(type) {
+		case StartDirectoryMsgHeader:
+			names = append(names, h.Name+"/")
+		case FileMsgHeader:
+			names = append(names, h.Name)
+			if err := source.CopyBodyTo(h, &got); err != nil {
+				t.Fatalf("fail to CopyBodyTo; %s", err)
+			}
+		}
+	}
+	if err := source.Close(); err != nil {
+		t.Errorf("fail to close source; %s", err)
+	}
+	if err := source.Close(); err != nil {
+		t.Errorf("second Close of source must return the same result; %s", err)
+	}
+	if len(names) != 2 || names[0] != "sub/" || names[1] != "foo" {
+		t.Errorf("unmatch names. got:%v", names)
+	}
+	if !bytes.Equal(got.Bytes(), content) {
+		t.Errorf("unmatch content. got:%q, want:%q", got.Bytes(), content)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	s, l, err := newTestSshdServer()
+	if err != nil {
+		t.Fatalf("fail to create test sshd server; %s", err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := newTestSshClient(l.Addr().String())
+	if err != nil {
+		t.Fatalf("fail to serve test sshd server; %s", err)
+	}
+	defer c.Close()
+
+	remoteDir, err := ioutil.TempDir("", "go-scp-TestRelay-remote")
+	if err != nil {
+		t.Fatalf("fail to get tempdir; %s", err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	entries := []fileInfo{
+		{name: "foo", maxSize: testMaxFileSize, mode: 0644},
+		{name: "baz", isDir: true, mode: 0755,
+			entries: []fileInfo{
+				{name: "hoge", maxSize: testMaxFileSize, mode: 0600},
+				{name: "emptyDir", isDir: true, mode: 0700},
+			},
+		},
+	}
+	srcDir := filepath.Join(remoteDir, "src")
+	if err := os.Mkdir(srcDir, 0755); err != nil {
+		t.Fatalf("fail to create directory; %s", err)
+	}
+	if err := generateRandomFiles(srcDir, entries); err != nil {
+		t.Fatalf("fail to generate remote files; %s", err)
+	}
+
+	destDir := filepath.Join(remoteDir, "dest")
+	if err := NewSCP(c).Relay(c, srcDir, c, destDir); err != nil {
+		t.Fatalf("fail to Relay directory; %s", err)
+	}
+	sameDirTreeContent(t, srcDir, destDir)
+
+	if err := NewSCP(c).Relay(c, filepath.Join(srcDir, "foo"), c, filepath.Join(remoteDir, "bar")); err != nil {
+		t.Fatalf("fail to Relay file; %s", err)
+	}
+	sameFileInfoAndContent(t, remoteDir, srcDir, "bar", "foo")
+}
+
+func TestIsSubdirectory(t *testing.T) {
+	tests := []struct {
+		base, target string
+		want         bool
+	}{
+		{"/a/b", "/a/b", true},
+		{"/a/b", "/a/b/c", true},
+		// Leaving a skipped directory to its parent ends the skip.
+		{"/a/b", "/a", false},
+		{"/a/b", "/a/c", false},
+	}
+	for _, tt := range tests {
+		got, err := isSubdirectory(tt.base, tt.target)
+		if err != nil {
+			t.Fatalf("fail to check subdirectory; %s", err)
+		}
+		if got != tt.want {
+			t.Errorf("unmatch result for %s in %s. got:%v, want:%v", tt.target, tt.base, got, tt.want)
+		}
+	}
+}
+
+func TestMetadataApplierBestEffort(t *testing.T) {
+	for _, errno := range []syscall.Errno{syscall.EPERM, syscall.ENOTSUP} {
+		warnings := &Warnings{}
+		m := NewSCP(nil, WithWarnings(warnings), WithBestEffortMetadata()).newMetadataApplier()
+		calls := 0
+		fail := func() error {
+			calls++
+			return &os.PathError{Op: "chmod", Path: "foo", Err: errno}
+		}
+		for _, name := range []string{"foo", "bar", "baz"} {
+			if err := m.apply(name, "chmod", fail); err != nil {
+				t.Errorf("best-effort failure must not be returned. got:%v", err)
+			}
+		}
+		if calls != 1 {
+			t.Errorf("operation must be skipped after %s. got:%d calls", errno, calls)
+		}
+		if list := warnings.List(); len(list) != 1 || list[0].Path != "foo" || list[0].Op != "chmod" {
+			t.Errorf("only the first failure must be recorded. got:%v", list)
+		}
+		// The other operations are still applied.
+		if err := m.apply("foo", "chtimes", func() error { calls++; return nil }); err != nil || calls != 2 {
+			t.Errorf("other operation must be applied. err:%v, calls:%d", err, calls)
+		}
+	}
+
+	// The other errors are not tolerated without a warning collector.
+	m := NewSCP(nil, WithBestEffortMetadata()).newMetadataApplier()
+	for i := 0; i < 2; i++ {
+		if err := m.apply("foo", "chmod", func() error { return os.ErrNotExist }); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("unmatch error. got:%v, want:%v", err, os.ErrNotExist)
+		}
+	}
 }
@@ -0,0 +1,144 @@
+package scp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// sparseBlockSize is the size of the blocks of zeros which are skipped
+// instead of written on receives with WithSparseFiles.
+const sparseBlockSize = 4096
+
+// WithSparseFiles makes the transfers keep sparse files, such as VM images,
+// sparse. On receives, the blocks of zeros are skipped with seeks instead of
+// written, so they become holes in the local file. On sends, the holes of
+// the local files are found with SEEK_DATA and SEEK_HOLE where the platform
+// supports them and sent as zeros without being read. The remote scp writes
+// the zeros as they are, so whether the remote file is sparse is up to
+// the remote server.
+func WithSparseFiles() ScpOption {
+	return func(s *SCP) {
+		s.sparseFiles = true
+	}
+}
+
+// sparseWriter writes to a file skipping the blocks of zeros.
+type sparseWriter struct {
+	file *os.File
+	off  int64
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := sparseBlockSize - int(w.off%sparseBlockSize)
+		if n > len(p) {
+			n = len(p)
+		}
+		if isZeros(p[:n]) {
+			if _, err := w.file.Seek(int64(n), io.SeekCurrent); err != nil {
+				return written, err
+			}
+		} else if _, err := w.file.Write(p[:n]); err != nil {
+			return written, err
+		}
+		w.off += int64(n)
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// finish sets the size of the file, which ends with a hole if the last
+// block was skipped.
+func (w *sparseWriter) finish() error {
+	return w.file.Truncate(w.off)
+}
+
+func isZeros(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sparseReader reads a file of size bytes returning zeros for the holes
+// without reading them.
+type sparseReader struct {
+	file *os.File
+	size int64
+	off  int64
+	// The data is in [dataStart, dataEnd) and a hole is before dataStart.
+	dataStart, dataEnd int64
+}
+
+// newSparseReader returns a reader of file which skips the holes, or file
+// itself if the platform cannot find the holes.
+func newSparseReader(file *os.File, size int64) io.ReadCloser {
+	if seekData < 0 {
+		return file
+	}
+	return &sparseReader{file: file, size: size}
+}
+
+func (r *sparseReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	if r.off >= r.dataEnd {
+		r.findData()
+	}
+	if r.off < r.dataStart {
+		n := len(p)
+		if int64(n) > r.dataStart-r.off {
+			n = int(r.dataStart - r.off)
+		}
+		for i := range p[:n] {
+			p[i] = 0
+		}
+		r.off += int64(n)
+		return n, nil
+	}
+	if int64(len(p)) > r.dataEnd-r.off {
+		p = p[:r.dataEnd-r.off]
+	}
+	n, err := r.file.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// findData finds the next data from the offset. If the holes cannot be
+// found, the rest of the file is read as data.
+func (r *sparseReader) findData() {
+	r.dataStart, r.dataEnd = r.off, r.size
+	start, err := r.file.Seek(r.off, seekData)
+	if err != nil {
+		if errors.Is(err, syscall.ENXIO) {
+			// There is no data after the offset.
+			r.dataStart = r.size
+		}
+		return
+	}
+	end, err := r.file.Seek(start, seekHole)
+	if err != nil || start < r.off || end <= start {
+		return
+	}
+	if start > r.size {
+		start = r.size
+	}
+	r.dataStart = start
+	if end < r.size {
+		r.dataEnd = end
+	}
+}
+
+func (r *sparseReader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,7 @@
+package scp
+
+// The whence values of lseek for finding the holes of sparse files.
+const (
+	seekHole = 3
+	seekData = 4
+)
@@ -0,0 +1,7 @@
+package scp
+
+// The whence values of lseek for finding the holes of sparse files.
+const (
+	seekData = 3
+	seekHole = 4
+)
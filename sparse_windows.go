@@ -0,0 +1,8 @@
+package scp
+
+// Windows has no whence values for finding the holes of sparse files, so
+// the files are read as they are.
+const (
+	seekData = -1
+	seekHole = -1
+)
@@ -0,0 +1,211 @@
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// StreamFunc is called by ReceiveDirStream for each remote file with
+// the slash-separated path relative to the source directory, the file
+// information and the file body. The body is valid only until the function
+// returns, and the rest of the body which is not read is discarded.
+// Returning an error aborts the receive.
+type StreamFunc func(path string, info os.FileInfo, body io.Reader) error
+
+// ReceiveDirStream receives files under a remote srcDir and passes each file
+// to fn instead of writing it to the local disk, for example to upload it to
+// an object storage. The files are passed in the order sent by the remote
+// scp, and directories are not passed. The actual type of info is
+// scp.FileInfo as in Receive.
+func (s *SCP) ReceiveDirStream(srcDir string, fn StreamFunc) (err error) {
+	s, op := s.withTimeout()
+	defer op.finish(&err)
+	srcDir = s.cleanRemotePath(srcDir)
+	receiver := &streamReceiver{scp: s, fn: fn}
+	return runResourceSession(s.sessionConfig(), srcDir, false, true, func(rs *resourceSession) error {
+		return s.walkRemoteDir(rs, streamRoot, true, nil, receiver)
+	})
+}
+
+// streamRoot is the directory which the paths of the receivers not writing
+// to the local disk, such as streamReceiver, are relative to.
+const streamRoot = "."
+
+// streamReceiver passes the received files to a StreamFunc.
+type streamReceiver struct {
+	scp *SCP
+	fn  StreamFunc
+}
+
+func (r *streamReceiver) startDirectory(dir string, timeHeader TimeMsgHeader, dirHeader StartDirectoryMsgHeader) error {
+	return nil
+}
+
+func (r *streamReceiver) endDirectory(dir string, timeHeader TimeMsgHeader) error {
+	return nil
+}
+
+func (r *streamReceiver) receiveFile(rs *resourceSession, path string, timeHeader TimeMsgHeader, fileHeader FileMsgHeader) (err error) {
+	rel, err := filepath.Rel(streamRoot, path)
+	if err != nil {
+		return fmt.Errorf("failed to get relative path: err=%w", err)
+	}
+	fileInfo := NewFileInfo(path, fileHeader.Size, fileHeader.Mode, timeHeader.Mtime, timeHeader.Atime)
+	observer := r.scp.sourceObserver
+	observer.OnFileInfo(fileInfo)
+	defer func() {
+		notifyFileDone(observer, fileInfo, err)
+	}()
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := r.fn(filepath.ToSlash(rel), fileInfo, pr)
+		if err != nil {
+			// Fail the copy below.
+			pr.CloseWithError(err)
+		} else {
+			// Discard the rest so the transfer can go on.
+			io.Copy(ioutil.Discard, pr)
+		}
+		done <- err
+	}()
+	wo := &writerProxy{
+		writer:       pw,
+		onWriterFunc: observer.OnWrite,
+	}
+	err = rs.CopyFileBodyTo(fileHeader, wo)
+	pw.CloseWithError(err)
+	if ferr := <-done; ferr != nil {
+		return fmt.Errorf("error from StreamFunc: err=%w", ferr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to copy file: err=%w", err)
+	}
+	return nil
+}
+
+// errIteratorClosed aborts the receive of a DirIterator closed early.
+var errIteratorClosed = errors.New("scp: iterator closed")
+
+// DirIterator iterates over the files of a recursive receive opened with
+// ReceiveDirIter. The files are received one by one as Next is called, so
+// the caller controls the pace of the transfer. A DirIterator must be closed
+// with Close, which stops the receive if not all the files were read.
+//
+//	it := s.ReceiveDirIter(srcDir)
+//	defer it.Close()
+//	for it.Next() {
+//		upload(it.Path(), it.Info(), it.Body())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type DirIterator struct {
+	entries chan dirEntry
+	advance chan struct{}
+	closing chan struct{}
+	done    chan struct{}
+	cur     *dirEntry
+	err     error
+	closed  bool
+}
+
+type dirEntry struct {
+	path string
+	info os.FileInfo
+	body io.Reader
+}
+
+// ReceiveDirIter starts receiving files under a remote srcDir and returns
+// an iterator over them. It is the pull-style version of ReceiveDirStream.
+func (s *SCP) ReceiveDirIter(srcDir string) *DirIterator {
+	it := &DirIterator{
+		entries: make(chan dirEntry),
+		advance: make(chan struct{}),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(it.done)
+		it.err = s.ReceiveDirStream(srcDir, func(path string, info os.FileInfo, body io.Reader) error {
+			select {
+			case it.entries <- dirEntry{path: path, info: info, body: body}:
+			case <-it.closing:
+				return errIteratorClosed
+			}
+			// Hold the body until the caller moves to the next file.
+			select {
+			case <-it.advance:
+				return nil
+			case <-it.closing:
+				return errIteratorClosed
+			}
+		})
+	}()
+	return it
+}
+
+// Next moves to the next file and reports whether there is one. The rest
+// of the body of the previous file is discarded.
+func (it *DirIterator) Next() bool {
+	if it.closed {
+		return false
+	}
+	if it.cur != nil {
+		it.cur = nil
+		select {
+		case it.advance <- struct{}{}:
+		case <-it.done:
+			return false
+		}
+	}
+	select {
+	case e := <-it.entries:
+		it.cur = &e
+		return true
+	case <-it.done:
+		return false
+	}
+}
+
+// Path returns the slash-separated path of the current file relative to
+// the source directory.
+func (it *DirIterator) Path() string { return it.cur.path }
+
+// Info returns the information of the current file. The actual type is
+// scp.FileInfo as in Receive.
+func (it *DirIterator) Info() os.FileInfo { return it.cur.info }
+
+// Body returns the body of the current file, which is valid until the next
+// call of Next or Close.
+func (it *DirIterator) Body() io.Reader { return it.cur.body }
+
+// Err returns the error which stopped the iteration, if any. It must be
+// called after Next returns false.
+func (it *DirIterator) Err() error {
+	select {
+	case <-it.done:
+	default:
+		return nil
+	}
+	if errors.Is(it.err, errIteratorClosed) {
+		return nil
+	}
+	return it.err
+}
+
+// Close stops the receive if it is in progress and waits for the session
+// to end. It returns the same error as Err.
+func (it *DirIterator) Close() error {
+	if !it.closed {
+		it.closed = true
+		close(it.closing)
+	}
+	<-it.done
+	return it.Err()
+}
@@ -0,0 +1,235 @@
+package scp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SyncMode is the mode to skip the unchanged files in SendDir and
+// ReceiveDir.
+type SyncMode int
+
+const (
+	// SyncNone copies all the files. It is the default.
+	SyncNone SyncMode = iota
+	// SyncSizeAndTime skips the files whose size and modification time in
+	// seconds are the same as the destination file.
+	SyncSizeAndTime
+	// SyncChecksum skips the files whose SHA-256 digests are the same as
+	// the destination file. The remote digests are computed with
+	// the sha256sum command, or shasum if it is not available.
+	SyncChecksum
+)
+
+// WithSync sets the mode to skip the unchanged files in SendDir and
+// ReceiveDir. The remote files are listed with the find command and
+// the stat or checksum commands before the copy. SendDir does not send
+// the unchanged files. ReceiveDir requests only the changed files in
+// batches with the scp protocol even if WithTarStream is set, so the paths
+// with newlines are not supported.
+func WithSync(mode SyncMode) ScpOption {
+	return func(s *SCP) {
+		s.sync = mode
+	}
+}
+
+// remoteFileState is the state of a remote file listed by statRemoteTree
+// or sumRemoteTree.
+type remoteFileState struct {
+	size  int64
+	mtime int64
+	sum   string
+}
+
+// unchanged reports whether the local file at localPath with info is
+// the same as the remote file in the sync mode.
+func (st remoteFileState) unchanged(mode SyncMode, localPath string, info os.FileInfo) (bool, error) {
+	if mode == SyncChecksum {
+		sum, err := localFileSHA256(localPath)
+		if err != nil {
+			return false, err
+		}
+		return sum == st.sum, nil
+	}
+	return st.size == info.Size() && st.mtime == info.ModTime().Unix(), nil
+}
+
+// listRemoteTree returns the states of the files under the remote dir for
+// the sync mode.
+func (s *SCP) listRemoteTree(dir string) (map[string]remoteFileState, error) {
+	if s.sync == SyncChecksum {
+		return s.sumRemoteTree(dir)
+	}
+	return s.statRemoteTree(dir)
+}
+
+// statRemoteTree returns the states of the regular files under the remote
+// dir keyed by the slash separated relative paths. It returns an empty map
+// if dir does not exist.
+func (s *SCP) statRemoteTree(dir string) (map[string]remoteFileState, error) {
+	cmd := "cd " + escapeShellArg(dir) + " 2>/dev/null || exit 0; " +
+		"if stat -c %s . >/dev/null 2>&1; then find . -type f -exec stat -c '%s %Y %n' {} +; " +
+		"else find . -type f -exec stat -f '%z %m %N' {} +; fi"
+	var out bytes.Buffer
+	if err := runCommandSession(s.sessionConfig(), cmd, nil, &out); err != nil {
+		return nil, fmt.Errorf("failed to list remote files: err=%w", err)
+	}
+	states := make(map[string]remoteFileState)
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected output of remote stat: %q", scanner.Text())
+		}
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size in remote stat: err=%w", err)
+		}
+		mtime, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modification time in remote stat: err=%w", err)
+		}
+		name := s.nameNormalization.normalize(strings.TrimPrefix(fields[2], "./"))
+		states[name] = remoteFileState{size: size, mtime: mtime}
+	}
+	return states, scanner.Err()
+}
+
+// sumRemoteTree returns the SHA-256 digests of the regular files under
+// the remote dir keyed by the slash separated relative paths. It returns
+// an empty map if dir does not exist.
+func (s *SCP) sumRemoteTree(dir string) (map[string]remoteFileState, error) {
+	cmd := "cd " + escapeShellArg(dir) + " 2>/dev/null || exit 0; " +
+		"if command -v sha256sum >/dev/null 2>&1; then find . -type f -exec sha256sum {} +; " +
+		"else find . -type f -exec shasum -a 256 {} +; fi"
+	var out bytes.Buffer
+	if err := runCommandSession(s.sessionConfig(), cmd, nil, &out); err != nil {
+		return nil, fmt.Errorf("failed to compute remote checksums: err=%w", err)
+	}
+	states := make(map[string]remoteFileState)
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		// The lines are "<digest>  <path>", or "<digest> *<path>" in
+		// the binary mode.
+		line := scanner.Text()
+		if len(line) < 67 || line[64] != ' ' {
+			return nil, fmt.Errorf("unexpected output of remote checksum: %q", line)
+		}
+		name := s.nameNormalization.normalize(strings.TrimPrefix(line[66:], "./"))
+		states[name] = remoteFileState{sum: line[:64]}
+	}
+	return states, scanner.Err()
+}
+
+func localFileSHA256(filename string) (string, error) {
+	h := sha256.New()
+	if err := hashLocalFile(filename, h); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// remoteTopDir returns the remote top directory of the tree sent by SendDir,
+// which is placed under destDir if it exists, or as destDir otherwise.
+func (s *SCP) remoteTopDir(srcDir, destDir string) (string, error) {
+	fi, err := s.statRemote(destDir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to get information of destination directory: err=%w", err)
+	}
+	if err == nil && fi.IsDir() {
+		return path.Join(destDir, s.nameNormalization.normalize(s.topDirBase(srcDir))), nil
+	}
+	return destDir, nil
+}
+
+// sendSyncFilter returns acceptFn which also rejects the files unchanged on
+// the remote server in the sync mode. top is the remote top directory of
+// the sent tree.
+func (s *SCP) sendSyncFilter(srcDir, top string, acceptFn AcceptFunc) (AcceptFunc, error) {
+	if s.sync == SyncNone {
+		return acceptFn, nil
+	}
+	states, err := s.listRemoteTree(top)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(parentDir string, info os.FileInfo) (bool, error) {
+		accepted, err := acceptFn(parentDir, info)
+		if err != nil || !accepted || info.IsDir() {
+			return accepted, err
+		}
+		rel, err := filepath.Rel(srcDir, filepath.Join(parentDir, info.Name()))
+		if err != nil {
+			return false, err
+		}
+		rel = filepath.ToSlash(rel)
+		if s.mapFunc != nil {
+			if rel, err = s.mapPath(rel, info); err != nil {
+				return false, err
+			}
+		}
+		state, ok := states[s.nameNormalization.normalize(rel)]
+		if !ok {
+			return true, nil
+		}
+		unchanged, err := state.unchanged(s.sync, filepath.Join(parentDir, info.Name()), info)
+		return !unchanged, err
+	}, nil
+}
+
+// receiveSyncFilter returns acceptFn which also rejects the files unchanged
+// on the local side in the sync mode. top is the local top directory of
+// the copied tree corresponding to the remote srcDir.
+func (s *SCP) receiveSyncFilter(srcDir, top string, acceptFn AcceptFunc) (AcceptFunc, error) {
+	if s.sync == SyncNone {
+		return acceptFn, nil
+	}
+	var states map[string]remoteFileState
+	if s.sync == SyncChecksum {
+		var err error
+		if states, err = s.sumRemoteTree(srcDir); err != nil {
+			return nil, err
+		}
+	}
+	return func(parentDir string, info os.FileInfo) (bool, error) {
+		accepted, err := acceptFn(parentDir, info)
+		if err != nil || !accepted || info.IsDir() {
+			return accepted, err
+		}
+		localPath := filepath.Join(parentDir, info.Name())
+		rel, err := filepath.Rel(top, localPath)
+		if err != nil {
+			return false, err
+		}
+		rel = filepath.ToSlash(rel)
+		if s.mapFunc != nil {
+			mapped, err := s.mapPath(rel, info)
+			if err != nil {
+				return false, err
+			}
+			localPath = filepath.Join(top, filepath.FromSlash(mapped))
+		}
+		fi, err := os.Stat(localPath)
+		if err != nil || !fi.Mode().IsRegular() {
+			return true, nil
+		}
+		state := remoteFileState{size: info.Size(), mtime: info.ModTime().Unix()}
+		if s.sync == SyncChecksum {
+			var ok bool
+			if state, ok = states[rel]; !ok {
+				return true, nil
+			}
+		}
+		unchanged, err := state.unchanged(s.sync, localPath, fi)
+		return !unchanged, err
+	}, nil
+}
@@ -0,0 +1,117 @@
+package scp
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ljun20160606/go-scp/scpwire"
+)
+
+// SendTarAsDir sends the entries of tr to the remote destDir as a directory
+// tree, without extracting the archive on the local disk. destDir must be
+// an existing directory. The permissions and the times of the entries are
+// kept, and the parent directories missing in the archive are created with
+// the permission 0755. The entries do not have to be grouped by directory.
+// Entries with absolute paths or paths outside destDir are rejected with
+// ErrUnsafeArchivePath, and links and special files are skipped.
+func (s *SCP) SendTarAsDir(tr *tar.Reader, destDir string) (err error) {
+	s, op := s.withTimeout()
+	defer op.finish(&err)
+	destDir = s.cleanRemotePath(destDir)
+	normalization := s.nameNormalization
+
+	return runSinkSession(s.sessionConfig(), destDir, true, true, func(ss *sinkSession) error {
+		// dirs is the stack of the directories entered in the session.
+		var dirs []string
+		// dirInfos holds the directory entries of the archive, which are
+		// used again when the directories are entered again.
+		dirInfos := make(map[string]*FileInfo)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("failed to read tar: err=%w", err)
+			}
+			name, err := tarEntryName(h.Name)
+			if err != nil {
+				return err
+			}
+			if name == "." {
+				continue
+			}
+			if h.Typeflag != tar.TypeDir && h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA {
+				// Links and special files are skipped as in WithAutoExtract.
+				continue
+			}
+
+			// Leave the directories which the entry is not in, and enter
+			// the parent directories of the entry.
+			elems := strings.Split(name, "/")
+			parents := elems[:len(elems)-1]
+			n := 0
+			for n < len(dirs) && n < len(parents) && dirs[n] == parents[n] {
+				n++
+			}
+			for len(dirs) > n {
+				if err := ss.EndDirectory(); err != nil {
+					return err
+				}
+				dirs = dirs[:len(dirs)-1]
+			}
+			for i, dir := range parents[n:] {
+				dirInfo, ok := dirInfos[strings.Join(parents[:n+i+1], "/")]
+				if !ok {
+					dirInfo = NewFileInfo(dir, 0, 0755|os.ModeDir, time.Time{}, time.Time{})
+				}
+				if err := ss.StartDirectory(normalization.normalizeFileInfo(dirInfo)); err != nil {
+					return err
+				}
+				dirs = append(dirs, dir)
+			}
+
+			base := elems[len(elems)-1]
+			atime := h.AccessTime
+			if atime.IsZero() {
+				atime = h.ModTime
+			}
+			mode := scpwire.FromUnixMode(uint32(h.Mode))
+			if h.Typeflag == tar.TypeDir {
+				dirInfo := NewFileInfo(base, 0, mode|os.ModeDir, h.ModTime, atime)
+				dirInfos[name] = dirInfo
+				if err := ss.StartDirectory(normalization.normalizeFileInfo(dirInfo)); err != nil {
+					return err
+				}
+				dirs = append(dirs, base)
+				continue
+			}
+			fileInfo := NewFileInfo(base, h.Size, mode, h.ModTime, atime)
+			err = s.writeFile(ss, normalization.normalizeFileInfo(fileInfo), ioutil.NopCloser(tr), "", path.Join(destDir, name))
+			if err != nil {
+				return fmt.Errorf("failed to copy file: err=%w", err)
+			}
+		}
+		for range dirs {
+			if err := ss.EndDirectory(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// tarEntryName returns the cleaned slash-separated name of the tar entry.
+// It rejects absolute paths and paths escaping the top directory.
+func tarEntryName(name string) (string, error) {
+	name = path.Clean(strings.Replace(name, "\\", "/", -1))
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("%w: %s", ErrUnsafeArchivePath, name)
+	}
+	return name, nil
+}
@@ -0,0 +1,243 @@
+package scp
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sendDirTar is SendDir with WithTarStream.
+func (s *SCP) sendDirTar(srcDir, destDir string, acceptFn AcceptFunc) error {
+	remote, err := s.statRemote(destDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to get information of destination directory: err=%w", err)
+	}
+	// Place the tree in the same way as the remote scp: under destDir if it
+	// exists, or as destDir otherwise.
+	var extractDir, prefix string
+	switch {
+	case err != nil:
+		extractDir, prefix = path.Dir(destDir), path.Base(destDir)
+	case remote.IsDir():
+		extractDir, prefix = destDir, s.nameNormalization.normalize(s.topDirBase(srcDir))
+	default:
+		return fmt.Errorf("destination is not a directory: %s", destDir)
+	}
+
+	cmd := "tar -xpzf - -C " + escapeShellArg(extractDir)
+	err = runCommandSession(s.sessionConfig(), cmd, func(w io.Writer) error {
+		return s.writeTarGz(w, srcDir, prefix, extractDir, acceptFn, ioutil.Discard)
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to send directory: err=%w", err)
+	}
+	return nil
+}
+
+// receiveDirTar is ReceiveDir with WithTarStream.
+func (s *SCP) receiveDirTar(srcDir, destDir string, skipsFirstDirectory bool, acceptFn AcceptFunc) error {
+	remoteBase := path.Dir(srcDir)
+	cmd := "tar -czf - -C " + escapeShellArg(remoteBase) + " " + escapeShellArg("./"+path.Base(srcDir))
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := s.readTarGz(pr, destDir, remoteBase, skipsFirstDirectory, acceptFn)
+		if err == nil {
+			// Consume the padding after the end of the archive.
+			_, err = io.Copy(ioutil.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		done <- err
+	}()
+	err := runCommandSession(s.sessionConfig(), cmd, nil, pw)
+	pw.CloseWithError(err)
+	if rerr := <-done; rerr != nil {
+		return rerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to receive directory: err=%w", err)
+	}
+	return nil
+}
+
+// readTarGz extracts the gzipped tar stream of a remote directory under
+// destDir with the entries accepted by acceptFn. The entry names are
+// relative to remoteBase. If skipsFirstDirectory is true, the entries under
+// the top directory are placed directly under destDir.
+func (s *SCP) readTarGz(r io.Reader, destDir, remoteBase string, skipsFirstDirectory bool, acceptFn AcceptFunc) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to read tar stream: err=%w", err)
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+
+	m := s.newMetadataApplier()
+	type dirTimes struct {
+		path         string
+		atime, mtime time.Time
+	}
+	var dirs []dirTimes
+	var skipDirs []string
+	// received is the local paths of the files written, by entry name, for
+	// the hard links to them.
+	received := make(map[string]string)
+	entryName := func(tarName string) (string, bool) {
+		name := path.Clean(tarName)
+		if skipsFirstDirectory {
+			i := strings.Index(name, "/")
+			if i < 0 {
+				return "", false
+			}
+			name = name[i+1:]
+		}
+		return s.nameNormalization.normalize(name), true
+	}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read tar stream: err=%w", err)
+		}
+		if h.Typeflag != tar.TypeDir && h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA && h.Typeflag != tar.TypeLink {
+			// Symbolic links and special files are skipped.
+			continue
+		}
+		remoteName := path.Clean(h.Name)
+		name, ok := entryName(h.Name)
+		if !ok {
+			continue
+		}
+		if skippedByDir(skipDirs, name) {
+			continue
+		}
+		localPath, err := archiveEntryPath(destDir, name)
+		if err != nil {
+			return err
+		}
+
+		atime := h.AccessTime
+		if atime.IsZero() {
+			atime = h.ModTime
+		}
+		mode := h.FileInfo().Mode()
+		// A hard link has no content in the archive. The file which it
+		// links to comes before it, so its content is copied from the file
+		// received.
+		size := h.Size
+		var linkTarget string
+		if h.Typeflag == tar.TypeLink {
+			target, ok := entryName(h.Linkname)
+			if ok {
+				linkTarget = received[target]
+			}
+			if linkTarget == "" {
+				return fmt.Errorf("failed to receive hard link %s: target %s was not received", remoteName, h.Linkname)
+			}
+			st, err := os.Stat(linkTarget)
+			if err != nil {
+				return fmt.Errorf("failed to get information of hard link target: err=%w", err)
+			}
+			size = st.Size()
+		}
+		info := NewFileInfo(path.Base(name), size, mode, h.ModTime, atime)
+		accepted, err := acceptFn(filepath.Dir(localPath), info)
+		if err != nil {
+			return fmt.Errorf("error from accessFn: err=%w", err)
+		}
+
+		if h.Typeflag == tar.TypeDir {
+			if !accepted {
+				skipDirs = append(skipDirs, name)
+				continue
+			}
+			if s.mapFunc != nil {
+				continue
+			}
+			if err := os.MkdirAll(localPath, mode&modePermBits); err != nil {
+				return fmt.Errorf("failed to create directory: err=%w", err)
+			}
+			if err := m.chmod(localPath, mode&modePermBits); err != nil {
+				return fmt.Errorf("failed to change directory mode: err=%w", err)
+			}
+			dirs = append(dirs, dirTimes{path: localPath, atime: atime, mtime: h.ModTime})
+			continue
+		}
+		if !accepted {
+			continue
+		}
+		if s.mapFunc != nil {
+			top := destDir
+			if !skipsFirstDirectory {
+				top = filepath.Join(destDir, strings.SplitN(name, "/", 2)[0])
+			}
+			if localPath, err = s.mapLocalPath(top, localPath, info); err != nil {
+				return err
+			}
+		}
+
+		fileInfo := NewFileInfo(localPath, size, mode, h.ModTime, atime)
+		if kept, err := s.keepsExisting(localPath, fileInfo); err != nil {
+			return err
+		} else if kept {
+			received[name] = localPath
+			continue
+		}
+		var body io.Reader = tr
+		var linkFile *os.File
+		if linkTarget != "" {
+			if linkFile, err = os.Open(linkTarget); err != nil {
+				return fmt.Errorf("failed to open hard link target: err=%w", err)
+			}
+			body = linkFile
+		}
+		a := s.newAuditor(DirectionDownload, localPath, path.Join(remoteBase, remoteName))
+		err = s.writeReceivedFile(m, localPath, fileInfo, func(w io.Writer) error {
+			if a != nil {
+				w = io.MultiWriter(w, a)
+			}
+			_, err := io.Copy(w, body)
+			return err
+		})
+		if linkFile != nil {
+			linkFile.Close()
+		}
+		a.finish(err)
+		if err != nil {
+			return err
+		}
+		received[name] = localPath
+		if err := s.extractReceived(localPath); err != nil {
+			return err
+		}
+	}
+
+	// The times of the directories are set after their entries are written,
+	// the deepest first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dir := dirs[i]
+		if err := m.chtimes(dir.path, dir.atime, dir.mtime); err != nil {
+			return fmt.Errorf("failed to change directory time: err=%w", err)
+		}
+	}
+	return nil
+}
+
+// skippedByDir returns whether name is under one of the skipped directories.
+func skippedByDir(skipDirs []string, name string) bool {
+	for _, dir := range skipDirs {
+		if strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
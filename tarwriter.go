@@ -0,0 +1,93 @@
+package scp
+
+import (
+	"archive/tar"
+	"fmt"
+	"path/filepath"
+
+	"github.com/ljun20160606/go-scp/scpwire"
+)
+
+// ReceiveDirToTar receives files and directories under a remote srcDir and
+// writes them to tw without writing them to the local disk, for example to
+// upload a backup archive. The names of the entries are the slash-separated
+// paths relative to srcDir, and the permissions and the modification times
+// are those of the remote entries. You can filter the files and directories
+// with acceptFn as in ReceiveDir. tw is not closed.
+func (s *SCP) ReceiveDirToTar(srcDir string, tw *tar.Writer, acceptFn AcceptFunc) (err error) {
+	s, op := s.withTimeout()
+	defer op.finish(&err)
+	srcDir = s.cleanRemotePath(srcDir)
+	receiver := &tarReceiver{scp: s, tw: tw}
+	return runResourceSession(s.sessionConfig(), srcDir, false, true, func(rs *resourceSession) error {
+		return s.walkRemoteDir(rs, streamRoot, true, acceptFn, receiver)
+	})
+}
+
+// tarReceiver writes the received files and directories to a tar.Writer.
+type tarReceiver struct {
+	scp *SCP
+	tw  *tar.Writer
+}
+
+// name returns the name of the tar entry for the path under streamRoot.
+func (r *tarReceiver) name(path string) (string, error) {
+	rel, err := filepath.Rel(streamRoot, path)
+	if err != nil {
+		return "", fmt.Errorf("failed to get relative path: err=%w", err)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func (r *tarReceiver) startDirectory(dir string, timeHeader TimeMsgHeader, dirHeader StartDirectoryMsgHeader) error {
+	name, err := r.name(dir)
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     int64(scpwire.ToUnixMode(dirHeader.Mode)),
+		ModTime:  timeHeader.Mtime,
+	}
+	if err := r.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write tar header: err=%w", err)
+	}
+	return nil
+}
+
+func (r *tarReceiver) endDirectory(dir string, timeHeader TimeMsgHeader) error {
+	return nil
+}
+
+func (r *tarReceiver) receiveFile(rs *resourceSession, path string, timeHeader TimeMsgHeader, fileHeader FileMsgHeader) (err error) {
+	name, err := r.name(path)
+	if err != nil {
+		return err
+	}
+	fileInfo := NewFileInfo(path, fileHeader.Size, fileHeader.Mode, timeHeader.Mtime, timeHeader.Atime)
+	observer := r.scp.sourceObserver
+	observer.OnFileInfo(fileInfo)
+	defer func() {
+		notifyFileDone(observer, fileInfo, err)
+	}()
+
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     fileHeader.Size,
+		Mode:     int64(scpwire.ToUnixMode(fileHeader.Mode)),
+		ModTime:  timeHeader.Mtime,
+	}
+	if err := r.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write tar header: err=%w", err)
+	}
+	wo := &writerProxy{
+		writer:       r.tw,
+		onWriterFunc: observer.OnWrite,
+	}
+	if err := rs.CopyFileBodyTo(fileHeader, wo); err != nil {
+		return fmt.Errorf("failed to copy file: err=%w", err)
+	}
+	return nil
+}
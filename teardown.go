@@ -0,0 +1,152 @@
+package scp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrTeardownTimeout is returned when the remote command does not exit
+// within the teardown timeout after its input is closed, or the context is
+// done while waiting for it.
+var ErrTeardownTimeout = errors.New("scp: remote command did not exit in time")
+
+// ErrSudoPasswordRequired is returned when sudo run with WithSudo requires
+// a password.
+var ErrSudoPasswordRequired = errors.New("scp: sudo requires a password")
+
+const (
+	defaultTeardownTimeout = 30 * time.Second
+
+	// maxStderrSize is the maximum number of bytes of the standard error of
+	// the remote command kept for the errors.
+	maxStderrSize = 64 * 1024
+)
+
+// stderrBuffer keeps the first maxStderrSize bytes of the standard error of
+// the remote command. It is safe for concurrent use.
+type stderrBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *stderrBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if rest := maxStderrSize - b.buf.Len(); rest > 0 {
+		if len(p) > rest {
+			b.buf.Write(p[:rest])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (b *stderrBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// teardown waits for the remote command to exit with a bound.
+type teardown struct {
+	ctx     context.Context
+	timeout time.Duration
+	stderr  *stderrBuffer
+	// cmd is the remote command line reported in the errors.
+	cmd  string
+	sudo bool
+	idle *idleWatch
+	file *fileTimer
+	log  *sessionLog
+	// active is the count of the session in the expvar counters, which is
+	// set when the remote command is started.
+	active *expvarSession
+}
+
+func (c *sessionConfig) newTeardown(session Session) *teardown {
+	t := &teardown{
+		ctx:     c.ctx,
+		timeout: c.teardownTimeout,
+		stderr:  &stderrBuffer{},
+		sudo:    c.sudo,
+		idle:    newIdleWatch(c.idleTimeout, session, c.pause),
+		file:    newFileTimer(c.perFileTimeout, session),
+		log:     c.newSessionLog(),
+	}
+	session.SetStderr(t.stderr)
+	return t
+}
+
+// wait waits for the session to exit. If the command fails, it returns
+// *CommandError with the captured standard error. If the context is done or
+// the timeout passes first, it closes the session and the error wraps
+// ErrTeardownTimeout.
+func (t *teardown) wait(session Session) (err error) {
+	t.idle.stop()
+	defer t.active.end()
+	defer func() { t.log.finish(t.cmd, err) }()
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	var timeout <-chan time.Time
+	if t.timeout > 0 {
+		timer := time.NewTimer(t.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			return t.timeoutErr(t.commandError(err))
+		}
+		return nil
+	case <-t.ctx.Done():
+	case <-timeout:
+	}
+	_ = session.Close()
+	return t.commandError(ErrTeardownTimeout)
+}
+
+// timeoutErr returns the error for the idle timeout or the per-file timeout
+// instead of err if the session was closed for it.
+func (t *teardown) timeoutErr(err error) error {
+	if terr := t.idle.err(err); terr != err {
+		return terr
+	}
+	return t.file.err(err)
+}
+
+func (t *teardown) commandError(err error) error {
+	stderr := t.stderr.String()
+	if t.sudo && strings.Contains(stderr, "a password is required") {
+		err = fmt.Errorf("%w: %s", ErrSudoPasswordRequired, err)
+	}
+	return &CommandError{Cmd: t.cmd, Stderr: stderr, Err: err}
+}
+
+// explain returns the error of the remote command instead of err if err is
+// caused by the end of the output of the command, which usually means that
+// the command exited, for example because scp is not found. The end caused
+// by the context done is not explained.
+func (t *teardown) explain(session Session, err error) error {
+	if terr := t.timeoutErr(err); terr != err {
+		t.idle.stop()
+		return terr
+	}
+	if !errors.Is(err, io.EOF) || t.ctx.Err() != nil {
+		return err
+	}
+	if werr := t.wait(session); werr != nil {
+		return werr
+	}
+	return err
+}
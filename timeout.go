@@ -0,0 +1,148 @@
+package scp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrTimeout is returned when an operation or a file transfer does not
+// finish within the timeout set with WithTimeout or WithPerFileTimeout.
+var ErrTimeout = errors.New("scp: timeout")
+
+// timeoutError is an error of kind, ErrTimeout or ErrIdleTimeout, caused by
+// err. Both kind and err are matched by errors.Is and errors.As.
+type timeoutError struct {
+	kind error
+	msg  string
+	err  error
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s: %s: err=%s", e.kind, e.msg, e.err)
+}
+
+func (e *timeoutError) Is(target error) bool { return target == e.kind }
+
+func (e *timeoutError) Unwrap() error { return e.err }
+
+// WithTimeout sets the maximum time of each operation such as SendFile,
+// ReceiveDir and Relay. When it passes, the sessions are closed and the
+// operation fails with ErrTimeout. The sessions opened with OpenSource and
+// OpenSink are not bounded. Zero or a negative value, the default, means
+// no limit.
+func WithTimeout(d time.Duration) ScpOption {
+	return func(s *SCP) {
+		s.timeout = d
+	}
+}
+
+// WithPerFileTimeout sets the maximum time of transferring each file over
+// the scp protocol, so that a stuck file does not block a large directory
+// transfer indefinitely. When it passes, the session is closed and the
+// operation fails with ErrTimeout. The transfers through other commands,
+// such as with WithTarStream, are not bounded. Zero or a negative value,
+// the default, means no limit.
+func WithPerFileTimeout(d time.Duration) ScpOption {
+	return func(s *SCP) {
+		s.perFileTimeout = d
+	}
+}
+
+// operation bounds an operation with the timeout set with WithTimeout.
+// finish is no-op on a nil operation, which is used when no timeout is set.
+type operation struct {
+	parent  context.Context
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration
+}
+
+// withTimeout returns a shallow copy of s whose context is done when
+// the timeout set with WithTimeout passes, and the operation which must be
+// finished when the operation returns.
+func (s *SCP) withTimeout() (*SCP, *operation) {
+	if s.timeout <= 0 {
+		return s, nil
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, s.timeout)
+	op := &operation{parent: s.ctx, ctx: ctx, cancel: cancel, timeout: s.timeout}
+	return s.withContext(ctx), op
+}
+
+// finish releases the context and replaces *err with an error wrapping
+// ErrTimeout if the operation failed because the timeout passed.
+func (op *operation) finish(err *error) {
+	if op == nil {
+		return
+	}
+	expired := op.ctx.Err() == context.DeadlineExceeded && op.parent.Err() == nil
+	op.cancel()
+	if *err != nil && expired {
+		*err = &timeoutError{kind: ErrTimeout, msg: fmt.Sprintf("operation took longer than %s", op.timeout), err: *err}
+	}
+}
+
+// fileTimer closes a session when a file transfer over it takes longer
+// than the timeout set with WithPerFileTimeout. All the methods are no-op
+// on a nil fileTimer, which is used when no timeout is set.
+type fileTimer struct {
+	timeout time.Duration
+	session io.Closer
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired bool
+}
+
+func newFileTimer(timeout time.Duration, session io.Closer) *fileTimer {
+	if timeout <= 0 {
+		return nil
+	}
+	return &fileTimer{timeout: timeout, session: session}
+}
+
+// start starts timing a file transfer.
+func (t *fileTimer) start() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timer = time.AfterFunc(t.timeout, func() {
+		t.mu.Lock()
+		t.expired = true
+		t.mu.Unlock()
+		_ = t.session.Close()
+	})
+}
+
+// stop stops timing the file transfer started last.
+func (t *fileTimer) stop() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
+
+// err returns an error wrapping ErrTimeout instead of err if the session
+// was closed for the timeout.
+func (t *fileTimer) err(err error) error {
+	if t == nil || err == nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.expired {
+		return err
+	}
+	return &timeoutError{kind: ErrTimeout, msg: fmt.Sprintf("file transfer took longer than %s", t.timeout), err: err}
+}
@@ -0,0 +1,128 @@
+package scp
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Tracer starts the spans of the transfers set with WithTracer. It is
+// modeled after the Tracer of OpenTelemetry, which can be adapted to it in
+// a few lines without this package depending on OpenTelemetry.
+type Tracer interface {
+	// Start starts a span named name as a child of the span in ctx, if any,
+	// and returns a context holding the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetAttribute sets an attribute of the span. The values are strings,
+	// int64s and time.Durations.
+	SetAttribute(key string, value interface{})
+	// End ends the span with the error of the operation, or nil if it
+	// succeeded.
+	End(err error)
+}
+
+// The attributes of the spans.
+const (
+	AttrRemoteHost = "scp.remote.host"
+	AttrLocalPath  = "scp.local.path"
+	AttrRemotePath = "scp.remote.path"
+	AttrBytes      = "scp.bytes"
+	AttrDuration   = "scp.duration"
+)
+
+// WithTracer makes SendFile, SendDir, ReceiveFile, ReceiveDir and their
+// parallel variants start a span per operation with t, and a child span
+// named "scp.file" per file copied by the operation. The spans have
+// the remote host, the local and remote paths, the number of content bytes
+// and the duration as attributes. The spans of the operations are children
+// of the span in the context set with WithContext. t must be safe for
+// concurrent use, since the files of the parallel variants are traced
+// concurrently.
+func WithTracer(t Tracer) ScpOption {
+	return func(s *SCP) {
+		s.tracer = t
+	}
+}
+
+// observedOp is the span and the metrics of an operation. All the methods
+// are no-op on a nil observedOp, which is used when neither a tracer nor
+// metrics are set.
+type observedOp struct {
+	name    string
+	host    string
+	metrics Metrics
+	// span is nil if no tracer is set.
+	span  Span
+	start time.Time
+	bytes int64
+}
+
+// observeOp starts the span of the operation name and returns a copy of s
+// whose context holds the span, so that the spans of the files are its
+// children. The operation is observed by the metrics when it finishes.
+func (s *SCP) observeOp(name, localPath, remotePath string) (*SCP, *observedOp) {
+	metrics := withExpvarMetrics(s.metrics)
+	if s.tracer == nil && metrics == nil {
+		return s, nil
+	}
+	op := &observedOp{
+		name:    name,
+		host:    s.sessionConfig().remoteAddr(),
+		metrics: metrics,
+		start:   time.Now(),
+	}
+	ctx := s.ctx
+	if s.tracer != nil {
+		ctx, op.span = s.tracer.Start(ctx, "scp."+name)
+		setPathAttributes(op.span, op.host, localPath, remotePath)
+	}
+	c := s.withContext(ctx)
+	c.observedOp = op
+	return c, op
+}
+
+// addBytes adds the content bytes of a file copied by the operation.
+func (op *observedOp) addBytes(n int64) {
+	if op == nil {
+		return
+	}
+	atomic.AddInt64(&op.bytes, n)
+}
+
+// finish ends the span with *err and observes the operation.
+func (op *observedOp) finish(err *error) {
+	if op == nil {
+		return
+	}
+	elapsed := time.Since(op.start)
+	if op.span != nil {
+		op.span.SetAttribute(AttrBytes, atomic.LoadInt64(&op.bytes))
+		op.span.SetAttribute(AttrDuration, elapsed)
+		op.span.End(*err)
+	}
+	if op.metrics != nil {
+		op.metrics.ObserveTransfer(op.host, op.name, elapsed, *err)
+	}
+}
+
+// startFileSpan starts the span of a file copied by the operation of s.
+func (s *SCP) startFileSpan(remoteAddr, localPath, remotePath string) Span {
+	if s.tracer == nil {
+		return nil
+	}
+	_, span := s.tracer.Start(s.ctx, "scp.file")
+	setPathAttributes(span, remoteAddr, localPath, remotePath)
+	return span
+}
+
+func setPathAttributes(span Span, remoteAddr, localPath, remotePath string) {
+	span.SetAttribute(AttrRemoteHost, remoteAddr)
+	if localPath != "" {
+		span.SetAttribute(AttrLocalPath, localPath)
+	}
+	span.SetAttribute(AttrRemotePath, remotePath)
+}
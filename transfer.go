@@ -0,0 +1,134 @@
+package scp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrTransferCanceled is returned by Transfer.Wait for a transfer
+// interrupted with Transfer.Cancel.
+var ErrTransferCanceled = errors.New("scp: transfer canceled")
+
+// Transfer is a handle of a transfer running in the background, started
+// with StartSendFile, StartSendDir, StartReceiveFile or StartReceiveDir.
+type Transfer struct {
+	cancel context.CancelFunc
+	usage  hostUsage
+	pause  pauseGate
+	start  time.Time
+	done   chan struct{}
+
+	mu     sync.Mutex
+	end    time.Time
+	report *TransferReport
+	err    error
+}
+
+// TransferStats is the statistics of a Transfer.
+type TransferStats struct {
+	// Usage is the bytes sent and received so far, including the protocol
+	// messages.
+	Usage HostUsage
+	// Elapsed is the time since the transfer started, or its duration if
+	// it finished.
+	Elapsed time.Duration
+	// Paused reports whether the transfer is paused.
+	Paused bool
+	// Done reports whether the transfer finished.
+	Done bool
+}
+
+// StartSendFile starts SendFile in the background and returns its handle.
+func (s *SCP) StartSendFile(srcFile, destFile string) *Transfer {
+	return s.startJob(Job{Kind: JobSendFile, Src: srcFile, Dest: destFile})
+}
+
+// StartSendDir starts SendDir in the background and returns its handle.
+func (s *SCP) StartSendDir(srcDir, destDir string, acceptFn AcceptFunc) *Transfer {
+	return s.startJob(Job{Kind: JobSendDir, Src: srcDir, Dest: destDir, AcceptFn: acceptFn})
+}
+
+// StartReceiveFile starts ReceiveFile in the background and returns its
+// handle.
+func (s *SCP) StartReceiveFile(srcFile, destFile string) *Transfer {
+	return s.startJob(Job{Kind: JobReceiveFile, Src: srcFile, Dest: destFile})
+}
+
+// StartReceiveDir starts ReceiveDir in the background and returns its
+// handle.
+func (s *SCP) StartReceiveDir(srcDir, destDir string, acceptFn AcceptFunc) *Transfer {
+	return s.startJob(Job{Kind: JobReceiveDir, Src: srcDir, Dest: destDir, AcceptFn: acceptFn})
+}
+
+func (s *SCP) startJob(job Job) *Transfer {
+	ctx, cancel := context.WithCancel(s.ctx)
+	t := &Transfer{cancel: cancel, start: time.Now(), done: make(chan struct{})}
+	c := s.withContext(ctx)
+	c.usage = &t.usage
+	c.pause = &t.pause
+	go func() {
+		report, err := c.runJob(job)
+		if err != nil && ctx.Err() != nil && s.ctx.Err() == nil {
+			err = fmt.Errorf("%w: err=%s", ErrTransferCanceled, err)
+		}
+		cancel()
+		t.mu.Lock()
+		t.end = time.Now()
+		t.report = report
+		t.err = err
+		t.mu.Unlock()
+		close(t.done)
+	}()
+	return t
+}
+
+// Wait waits for the transfer to finish and returns its result. The report
+// is nil for the transfers of a single file.
+func (t *Transfer) Wait() (*TransferReport, error) {
+	<-t.done
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.report, t.err
+}
+
+// Done returns a channel which is closed when the transfer finishes.
+func (t *Transfer) Done() <-chan struct{} {
+	return t.done
+}
+
+// Cancel interrupts the transfer, which then fails with an error wrapping
+// ErrTransferCanceled. It does nothing if the transfer already finished.
+func (t *Transfer) Cancel() {
+	t.cancel()
+	t.pause.resume()
+}
+
+// Pause stops reading and writing the sessions of the transfer, keeping
+// them open, for example to yield the bandwidth to interactive traffic.
+// The remote scp waits while paused. WithIdleTimeout does not count
+// the paused time, but WithTimeout and WithPerFileTimeout do.
+func (t *Transfer) Pause() {
+	t.pause.pause()
+}
+
+// Resume resumes the transfer paused with Pause.
+func (t *Transfer) Resume() {
+	t.pause.resume()
+}
+
+// Stats returns the statistics of the transfer.
+func (t *Transfer) Stats() TransferStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := TransferStats{Usage: t.usage.snapshot(), Paused: t.pause.paused()}
+	if t.end.IsZero() {
+		stats.Elapsed = time.Since(t.start)
+	} else {
+		stats.Elapsed = t.end.Sub(t.start)
+		stats.Done = true
+	}
+	return stats
+}
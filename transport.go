@@ -0,0 +1,335 @@
+package scp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Session runs a single command on the remote side, such as an SSH session
+// or a local "docker exec -i" process. The pipes and the standard error are
+// set up before Start.
+type Session interface {
+	StdinPipe() (io.WriteCloser, error)
+	StdoutPipe() (io.Reader, error)
+	// SetStderr sets the writer of the standard error of the command.
+	SetStderr(w io.Writer)
+	// Start starts cmd, which is a shell command line.
+	Start(cmd string) error
+	// Wait waits for the command to exit. A command exiting with a non-zero
+	// status returns an error.
+	Wait() error
+	// Close stops the command if it is running and releases the session.
+	Close() error
+}
+
+// Transport creates the sessions the scp commands run over.
+type Transport interface {
+	NewSession() (Session, error)
+}
+
+// WithTransport makes the client run the remote commands over t instead of
+// the ssh.Client given to NewSCP, which may be nil then. The SSH specific
+// options, such as WithSubsystem and WithHostCopyAgentForwarding, fail with other
+// transports.
+func WithTransport(t Transport) ScpOption {
+	return func(s *SCP) {
+		s.transport = t
+	}
+}
+
+// errNotSSHSession is returned for the operations which need an SSH session
+// when the session is created by another transport.
+var errNotSSHSession = errors.New("scp: the operation requires an ssh session")
+
+// sshSession is the Session of an SSH session.
+type sshSession struct {
+	*ssh.Session
+}
+
+func (s sshSession) SetStderr(w io.Writer) { s.Session.Stderr = w }
+
+// newSession creates a session with the transport, or with the ssh.Client if
+// the transport is not set.
+func (c *sessionConfig) newSession() (Session, error) {
+	if c.transport != nil {
+		return c.transport.NewSession()
+	}
+	return c.openSession(func(client *ssh.Client) (Session, error) {
+		session, err := client.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		return sshSession{session}, nil
+	})
+}
+
+// newScpSession creates a session for the remote scp, which is a session of
+// the subsystem with WithSubsystem.
+func (c *sessionConfig) newScpSession() (Session, error) {
+	if c.subsystem == "" {
+		return c.newSession()
+	}
+	if c.transport != nil {
+		return nil, errNotSSHSession
+	}
+	return c.openSession(newSubsystemSession)
+}
+
+// openSession opens a session on the ssh.Client with open. With
+// WithReconnect, the client is dialed if it is not connected yet, and dialed
+// again if the session cannot be opened because the connection is lost.
+func (c *sessionConfig) openSession(open func(client *ssh.Client) (Session, error)) (Session, error) {
+	if c.client == nil && c.reconnect != nil {
+		client, err := c.reconnect.redial(c.ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		c.client = client
+	}
+	session, err := open(c.client)
+	if err != nil && c.reconnect != nil && connectionLost(c.client, err) {
+		client, rerr := c.reconnect.redial(c.ctx, c.client)
+		if rerr != nil {
+			return nil, rerr
+		}
+		c.client = client
+		session, err = open(client)
+	}
+	return session, err
+}
+
+// subsystemSession is the Session of an SSH subsystem. It is built on
+// the channel, since ssh.Session cannot wait for a subsystem: only Start,
+// Run and Shell make it started.
+type subsystemSession struct {
+	ch     ssh.Channel
+	stderr io.Writer
+	// exitStatus receives the result of the exit status of the subsystem.
+	exitStatus chan error
+	stderrDone chan struct{}
+}
+
+func newSubsystemSession(client *ssh.Client) (Session, error) {
+	ch, reqs, err := client.OpenChannel("session", nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &subsystemSession{ch: ch, exitStatus: make(chan error, 1)}
+	go func() {
+		s.exitStatus <- waitExitStatus(reqs)
+	}()
+	return s, nil
+}
+
+// waitExitStatus reads the requests of a session until the channel is
+// closed and returns the error for its exit status.
+func waitExitStatus(reqs <-chan *ssh.Request) error {
+	status := -1
+	var signal string
+	for req := range reqs {
+		switch req.Type {
+		case "exit-status":
+			if len(req.Payload) >= 4 {
+				status = int(binary.BigEndian.Uint32(req.Payload))
+			}
+		case "exit-signal":
+			var payload struct {
+				Signal     string
+				CoreDumped bool
+				Error      string
+				Lang       string
+			}
+			if err := ssh.Unmarshal(req.Payload, &payload); err == nil {
+				signal = payload.Signal
+			}
+		default:
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}
+	switch {
+	case status == 0:
+		return nil
+	case signal != "":
+		return fmt.Errorf("scp: subsystem killed by signal %s", signal)
+	case status == -1:
+		return &ssh.ExitMissingError{}
+	}
+	return fmt.Errorf("scp: subsystem exited with status %d", status)
+}
+
+// requestSubsystem starts the subsystem name.
+func (s *subsystemSession) requestSubsystem(name string) error {
+	payload := ssh.Marshal(struct{ Name string }{name})
+	ok, err := s.ch.SendRequest("subsystem", true, payload)
+	if err == nil && !ok {
+		err = errors.New("ssh: subsystem request failed")
+	}
+	if err != nil {
+		return err
+	}
+	stderr := s.stderr
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+	s.stderrDone = make(chan struct{})
+	go func() {
+		defer close(s.stderrDone)
+		_, _ = io.Copy(stderr, s.ch.Stderr())
+	}()
+	return nil
+}
+
+func (s *subsystemSession) StdinPipe() (io.WriteCloser, error) {
+	return subsystemStdin{s.ch}, nil
+}
+
+func (s *subsystemSession) StdoutPipe() (io.Reader, error) { return s.ch, nil }
+
+func (s *subsystemSession) SetStderr(w io.Writer) { s.stderr = w }
+
+func (s *subsystemSession) Start(cmd string) error {
+	return errors.New("scp: a subsystem session cannot run a command")
+}
+
+func (s *subsystemSession) Wait() error {
+	if s.stderrDone == nil {
+		return errors.New("scp: session not started")
+	}
+	err := <-s.exitStatus
+	<-s.stderrDone
+	return err
+}
+
+func (s *subsystemSession) Close() error { return s.ch.Close() }
+
+// subsystemStdin is the input of a subsystem session. Closing it sends EOF
+// and leaves the channel open for the output.
+type subsystemStdin struct {
+	ssh.Channel
+}
+
+func (w subsystemStdin) Close() error { return w.CloseWrite() }
+
+// CommandTransport is the Transport running each command as a local process,
+// such as "docker exec -i container sh -c cmd" or "kubectl exec -i pod --
+// sh -c cmd", so the scp protocol runs over the standard input and output
+// of the process.
+type CommandTransport struct {
+	// Name and Args are the program and its arguments. The command line
+	// of the remote command is appended as the last argument.
+	Name string
+	Args []string
+}
+
+// NewCommandTransport returns the CommandTransport running name with args
+// followed by the command line. For example,
+//
+//	NewCommandTransport("docker", "exec", "-i", "web", "sh", "-c")
+//
+// runs the scp commands in the container named web.
+func NewCommandTransport(name string, args ...string) *CommandTransport {
+	return &CommandTransport{Name: name, Args: args}
+}
+
+// NewSession implements Transport.
+func (t *CommandTransport) NewSession() (Session, error) {
+	return &commandSession{transport: t}, nil
+}
+
+// commandSession is the Session of a local process. The pipes are OS pipes
+// so that Wait does not wait for the input to be closed.
+type commandSession struct {
+	transport *CommandTransport
+	cmd       *exec.Cmd
+	stderr    io.Writer
+
+	// stdinR and stdoutW are the ends of the pipes for the process, which
+	// are closed after Start, and stdinW and stdoutR are the ends for
+	// the caller.
+	stdinR, stdinW   *os.File
+	stdoutR, stdoutW *os.File
+
+	closeOnce sync.Once
+}
+
+func (s *commandSession) StdinPipe() (io.WriteCloser, error) {
+	if s.stdinW != nil {
+		return nil, errors.New("scp: stdin already set")
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	s.stdinR, s.stdinW = r, w
+	return w, nil
+}
+
+func (s *commandSession) StdoutPipe() (io.Reader, error) {
+	if s.stdoutR != nil {
+		return nil, errors.New("scp: stdout already set")
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	s.stdoutR, s.stdoutW = r, w
+	return r, nil
+}
+
+func (s *commandSession) SetStderr(w io.Writer) { s.stderr = w }
+
+func (s *commandSession) Start(cmd string) error {
+	if s.cmd != nil {
+		return errors.New("scp: session already started")
+	}
+	args := append(append([]string(nil), s.transport.Args...), cmd)
+	s.cmd = exec.Command(s.transport.Name, args...)
+	if s.stdinR != nil {
+		s.cmd.Stdin = s.stdinR
+	}
+	if s.stdoutW != nil {
+		s.cmd.Stdout = s.stdoutW
+	}
+	s.cmd.Stderr = s.stderr
+	err := s.cmd.Start()
+	if s.stdinR != nil {
+		s.stdinR.Close()
+	}
+	if s.stdoutW != nil {
+		s.stdoutW.Close()
+	}
+	return err
+}
+
+func (s *commandSession) Wait() error {
+	if s.cmd == nil {
+		return errors.New("scp: session not started")
+	}
+	return s.cmd.Wait()
+}
+
+func (s *commandSession) Close() error {
+	s.closeOnce.Do(func() {
+		// Killing a process which already exited does nothing.
+		if s.cmd != nil && s.cmd.Process != nil {
+			_ = s.cmd.Process.Kill()
+		}
+		if s.stdinW != nil {
+			s.stdinW.Close()
+		}
+		if s.stdoutR != nil {
+			s.stdoutR.Close()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,56 @@
+package scp
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Warning describes a non-fatal failure which occurred while applying
+// metadata such as the permission or the time to a received file or directory.
+type Warning struct {
+	// Path is the local path of the file or directory.
+	Path string
+	// Op is the failed operation, for example "chmod" or "chtimes".
+	Op string
+	// Err is the error returned by the operation.
+	Err error
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s %s: err=%s", w.Op, w.Path, w.Err)
+}
+
+// Warnings collects non-fatal warnings. It is safe for concurrent use.
+type Warnings struct {
+	mu       sync.Mutex
+	warnings []Warning
+}
+
+// List returns a copy of the collected warnings.
+func (w *Warnings) List() []Warning {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	list := make([]Warning, len(w.warnings))
+	copy(list, w.warnings)
+	return list
+}
+
+// Len returns the number of the collected warnings.
+func (w *Warnings) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.warnings)
+}
+
+// Reset removes all the collected warnings.
+func (w *Warnings) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.warnings = nil
+}
+
+func (w *Warnings) add(warning Warning) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.warnings = append(w.warnings, warning)
+}